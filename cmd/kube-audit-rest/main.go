@@ -14,40 +14,192 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"slices"
+	"strings"
 	"syscall"
+	"time"
 
 	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	clusterwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/cluster_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
 	diskwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/disk_writer"
+	fanoutwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/fanout_writer"
+	httpwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/http_writer"
+	kafkawriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/kafka_writer"
+	queuewriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/queue_writer"
+	spoolwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/spool_writer"
 	stderrwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/stderr_writer"
+	blobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store"
+	directoryblobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store/directory_blob_store"
+	s3blobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store/s3_blob_store"
+	certsource "github.com/RichardoC/kube-audit-rest/internal/cert_source"
+	filecertsource "github.com/RichardoC/kube-audit-rest/internal/cert_source/file_cert_source"
+	secretcertsource "github.com/RichardoC/kube-audit-rest/internal/cert_source/secret_cert_source"
 	"github.com/RichardoC/kube-audit-rest/internal/common"
+	eventfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter"
+	celfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter/cel_filter"
+	policyfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter/policy_filter"
+	eventprocessor "github.com/RichardoC/kube-audit-rest/internal/event_processor"
 	eventprocessorimpl "github.com/RichardoC/kube-audit-rest/internal/event_processor/event_processor_impl"
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	difftransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer/diff_transformer"
+	offloadtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer/offload_transformer"
+	redactiontransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer/redaction_transformer"
+	trimtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer/trim_transformer"
+	"github.com/RichardoC/kube-audit-rest/internal/health"
 	logrequestlistener "github.com/RichardoC/kube-audit-rest/internal/http_listener/log_request_listener"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
 	prometheusmetrics "github.com/RichardoC/kube-audit-rest/internal/metrics/prometheus_metrics"
+	segmentarchiver "github.com/RichardoC/kube-audit-rest/internal/segment_archiver"
+	s3archiver "github.com/RichardoC/kube-audit-rest/internal/segment_archiver/s3_archiver"
 	"github.com/thought-machine/go-flags"
 
 	"go.uber.org/automaxprocs/maxprocs"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 type Options struct {
-	LoggerFilename   string `long:"logger-filename" description:"Location to log audit log to" default:"/tmp/kube-audit-rest.log"`
-	AuditToStdErr    bool   `long:"audit-to-std-log" description:"Not recommended - log to stderr/stdout rather than a file"`
-	LoggerMaxSize    int    `long:"logger-max-size" description:"Maximum size for each log file in megabytes" default:"500"`
-	LoggerMaxBackups int    `long:"logger-max-backups" description:"Maximum number of rolled log files to store, 0 means store all rolled files" default:"1"`
-	CertFilename     string `long:"cert-filename" description:"Location of certificate for TLS" default:"/etc/tls/tls.crt"`
-	CertKeyFilename  string `long:"cert-key-filename" description:"Location of certificate key for TLS" default:"/etc/tls/tls.key"`
-	ServerPort       int    `long:"server-port" description:"Port to run https server on" default:"9090"`
-	MetricsPort      int    `long:"metrics-port" description:"Port to run http metrics server on" default:"55555"`
-	Verbose          bool   `long:"verbosity" short:"v" description:"Uses zap Development default verbose mode rather than production"`
+	LoggerFilename          string        `long:"logger-filename" description:"Location to log audit log to. With --clusters-filename, {cluster} is replaced with the cluster of each event, so each cluster has its own files" default:"/tmp/kube-audit-rest.log"`
+	AuditToStdErr           bool          `long:"audit-to-std-log" description:"Not recommended - log to stderr/stdout rather than a file, same as --sink=stderr"`
+	Sinks                   []string      `long:"sink" description:"Where to write audit events. Can be repeated to write every event to each of them" choice:"disk" choice:"stderr" choice:"kafka" choice:"http" default:"disk"`
+	RequiredSinks           []string      `long:"required-sink" description:"With several sinks, a sink that's written before the request is answered. Other sinks are written in the background. Can be repeated" choice:"disk" choice:"stderr" choice:"kafka" choice:"http"`
+	SinkBufferSize          int           `long:"sink-buffer-size" description:"With several sinks, how many events a sink that isn't required can fall behind by before events are dropped for it" default:"10000"`
+	LoggerMaxSize           int           `long:"logger-max-size" description:"Maximum size for each log file in megabytes, 0 means no limit" default:"500"`
+	LoggerMaxBackups        int           `long:"logger-max-backups" description:"Maximum number of rolled log files to store, 0 means store all rolled files" default:"1"`
+	LoggerMaxAge            int           `long:"logger-max-age" description:"Maximum number of days to keep rolled log files for, 0 means keep them forever" default:"0"`
+	LoggerRotateInterval    time.Duration `long:"logger-rotate-interval" description:"Roll the log file at every multiple of this interval in UTC, such as 1h for every hour or 24h for every day. 0 only rolls on size" default:"0"`
+	LoggerCompression       string        `long:"logger-compression" description:"Compression of rolled log files" choice:"none" choice:"gzip" choice:"zstd" default:"none"`
+	HashChain               bool          `long:"hash-chain" description:"Add seq, prevHash and hash fields to every line of the log file, linking it to the line before, so edits can be found with the verify command"`
+	HashChainStateFilename  string        `long:"hash-chain-state-filename" description:"Where the head of the hash chain is saved so it carries on after a restart, the log file name with .chain added if unset"`
+	SigningKeyFilename      string        `long:"signing-key-filename" description:"Location of a PEM encoded Ed25519 private key that signs checkpoints in the log file and rolled log files, disabled if unset"`
+	CheckpointEvents        int           `long:"checkpoint-events" description:"With a signing key, write a checkpoint after this many lines, 0 means no limit" default:"1000"`
+	CheckpointInterval      time.Duration `long:"checkpoint-interval" description:"With a signing key, write a checkpoint this often if there are lines since the last one, 0 disables" default:"1m"`
+	KEKFilename             string        `long:"kek-filename" description:"Location of a 256 bit key encryption key, raw or in base64. Each log file is encrypted with its own data key, wrapped by this key. Can't be used with --logger-compression, disabled if unset"`
+	CertFilename            string        `long:"cert-filename" description:"Location of certificate for TLS" default:"/etc/tls/tls.crt"`
+	CertKeyFilename         string        `long:"cert-key-filename" description:"Location of certificate key for TLS" default:"/etc/tls/tls.key"`
+	CertReloadInterval      time.Duration `long:"cert-reload-interval" description:"How often to check the certificate and key for changes, in case a change to the files isn't noticed straight away. With --self-signed-tls, how often to check the secret" default:"1m"`
+	ClientCAFilename        string        `long:"client-ca-filename" description:"Location of the CA bundle client certificates must be signed by, such as the one for the apiserver's webhook client certificate. Clients don't need a certificate if unset"`
+	ClientAllowedNames      []string      `long:"client-allowed-name" description:"With --client-ca-filename, a subject common name or SAN a client certificate must have. Can be repeated, every certificate from the CA is allowed if unset"`
+	BearerTokenFilename     string        `long:"bearer-token-filename" description:"Location of a token requests must have in an \"Authorization: Bearer <token>\" header, for when client certificates can't be used. Re-read for every request, so it can be rotated. No token is needed if unset"`
+	AllowedSourceCIDRs      []string      `long:"allowed-source-cidr" description:"CIDR requests must come from, such as the apiserver's addresses. Can be repeated, requests from anywhere are allowed if unset"`
+	SelfSignedTLS           bool          `long:"self-signed-tls" description:"Generate a CA and serving certificate, stored in a secret and renewed before they expire, instead of using --cert-filename and --cert-key-filename. Needs access to the kubernetes API"`
+	SelfSignedTLSNamespace  string        `long:"self-signed-tls-namespace" description:"Namespace of the secret, normally the namespace kube-audit-rest is running in" env:"KUBE_AUDIT_REST_NAMESPACE" default:"kube-audit-rest"`
+	SelfSignedTLSSecret     string        `long:"self-signed-tls-secret" description:"Name of the secret the CA and serving certificate are stored in" default:"kube-audit-rest-tls"`
+	SelfSignedTLSWebhook    string        `long:"self-signed-tls-webhook" description:"Name of the ValidatingWebhookConfiguration whose caBundle is set to the CA, not set if empty" default:"kube-audit-rest"`
+	SelfSignedTLSDNSNames   []string      `long:"self-signed-tls-dns-name" description:"Name the serving certificate is for. Can be repeated" default:"kube-audit-rest.kube-audit-rest.svc"`
+	SelfSignedTLSCAValidity time.Duration `long:"self-signed-tls-ca-validity" description:"How long each generated CA is valid for" default:"87600h"`
+	SelfSignedTLSValidity   time.Duration `long:"self-signed-tls-cert-validity" description:"How long each generated serving certificate is valid for" default:"2160h"`
+	SelfSignedTLSRenew      time.Duration `long:"self-signed-tls-renew-before" description:"Renew the CA and serving certificate once they'd expire within this" default:"720h"`
+	ServerPort              int           `long:"server-port" description:"Port to run https server on" default:"9090"`
+	ClustersFilename        string        `long:"clusters-filename" description:"Location of the clusters that can send requests to /log-request/<cluster>, with their tokens and sinks, when one kube-audit-rest serves several clusters"`
+	MetricsPort             int           `long:"metrics-port" description:"Port to run http metrics server on, which also serves the /readyz and /healthz probes" default:"55555"`
+	LivenessWriteTimeout    time.Duration `long:"liveness-write-timeout" description:"/healthz fails once writing an event has made no progress for this long, so the pod is restarted. Should allow for the retries of remote sinks" default:"5m"`
+	PolicyFilename          string        `long:"policy-filename" description:"Location of a YAML policy deciding which events are written, all events are written if unset"`
+	CelFilterFilename       string        `long:"cel-filter-filename" description:"Location of a YAML file of CEL expressions deciding which events are written, evaluated after the policy"`
+	TrimFields              []string      `long:"trim-field" description:"Bulky field removed from the object and oldObject before they're written. Can be repeated" choice:"managed-fields" choice:"last-applied-configuration" choice:"status"`
+	RedactionMode           string        `long:"redaction-mode" description:"How to redact Secret data and other sensitive fields from written events" choice:"none" choice:"remove" choice:"mask" choice:"hash" default:"none"`
+	RedactionRules          []string      `long:"redaction-rule" description:"Additional field to redact, as <kind>:<path> such as ConfigMap:data.password. Can be repeated"`
+	RedactionSaltFilename   string        `long:"redaction-salt-filename" description:"Location of the salt used by the hash redaction mode, a random salt is used if unset"`
+	DiffMode                string        `long:"diff-mode" description:"Add the changes from oldObject to object of updates as the objectDiff field, as an RFC 6902 JSON Patch or a list of the changed paths" choice:"none" choice:"json-patch" choice:"paths" default:"none"`
+	DiffIgnorePaths         []string      `long:"diff-ignore-path" description:"Path within the object left out of the diff along with everything below it, such as metadata.managedFields. Can be repeated, replacing the defaults" default:"metadata.managedFields" default:"metadata.resourceVersion"`
+	OffloadThreshold        int           `long:"offload-threshold" description:"Objects larger than this many bytes are stored in the blob store and replaced by a reference to it, 0 disables" default:"0"`
+	BlobStore               string        `long:"blob-store" description:"Where offloaded objects are stored" choice:"directory" choice:"s3" default:"directory"`
+	BlobDirectory           string        `long:"blob-directory" description:"Directory offloaded objects are stored in with --blob-store=directory"`
+	BlobS3Bucket            string        `long:"blob-s3-bucket" description:"Bucket offloaded objects are stored in with --blob-store=s3, under --s3-prefix and using the other --s3 flags to connect"`
+	BlobRetention           time.Duration `long:"blob-retention" description:"Delete offloaded objects that haven't been used for this long, at least 24h. Should be longer than the log files are kept. 0 keeps them forever" default:"0"`
+	BlobStoreTimeout        time.Duration `long:"blob-store-timeout" description:"Time allowed to store each offloaded object, after which it's written as it is" default:"10s"`
+	OutputFormat            string        `long:"output-format" description:"Format of each written event" choice:"admission-review" choice:"audit-event" default:"admission-review"`
+	AuditLevel              string        `long:"audit-level" description:"How much of each request is written with the audit-event output format" choice:"Metadata" choice:"Request" choice:"RequestResponse" default:"RequestResponse"`
+	QueueSize               int           `long:"queue-size" description:"Number of events to queue in memory so responses don't wait for them to be written, 0 writes events before responding" default:"0"`
+	QueueOverflow           string        `long:"queue-overflow" description:"What to do with events logged while the queue is full" choice:"block" choice:"drop-newest" choice:"drop-oldest" choice:"spill-to-disk" default:"block"`
+	QueueSpillDirectory     string        `long:"queue-spill-directory" description:"Directory events are spilled to with --queue-overflow=spill-to-disk" default:"/tmp/kube-audit-rest-spill"`
+	QueueSpillMaxBytes      int64         `long:"queue-spill-max-bytes" description:"Maximum size of the events spilled to disk, 0 means no limit" default:"1073741824"`
+	SpoolDirectory          string        `long:"spool-directory" description:"Directory the kafka and http sinks' events are spooled to before being sent, so they survive restarts and outages. Disabled if unset"`
+	SpoolSegmentMaxBytes    int64         `long:"spool-segment-max-bytes" description:"Size of each spool file, files are deleted once every sink has sent their events" default:"67108864"`
+	SpoolMaxBytes           int64         `long:"spool-max-bytes" description:"Maximum size of the spool, events are rejected once it is full. 0 means no limit" default:"10737418240"`
+	SpoolCheckpointInterval time.Duration `long:"spool-checkpoint-interval" description:"How often each spooled sink is flushed and its progress saved" default:"1s"`
+	KafkaBrokers            []string      `long:"kafka-broker" description:"Address of a kafka broker as host:port. Can be repeated"`
+	KafkaTopic              string        `long:"kafka-topic" description:"Kafka topic to write audit events to" default:"kube-audit-rest"`
+	KafkaPartitionKey       string        `long:"kafka-partition-key" description:"Field used as the message key, so related events keep their order" choice:"none" choice:"namespace" choice:"uid" default:"none"`
+	KafkaRequiredAcks       string        `long:"kafka-required-acks" description:"Acknowledgements required before an event is considered delivered" choice:"none" choice:"leader" choice:"all" default:"all"`
+	KafkaCompression        string        `long:"kafka-compression" description:"Compression of kafka message batches" choice:"none" choice:"gzip" choice:"snappy" choice:"lz4" choice:"zstd" default:"none"`
+	KafkaBatchMaxMessages   int           `long:"kafka-batch-max-messages" description:"Send a batch once it has this many events, 0 means no limit" default:"0"`
+	KafkaBatchMaxBytes      int           `long:"kafka-batch-max-bytes" description:"Send a batch once it is this many bytes, 0 means no limit" default:"0"`
+	KafkaBatchTimeout       time.Duration `long:"kafka-batch-timeout" description:"Send a batch once it is this old" default:"100ms"`
+	KafkaTLS                bool          `long:"kafka-tls" description:"Connect to the kafka brokers over TLS"`
+	KafkaTLSCAFilename      string        `long:"kafka-tls-ca-filename" description:"Location of the CA used to verify the kafka brokers, the system roots are used if unset"`
+	KafkaTLSCertFilename    string        `long:"kafka-tls-cert-filename" description:"Location of the client certificate for kafka"`
+	KafkaTLSKeyFilename     string        `long:"kafka-tls-key-filename" description:"Location of the client certificate key for kafka"`
+	KafkaTLSInsecure        bool          `long:"kafka-tls-insecure-skip-verify" description:"Not recommended - don't verify the kafka brokers' certificates"`
+	KafkaSASLMechanism      string        `long:"kafka-sasl-mechanism" description:"SASL mechanism to authenticate to kafka with, disabled if unset" choice:"" choice:"PLAIN" choice:"SCRAM-SHA-256" choice:"SCRAM-SHA-512" default:""`
+	KafkaSASLUsername       string        `long:"kafka-sasl-username" description:"Username to authenticate to kafka with"`
+	KafkaSASLPasswordFile   string        `long:"kafka-sasl-password-filename" description:"Location of the password to authenticate to kafka with"`
+	HTTPURL                 string        `long:"http-url" description:"URL to POST batches of newline delimited events to"`
+	HTTPHeaders             []string      `long:"http-header" description:"Header to send with every request, as 'Name: value'. Can be repeated"`
+	HTTPBearerTokenFilename string        `long:"http-bearer-token-filename" description:"Location of a bearer token to send with every request, re-read for each request"`
+	HTTPCompression         string        `long:"http-compression" description:"Compression of each batch" choice:"none" choice:"gzip" default:"gzip"`
+	HTTPBatchMaxEvents      int           `long:"http-batch-max-events" description:"Send a batch once it has this many events" default:"500"`
+	HTTPBatchMaxBytes       int           `long:"http-batch-max-bytes" description:"Send a batch once it is this many bytes, before compression" default:"1048576"`
+	HTTPBatchTimeout        time.Duration `long:"http-batch-timeout" description:"Send a batch once it is this old" default:"1s"`
+	HTTPMaxRetries          int           `long:"http-max-retries" description:"Times to retry a batch on connection errors, 5xx and 429 responses before dropping it" default:"5"`
+	HTTPRetryInitialBackoff time.Duration `long:"http-retry-initial-backoff" description:"Time to wait before the first retry, doubled for each retry after" default:"500ms"`
+	HTTPRetryMaxBackoff     time.Duration `long:"http-retry-max-backoff" description:"Longest time to wait between retries" default:"30s"`
+	HTTPTimeout             time.Duration `long:"http-timeout" description:"Timeout of each request" default:"10s"`
+	HTTPTLSCAFilename       string        `long:"http-tls-ca-filename" description:"Location of the CA used to verify the server, the system roots are used if unset"`
+	HTTPTLSCertFilename     string        `long:"http-tls-cert-filename" description:"Location of the client certificate for the server"`
+	HTTPTLSKeyFilename      string        `long:"http-tls-key-filename" description:"Location of the client certificate key for the server"`
+	HTTPTLSInsecure         bool          `long:"http-tls-insecure-skip-verify" description:"Not recommended - don't verify the server's certificate"`
+	ClusterName             string        `long:"cluster-name" description:"Name of the cluster kube-audit-rest is running in, added to every event and used to partition archived log files" env:"KUBE_AUDIT_REST_CLUSTER_NAME"`
+	Environment             string        `long:"environment" description:"Environment the cluster is in, such as production, added to every event" env:"KUBE_AUDIT_REST_ENVIRONMENT"`
+	Region                  string        `long:"region" description:"Region the cluster is in, added to every event" env:"KUBE_AUDIT_REST_REGION"`
+	PodName                 string        `long:"pod-name" description:"Name of the kube-audit-rest pod, from the downward API, added to every event" env:"KUBE_AUDIT_REST_POD_NAME"`
+	NodeName                string        `long:"node-name" description:"Name of the node kube-audit-rest is running on, from the downward API, added to every event" env:"KUBE_AUDIT_REST_NODE_NAME"`
+	MetadataVersion         bool          `long:"metadata-version" description:"Add the kube-audit-rest version to every event" env:"KUBE_AUDIT_REST_METADATA_VERSION"`
+	MetadataFields          []string      `long:"metadata-field" description:"Other field added to every event, as key=value. Can be repeated" env:"KUBE_AUDIT_REST_METADATA_FIELDS" env-delim:","`
+	S3Bucket                string        `long:"s3-bucket" description:"Bucket rolled log files are uploaded to before being deleted locally, disabled if unset"`
+	S3Endpoint              string        `long:"s3-endpoint" description:"host:port of the S3 compatible API" default:"s3.amazonaws.com"`
+	S3Prefix                string        `long:"s3-prefix" description:"Prefix of the uploaded objects' keys, followed by <cluster>/<YYYY-MM-DD>/<HH>/<file>"`
+	S3Region                string        `long:"s3-region" description:"Region of the bucket, looked up if unset"`
+	S3AccessKeyFilename     string        `long:"s3-access-key-filename" description:"Location of the access key for S3, re-read for each request. The environment, shared credentials file or IAM role are used if unset"`
+	S3SecretKeyFilename     string        `long:"s3-secret-key-filename" description:"Location of the secret key for S3, re-read for each request"`
+	S3DisableTLS            bool          `long:"s3-disable-tls" description:"Not recommended - connect to the S3 endpoint over plain http"`
+	S3TLSCAFilename         string        `long:"s3-tls-ca-filename" description:"Location of the CA used to verify the S3 endpoint, the system roots are used if unset"`
+	S3TLSInsecure           bool          `long:"s3-tls-insecure-skip-verify" description:"Not recommended - don't verify the S3 endpoint's certificate"`
+	S3MaxRetries            int           `long:"s3-max-retries" description:"Times to retry a failed or unverified upload before trying again 30s later" default:"5"`
+	S3RetryInitialBackoff   time.Duration `long:"s3-retry-initial-backoff" description:"Time to wait before the first retry, doubled for each retry after" default:"1s"`
+	ShutdownTimeout         time.Duration `long:"shutdown-timeout" description:"On SIGTERM, how long to wait for requests in progress to finish and events to be written before exiting. Should be shorter than the pod's terminationGracePeriodSeconds" default:"25s"`
+	Verbose                 bool          `long:"verbosity" short:"v" description:"Uses zap Development default verbose mode rather than production"`
 }
 
 func main() {
 	// Set and parse command line options
 	var opts Options
 	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("verify", "Verify the hash chain of log files",
+		"Checks every line of the given log files, oldest first, follows on from the line before it, and reports the first that doesn't", &verifyCommand{})
+	parser.AddCommand("verify-signatures", "Verify the signatures of log files",
+		"Checks the detached signature of each of the given log files that has one, and every checkpoint in them, against a public key", &verifySignaturesCommand{})
+	parser.AddCommand("decrypt", "Decrypt encrypted log files",
+		"Writes the decrypted content of the given log files to stdout, in order", &decryptCommand{})
 	_, err := parser.Parse()
+	if parser.Active != nil {
+		// The command has been run, and any error printed
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
 		log.Fatalf("can't parse flags: %v", err)
 	}
@@ -67,19 +219,220 @@ func main() {
 
 	// Create the components. In the future we can consider using containers
 	metricsServer := prometheusmetrics.New(opts.MetricsPort)
-	var auditWriter auditwritter.AuditWritter
+	readiness := health.New("readiness")
+	liveness := health.New("liveness")
+	metricsServer.Handle("GET /readyz", readiness)
+	metricsServer.Handle("GET /healthz", liveness)
+	formatter, err := commonwriter.NewFormatter(commonwriter.OutputFormat(opts.OutputFormat), commonwriter.AuditLevel(opts.AuditLevel))
+	if err != nil {
+		common.Logger.Fatalf("failed to configure output format with: %s", err.Error())
+	}
+	metadata, err := eventMetadata(opts)
+	if err != nil {
+		common.Logger.Fatalf("failed to configure event metadata with: %s", err.Error())
+	}
+	formatter = formatter.WithMetadata(metadata)
 	if opts.AuditToStdErr {
-		auditWriter = stderrwriter.New()
+		opts.Sinks = []string{"stderr"}
+	}
+	for _, name := range opts.RequiredSinks {
+		if !slices.Contains(opts.Sinks, name) {
+			common.Logger.Fatalf("required sink %s isn't one of the configured sinks", name)
+		}
+	}
+	var clusters []logrequestlistener.Cluster
+	if opts.ClustersFilename != "" {
+		clusters, err = logrequestlistener.LoadClusters(opts.ClustersFilename)
+		if err != nil {
+			common.Logger.Fatalf("failed to load clusters with: %s", err.Error())
+		}
+		for _, cluster := range clusters {
+			for _, name := range cluster.Sinks {
+				if !slices.Contains(opts.Sinks, name) {
+					common.Logger.Fatalf("sink %s of cluster %s isn't one of the configured sinks", name, cluster.Name)
+				}
+			}
+		}
+	}
+	var sinks []fanoutwriter.Sink
+	var spooledSinks []spoolwriter.Sink
+	for _, name := range opts.Sinks {
+		writer, err := newSink(name, opts, formatter, metricsServer, clusters)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure %s sink with: %s", name, err.Error())
+		}
+		if opts.SpoolDirectory != "" && (name == "kafka" || name == "http") {
+			spooledSinks = append(spooledSinks, spoolwriter.Sink{Name: name, Writer: writer})
+			continue
+		}
+		sinks = append(sinks, fanoutwriter.Sink{
+			Name:     name,
+			Writer:   writer,
+			Required: slices.Contains(opts.RequiredSinks, name),
+			Clusters: sinkClusters(clusters, name),
+		})
+	}
+	if len(spooledSinks) > 0 {
+		spool, err := spoolwriter.New(spoolwriter.Config{
+			Directory:          opts.SpoolDirectory,
+			SegmentMaxBytes:    opts.SpoolSegmentMaxBytes,
+			MaxBytes:           opts.SpoolMaxBytes,
+			CheckpointInterval: opts.SpoolCheckpointInterval,
+		}, spooledSinks, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure spool with: %s", err.Error())
+		}
+		// The spool writes every event to each of its sinks, so they can't be
+		// routed separately
+		var spoolClusters []string
+		for i, sink := range spooledSinks {
+			routed := sinkClusters(clusters, sink.Name)
+			if i > 0 && !slices.Equal(routed, spoolClusters) {
+				common.Logger.Fatalf("spooled sinks %s and %s must be routed the same clusters", spooledSinks[0].Name, sink.Name)
+			}
+			spoolClusters = routed
+		}
+		// Events are only safe once they're spooled, so always wait for that
+		sinks = append(sinks, fanoutwriter.Sink{Name: "spool", Writer: spool, Required: true, Clusters: spoolClusters})
+	}
+	var auditWriter auditwritter.AuditWritter
+	// A required sink goes through the fanout writer even on its own, so
+	// its failures are reported by the readiness probe
+	if len(sinks) == 1 && sinks[0].Clusters == nil && !sinks[0].Required {
+		auditWriter = sinks[0].Writer
 	} else {
-		auditWriter = diskwriter.New(opts.LoggerFilename, opts.LoggerMaxSize, opts.LoggerMaxBackups)
+		auditWriter, err = fanoutwriter.New(sinks, opts.SinkBufferSize, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure sinks with: %s", err.Error())
+		}
+	}
+	addHealthChecks("sinks", auditWriter, readiness, liveness, opts.LivenessWriteTimeout)
+	if opts.QueueSize > 0 {
+		auditWriter, err = queuewriter.New(auditWriter, queuewriter.Config{
+			Size:           opts.QueueSize,
+			Overflow:       queuewriter.OverflowMode(opts.QueueOverflow),
+			SpillDirectory: opts.QueueSpillDirectory,
+			SpillMaxBytes:  opts.QueueSpillMaxBytes,
+		}, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure queue with: %s", err.Error())
+		}
+		addHealthChecks("queue", auditWriter, readiness, liveness, opts.LivenessWriteTimeout)
+	}
+	var eventFilters []eventfilter.EventFilter
+	if opts.PolicyFilename != "" {
+		policyFilter, err := policyfilter.New(opts.PolicyFilename, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to load filter policy with: %s", err.Error())
+		}
+		eventFilters = append(eventFilters, policyFilter)
+	}
+	if opts.CelFilterFilename != "" {
+		celFilter, err := celfilter.New(opts.CelFilterFilename, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to compile CEL filters with: %s", err.Error())
+		}
+		eventFilters = append(eventFilters, celFilter)
+	}
+	var eventTransformers []eventtransformer.EventTransformer
+	// First, so the later transformers have less to work through
+	if len(opts.TrimFields) > 0 {
+		var fields []trimtransformer.Field
+		for _, field := range opts.TrimFields {
+			fields = append(fields, trimtransformer.Field(field))
+		}
+		trimTransformer, err := trimtransformer.New(fields, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure trimming with: %s", err.Error())
+		}
+		eventTransformers = append(eventTransformers, trimTransformer)
 	}
-	eventProcessor, err := eventprocessorimpl.New(auditWriter, metricsServer)
+	if opts.RedactionMode != "none" {
+		var salt []byte
+		if opts.RedactionSaltFilename != "" {
+			salt, err = os.ReadFile(opts.RedactionSaltFilename)
+			if err != nil {
+				common.Logger.Fatalf("failed to read redaction salt with: %s", err.Error())
+			}
+		}
+		redactionTransformer, err := redactiontransformer.New(redactiontransformer.Mode(opts.RedactionMode), opts.RedactionRules, salt, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure redaction with: %s", err.Error())
+		}
+		eventTransformers = append(eventTransformers, redactionTransformer)
+	}
+	// After redaction, so redacted values aren't in the diff
+	if opts.DiffMode != "none" {
+		diffTransformer, err := difftransformer.New(difftransformer.Mode(opts.DiffMode), opts.DiffIgnorePaths, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure diffs with: %s", err.Error())
+		}
+		eventTransformers = append(eventTransformers, diffTransformer)
+	}
+	// Last, so what's stored has been trimmed and redacted and the diff has
+	// been made from the whole objects
+	if opts.OffloadThreshold > 0 {
+		var store blobstore.BlobStore
+		if opts.BlobStore == "s3" {
+			store, err = s3blobstore.New(s3blobstore.Config{
+				S3ClientConfig: s3ClientConfig(opts),
+				Bucket:         opts.BlobS3Bucket,
+				Prefix:         opts.S3Prefix,
+			})
+		} else {
+			store, err = directoryblobstore.New(opts.BlobDirectory)
+		}
+		if err != nil {
+			common.Logger.Fatalf("failed to configure the blob store with: %s", err.Error())
+		}
+		offloadTransformer, err := offloadtransformer.New(offloadtransformer.Config{
+			Store:     store,
+			Threshold: opts.OffloadThreshold,
+			Retention: opts.BlobRetention,
+			Timeout:   opts.BlobStoreTimeout,
+		}, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure offloading with: %s", err.Error())
+		}
+		eventTransformers = append(eventTransformers, offloadTransformer)
+	}
+	eventProcessor, err := eventprocessorimpl.New(auditWriter, metricsServer, eventFilters, eventTransformers)
 
 	if err != nil {
 		common.Logger.Fatalf("failed to start audit eventProcessor with: %s", err.Error())
 	}
+	addProcessorHealthCheck(auditWriter, eventProcessor, liveness, opts.LivenessWriteTimeout)
 
-	httpListener := logrequestlistener.New(opts.ServerPort, opts.CertFilename, opts.CertKeyFilename, eventProcessor)
+	certSource, err := newCertSource(opts, metricsServer)
+	if err != nil {
+		common.Logger.Fatalf("failed to load TLS certificate with: %s", err.Error())
+	}
+	readiness.Add("tls", func() error {
+		return certificateLoaded(certSource)
+	})
+	var clientVerifier *logrequestlistener.ClientVerifier
+	if opts.ClientCAFilename != "" {
+		clientVerifier, err = logrequestlistener.NewClientVerifier(opts.ClientCAFilename, opts.ClientAllowedNames, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure client certificate verification with: %s", err.Error())
+		}
+	} else if len(opts.ClientAllowedNames) > 0 {
+		common.Logger.Fatalf("--client-allowed-name needs --client-ca-filename")
+	}
+	var authenticator *logrequestlistener.RequestAuthenticator
+	if opts.BearerTokenFilename != "" || len(opts.AllowedSourceCIDRs) > 0 {
+		authenticator, err = logrequestlistener.NewRequestAuthenticator(opts.BearerTokenFilename, opts.AllowedSourceCIDRs, metricsServer)
+		if err != nil {
+			common.Logger.Fatalf("failed to configure request authentication with: %s", err.Error())
+		}
+	}
+	httpListener := logrequestlistener.New(logrequestlistener.Config{
+		Port:           opts.ServerPort,
+		Certificates:   certSource,
+		ClientVerifier: clientVerifier,
+		Clusters:       clusters,
+		Authenticator:  authenticator,
+	}, eventProcessor, metricsServer)
 
 	go metricsServer.Start()
 	go httpListener.Start()
@@ -92,7 +445,29 @@ func main() {
 
 	go func() {
 		<-quit
-		httpListener.Stop()
+		start := time.Now()
+		// Events from requests that finish during shutdown. The writers that
+		// buffer events log how many they flushed themselves
+		tracker := eventProcessor.(eventprocessor.WriteTracker)
+		written := tracker.Written()
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+		defer cancel()
+		// Once every request has finished no more events can be logged, so
+		// everything still queued can be written and the writers closed
+		if err := httpListener.Stop(ctx); err != nil {
+			common.Logger.Errorw("failed to finish requests in progress", "error", err)
+		}
+		certSource.Close()
+		for _, transformer := range eventTransformers {
+			if closer, ok := transformer.(eventtransformer.Closer); ok {
+				closer.Close()
+			}
+		}
+		if err := auditWriter.Close(ctx); err != nil {
+			common.Logger.Errorw("failed to write every event before shutting down, some may be lost", "events", tracker.Written()-written, "error", err)
+		} else {
+			common.Logger.Infow("wrote every event before shutting down", "events", tracker.Written()-written, "duration", time.Since(start))
+		}
 		metricsServer.Stop()
 		close(done)
 	}()
@@ -100,3 +475,310 @@ func main() {
 	<-done
 	common.Logger.Infow("Server stopped")
 }
+
+// Adds the writer's checks to the probes, if it can tell whether it's healthy
+func addHealthChecks(name string, writer auditwritter.AuditWritter, readiness *health.Checks, liveness *health.Checks, writeTimeout time.Duration) {
+	reporter, ok := writer.(auditwritter.HealthReporter)
+	if !ok {
+		return
+	}
+	readiness.Add(name, reporter.Ready)
+	liveness.Add(name, func() error {
+		return reporter.Live(writeTimeout)
+	})
+}
+
+// A single sink isn't wrapped by a writer that can report on it, so the
+// event processor's progress writing to it is checked instead
+func addProcessorHealthCheck(writer auditwritter.AuditWritter, eventProcessor eventprocessor.EventProcessor, liveness *health.Checks, writeTimeout time.Duration) {
+	if _, ok := writer.(auditwritter.HealthReporter); ok {
+		return
+	}
+	tracker, ok := eventProcessor.(eventprocessor.WriteTracker)
+	if !ok {
+		return
+	}
+	liveness.Add("writer", func() error {
+		return tracker.Live(writeTimeout)
+	})
+}
+
+// Fails when there's no certificate to serve or it isn't valid now
+func certificateLoaded(certSource certsource.CertSource) error {
+	cert, err := certSource.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		return fmt.Errorf("no TLS certificate loaded: %w", err)
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errors.New("no TLS certificate loaded")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %w", err)
+		}
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("TLS certificate is only valid from %s to %s", leaf.NotBefore, leaf.NotAfter)
+	}
+	return nil
+}
+
+func newCertSource(opts Options, metricsServer metrics.MetricsServer) (certsource.CertSource, error) {
+	if !opts.SelfSignedTLS {
+		return filecertsource.New(opts.CertFilename, opts.CertKeyFilename, opts.CertReloadInterval, metricsServer)
+	}
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure the kubernetes client: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure the kubernetes client: %w", err)
+	}
+	return secretcertsource.New(secretcertsource.Config{
+		Client:        client,
+		Namespace:     opts.SelfSignedTLSNamespace,
+		SecretName:    opts.SelfSignedTLSSecret,
+		WebhookName:   opts.SelfSignedTLSWebhook,
+		DNSNames:      opts.SelfSignedTLSDNSNames,
+		CAValidity:    opts.SelfSignedTLSCAValidity,
+		CertValidity:  opts.SelfSignedTLSValidity,
+		RenewBefore:   opts.SelfSignedTLSRenew,
+		CheckInterval: opts.CertReloadInterval,
+	}, metricsServer)
+}
+
+// Creates the writer for one of the --sink values
+func newSink(name string, opts Options, formatter *commonwriter.Formatter, metricsServer metrics.MetricsServer, clusters []logrequestlistener.Cluster) (auditwritter.AuditWritter, error) {
+	switch name {
+	case "stderr":
+		return stderrwriter.New(formatter), nil
+	case "kafka":
+		return kafkawriter.New(kafkawriter.Config{
+			Brokers:               opts.KafkaBrokers,
+			Topic:                 opts.KafkaTopic,
+			PartitionKey:          kafkawriter.PartitionKey(opts.KafkaPartitionKey),
+			RequiredAcks:          opts.KafkaRequiredAcks,
+			Compression:           opts.KafkaCompression,
+			BatchMaxMessages:      opts.KafkaBatchMaxMessages,
+			BatchMaxBytes:         opts.KafkaBatchMaxBytes,
+			BatchTimeout:          opts.KafkaBatchTimeout,
+			TLSEnabled:            opts.KafkaTLS,
+			TLSCAFilename:         opts.KafkaTLSCAFilename,
+			TLSCertFilename:       opts.KafkaTLSCertFilename,
+			TLSKeyFilename:        opts.KafkaTLSKeyFilename,
+			TLSInsecureSkipVerify: opts.KafkaTLSInsecure,
+			SASLMechanism:         opts.KafkaSASLMechanism,
+			SASLUsername:          opts.KafkaSASLUsername,
+			SASLPasswordFilename:  opts.KafkaSASLPasswordFile,
+		}, formatter, metricsServer)
+	case "http":
+		return httpwriter.New(httpwriter.Config{
+			URL:                   opts.HTTPURL,
+			Headers:               opts.HTTPHeaders,
+			BearerTokenFilename:   opts.HTTPBearerTokenFilename,
+			Gzip:                  opts.HTTPCompression == "gzip",
+			BatchMaxEvents:        opts.HTTPBatchMaxEvents,
+			BatchMaxBytes:         opts.HTTPBatchMaxBytes,
+			BatchTimeout:          opts.HTTPBatchTimeout,
+			MaxRetries:            opts.HTTPMaxRetries,
+			InitialBackoff:        opts.HTTPRetryInitialBackoff,
+			MaxBackoff:            opts.HTTPRetryMaxBackoff,
+			Timeout:               opts.HTTPTimeout,
+			TLSCAFilename:         opts.HTTPTLSCAFilename,
+			TLSCertFilename:       opts.HTTPTLSCertFilename,
+			TLSKeyFilename:        opts.HTTPTLSKeyFilename,
+			TLSInsecureSkipVerify: opts.HTTPTLSInsecure,
+		}, formatter, metricsServer)
+	default:
+		if !strings.Contains(opts.LoggerFilename, clusterPlaceholder) {
+			return newDiskSink(opts, opts.LoggerFilename, opts.ClusterName, formatter, nil, metricsServer)
+		}
+		return newClusterDiskSinks(opts, formatter, metricsServer, clusters)
+	}
+}
+
+// Replaced in --logger-filename with the cluster of each event
+const clusterPlaceholder = "{cluster}"
+
+// Creates a disk writer for each cluster, and one for the events of
+// /log-request named after --cluster-name or "default"
+func newClusterDiskSinks(opts Options, formatter *commonwriter.Formatter, metricsServer metrics.MetricsServer, clusters []logrequestlistener.Cluster) (auditwritter.AuditWritter, error) {
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("%s in the logger filename needs --clusters-filename", clusterPlaceholder)
+	}
+	fallback := opts.ClusterName
+	if fallback == "" {
+		fallback = "default"
+	}
+	// A cluster with the fallback's name shares its files
+	names := []string{fallback}
+	for _, cluster := range clusters {
+		if cluster.Name != fallback {
+			names = append(names, cluster.Name)
+		}
+	}
+
+	var archivers map[string]segmentarchiver.SegmentArchiver
+	if opts.S3Bucket != "" {
+		var err error
+		archivers, err = s3archiver.NewForClusters(s3archiver.Config{
+			S3ClientConfig: s3ClientConfig(opts),
+			Bucket:         opts.S3Bucket,
+			Prefix:         opts.S3Prefix,
+			MaxRetries:     opts.S3MaxRetries,
+			InitialBackoff: opts.S3RetryInitialBackoff,
+		}, names, metricsServer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writers := map[string]auditwritter.AuditWritter{}
+	for _, name := range names {
+		filename := strings.ReplaceAll(opts.LoggerFilename, clusterPlaceholder, name)
+		writer, err := newDiskSink(opts, filename, name, formatter, archivers[name], metricsServer)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %w", name, err)
+		}
+		writers[name] = writer
+	}
+	fallbackWriter := writers[fallback]
+	delete(writers, fallback)
+	return clusterwriter.New(writers, fallbackWriter)
+}
+
+// Creates a disk writer logging to filename, with segments archived under
+// cluster. The archiver is created when it's nil and archiving is enabled
+func newDiskSink(opts Options, filename string, cluster string, formatter *commonwriter.Formatter, archiver segmentarchiver.SegmentArchiver, metricsServer metrics.MetricsServer) (auditwritter.AuditWritter, error) {
+	if archiver == nil && opts.S3Bucket != "" {
+		var err error
+		archiver, err = s3archiver.New(s3archiver.Config{
+			S3ClientConfig: s3ClientConfig(opts),
+			Bucket:         opts.S3Bucket,
+			Prefix:         opts.S3Prefix,
+			Cluster:        cluster,
+			MaxRetries:     opts.S3MaxRetries,
+			InitialBackoff: opts.S3RetryInitialBackoff,
+		}, metricsServer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.HashChain {
+		stateFilename := strings.ReplaceAll(opts.HashChainStateFilename, clusterPlaceholder, cluster)
+		if stateFilename == "" {
+			stateFilename = filename + ".chain"
+		} else if filename != opts.LoggerFilename && stateFilename == opts.HashChainStateFilename {
+			return nil, fmt.Errorf("the hash chain state filename needs %s when each cluster has its own log files", clusterPlaceholder)
+		}
+		chain, err := commonwriter.NewChain(stateFilename, filename)
+		if err != nil {
+			return nil, err
+		}
+		formatter = formatter.WithChain(chain)
+	}
+	return diskwriter.New(diskwriter.Config{
+		Filename:           filename,
+		MaxSizeMB:          opts.LoggerMaxSize,
+		RotateInterval:     opts.LoggerRotateInterval,
+		Compression:        diskwriter.Compression(opts.LoggerCompression),
+		MaxBackups:         opts.LoggerMaxBackups,
+		MaxAgeDays:         opts.LoggerMaxAge,
+		Archiver:           archiver,
+		SigningKeyFilename: opts.SigningKeyFilename,
+		CheckpointEvents:   opts.CheckpointEvents,
+		CheckpointInterval: opts.CheckpointInterval,
+		KEKFilename:        opts.KEKFilename,
+	}, formatter)
+}
+
+// The clusters whose events are written to the sink, with "" for events
+// from /log-request. nil when every event is written to every sink
+func sinkClusters(clusters []logrequestlistener.Cluster, sink string) []string {
+	routed := false
+	for _, cluster := range clusters {
+		routed = routed || len(cluster.Sinks) > 0
+	}
+	if !routed {
+		return nil
+	}
+	names := []string{""}
+	for _, cluster := range clusters {
+		if len(cluster.Sinks) == 0 || slices.Contains(cluster.Sinks, sink) {
+			names = append(names, cluster.Name)
+		}
+	}
+	return names
+}
+
+// Shared by everything stored in S3
+func s3ClientConfig(opts Options) common.S3ClientConfig {
+	return common.S3ClientConfig{
+		Endpoint:              opts.S3Endpoint,
+		Region:                opts.S3Region,
+		AccessKeyFilename:     opts.S3AccessKeyFilename,
+		SecretKeyFilename:     opts.S3SecretKeyFilename,
+		DisableTLS:            opts.S3DisableTLS,
+		TLSCAFilename:         opts.S3TLSCAFilename,
+		TLSInsecureSkipVerify: opts.S3TLSInsecure,
+	}
+}
+
+// Set when building with -ldflags "-X main.version=<version>"
+var version = ""
+
+// Falls back to the module version or commit recorded by go build
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return "unknown"
+}
+
+// The static fields added to every event, empty values are left out
+func eventMetadata(opts Options) (map[string]string, error) {
+	builtIn := map[string]string{
+		"cluster":     opts.ClusterName,
+		"environment": opts.Environment,
+		"region":      opts.Region,
+		"pod":         opts.PodName,
+		"node":        opts.NodeName,
+	}
+	// Only fields that are set are taken, so the rest can be given with
+	// --metadata-field
+	metadata := map[string]string{}
+	for key, value := range builtIn {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	if opts.MetadataVersion {
+		metadata["version"] = buildVersion()
+	}
+	for _, field := range opts.MetadataFields {
+		key, value, found := strings.Cut(field, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("metadata field %q must be of the form key=value", field)
+		}
+		if _, exists := metadata[key]; exists {
+			return nil, fmt.Errorf("metadata field %q is already set, by its own flag or an earlier --metadata-field", key)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	eventprocessorimpl "github.com/RichardoC/kube-audit-rest/internal/event_processor/event_processor_impl"
+	"github.com/RichardoC/kube-audit-rest/internal/health"
+	prometheusmetrics "github.com/RichardoC/kube-audit-rest/internal/metrics/prometheus_metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/thought-machine/go-flags"
+)
+
+func Test_WhenBuiltInFieldNotSet_ThenItCanBeGivenAsMetadataField(t *testing.T) {
+	metadata, err := eventMetadata(Options{MetadataFields: []string{"cluster=prod-eu"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"cluster": "prod-eu"}, metadata)
+}
+
+func Test_WhenBuiltInFieldSet_ThenMetadataFieldWithSameKeyRejected(t *testing.T) {
+	_, err := eventMetadata(Options{ClusterName: "prod-eu", MetadataFields: []string{"cluster=prod-us"}})
+
+	assert.ErrorContains(t, err, `metadata field "cluster" is already set`)
+}
+
+func Test_WhenDefaultDiskSink_ThenLivenessChecksWriter(t *testing.T) {
+	var opts Options
+	_, err := flags.ParseArgs(&opts, []string{"--logger-filename", path.Join(t.TempDir(), "audit.log")})
+	if err != nil {
+		t.Fatalf("parsing flags failed with : %s", err)
+	}
+	metricsServer := prometheusmetrics.New(0)
+	formatter, _ := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	writer, err := newSink("disk", opts, formatter, metricsServer, nil)
+	if err != nil {
+		t.Fatalf("creating disk sink failed with : %s", err)
+	}
+	t.Cleanup(func() { writer.Close(context.Background()) })
+	// Used on its own, so nothing else reports on it
+	_, ok := writer.(auditwritter.HealthReporter)
+	assert.False(t, ok)
+	eventProcessor, err := eventprocessorimpl.New(writer, metricsServer, nil, nil)
+	if err != nil {
+		t.Fatalf("creating event processor failed with : %s", err)
+	}
+	liveness := health.New("liveness")
+
+	addProcessorHealthCheck(writer, eventProcessor, liveness, opts.LivenessWriteTimeout)
+
+	response := httptest.NewRecorder()
+	liveness.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/healthz?format=json", nil))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `{"name":"writer","status":"ok"}`)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	diskwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/disk_writer"
+	"github.com/klauspost/compress/zstd"
+)
+
+type verifyCommand struct {
+	KEKFilename       string `long:"kek-filename" description:"Location of the key encryption key, for encrypted log files"`
+	PublicKeyFilename string `long:"public-key-filename" description:"Location of the PEM encoded Ed25519 public key the files were signed with, to check their checkpoints. Otherwise they're skipped unchecked"`
+	AllowUnfinished   bool   `long:"allow-unfinished" description:"Accept encrypted files that end without their final chunk, such as the log file still being written. Otherwise they're treated as truncated"`
+	Args              struct {
+		Files []string `positional-arg-name:"file" required:"1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Walks the files in the order they were written, reporting the first line
+// that doesn't follow on from the one before
+func (c *verifyCommand) Execute(args []string) error {
+	kek, err := loadOptionalKEK(c.KEKFilename)
+	if err != nil {
+		return err
+	}
+	var key ed25519.PublicKey
+	if c.PublicKeyFilename != "" {
+		if key, err = diskwriter.LoadVerifyingKey(c.PublicKeyFilename); err != nil {
+			return err
+		}
+	}
+	verifier := commonwriter.ChainVerifier{}
+	lines := 0
+	unchecked := 0
+	var first, last uint64
+	for _, filename := range c.Args.Files {
+		// Checkpoints don't span files
+		var checkpoints *diskwriter.CheckpointVerifier
+		if key != nil {
+			checkpoints = diskwriter.NewCheckpointVerifier(key)
+		}
+		err := readLines(filename, kek, c.AllowUnfinished, func(number int, line []byte) error {
+			if checkpoints != nil {
+				// Also checks that checkpoints cover the lines before them
+				if err := checkpoints.Verify(line); err != nil {
+					return fmt.Errorf("invalid checkpoint at %s:%d: %w", filename, number, err)
+				}
+			}
+			// Not part of the chain, so only skipped once checked
+			if diskwriter.IsCheckpoint(line) {
+				if checkpoints == nil {
+					unchecked++
+				}
+				return nil
+			}
+			seq, err := verifier.Verify(line)
+			if err != nil {
+				return fmt.Errorf("hash chain broken at %s:%d: %w", filename, number, err)
+			}
+			if lines == 0 {
+				first = seq
+			}
+			last = seq
+			lines++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if lines == 0 {
+		return errors.New("no lines to verify")
+	}
+	fmt.Printf("verified %d lines, from seq %d to %d\n", lines, first, last)
+	if unchecked > 0 {
+		fmt.Printf("skipped %d unchecked checkpoints, use --public-key-filename to check them\n", unchecked)
+	}
+	return nil
+}
+
+type verifySignaturesCommand struct {
+	PublicKeyFilename string `long:"public-key-filename" description:"Location of the PEM encoded Ed25519 public key of the key the files were signed with" required:"yes"`
+	KEKFilename       string `long:"kek-filename" description:"Location of the key encryption key, for encrypted log files"`
+	AllowUnfinished   bool   `long:"allow-unfinished" description:"Accept encrypted files that end without their final chunk, such as the log file still being written. Otherwise they're treated as truncated"`
+	Args              struct {
+		Files []string `positional-arg-name:"file" required:"1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Checks each file's detached signature, if it has one, and its checkpoints
+func (c *verifySignaturesCommand) Execute(args []string) error {
+	key, err := diskwriter.LoadVerifyingKey(c.PublicKeyFilename)
+	if err != nil {
+		return err
+	}
+	kek, err := loadOptionalKEK(c.KEKFilename)
+	if err != nil {
+		return err
+	}
+	for _, filename := range c.Args.Files {
+		if strings.HasSuffix(filename, diskwriter.SignatureSuffix) {
+			// Checked along with the file it signs
+			continue
+		}
+		signature := "no detached signature"
+		if _, err := os.Stat(filename + diskwriter.SignatureSuffix); err == nil {
+			if err := diskwriter.VerifySegment(key, filename); err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			signature = "valid detached signature"
+		}
+
+		// Checkpoints don't span files
+		verifier := diskwriter.NewCheckpointVerifier(key)
+		err := readLines(filename, kek, c.AllowUnfinished, func(number int, line []byte) error {
+			if err := verifier.Verify(line); err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, number, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		checkpoints, unchecked := verifier.Counts()
+		fmt.Printf("%s: %s, %d valid checkpoints, %d lines after the last checkpoint\n", filename, signature, checkpoints, unchecked)
+	}
+	return nil
+}
+
+type decryptCommand struct {
+	KEKFilename     string `long:"kek-filename" description:"Location of the key encryption key the files were encrypted with" required:"yes"`
+	AllowUnfinished bool   `long:"allow-unfinished" description:"Accept files that end without their final chunk, such as the log file still being written. Otherwise they're treated as truncated"`
+	Args            struct {
+		Files []string `positional-arg-name:"file" required:"1"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Writes the plaintext of each file to stdout, in order
+func (c *decryptCommand) Execute(args []string) error {
+	kek, err := diskwriter.LoadKEK(c.KEKFilename)
+	if err != nil {
+		return err
+	}
+	for _, filename := range c.Args.Files {
+		if err := decryptFile(filename, kek, c.AllowUnfinished, os.Stdout); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	return nil
+}
+
+// Fails once everything that could be decrypted has been written if the
+// file is unfinished, unless allowUnfinished is set
+func decryptFile(filename string, kek []byte, allowUnfinished bool, out io.Writer) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := diskwriter.NewDecryptingReader(file, kek)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, reader)
+	if errors.Is(err, diskwriter.ErrNoFinalChunk) {
+		if !allowUnfinished {
+			return fmt.Errorf("%w, use --allow-unfinished if it's the log file being written", err)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		return nil
+	}
+	return err
+}
+
+func loadOptionalKEK(filename string) ([]byte, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	return diskwriter.LoadKEK(filename)
+}
+
+// Calls fn with each line of the file, decompressing rolled log files and
+// decrypting encrypted ones, without the trailing newline. Line numbers
+// start at 1. An encrypted file without its final chunk fails once its
+// lines have been read, unless allowUnfinished is set
+func readLines(filename string, kek []byte, allowUnfinished bool, fn func(number int, line []byte) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	switch filepath.Ext(filename) {
+	case ".gz":
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", filename, err)
+		}
+		defer gz.Close()
+		reader = gz
+	case ".zst":
+		zst, err := zstd.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", filename, err)
+		}
+		defer zst.Close()
+		reader = zst
+	}
+
+	// Not a bufio.Scanner, as events can be larger than its buffer
+	buffered := bufio.NewReaderSize(reader, 1024*1024)
+	if diskwriter.IsEncrypted(buffered) {
+		if kek == nil {
+			return fmt.Errorf("%s is encrypted, the key encryption key is needed to read it", filename)
+		}
+		decrypted, err := diskwriter.NewDecryptingReader(buffered, kek)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", filename, err)
+		}
+		buffered = bufio.NewReaderSize(decrypted, 1024*1024)
+	}
+	for number := 1; ; number++ {
+		line, err := buffered.ReadBytes('\n')
+		if errors.Is(err, diskwriter.ErrNoFinalChunk) && len(line) == 0 {
+			if !allowUnfinished {
+				return fmt.Errorf("%s: %w, use --allow-unfinished if it's the log file being written", filename, err)
+			}
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			return nil
+		}
+		if len(line) > 0 {
+			if err := fn(number, bytes.TrimSuffix(line, []byte("\n"))); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	diskwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/disk_writer"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a disk writer adding every line to a hash chain
+func newChainedWriter(t *testing.T, config diskwriter.Config) auditwritter.AuditWritter {
+	formatter, _ := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	chain, err := commonwriter.NewChain(config.Filename+".chain", config.Filename)
+	if err != nil {
+		t.Fatalf("creating hash chain failed with : %s", err)
+	}
+	dw, err := diskwriter.New(config, formatter.WithChain(chain))
+	if err != nil {
+		t.Fatalf("creating disk writer failed with : %s", err)
+	}
+	t.Cleanup(func() { dw.Close(context.Background()) })
+	return dw
+}
+
+func logEvents(t *testing.T, dw auditwritter.AuditWritter, count int) {
+	for i := 1; i <= count; i++ {
+		assert.NoError(t, dw.LogEvent(fmt.Appendf(nil, `{"request":{"uid":"%d"}}`, i)))
+	}
+}
+
+func newKEK(t *testing.T) string {
+	kek := make([]byte, 32)
+	rand.Read(kek)
+	filename := path.Join(t.TempDir(), "kek")
+	assert.NoError(t, os.WriteFile(filename, []byte(base64.StdEncoding.EncodeToString(kek)+"\n"), 0600))
+	return filename
+}
+
+// Returns the filenames of a new signing key and its public key
+func newSigningKey(t *testing.T) (string, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	directory := t.TempDir()
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	assert.NoError(t, err)
+	privateFile := path.Join(directory, "signing.key")
+	publicFile := path.Join(directory, "signing.pub")
+	assert.NoError(t, os.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600))
+	assert.NoError(t, os.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600))
+	return privateFile, publicFile
+}
+
+func verify(files []string, configure func(*verifyCommand)) error {
+	command := &verifyCommand{}
+	command.Args.Files = files
+	if configure != nil {
+		configure(command)
+	}
+	return command.Execute(nil)
+}
+
+func Test_WhenChainIntact_ThenVerifySucceeds(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "audit.log")
+	dw := newChainedWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone})
+	logEvents(t, dw, 3)
+	assert.NoError(t, dw.Close(context.Background()))
+
+	assert.NoError(t, verify([]string{fileLog}, nil))
+}
+
+func Test_WhenChainTamperedWith_ThenVerifyFails(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "audit.log")
+	dw := newChainedWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone})
+	logEvents(t, dw, 3)
+	assert.NoError(t, dw.Close(context.Background()))
+	content, err := os.ReadFile(fileLog)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(fileLog, bytes.Replace(content, []byte(`"uid":"2"`), []byte(`"uid":"x"`), 1), 0600))
+
+	err = verify([]string{fileLog}, nil)
+
+	assert.ErrorContains(t, err, "hash chain broken at "+fileLog+":2")
+}
+
+func Test_WhenNoLines_ThenVerifyFails(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "audit.log")
+	assert.NoError(t, os.WriteFile(fileLog, nil, 0600))
+
+	assert.Error(t, verify([]string{fileLog}, nil))
+}
+
+func Test_WhenCheckpointForged_ThenVerifyWithPublicKeyFails(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "audit.log")
+	signingKey, publicKey := newSigningKey(t)
+	dw := newChainedWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, SigningKeyFilename: signingKey, CheckpointEvents: 2})
+	logEvents(t, dw, 4)
+	assert.NoError(t, dw.Close(context.Background()))
+	assert.NoError(t, verify([]string{fileLog}, func(c *verifyCommand) { c.PublicKeyFilename = publicKey }))
+
+	// Signed by a different key
+	_, otherKey := newSigningKey(t)
+	err := verify([]string{fileLog}, func(c *verifyCommand) { c.PublicKeyFilename = otherKey })
+
+	assert.ErrorContains(t, err, "invalid checkpoint at "+fileLog)
+}
+
+func Test_WhenSigned_ThenVerifySignaturesChecksCheckpoints(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "audit.log")
+	signingKey, publicKey := newSigningKey(t)
+	dw := newChainedWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, SigningKeyFilename: signingKey, CheckpointEvents: 2})
+	logEvents(t, dw, 4)
+	assert.NoError(t, dw.Close(context.Background()))
+
+	command := &verifySignaturesCommand{PublicKeyFilename: publicKey}
+	command.Args.Files = []string{fileLog}
+	assert.NoError(t, command.Execute(nil))
+
+	content, err := os.ReadFile(fileLog)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(fileLog, bytes.Replace(content, []byte(`"uid":"3"`), []byte(`"uid":"x"`), 1), 0600))
+	assert.Error(t, command.Execute(nil))
+}
+
+func Test_WhenEncrypted_ThenDecryptedAndVerifiedWithTheKEK(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "audit.log")
+	kekFile := newKEK(t)
+	dw := newChainedWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, KEKFilename: kekFile})
+	logEvents(t, dw, 3)
+	assert.NoError(t, dw.Close(context.Background()))
+	kek, err := diskwriter.LoadKEK(kekFile)
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, decryptFile(fileLog, kek, false, &out))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Contains(t, lines[0], `"uid":"1"`)
+		assert.Contains(t, lines[2], `"uid":"3"`)
+	}
+	assert.NoError(t, verify([]string{fileLog}, func(c *verifyCommand) { c.KEKFilename = kekFile }))
+	assert.ErrorContains(t, verify([]string{fileLog}, nil), "is encrypted")
+}
+
+func Test_WhenEncryptedFileUnfinished_ThenFailsUnlessAllowed(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "audit.log")
+	kekFile := newKEK(t)
+	dw := newChainedWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, KEKFilename: kekFile})
+	logEvents(t, dw, 3)
+	// Still open, so it has no final chunk
+	dw.Sync()
+	kek, err := diskwriter.LoadKEK(kekFile)
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.ErrorIs(t, decryptFile(fileLog, kek, false, &out), diskwriter.ErrNoFinalChunk)
+	// Everything before the missing chunk is still written
+	assert.Equal(t, 3, strings.Count(out.String(), "\n"))
+	out.Reset()
+	assert.NoError(t, decryptFile(fileLog, kek, true, &out))
+	assert.Equal(t, 3, strings.Count(out.String(), "\n"))
+
+	assert.ErrorIs(t, verify([]string{fileLog}, func(c *verifyCommand) { c.KEKFilename = kekFile }), diskwriter.ErrNoFinalChunk)
+	assert.NoError(t, verify([]string{fileLog}, func(c *verifyCommand) {
+		c.KEKFilename = kekFile
+		c.AllowUnfinished = true
+	}))
+}
@@ -0,0 +1,74 @@
+package clusterwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	"github.com/tidwall/gjson"
+)
+
+// Writes each event to the writer of its cluster, from /log-request/{cluster},
+// so every cluster has its own log files
+type clusterWritter struct {
+	writers map[string]auditwritter.AuditWritter
+	// For events from /log-request and clusters without a writer
+	fallback auditwritter.AuditWritter
+}
+
+func New(writers map[string]auditwritter.AuditWritter, fallback auditwritter.AuditWritter) (auditwritter.AuditWritter, error) {
+	if fallback == nil {
+		return nil, errors.New("a fallback writer is required")
+	}
+	return &clusterWritter{writers: writers, fallback: fallback}, nil
+}
+
+func (cw *clusterWritter) LogEvent(body []byte) error {
+	cluster := gjson.GetBytes(body, commonwriter.MetadataField+".cluster").Str
+	if writer, ok := cw.writers[cluster]; ok {
+		return writer.LogEvent(body)
+	}
+	return cw.fallback.LogEvent(body)
+}
+
+func (cw *clusterWritter) Sync() {
+	var wg sync.WaitGroup
+	for _, writer := range cw.all() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer.Sync()
+		}()
+	}
+	wg.Wait()
+}
+
+func (cw *clusterWritter) Close(ctx context.Context) error {
+	errs := []error{cw.fallback.Close(ctx)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for cluster, writer := range cw.writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writer.Close(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("cluster %s: %w", cluster, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (cw *clusterWritter) all() []auditwritter.AuditWritter {
+	writers := []auditwritter.AuditWritter{cw.fallback}
+	for _, writer := range cw.writers {
+		writers = append(writers, writer)
+	}
+	return writers
+}
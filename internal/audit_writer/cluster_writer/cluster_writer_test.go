@@ -0,0 +1,57 @@
+package clusterwriter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	clusterwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/cluster_writer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WhenEventForCluster_ThenWrittenToItsWriter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	prod := mymock.NewMockAuditWritter(ctrl)
+	fallback := mymock.NewMockAuditWritter(ctrl)
+	prodEvent := `{"request":{"uid":"a"},"kubeAuditRest":{"cluster":"prod"}}`
+	devEvent := `{"request":{"uid":"b"},"kubeAuditRest":{"cluster":"dev"}}`
+	plainEvent := `{"request":{"uid":"c"}}`
+	prod.EXPECT().LogEvent([]byte(prodEvent)).Return(nil)
+	fallback.EXPECT().LogEvent([]byte(devEvent)).Return(nil)
+	fallback.EXPECT().LogEvent([]byte(plainEvent)).Return(errors.New("disk full"))
+
+	cw, err := clusterwriter.New(map[string]auditwritter.AuditWritter{"prod": prod}, fallback)
+	if err != nil {
+		t.Fatalf("creating cluster writer failed with : %s", err)
+	}
+
+	assert.NoError(t, cw.LogEvent([]byte(prodEvent)))
+	assert.NoError(t, cw.LogEvent([]byte(devEvent)))
+	assert.ErrorContains(t, cw.LogEvent([]byte(plainEvent)), "disk full")
+}
+
+func Test_WhenClosed_ThenEveryWriterClosed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	prod := mymock.NewMockAuditWritter(ctrl)
+	fallback := mymock.NewMockAuditWritter(ctrl)
+	prod.EXPECT().Sync()
+	fallback.EXPECT().Sync()
+	prod.EXPECT().Close(gomock.Any()).Return(errors.New("segment not archived"))
+	fallback.EXPECT().Close(gomock.Any()).Return(nil)
+
+	cw, err := clusterwriter.New(map[string]auditwritter.AuditWritter{"prod": prod}, fallback)
+	if err != nil {
+		t.Fatalf("creating cluster writer failed with : %s", err)
+	}
+
+	cw.Sync()
+	assert.ErrorContains(t, cw.Close(context.Background()), "cluster prod: segment not archived")
+}
+
+func Test_WhenNoFallback_ThenErrorReturned(t *testing.T) {
+	_, err := clusterwriter.New(nil, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,161 @@
+package commonwriter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// How much of each request is recorded in the audit Event
+// https://kubernetes.io/docs/tasks/debug/debug-cluster/audit/#audit-policy
+type AuditLevel string
+
+const (
+	// User, timestamps, resource and verb but not the objects
+	AuditLevelMetadata AuditLevel = "Metadata"
+	// Metadata and the object from the request
+	AuditLevelRequest AuditLevel = "Request"
+	// Request and the previous state of the object
+	AuditLevelRequestResponse AuditLevel = "RequestResponse"
+)
+
+func (l AuditLevel) valid() bool {
+	return l == AuditLevelMetadata || l == AuditLevelRequest || l == AuditLevelRequestResponse
+}
+
+// Format of metav1.MicroTime, used by the audit Event timestamps
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// Subset of the audit.k8s.io/v1 Event that can be built from an AdmissionRequest
+// https://kubernetes.io/docs/reference/config-api/apiserver-audit.v1/#audit-k8s-io-v1-Event
+type auditEvent struct {
+	Kind                     string            `json:"kind"`
+	APIVersion               string            `json:"apiVersion"`
+	Level                    AuditLevel        `json:"level"`
+	AuditID                  string            `json:"auditID"`
+	Stage                    string            `json:"stage"`
+	Verb                     string            `json:"verb"`
+	User                     json.RawMessage   `json:"user"`
+	ObjectRef                objectReference   `json:"objectRef"`
+	RequestObject            json.RawMessage   `json:"requestObject,omitempty"`
+	ResponseObject           json.RawMessage   `json:"responseObject,omitempty"`
+	RequestReceivedTimestamp string            `json:"requestReceivedTimestamp,omitempty"`
+	StageTimestamp           string            `json:"stageTimestamp,omitempty"`
+	Annotations              map[string]string `json:"annotations,omitempty"`
+}
+
+type objectReference struct {
+	Resource    string `json:"resource,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name,omitempty"`
+	UID         string `json:"uid,omitempty"`
+	APIGroup    string `json:"apiGroup,omitempty"`
+	APIVersion  string `json:"apiVersion,omitempty"`
+	Subresource string `json:"subresource,omitempty"`
+}
+
+// Converts an AdmissionReview, with requestReceivedTimestamp already added,
+// into a compacted audit.k8s.io/v1 Event at the given level
+func ToAuditEvent(body []byte, level AuditLevel) ([]byte, error) {
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("invalid json")
+	}
+	review := gjson.ParseBytes(body)
+	req := review.Get("request")
+
+	timestamp := ""
+	if received, err := time.Parse(time.RFC3339Nano, review.Get(TimestampField).Str); err == nil {
+		timestamp = received.UTC().Format(microTimeFormat)
+	}
+
+	user := json.RawMessage(req.Get("userInfo").Raw)
+	if len(user) == 0 {
+		user = json.RawMessage("{}")
+	}
+
+	event := auditEvent{
+		Kind:       "Event",
+		APIVersion: "audit.k8s.io/v1",
+		Level:      level,
+		AuditID:    req.Get("uid").Str,
+		// Detection rules generally expect ResponseComplete, which is
+		// the only stage the kube-apiserver records objects in
+		Stage: "ResponseComplete",
+		Verb:  verb(req),
+		User:  user,
+		ObjectRef: objectReference{
+			Resource:    req.Get("resource.resource").Str,
+			Namespace:   req.Get("namespace").Str,
+			Name:        req.Get("name").Str,
+			UID:         firstExisting(req, "object.metadata.uid", "oldObject.metadata.uid"),
+			APIGroup:    req.Get("resource.group").Str,
+			APIVersion:  req.Get("resource.version").Str,
+			Subresource: req.Get("subResource").Str,
+		},
+		RequestReceivedTimestamp: timestamp,
+		StageTimestamp:           timestamp,
+	}
+	if req.Get("dryRun").Bool() {
+		event.annotate("kube-audit-rest/dry-run", "true")
+	}
+	// Added by the diff transformer, and only has somewhere to go as an annotation
+	if diff := review.Get("objectDiff"); diff.Exists() {
+		event.annotate("kube-audit-rest/object-diff", diff.Raw)
+	}
+	review.Get(MetadataField).ForEach(func(key, value gjson.Result) bool {
+		event.annotate("kube-audit-rest/"+key.Str, value.String())
+		return true
+	})
+	if level == AuditLevelRequest || level == AuditLevelRequestResponse {
+		event.RequestObject = rawObject(req.Get("object"))
+	}
+	if level == AuditLevelRequestResponse {
+		event.ResponseObject = rawObject(req.Get("oldObject"))
+	}
+
+	// Encoding compacts the raw objects, but leave any HTML characters as they were
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(event); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (e *auditEvent) annotate(key, value string) {
+	if e.Annotations == nil {
+		e.Annotations = map[string]string{}
+	}
+	e.Annotations[key] = value
+}
+
+// Admission only sees CREATE, UPDATE, DELETE and CONNECT. Patches are
+// sent as UPDATE, but can be recognised from their options
+func verb(req gjson.Result) string {
+	if req.Get("options.kind").Str == "PatchOptions" {
+		return "patch"
+	}
+	return strings.ToLower(req.Get("operation").Str)
+}
+
+func firstExisting(req gjson.Result, paths ...string) string {
+	for _, path := range paths {
+		if value := req.Get(path); value.Exists() {
+			return value.Str
+		}
+	}
+	return ""
+}
+
+// Omits missing and null objects rather than writing "null"
+func rawObject(object gjson.Result) json.RawMessage {
+	if !object.Exists() || object.Type == gjson.Null {
+		return nil
+	}
+	return json.RawMessage(object.Raw)
+}
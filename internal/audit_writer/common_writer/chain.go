@@ -0,0 +1,252 @@
+package commonwriter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+)
+
+// The prevHash of the first line of a chain
+var GenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// Matches the fields a Chain appends to the end of each line
+var chainFields = regexp.MustCompile(`,"seq":(\d+),"prevHash":"([0-9a-f]{64})","hash":"([0-9a-f]{64})"}$`)
+
+// Links every line written to the previous one, so lines that are edited,
+// removed or reordered after being written can be found. Each line gets a
+// seq, the hash of the previous line as prevHash, and its own hash, which
+// is the SHA-256 of prevHash followed by the line without its hash field.
+// The head of the chain is saved after every line, so it carries on over
+// restarts and rolled files. It's only synced by Sync and Close, as the
+// last line of the log file is used instead when they don't match
+type Chain struct {
+	mu     sync.Mutex
+	state  *os.File
+	seq    uint64
+	hash   string
+	closed bool
+}
+
+// The head is loaded from and saved to stateFilename, a new chain is
+// started if it doesn't exist. If the last line of logFilename is a
+// different link, as the process stopped before the head or the line
+// reached the disk, the chain carries on from that line instead
+func NewChain(stateFilename string, logFilename string) (*Chain, error) {
+	state, err := os.OpenFile(stateFilename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hash chain state: %w", err)
+	}
+	chain := &Chain{state: state, hash: GenesisHash}
+	content, err := io.ReadAll(state)
+	if err != nil {
+		state.Close()
+		return nil, fmt.Errorf("failed to read hash chain state: %w", err)
+	}
+	if len(content) > 0 {
+		if _, err := fmt.Sscanf(string(content), "%d %64s", &chain.seq, &chain.hash); err != nil || !isHash(chain.hash) {
+			state.Close()
+			return nil, fmt.Errorf("invalid hash chain state in %s", stateFilename)
+		}
+	}
+
+	last, err := lastChainLine(logFilename)
+	if err != nil {
+		state.Close()
+		return nil, fmt.Errorf("failed to read the end of the log file: %w", err)
+	}
+	if last != nil {
+		// Only its own hash is checked, as lines before it are checked by verify
+		verifier := ChainVerifier{}
+		seq, err := verifier.Verify(last)
+		if err == nil && (seq != chain.seq || verifier.hash != chain.hash) {
+			common.Logger.Warnw("hash chain state doesn't match the log file, carrying on from its last line", "stateSeq", chain.seq, "logSeq", seq)
+			chain.seq = seq
+			chain.hash = verifier.hash
+			if err := chain.save(); err != nil {
+				state.Close()
+				return nil, fmt.Errorf("failed to save hash chain state: %w", err)
+			}
+		}
+	}
+	return chain, nil
+}
+
+// How many lines from the end of the log file are looked at for one with
+// the chain fields, allowing for checkpoints after the last event
+const maxTrailingLines = 8
+
+// Returns the last complete line of the file with the chain fields, or nil
+// if there isn't one near the end, such as when the file is encrypted
+func lastChainLine(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read backwards in blocks, as lines can be large. Whatever follows the
+	// last newline is incomplete or empty, so it's skipped
+	var partial []byte
+	ended := false
+	seen := 0
+	for offset := info.Size(); offset > 0; {
+		size := min(offset, 64*1024)
+		offset -= size
+		block := make([]byte, size, size+int64(len(partial)))
+		if _, err := file.ReadAt(block, offset); err != nil {
+			return nil, err
+		}
+		lines := bytes.Split(append(block, partial...), []byte("\n"))
+		if !ended {
+			if len(lines) == 1 {
+				continue
+			}
+			lines = lines[:len(lines)-1]
+			ended = true
+		}
+		// The first piece may continue in the previous block
+		complete := lines
+		partial = nil
+		if offset > 0 {
+			partial, complete = lines[0], lines[1:]
+		}
+		for i := len(complete) - 1; i >= 0; i-- {
+			if chainFields.Match(complete[i]) {
+				return complete[i], nil
+			}
+			seen++
+			if seen >= maxTrailingLines {
+				return nil, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Writes the line to writer as the next link in the chain. The chain only
+// moves on once the line has been written
+func (c *Chain) write(line []byte, writer io.Writer) error {
+	if len(line) < 2 || line[0] != '{' || line[len(line)-1] != '}' {
+		return errors.New("only json objects can be added to the hash chain")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.seq + 1
+	unhashed := fmt.Appendf(withRoom(line[:len(line)-1]), `,"seq":%d,"prevHash":"%s"}`, seq, c.hash)
+	hash := linkHash(c.hash, unhashed)
+	linked := fmt.Appendf(unhashed[:len(unhashed)-1], `,"hash":"%s"}`+"\n", hash)
+	if _, err := writer.Write(linked); err != nil {
+		return err
+	}
+
+	c.seq = seq
+	c.hash = hash
+	if err := c.save(); err != nil {
+		common.Logger.Errorw("failed to save hash chain state, the chain will be broken after a restart", "error", err)
+	}
+	return nil
+}
+
+func (c *Chain) save() error {
+	// Fixed width, so it's always completely overwritten
+	_, err := c.state.WriteAt(fmt.Appendf(nil, "%020d %s\n", c.seq, c.hash), 0)
+	return err
+}
+
+// Syncs the saved head to disk, so it survives a power loss. Doesn't wait
+// for a line being written, so it can be called while writing one
+func (c *Chain) Sync() error {
+	return c.state.Sync()
+}
+
+// Syncs and closes the saved head. The chain mustn't be used after
+func (c *Chain) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return errors.Join(c.state.Sync(), c.state.Close())
+}
+
+// Returns a copy with room for the chain fields, so appending to it
+// doesn't modify the caller's slice
+func withRoom(b []byte) []byte {
+	return append(make([]byte, 0, len(b)+256), b...)
+}
+
+func linkHash(prevHash string, unhashed []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(prevHash))
+	hash.Write(unhashed)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Checks that lines written by a Chain follow on from each other, in the
+// order they were written. The first line verified may be from the middle
+// of a chain, as older files may have been deleted
+type ChainVerifier struct {
+	started bool
+	seq     uint64
+	hash    string
+}
+
+// Returns the seq of the line, or an error if it isn't the next link
+func (v *ChainVerifier) Verify(line []byte) (uint64, error) {
+	match := chainFields.FindSubmatchIndex(line)
+	if match == nil {
+		return 0, errors.New("line has no hash chain fields")
+	}
+	seq, err := strconv.ParseUint(string(line[match[2]:match[3]]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid seq: %w", err)
+	}
+	prevHash := string(line[match[4]:match[5]])
+	hash := string(line[match[6]:match[7]])
+	// The line as it was when it was hashed, ending after prevHash
+	unhashed := append(withRoom(line[:match[5]+1]), '}')
+
+	if computed := linkHash(prevHash, unhashed); computed != hash {
+		return seq, fmt.Errorf("line %d was modified, its hash is %s but its content hashes to %s", seq, hash, computed)
+	}
+	switch {
+	case v.started && seq != v.seq+1:
+		return seq, fmt.Errorf("expected line %d but found line %d", v.seq+1, seq)
+	case v.started && prevHash != v.hash:
+		return seq, fmt.Errorf("line %d doesn't follow on from line %d, its prevHash is %s but the hash of line %d is %s", seq, v.seq, prevHash, v.seq, v.hash)
+	case !v.started && seq == 1 && prevHash != GenesisHash:
+		return seq, fmt.Errorf("line 1 has prevHash %s rather than the start of a chain", prevHash)
+	}
+	v.started = true
+	v.seq = seq
+	v.hash = hash
+	return seq, nil
+}
@@ -8,27 +8,155 @@ import (
 	"time"
 
 	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
-func LogEvent(body []byte, writer io.Writer) {
+type OutputFormat string
+
+const (
+	// The AdmissionReview as received, with requestReceivedTimestamp added
+	FormatAdmissionReview OutputFormat = "admission-review"
+	// An audit.k8s.io/v1 Event, as written by the kube-apiserver audit log
+	FormatAuditEvent OutputFormat = "audit-event"
+)
+
+// Renders events into single lines in the configured output format,
+// shared by every AuditWritter implementation
+type Formatter struct {
+	format OutputFormat
+	level  AuditLevel
+	// Only used by LogEvent, optional
+	chain *Chain
+	// Rendered MetadataField, optional
+	metadata []byte
+}
+
+// The top level field static metadata is added to, alongside TimestampField
+const MetadataField = "kubeAuditRest"
+
+// Set when the request is received, so events written later, such as from
+// a queue or spool, keep the time they happened
+const TimestampField = "requestReceivedTimestamp"
+
+// level is only used by FormatAuditEvent
+func NewFormatter(format OutputFormat, level AuditLevel) (*Formatter, error) {
+	switch format {
+	case FormatAdmissionReview:
+	case FormatAuditEvent:
+		if !level.valid() {
+			return nil, fmt.Errorf("unknown audit level %q", level)
+		}
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+	return &Formatter{format: format, level: level}, nil
+}
+
+// Returns a copy of the formatter that adds every line LogEvent writes to
+// the hash chain. Each writer needs its own chain
+func (f *Formatter) WithChain(chain *Chain) *Formatter {
+	withChain := *f
+	withChain.chain = chain
+	return &withChain
+}
+
+// Returns a copy of the formatter that adds the fields, such as the cluster
+// name, to every event as MetadataField. Empty values are left out, and
+// fields already in the event, such as the cluster from the request path,
+// are kept
+func (f *Formatter) WithMetadata(fields map[string]string) *Formatter {
+	nonEmpty := map[string]string{}
+	for key, value := range fields {
+		if value != "" {
+			nonEmpty[key] = value
+		}
+	}
+	withMetadata := *f
+	withMetadata.metadata = nil
+	if len(nonEmpty) > 0 {
+		// Maps are encoded in key order, so every event has the same bytes
+		withMetadata.metadata, _ = json.Marshal(nonEmpty)
+	}
+	return &withMetadata
+}
+
+// Returns the event as compacted json, without a trailing newline
+func (f *Formatter) Format(body []byte) ([]byte, error) {
 	requestStr := string(body)
 	updatedObj, err := addTimestamp(requestStr)
 	if err != nil {
 		common.Logger.Debugw("failed to add timestamp", "error", err)
+		updatedObj = requestStr
+	}
+	if f.metadata != nil {
+		if withMetadata, err := f.addMetadata(updatedObj); err != nil {
+			common.Logger.Debugw("failed to add metadata", "error", err)
+		} else {
+			updatedObj = withMetadata
+		}
+	}
+
+	if f.format == FormatAuditEvent {
+		return ToAuditEvent([]byte(updatedObj), f.level)
 	}
 
 	// Compact the json for single line use regardless of request prettiness
 	dst := &bytes.Buffer{}
 	json.Compact(dst, []byte(updatedObj))
+	return dst.Bytes(), nil
+}
 
-	_, err = fmt.Fprintln(writer, dst)
+func (f *Formatter) LogEvent(body []byte, writer io.Writer) error {
+	line, err := f.Format(body)
 	if err != nil {
-		common.Logger.Error(err)
+		return fmt.Errorf("failed to format event: %w", err)
+	}
+	if f.chain != nil {
+		return f.chain.write(line, writer)
+	}
+
+	_, err = fmt.Fprintln(writer, string(line))
+	return err
+}
+
+// Syncs the hash chain's head, if there is one
+func (f *Formatter) Sync() error {
+	if f.chain == nil {
+		return nil
+	}
+	return f.chain.Sync()
+}
+
+// Syncs and closes the hash chain's head, if there is one
+func (f *Formatter) Close() error {
+	if f.chain == nil {
+		return nil
 	}
+	return f.chain.Close()
 }
 
+func (f *Formatter) addMetadata(requestBody string) (string, error) {
+	existing := gjson.Get(requestBody, MetadataField)
+	if !existing.IsObject() {
+		return sjson.SetRaw(requestBody, MetadataField, string(f.metadata))
+	}
+	var err error
+	gjson.ParseBytes(f.metadata).ForEach(func(key, value gjson.Result) bool {
+		if existing.Get(gjson.Escape(key.Str)).Exists() {
+			return true
+		}
+		requestBody, err = sjson.Set(requestBody, MetadataField+"."+gjson.Escape(key.Str), value.Str)
+		return err == nil
+	})
+	return requestBody, err
+}
+
+// Events that already have a timestamp keep it
 func addTimestamp(requestBody string) (string, error) {
+	if gjson.Get(requestBody, TimestampField).Str != "" {
+		return requestBody, nil
+	}
 	currentTime := time.Now().Format(time.RFC3339Nano)
-	return sjson.Set(requestBody, "requestReceivedTimestamp", currentTime)
+	return sjson.Set(requestBody, TimestampField, currentTime)
 }
@@ -0,0 +1,343 @@
+package commonwriter_test
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Regenerate the golden files with
+// go test ./internal/audit_writer/common_writer/ -update
+var update = flag.Bool("update", false, "update the golden files")
+
+// The requests the local testing sends, sorted by uid
+const sampleData = "../../../testing/locally/data/kube-audit-rest-sorted.log"
+
+// The sample data has the non deterministic timestamps removed
+const fixedTimestamp = "2023-02-04T21:56:41.610688981Z"
+
+func readLines(t *testing.T, filename string) [][]byte {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, bytes.Clone(scanner.Bytes()))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func Test_WhenConvertingSampleData_ThenMatchesGoldenFiles(t *testing.T) {
+	testCases := []struct {
+		level  commonwriter.AuditLevel
+		golden string
+	}{
+		{commonwriter.AuditLevelMetadata, "audit-event-metadata.golden"},
+		{commonwriter.AuditLevelRequest, "audit-event-request.golden"},
+		{commonwriter.AuditLevelRequestResponse, "audit-event-requestresponse.golden"},
+	}
+	requests := readLines(t, sampleData)
+
+	for _, tc := range testCases {
+		t.Run(string(tc.level), func(t *testing.T) {
+			var got bytes.Buffer
+			for _, request := range requests {
+				withTimestamp, err := sjson.SetBytes(request, "requestReceivedTimestamp", fixedTimestamp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				event, err := commonwriter.ToAuditEvent(withTimestamp, tc.level)
+				if err != nil {
+					t.Fatalf("converting %s failed with : %s", request, err)
+				}
+				got.Write(event)
+				got.WriteString("\n")
+			}
+
+			goldenFile := path.Join("testdata", tc.golden)
+			if *update {
+				if err := os.WriteFile(goldenFile, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, string(want), got.String())
+		})
+	}
+}
+
+func Test_WhenConvertingRequest_ThenFieldsMapped(t *testing.T) {
+	request := `{"request":{"uid":"abc","resource":{"group":"apps","version":"v1","resource":"deployments"},"subResource":"scale",` +
+		`"name":"web","namespace":"default","operation":"UPDATE","userInfo":{"username":"alice","groups":["devs"]},` +
+		`"object":{"metadata":{"uid":"obj-uid"},"spec":{"replicas":2}},"oldObject":{"metadata":{"uid":"obj-uid"},"spec":{"replicas":1}},` +
+		`"dryRun":true,"options":{"kind":"PatchOptions","apiVersion":"meta.k8s.io/v1"}},"requestReceivedTimestamp":"2023-02-04T21:56:41.610688981+01:00"}`
+
+	event, err := commonwriter.ToAuditEvent([]byte(request), commonwriter.AuditLevelRequestResponse)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "audit.k8s.io/v1", gjson.GetBytes(event, "apiVersion").Str)
+	assert.Equal(t, "Event", gjson.GetBytes(event, "kind").Str)
+	assert.Equal(t, "abc", gjson.GetBytes(event, "auditID").Str)
+	assert.Equal(t, "patch", gjson.GetBytes(event, "verb").Str)
+	assert.Equal(t, "alice", gjson.GetBytes(event, "user.username").Str)
+	assert.Equal(t, `{"resource":"deployments","namespace":"default","name":"web","uid":"obj-uid","apiGroup":"apps","apiVersion":"v1","subresource":"scale"}`,
+		gjson.GetBytes(event, "objectRef").Raw)
+	assert.Equal(t, int64(2), gjson.GetBytes(event, "requestObject.spec.replicas").Int())
+	assert.Equal(t, int64(1), gjson.GetBytes(event, "responseObject.spec.replicas").Int())
+	assert.Equal(t, "2023-02-04T20:56:41.610688Z", gjson.GetBytes(event, "requestReceivedTimestamp").Str)
+	assert.Equal(t, "2023-02-04T20:56:41.610688Z", gjson.GetBytes(event, "stageTimestamp").Str)
+	assert.Equal(t, "true", gjson.GetBytes(event, `annotations.kube-audit-rest/dry-run`).Str)
+}
+
+func Test_WhenConvertingRequestWithDiff_ThenDiffAnnotated(t *testing.T) {
+	request := `{"request":{"uid":"abc","operation":"UPDATE","object":{"spec":{"replicas":2}},"oldObject":{"spec":{"replicas":1}}},` +
+		`"objectDiff":[{"op":"replace","path":"/spec/replicas","value":2}]}`
+
+	event, err := commonwriter.ToAuditEvent([]byte(request), commonwriter.AuditLevelMetadata)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"op":"replace","path":"/spec/replicas","value":2}]`, gjson.GetBytes(event, `annotations.kube-audit-rest/object-diff`).Str)
+}
+
+func Test_WhenFormattingAdmissionReview_ThenCompactedWithTimestamp(t *testing.T) {
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	formatter.LogEvent([]byte("{\n  \"request\": {\"uid\": \"abc\"}\n}"), &out)
+
+	line := out.String()
+	assert.True(t, strings.HasPrefix(line, `{"request":{"uid":"abc"},"requestReceivedTimestamp":"`))
+	assert.True(t, strings.HasSuffix(line, "\"}\n"))
+}
+
+func Test_WhenEventAlreadyHasTimestamp_ThenItIsKept(t *testing.T) {
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAuditEvent, commonwriter.AuditLevelMetadata)
+	assert.NoError(t, err)
+
+	line, err := formatter.Format([]byte(`{"request":{"uid":"abc"},"requestReceivedTimestamp":"2023-02-04T21:56:41.610688981Z"}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2023-02-04T21:56:41.610688Z", gjson.GetBytes(line, "requestReceivedTimestamp").Str)
+	assert.Equal(t, "2023-02-04T21:56:41.610688Z", gjson.GetBytes(line, "stageTimestamp").Str)
+}
+
+func Test_WhenFormattingAuditEvent_ThenTimestampUsed(t *testing.T) {
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAuditEvent, commonwriter.AuditLevelMetadata)
+	assert.NoError(t, err)
+
+	line, err := formatter.Format([]byte(`{"request":{"uid":"abc","operation":"CREATE","object":{"a":1}}}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "create", gjson.GetBytes(line, "verb").Str)
+	assert.NotEmpty(t, gjson.GetBytes(line, "stageTimestamp").Str)
+	assert.False(t, gjson.GetBytes(line, "requestObject").Exists())
+}
+
+func Test_WhenMetadataSet_ThenAddedToEveryEvent(t *testing.T) {
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	assert.NoError(t, err)
+	formatter = formatter.WithMetadata(map[string]string{"cluster": "prod-eu", "region": "eu-west-1", "environment": ""})
+
+	line, err := formatter.Format([]byte(`{"request":{"uid":"abc"}}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"cluster":"prod-eu","region":"eu-west-1"}`, gjson.GetBytes(line, "kubeAuditRest").Raw)
+	assert.NotEmpty(t, gjson.GetBytes(line, "requestReceivedTimestamp").Str)
+}
+
+func Test_WhenMetadataSetForAuditEvent_ThenAnnotated(t *testing.T) {
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAuditEvent, commonwriter.AuditLevelMetadata)
+	assert.NoError(t, err)
+	formatter = formatter.WithMetadata(map[string]string{"cluster": "prod-eu", "version": "v1.2.3"})
+
+	line, err := formatter.Format([]byte(`{"request":{"uid":"abc","operation":"CREATE"}}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "prod-eu", gjson.GetBytes(line, `annotations.kube-audit-rest/cluster`).Str)
+	assert.Equal(t, "v1.2.3", gjson.GetBytes(line, `annotations.kube-audit-rest/version`).Str)
+}
+
+func Test_WhenEventHasCluster_ThenKeptOverMetadata(t *testing.T) {
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	assert.NoError(t, err)
+	formatter = formatter.WithMetadata(map[string]string{"cluster": "central", "region": "eu-west-1"})
+
+	line, err := formatter.Format([]byte(`{"request":{"uid":"abc"},"kubeAuditRest":{"cluster":"prod-eu"}}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"cluster":"prod-eu","region":"eu-west-1"}`, gjson.GetBytes(line, "kubeAuditRest").Raw)
+}
+
+func Test_WhenMetadataEmpty_ThenNothingAdded(t *testing.T) {
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	assert.NoError(t, err)
+	formatter = formatter.WithMetadata(map[string]string{"cluster": ""})
+
+	line, err := formatter.Format([]byte(`{"request":{"uid":"abc"}}`))
+
+	assert.NoError(t, err)
+	assert.False(t, gjson.GetBytes(line, "kubeAuditRest").Exists())
+}
+
+func Test_WhenFormatInvalid_ThenErrorReturned(t *testing.T) {
+	_, err := commonwriter.NewFormatter("yaml", "")
+	assert.Error(t, err)
+	_, err = commonwriter.NewFormatter(commonwriter.FormatAuditEvent, "Everything")
+	assert.Error(t, err)
+}
+
+func newChainedFormatter(t *testing.T, stateFilename string) *commonwriter.Formatter {
+	formatter, _ := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	chain, err := commonwriter.NewChain(stateFilename, stateFilename+".log")
+	if err != nil {
+		t.Fatalf("creating hash chain failed with : %s", err)
+	}
+	return formatter.WithChain(chain)
+}
+
+func Test_WhenChained_ThenEachLineLinkedToThePreviousOne(t *testing.T) {
+	state := path.Join(t.TempDir(), "chain")
+	formatter := newChainedFormatter(t, state)
+
+	var out bytes.Buffer
+	for _, uid := range []string{"a", "b", "c"} {
+		assert.NoError(t, formatter.LogEvent([]byte(`{"request":{"uid":"`+uid+`"}}`), &out))
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, commonwriter.GenesisHash, gjson.Get(lines[0], "prevHash").Str)
+	verifier := commonwriter.ChainVerifier{}
+	for i, line := range lines {
+		assert.Equal(t, int64(i+1), gjson.Get(line, "seq").Int())
+		assert.Equal(t, "abc"[i:i+1], gjson.Get(line, "request.uid").Str)
+		if i > 0 {
+			assert.Equal(t, gjson.Get(lines[i-1], "hash").Str, gjson.Get(line, "prevHash").Str)
+		}
+		_, err := verifier.Verify([]byte(line))
+		assert.NoError(t, err)
+	}
+
+	// A restart carries on from the last line
+	var restarted bytes.Buffer
+	assert.NoError(t, newChainedFormatter(t, state).LogEvent([]byte(`{"request":{"uid":"d"}}`), &restarted))
+	seq, err := verifier.Verify(bytes.TrimSuffix(restarted.Bytes(), []byte("\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), seq)
+}
+
+func Test_WhenChainTamperedWith_ThenVerifyFails(t *testing.T) {
+	formatter := newChainedFormatter(t, path.Join(t.TempDir(), "chain"))
+	var out bytes.Buffer
+	for _, uid := range []string{"a", "b", "c"} {
+		assert.NoError(t, formatter.LogEvent([]byte(`{"request":{"uid":"`+uid+`"}}`), &out))
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+
+	testCases := []struct {
+		name  string
+		lines []string
+	}{
+		{"edited", []string{lines[0], strings.Replace(lines[1], `"uid":"b"`, `"uid":"x"`, 1), lines[2]}},
+		{"removed", []string{lines[0], lines[2]}},
+		{"reordered", []string{lines[0], lines[2], lines[1]}},
+		{"unchained", []string{lines[0], `{"request":{"uid":"x"}}`}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier := commonwriter.ChainVerifier{}
+			_, err := verifier.Verify([]byte(tc.lines[0]))
+			assert.NoError(t, err)
+			var failed error
+			for _, line := range tc.lines[1:] {
+				if _, err := verifier.Verify([]byte(line)); err != nil {
+					failed = err
+					break
+				}
+			}
+			assert.Error(t, failed)
+		})
+	}
+}
+
+func Test_WhenChainStateInvalid_ThenErrorReturned(t *testing.T) {
+	state := path.Join(t.TempDir(), "chain")
+	os.WriteFile(state, []byte("not a chain head"), 0600)
+	_, err := commonwriter.NewChain(state, state+".log")
+	assert.Error(t, err)
+}
+
+func Test_WhenChainStateAheadOfLog_ThenChainCarriesOnFromLog(t *testing.T) {
+	state := path.Join(t.TempDir(), "chain")
+	formatter := newChainedFormatter(t, state)
+	var out bytes.Buffer
+	assert.NoError(t, formatter.LogEvent([]byte(`{"request":{"uid":"a"}}`), &out))
+	synced := out.String()
+	for _, uid := range []string{"b", "c"} {
+		assert.NoError(t, formatter.LogEvent([]byte(`{"request":{"uid":"`+uid+`"}}`), &out))
+	}
+	// As if the machine crashed after the state was saved, but before the
+	// last lines of the log file reached the disk
+	os.WriteFile(state+".log", []byte(synced), 0600)
+
+	var restarted bytes.Buffer
+	assert.NoError(t, newChainedFormatter(t, state).LogEvent([]byte(`{"request":{"uid":"d"}}`), &restarted))
+	verifier := commonwriter.ChainVerifier{}
+	_, err := verifier.Verify(bytes.TrimSuffix([]byte(synced), []byte("\n")))
+	assert.NoError(t, err)
+	seq, err := verifier.Verify(bytes.TrimSuffix(restarted.Bytes(), []byte("\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+}
+
+func Test_WhenChainStateBehindLog_ThenChainCarriesOnFromLog(t *testing.T) {
+	state := path.Join(t.TempDir(), "chain")
+	formatter := newChainedFormatter(t, state)
+	var out bytes.Buffer
+	assert.NoError(t, formatter.LogEvent([]byte(`{"request":{"uid":"a"}}`), &out))
+	stale, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatalf("reading hash chain state failed with : %s", err)
+	}
+	for _, uid := range []string{"b", "c"} {
+		assert.NoError(t, formatter.LogEvent([]byte(`{"request":{"uid":"`+uid+`"}}`), &out))
+	}
+	// As if the process crashed before the state was saved, with a
+	// checkpoint and an incomplete line after the last event
+	os.WriteFile(state, stale, 0600)
+	out.WriteString(`{"checkpoint":{"lines":3},"signature":"x"}` + "\n" + `{"request":{"uid":"d"`)
+	os.WriteFile(state+".log", out.Bytes(), 0600)
+
+	var restarted bytes.Buffer
+	assert.NoError(t, newChainedFormatter(t, state).LogEvent([]byte(`{"request":{"uid":"d"}}`), &restarted))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	verifier := commonwriter.ChainVerifier{}
+	for _, line := range lines[:3] {
+		_, err := verifier.Verify([]byte(line))
+		assert.NoError(t, err)
+	}
+	seq, err := verifier.Verify(bytes.TrimSuffix(restarted.Bytes(), []byte("\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), seq)
+}
@@ -1,26 +1,56 @@
 package diskwriter
 
 import (
+	"context"
+	"fmt"
+
 	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
 	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
-	"gopkg.in/natefinch/lumberjack.v2"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
 )
 
 type diskWritter struct {
-	lumberjackLogger *lumberjack.Logger
+	file      *rotatingFile
+	formatter *commonwriter.Formatter
 }
 
-func New(filename string, loggerMaxSize int, loggerMaxBackups int) auditwritter.AuditWritter {
-	lumberjackLogger := &lumberjack.Logger{
-		Filename:   filename,
-		MaxSize:    loggerMaxSize,
-		MaxBackups: loggerMaxBackups,
+func New(config Config, formatter *commonwriter.Formatter) (auditwritter.AuditWritter, error) {
+	file, err := openRotatingFile(config, formatter.Sync)
+	if err != nil {
+		return nil, err
 	}
-	return &diskWritter{lumberjackLogger: lumberjackLogger}
+	return &diskWritter{file: file, formatter: formatter}, nil
+}
+
+func (dw *diskWritter) LogEvent(body []byte) error {
+	return dw.formatter.LogEvent(body, dw.file)
 }
 
-func (dw *diskWritter) LogEvent(body []byte) {
-	commonwriter.LogEvent(body, dw.lumberjackLogger)
+// Syncs the current log file to disk, then the hash chain's head
+func (dw *diskWritter) Sync() {
+	if err := dw.file.Sync(); err != nil {
+		common.Logger.Errorw("failed to sync log file", "error", err)
+	}
+	if err := dw.formatter.Sync(); err != nil {
+		common.Logger.Errorw("failed to sync hash chain state", "error", err)
+	}
 }
 
-func (dw *diskWritter) Sync() {}
+// Syncs and closes the log file, then waits for any rolled file being
+// compressed or archived. An interrupted compression or upload is redone on
+// the next start
+func (dw *diskWritter) Close(ctx context.Context) error {
+	milled, err := dw.file.Close(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	if err := dw.formatter.Close(); err != nil {
+		return fmt.Errorf("failed to close hash chain state: %w", err)
+	}
+	select {
+	case <-milled:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gave up compressing or archiving rolled log files: %w", ctx.Err())
+	}
+}
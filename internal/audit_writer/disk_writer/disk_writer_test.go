@@ -1,22 +1,60 @@
 package diskwriter_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
 	diskwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/disk_writer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
 )
 
+func newWriter(t *testing.T, config diskwriter.Config) auditwritter.AuditWritter {
+	formatter, _ := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	dw, err := diskwriter.New(config, formatter)
+	if err != nil {
+		t.Fatalf("creating disk writer failed with : %s", err)
+	}
+	// Stop compressing before the test's directory is removed
+	t.Cleanup(func() { dw.Close(context.Background()) })
+	return dw
+}
+
+// Returns the rolled segments next to the log file, oldest first
+func segments(t *testing.T, fileLog string) []string {
+	matches, err := filepath.Glob(strings.TrimSuffix(fileLog, ".log") + "-*")
+	assert.NoError(t, err)
+	return matches
+}
+
 func Test_WhenWritingEvent_ThenEventWritten(t *testing.T) {
 	// Create a tmp dir where we'll put the log file for this test
 	// This directory is automatically destroyed after the test has finished
 	tmpDir := t.TempDir()
 	fileLog := path.Join(tmpDir, "test_file.log")
-	dw := diskwriter.New(fileLog, 1, 1)
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, MaxSizeMB: 1, MaxBackups: 1, Compression: diskwriter.CompressionNone})
 
 	event := "{\"testEvent\": \"test\"}"
 	dw.LogEvent([]byte(event))
@@ -30,3 +68,487 @@ func Test_WhenWritingEvent_ThenEventWritten(t *testing.T) {
 	json.Unmarshal(byteContent, &content)
 	assert.Equal(t, content["testEvent"], "test")
 }
+
+func Test_WhenClosed_ThenEventsOnDisk(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone})
+
+	dw.LogEvent([]byte("{\"testEvent\": \"test\"}"))
+	assert.NoError(t, dw.Close(context.Background()))
+
+	byteContent, err := os.ReadFile(fileLog)
+	assert.NoError(t, err)
+	assert.Contains(t, string(byteContent), "\"testEvent\":\"test\"")
+}
+
+func Test_WhenFileFull_ThenRolledToTimestampedSegment(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, MaxSizeMB: 1, Compression: diskwriter.CompressionNone})
+
+	// Two of these don't fit in 1MB
+	event := `{"data":"` + strings.Repeat("a", 600*1024) + `"}`
+	assert.NoError(t, dw.LogEvent([]byte(event)))
+	assert.NoError(t, dw.LogEvent([]byte(event)))
+	assert.NoError(t, dw.Close(context.Background()))
+
+	rolled := segments(t, fileLog)
+	assert.Len(t, rolled, 1)
+	assert.Regexp(t, `test_file-\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}Z-000\.log$`, rolled[0])
+	info, err := os.Stat(fileLog)
+	assert.NoError(t, err)
+	assert.Less(t, info.Size(), int64(1024*1024))
+}
+
+func Test_WhenIntervalEnds_ThenRolledEvenWithoutWrites(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, RotateInterval: 50 * time.Millisecond, Compression: diskwriter.CompressionNone})
+
+	assert.NoError(t, dw.LogEvent([]byte(`{"event":1}`)))
+	assert.Eventually(t, func() bool { return len(segments(t, fileLog)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, dw.LogEvent([]byte(`{"event":2}`)))
+	assert.Eventually(t, func() bool { return len(segments(t, fileLog)) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, dw.Close(context.Background()))
+
+	// Nothing was written in later intervals, so no more segments were rolled
+	rolled := segments(t, fileLog)
+	assert.Len(t, rolled, 2)
+	first, _ := os.ReadFile(rolled[0])
+	second, _ := os.ReadFile(rolled[1])
+	assert.Contains(t, string(first)+string(second), `"event":1`)
+	assert.Contains(t, string(first)+string(second), `"event":2`)
+}
+
+func Test_WhenRestartedAfterInterval_ThenLeftoverFileRolledWithItsIntervalName(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	assert.NoError(t, os.WriteFile(fileLog, []byte("{\"event\":\"old\"}\n"), 0600))
+	written := time.Date(2024, 3, 5, 14, 35, 10, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(fileLog, written, written))
+
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, RotateInterval: time.Hour, Compression: diskwriter.CompressionNone})
+	assert.NoError(t, dw.Close(context.Background()))
+
+	assert.Equal(t, []string{strings.TrimSuffix(fileLog, ".log") + "-2024-03-05T14-00-00Z-000.log"}, segments(t, fileLog))
+}
+
+func Test_WhenCompressing_ThenRolledSegmentsCompressed(t *testing.T) {
+	testCases := []struct {
+		compression diskwriter.Compression
+		suffix      string
+		decompress  func(io.Reader) (io.Reader, error)
+	}{
+		{diskwriter.CompressionGzip, ".gz", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{diskwriter.CompressionZstd, ".zst", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.compression), func(t *testing.T) {
+			fileLog := path.Join(t.TempDir(), "test_file.log")
+			dw := newWriter(t, diskwriter.Config{Filename: fileLog, RotateInterval: 50 * time.Millisecond, Compression: tc.compression})
+
+			assert.NoError(t, dw.LogEvent([]byte(`{"event":1}`)))
+			assert.Eventually(t, func() bool {
+				rolled := segments(t, fileLog)
+				return len(rolled) == 1 && strings.HasSuffix(rolled[0], tc.suffix)
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.NoError(t, dw.Close(context.Background()))
+
+			file, err := os.Open(segments(t, fileLog)[0])
+			assert.NoError(t, err)
+			defer file.Close()
+			reader, err := tc.decompress(file)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Contains(t, string(content), `"event":1`)
+		})
+	}
+}
+
+func Test_WhenPastRetention_ThenRolledSegmentsDeleted(t *testing.T) {
+	directory := t.TempDir()
+	fileLog := path.Join(directory, "test_file.log")
+	old := time.Now().AddDate(0, 0, -10)
+	for _, name := range []string{
+		"test_file-2024-03-05T12-00-00Z-000.log.gz",
+		"test_file-2024-03-05T13-00-00Z-000.log.gz",
+		"test_file-2024-03-05T14-00-00Z-000.log.gz",
+		"test_file-2024-03-05T14-00-00Z-001.log.gz",
+	} {
+		assert.NoError(t, os.WriteFile(path.Join(directory, name), nil, 0600))
+	}
+	// Too old, even though it's the newest
+	assert.NoError(t, os.WriteFile(path.Join(directory, "test_file-2024-03-05T15-00-00Z-000.log.gz"), nil, 0600))
+	assert.NoError(t, os.Chtimes(path.Join(directory, "test_file-2024-03-05T15-00-00Z-000.log.gz"), old, old))
+	// Not a segment, so left alone
+	assert.NoError(t, os.WriteFile(path.Join(directory, "test_file-notes.txt"), nil, 0600))
+
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, MaxBackups: 3, MaxAgeDays: 7, Compression: diskwriter.CompressionGzip})
+	assert.NoError(t, dw.Close(context.Background()))
+
+	assert.Equal(t, []string{
+		path.Join(directory, "test_file-2024-03-05T13-00-00Z-000.log.gz"),
+		path.Join(directory, "test_file-2024-03-05T14-00-00Z-000.log.gz"),
+		path.Join(directory, "test_file-2024-03-05T14-00-00Z-001.log.gz"),
+		path.Join(directory, "test_file-notes.txt"),
+	}, segments(t, fileLog))
+}
+
+func Test_WhenArchiving_ThenCompressedSegmentsArchivedOldestFirstAndDeleted(t *testing.T) {
+	directory := t.TempDir()
+	fileLog := path.Join(directory, "test_file.log")
+	for _, name := range []string{
+		"test_file-2024-03-05T14-00-00Z-000.log",
+		"test_file-2024-03-05T13-00-00Z-000.log.gz",
+	} {
+		assert.NoError(t, os.WriteFile(path.Join(directory, name), []byte("{}\n"), 0600))
+	}
+	archiver := mymock.NewMockSegmentArchiver(gomock.NewController(t))
+	first := archiver.EXPECT().Archive(gomock.Any(), path.Join(directory, "test_file-2024-03-05T13-00-00Z-000.log.gz"), time.Date(2024, 3, 5, 13, 0, 0, 0, time.UTC))
+	archiver.EXPECT().Archive(gomock.Any(), path.Join(directory, "test_file-2024-03-05T14-00-00Z-000.log.gz"), time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)).After(first)
+
+	// Retention doesn't apply, so nothing is deleted before it's archived
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, MaxBackups: 1, Compression: diskwriter.CompressionGzip, Archiver: archiver})
+	assert.NoError(t, dw.Close(context.Background()))
+
+	assert.Empty(t, segments(t, fileLog))
+}
+
+func Test_WhenArchivingFails_ThenSegmentKept(t *testing.T) {
+	directory := t.TempDir()
+	fileLog := path.Join(directory, "test_file.log")
+	segment := path.Join(directory, "test_file-2024-03-05T14-00-00Z-000.log")
+	assert.NoError(t, os.WriteFile(segment, []byte("{}\n"), 0600))
+	archiver := mymock.NewMockSegmentArchiver(gomock.NewController(t))
+	archiver.EXPECT().Archive(gomock.Any(), segment, gomock.Any()).Return(errors.New("bucket not found"))
+
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, Archiver: archiver})
+	assert.NoError(t, dw.Close(context.Background()))
+
+	assert.Equal(t, []string{segment}, segments(t, fileLog))
+}
+
+func Test_WhenCloseDeadlinePasses_ThenArchivingCancelled(t *testing.T) {
+	directory := t.TempDir()
+	fileLog := path.Join(directory, "test_file.log")
+	segment := path.Join(directory, "test_file-2024-03-05T14-00-00Z-000.log")
+	assert.NoError(t, os.WriteFile(segment, []byte("{}\n"), 0600))
+	archiver := mymock.NewMockSegmentArchiver(gomock.NewController(t))
+	archiver.EXPECT().Archive(gomock.Any(), segment, gomock.Any()).DoAndReturn(func(ctx context.Context, _ string, _ time.Time) error {
+		// Like an upload to an unavailable bucket, retried until cancelled
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, Archiver: archiver})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, dw.Close(ctx), context.DeadlineExceeded)
+
+	assert.Equal(t, []string{segment}, segments(t, fileLog))
+}
+
+// Returns the filename of a new signing key, and its public key
+func newSigningKey(t *testing.T) (string, ed25519.PublicKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.NoError(t, err)
+	filename := path.Join(t.TempDir(), "signing.key")
+	assert.NoError(t, os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return filename, public
+}
+
+func verifyCheckpoints(t *testing.T, key ed25519.PublicKey, content []byte) (int, int, error) {
+	verifier := diskwriter.NewCheckpointVerifier(key)
+	for _, line := range bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n")) {
+		if err := verifier.Verify(line); err != nil {
+			return 0, 0, err
+		}
+	}
+	checkpoints, unchecked := verifier.Counts()
+	return checkpoints, unchecked, nil
+}
+
+func Test_WhenSigning_ThenCheckpointsCoverEveryLine(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	keyFile, public := newSigningKey(t)
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, SigningKeyFilename: keyFile, CheckpointEvents: 2})
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, dw.LogEvent([]byte(`{"event":1}`)))
+	}
+	assert.NoError(t, dw.Close(context.Background()))
+
+	content, err := os.ReadFile(fileLog)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	assert.Len(t, lines, 8)
+	for _, i := range []int{2, 5, 7} {
+		assert.True(t, diskwriter.IsCheckpoint([]byte(lines[i])), lines[i])
+	}
+	checkpoints, unchecked, err := verifyCheckpoints(t, public, content)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, checkpoints)
+	assert.Equal(t, 0, unchecked)
+
+	// Any change to the lines is found
+	_, _, err = verifyCheckpoints(t, public, bytes.Replace(content, []byte(`"event":1`), []byte(`"event":2`), 1))
+	assert.Error(t, err)
+	// Another key's checkpoints aren't accepted
+	_, other := newSigningKey(t)
+	_, _, err = verifyCheckpoints(t, other, content)
+	assert.Error(t, err)
+}
+
+func Test_WhenCheckpointedLinesTamperedWith_ThenVerifyFails(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	keyFile, public := newSigningKey(t)
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, SigningKeyFilename: keyFile, CheckpointEvents: 2})
+	for i := 1; i <= 4; i++ {
+		assert.NoError(t, dw.LogEvent(fmt.Appendf(nil, `{"event":%d}`, i)))
+	}
+	assert.NoError(t, dw.Close(context.Background()))
+	content, err := os.ReadFile(fileLog)
+	assert.NoError(t, err)
+	// Two events then their checkpoint, twice
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if !assert.Len(t, lines, 6) {
+		return
+	}
+	checkpoint := lines[5]
+	body := gjson.Get(checkpoint, "checkpoint").Raw
+	otherPrivate := func() ed25519.PrivateKey {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		return private
+	}()
+
+	testCases := []struct {
+		name     string
+		lines    []string
+		expected string
+	}{
+		{"tampered line", []string{lines[3], strings.Replace(lines[4], `"event":4`, `"event":5`, 1), checkpoint}, "lines before the checkpoint were modified"},
+		{"reordered lines", []string{lines[4], lines[3], checkpoint}, "lines before the checkpoint were modified"},
+		{"removed line", []string{lines[3], checkpoint}, "checkpoint covers 2 lines but 1 lines came before it"},
+		{"added line", []string{lines[3], lines[4], lines[0], checkpoint}, "checkpoint covers 2 lines but 3 lines came before it"},
+		{"checkpoint of other lines", []string{lines[0], lines[1], checkpoint}, "lines before the checkpoint were modified"},
+		{"edited checkpoint", []string{lines[3], lines[4], strings.Replace(checkpoint, `"lines":2`, `"lines":3`, 1)}, "checkpoint signature is invalid"},
+		{"signed by another key", []string{lines[3], lines[4], fmt.Sprintf(`{"checkpoint":%s,"signature":"%s"}`, body, base64.StdEncoding.EncodeToString(ed25519.Sign(otherPrivate, []byte(body))))}, "checkpoint signature is invalid"},
+		{"signature not base64", []string{lines[3], lines[4], fmt.Sprintf(`{"checkpoint":%s,"signature":"%s"}`, body, "not base64!")}, "checkpoint signature is invalid"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := verifyCheckpoints(t, public, []byte(strings.Join(tc.lines, "\n")+"\n"))
+			assert.ErrorContains(t, err, tc.expected)
+		})
+	}
+}
+
+func Test_WhenSigning_ThenRolledSegmentsSignedAndArchivedWithTheirSignature(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	// Left from before a restart, so it's rolled into its own segment
+	assert.NoError(t, os.WriteFile(fileLog, []byte("{\"event\":\"old\"}\n"), 0600))
+	keyFile, public := newSigningKey(t)
+	archiver := mymock.NewMockSegmentArchiver(gomock.NewController(t))
+	var archived []string
+	archiver.EXPECT().Archive(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, path string, started time.Time) error {
+		// Kept, to check the signature once the segment's deleted
+		content, _ := os.ReadFile(path)
+		os.WriteFile(path+".archived", content, 0600)
+		archived = append(archived, path)
+		return nil
+	}).Times(2)
+
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionGzip, SigningKeyFilename: keyFile, Archiver: archiver})
+	assert.NoError(t, dw.Close(context.Background()))
+
+	if assert.Len(t, archived, 2) {
+		assert.Regexp(t, `test_file-.*-000\.log\.gz$`, archived[0])
+		assert.Equal(t, archived[0]+diskwriter.SignatureSuffix, archived[1])
+		// The signature is checked against the segment as it was archived
+		os.Rename(archived[0]+".archived", archived[0])
+		os.Rename(archived[1]+".archived", archived[1])
+		assert.NoError(t, diskwriter.VerifySegment(public, archived[0]))
+		os.WriteFile(archived[0], []byte("tampered"), 0600)
+		assert.Error(t, diskwriter.VerifySegment(public, archived[0]))
+	}
+}
+
+func newKEK(t *testing.T) string {
+	kek := make([]byte, 32)
+	rand.Read(kek)
+	filename := path.Join(t.TempDir(), "kek")
+	assert.NoError(t, os.WriteFile(filename, []byte(base64.StdEncoding.EncodeToString(kek)+"\n"), 0600))
+	return filename
+}
+
+func decrypt(t *testing.T, kekFile string, content []byte) ([]byte, error) {
+	kek, err := diskwriter.LoadKEK(kekFile)
+	assert.NoError(t, err)
+	reader, err := diskwriter.NewDecryptingReader(bytes.NewReader(content), kek)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func Test_WhenEncrypting_ThenOnlyDecryptableWithTheKEK(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	kekFile := newKEK(t)
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, KEKFilename: kekFile})
+
+	// Split over several chunks
+	large := `{"data":"` + strings.Repeat("a", 150*1024) + `"}`
+	assert.NoError(t, dw.LogEvent([]byte(`{"secret":"hunter2"}`)))
+	assert.NoError(t, dw.LogEvent([]byte(large)))
+	assert.NoError(t, dw.Close(context.Background()))
+
+	content, err := os.ReadFile(fileLog)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "hunter2")
+	plaintext, err := decrypt(t, kekFile, content)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(plaintext), "\n"), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"secret":"hunter2"`)
+		assert.Contains(t, lines[1], strings.Repeat("a", 150*1024))
+	}
+
+	_, err = decrypt(t, newKEK(t), content)
+	assert.Error(t, err)
+	modified := bytes.Clone(content)
+	modified[len(modified)/2] ^= 1
+	_, err = decrypt(t, kekFile, modified)
+	assert.Error(t, err)
+	// Without the empty final chunk, which is 4 bytes of length and a 16 byte tag
+	_, err = decrypt(t, kekFile, content[:len(content)-20])
+	assert.ErrorIs(t, err, diskwriter.ErrNoFinalChunk)
+}
+
+// Returns an encrypted log file of three events, and where each of its
+// chunks starts. The last chunk is the empty final one
+func encryptedChunks(t *testing.T, kekFile string) ([]byte, []int) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, KEKFilename: kekFile})
+	// The same length once formatted, as they already have a timestamp
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, dw.LogEvent(fmt.Appendf(nil, `{"event":%d,"requestReceivedTimestamp":"2024-03-05T14:00:00Z"}`, i)))
+	}
+	assert.NoError(t, dw.Close(context.Background()))
+	content, err := os.ReadFile(fileLog)
+	assert.NoError(t, err)
+
+	// Each chunk is 4 bytes of length, then the line and a 16 byte tag
+	line := len(`{"event":1,"requestReceivedTimestamp":"2024-03-05T14:00:00Z"}` + "\n")
+	chunk := 4 + line + 16
+	header := len(content) - 3*chunk - 20
+	return content, []int{header, header + chunk, header + 2*chunk, header + 3*chunk}
+}
+
+func Test_WhenEncryptedFileTamperedWith_ThenDecryptingFails(t *testing.T) {
+	kekFile := newKEK(t)
+	content, starts := encryptedChunks(t, kekFile)
+	other, _ := encryptedChunks(t, kekFile)
+	plaintext, err := decrypt(t, kekFile, content)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(plaintext), "\n"))
+
+	chunk := func(b []byte, i int) []byte {
+		return b[starts[i]:starts[i+1]]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	testCases := []struct {
+		name     string
+		content  []byte
+		expected string
+	}{
+		{"modified chunk", func() []byte {
+			modified := bytes.Clone(content)
+			modified[starts[1]+10] ^= 1
+			return modified
+		}(), "failed to decrypt chunk 1, it was modified or moved"},
+		{"swapped chunks", join(content[:starts[0]], chunk(content, 1), chunk(content, 0), content[starts[2]:]), "failed to decrypt chunk 0, it was modified or moved"},
+		{"chunk from another file", join(content[:starts[1]], chunk(other, 1), content[starts[2]:]), "failed to decrypt chunk 1, it was modified or moved"},
+		{"removed chunk", join(content[:starts[1]], content[starts[2]:]), "failed to decrypt chunk 1, it was modified or moved"},
+		{"final chunk moved earlier", join(content[:starts[1]], content[starts[3]:], content[starts[1]:starts[3]]), "failed to decrypt chunk 1, it was modified or moved"},
+		{"data after the final chunk", join(content, chunk(content, 2)), "encrypted file continues after its final chunk"},
+		{"chunk too large", join(content[:starts[0]], []byte{0xff, 0xff, 0xff, 0xff}, content[starts[0]+4:]), "chunk 0 is 4294967295 bytes, more than the largest chunk"},
+		{"truncated", content[:starts[3]], diskwriter.ErrNoFinalChunk.Error()},
+		{"truncated part way through a chunk", content[:starts[2]+10], diskwriter.ErrNoFinalChunk.Error()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decrypt(t, kekFile, tc.content)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
+
+func Test_WhenEncryptingAfterRestart_ThenLeftoverFileRolled(t *testing.T) {
+	fileLog := path.Join(t.TempDir(), "test_file.log")
+	kekFile := newKEK(t)
+	for _, event := range []string{`{"event":1}`, `{"event":2}`} {
+		dw := newWriter(t, diskwriter.Config{Filename: fileLog, Compression: diskwriter.CompressionNone, KEKFilename: kekFile})
+		assert.NoError(t, dw.LogEvent([]byte(event)))
+		assert.NoError(t, dw.Close(context.Background()))
+	}
+
+	rolled := segments(t, fileLog)
+	if assert.Len(t, rolled, 1) {
+		content, _ := os.ReadFile(rolled[0])
+		plaintext, err := decrypt(t, kekFile, content)
+		assert.NoError(t, err)
+		assert.Contains(t, string(plaintext), `"event":1`)
+		assert.NotContains(t, string(plaintext), `"event":2`)
+	}
+	content, _ := os.ReadFile(fileLog)
+	plaintext, err := decrypt(t, kekFile, content)
+	assert.NoError(t, err)
+	assert.Contains(t, string(plaintext), `"event":2`)
+	assert.NotContains(t, string(plaintext), `"event":1`)
+}
+
+func Test_WhenEncryptedFileCantBeRolled_ThenKeptDecryptable(t *testing.T) {
+	// Short enough for the log file, but not its segment names, so
+	// renaming it fails
+	fileLog := path.Join(t.TempDir(), strings.Repeat("a", 240)+".log")
+	kekFile := newKEK(t)
+	dw := newWriter(t, diskwriter.Config{Filename: fileLog, MaxSizeMB: 1, Compression: diskwriter.CompressionNone, KEKFilename: kekFile})
+
+	// Two of these don't fit in 1MB
+	event := `{"data":"` + strings.Repeat("b", 600*1024) + `"}`
+	assert.NoError(t, dw.LogEvent([]byte(event)))
+	assert.NoError(t, dw.LogEvent([]byte(event)))
+	assert.NoError(t, dw.LogEvent([]byte(`{"event":3}`)))
+	assert.NoError(t, dw.Close(context.Background()))
+
+	assert.Empty(t, segments(t, fileLog))
+	content, err := os.ReadFile(fileLog)
+	assert.NoError(t, err)
+	plaintext, err := decrypt(t, kekFile, content)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(plaintext), "\n"))
+	assert.Contains(t, string(plaintext), `"event":3`)
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	formatter, _ := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	testCases := []struct {
+		name   string
+		config diskwriter.Config
+	}{
+		{"no filename", diskwriter.Config{Compression: diskwriter.CompressionNone}},
+		{"bad compression", diskwriter.Config{Filename: path.Join(t.TempDir(), "test_file.log"), Compression: "bzip2"}},
+		{"negative max age", diskwriter.Config{Filename: path.Join(t.TempDir(), "test_file.log"), Compression: diskwriter.CompressionNone, MaxAgeDays: -1}},
+		{"encrypted and compressed", diskwriter.Config{Filename: path.Join(t.TempDir(), "test_file.log"), Compression: diskwriter.CompressionGzip, KEKFilename: newKEK(t)}},
+		{"missing signing key", diskwriter.Config{Filename: path.Join(t.TempDir(), "test_file.log"), Compression: diskwriter.CompressionNone, SigningKeyFilename: path.Join(t.TempDir(), "missing.key")}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := diskwriter.New(tc.config, formatter)
+			assert.Error(t, err)
+		})
+	}
+}
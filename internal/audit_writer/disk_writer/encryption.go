@@ -0,0 +1,232 @@
+package diskwriter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted files start with a header holding the file's data key, wrapped
+// by the key encryption key (KEK):
+//
+//	magic (8) | KEK fingerprint (8) | wrap nonce (12) | wrapped data key (48)
+//
+// followed by chunks of at most maxChunkSize bytes of plaintext, each
+//
+//	ciphertext length (4, big endian) | AES-256-GCM ciphertext and tag
+//
+// The nonce of each chunk is its index followed by a byte that's 1 for the
+// final chunk, which is empty and written when the file is closed, and the
+// header is the additional data. So chunks can't be reordered, moved between
+// files or removed from the end without decryption failing
+const (
+	encryptionMagic  = "KARENC01"
+	fingerprintSize  = 8
+	dataKeySize      = 32
+	encryptionHeader = len(encryptionMagic) + fingerprintSize + 12 + dataKeySize + 16
+	maxChunkSize     = 64 * 1024
+)
+
+// Loads a 256 bit key encryption key, from a file holding either the raw
+// key or the key in base64, such as one created by openssl rand -base64 32
+func LoadKEK(filename string) ([]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key encryption key: %w", err)
+	}
+	if len(content) == dataKeySize {
+		return content, nil
+	}
+	kek, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(content)))
+	if err != nil || len(kek) != dataKeySize {
+		return nil, fmt.Errorf("key encryption key in %s isn't 32 bytes, or 32 bytes in base64", filename)
+	}
+	return kek, nil
+}
+
+func fingerprint(kek []byte) []byte {
+	sum := sha256.Sum256(kek)
+	return sum[:fingerprintSize]
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	// Only fails for keys of the wrong size
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	return gcm
+}
+
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypts everything written to a newly created file with its own data key
+type encryptingFile struct {
+	file   *os.File
+	gcm    cipher.AEAD
+	header []byte
+	chunks uint64
+}
+
+// Writes the header to the file, which must be empty
+func newEncryptingFile(file *os.File, kek []byte) (*encryptingFile, error) {
+	dataKey := make([]byte, dataKeySize)
+	wrapNonce := make([]byte, 12)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(wrapNonce); err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptionMagic), fingerprint(kek)...)
+	header = append(header, wrapNonce...)
+	header = newGCM(kek).Seal(header, wrapNonce, dataKey, bytes.Clone(header))
+	if _, err := file.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write encryption header: %w", err)
+	}
+	return &encryptingFile{file: file, gcm: newGCM(dataKey), header: header}, nil
+}
+
+// Returns len(p) once every chunk of p has been written
+func (ef *encryptingFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxChunkSize)]
+		if err := ef.writeChunk(chunk, false); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (ef *encryptingFile) writeChunk(plaintext []byte, final bool) error {
+	framed := make([]byte, 4, 4+len(plaintext)+ef.gcm.Overhead())
+	framed = ef.gcm.Seal(framed, chunkNonce(ef.chunks, final), plaintext, ef.header)
+	binary.BigEndian.PutUint32(framed, uint32(len(framed)-4))
+	// One write, so a chunk is only partly written if the disk fails
+	if _, err := ef.file.Write(framed); err != nil {
+		return err
+	}
+	ef.chunks++
+	return nil
+}
+
+func (ef *encryptingFile) Sync() error {
+	return ef.file.Sync()
+}
+
+// Writes the final chunk, which shows the file wasn't truncated
+func (ef *encryptingFile) Close() error {
+	finalErr := ef.writeChunk(nil, true)
+	return errors.Join(finalErr, ef.file.Close())
+}
+
+// Returned when an encrypted file ends without its final chunk, because
+// it's still being written, the writer crashed or it was truncated
+var ErrNoFinalChunk = errors.New("encrypted file ends without its final chunk, it's still being written or was truncated")
+
+// Whether the reader starts like an encrypted file, without consuming it
+func IsEncrypted(reader *bufio.Reader) bool {
+	magic, _ := reader.Peek(len(encryptionMagic))
+	return string(magic) == encryptionMagic
+}
+
+type decryptingReader struct {
+	reader *bufio.Reader
+	gcm    cipher.AEAD
+	header []byte
+	chunks uint64
+	// Decrypted but not read yet
+	pending []byte
+	done    bool
+}
+
+// Returns a reader of the plaintext of an encrypted file. Reading returns
+// ErrNoFinalChunk once every complete chunk has been read if the file ends
+// without its final chunk
+func NewDecryptingReader(reader io.Reader, kek []byte) (io.Reader, error) {
+	header := make([]byte, encryptionHeader)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("not an encrypted log file")
+	}
+	fingerprintEnd := len(encryptionMagic) + fingerprintSize
+	if !bytes.Equal(header[len(encryptionMagic):fingerprintEnd], fingerprint(kek)) {
+		return nil, errors.New("encrypted with a different key encryption key")
+	}
+	wrapNonce := header[fingerprintEnd : fingerprintEnd+12]
+	authenticated := header[:fingerprintEnd+12]
+	dataKey, err := newGCM(kek).Open(nil, wrapNonce, header[fingerprintEnd+12:], authenticated)
+	if err != nil {
+		return nil, errors.New("failed to unwrap the data key, the header was modified")
+	}
+	return &decryptingReader{reader: bufio.NewReader(reader), gcm: newGCM(dataKey), header: header}, nil
+}
+
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	for len(dr.pending) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.pending)
+	dr.pending = dr.pending[n:]
+	return n, nil
+}
+
+func (dr *decryptingReader) readChunk() error {
+	var length [4]byte
+	if _, err := io.ReadFull(dr.reader, length[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrNoFinalChunk
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxChunkSize+uint32(dr.gcm.Overhead()) {
+		return fmt.Errorf("chunk %d is %d bytes, more than the largest chunk", dr.chunks, size)
+	}
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(dr.reader, ciphertext); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrNoFinalChunk
+		}
+		return err
+	}
+
+	plaintext, err := dr.gcm.Open(nil, chunkNonce(dr.chunks, false), ciphertext, dr.header)
+	if err != nil {
+		final, finalErr := dr.gcm.Open(nil, chunkNonce(dr.chunks, true), ciphertext, dr.header)
+		if finalErr != nil || len(final) != 0 {
+			return fmt.Errorf("failed to decrypt chunk %d, it was modified or moved", dr.chunks)
+		}
+		if _, err := dr.reader.Peek(1); !errors.Is(err, io.EOF) {
+			return errors.New("encrypted file continues after its final chunk")
+		}
+		dr.done = true
+	}
+	dr.pending = plaintext
+	dr.chunks++
+	return nil
+}
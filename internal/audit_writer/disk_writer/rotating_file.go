@@ -0,0 +1,691 @@
+package diskwriter
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	segmentarchiver "github.com/RichardoC/kube-audit-rest/internal/segment_archiver"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of rolled segments
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// Format of the time in rolled segment names, which sorts in time order and
+// has no characters that need escaping in file names or globs
+const segmentTimeFormat = "2006-01-02T15-04-05Z"
+
+// How long to wait before retrying segments that failed to be archived
+const archiveRetryInterval = 30 * time.Second
+
+// How long to wait before rolling on time again after it failed
+const rotateRetryInterval = 30 * time.Second
+
+type Config struct {
+	// The file events are written to. Rolled segments are kept next to it, as
+	// <name>-<start time>-<sequence><ext>, plus .gz or .zst when compressed
+	Filename string
+	// Roll the file once it reaches this many megabytes, 0 means no limit
+	MaxSizeMB int
+	// Roll the file at every multiple of this interval in UTC, so 1h rolls on
+	// the hour and 24h at midnight. 0 disables rolling on time
+	RotateInterval time.Duration
+	Compression    Compression
+	// Rolled segments beyond the newest MaxBackups are deleted, 0 keeps them all
+	MaxBackups int
+	// Rolled segments last written more than this many days ago are deleted,
+	// 0 keeps them all
+	MaxAgeDays int
+	// Rolled segments are archived once they're compressed and signed, oldest
+	// first, along with their signatures, and deleted once they have been.
+	// MaxBackups and MaxAgeDays are ignored, so segments are only deleted
+	// after they've been archived. Optional
+	Archiver segmentarchiver.SegmentArchiver
+
+	// Ed25519 key that signs checkpoints and rolled segments, optional. A
+	// checkpoint is written every CheckpointEvents lines and every
+	// CheckpointInterval, when either is set, and before the file is rolled
+	// or closed so checkpoints never span files
+	SigningKeyFilename string
+	CheckpointEvents   int
+	CheckpointInterval time.Duration
+
+	// Encrypt each segment with its own AES-256-GCM data key, wrapped by the
+	// key encryption key in this file, optional. Can't be used with
+	// compression, as encrypted segments don't compress
+	KEKFilename string
+}
+
+// The file being written to, which is encrypted when there's a KEK
+type logFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// An io.Writer that rolls the file it writes to on size and time. Each Write
+// goes to a single segment, so events are never split between segments
+type rotatingFile struct {
+	config   Config
+	maxBytes int64
+	// Matches rolled segments, capturing the start time and any compression suffix
+	segmentPattern *regexp.Regexp
+
+	mu sync.Mutex
+	// Nil once closed, or when reopening it after rolling failed, in which
+	// case the next Write tries again
+	file logFile
+	size int64
+	// When the current segment was started, which names it once it's rolled.
+	// The start of the interval when rolling on time
+	started time.Time
+	// Zero unless rolling on time
+	nextRotation time.Time
+
+	// Nil unless encrypting
+	kek []byte
+	// Nil unless signing
+	signingKey ed25519.PrivateKey
+	// Of the lines written since the last checkpoint
+	digest hash.Hash
+	lines  int
+
+	// Signalled after rolling to compress, archive and delete old segments
+	mill chan struct{}
+	// Closed by Close to stop the background goroutines
+	closing   chan struct{}
+	closeOnce sync.Once
+	// Closed once the mill goroutine has stopped
+	milled chan struct{}
+	// Called before rolling, so anything that has to match the end of the
+	// rolled file, such as the hash chain's head, is on disk first
+	beforeRoll func() error
+	// Passed to the archiver, and cancelled once Close gives up waiting
+	archiving     context.Context
+	stopArchiving context.CancelFunc
+}
+
+func openRotatingFile(config Config, beforeRoll func() error) (*rotatingFile, error) {
+	if config.Filename == "" {
+		return nil, errors.New("a log filename is required")
+	}
+	switch config.Compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("unknown log compression %q", config.Compression)
+	}
+	if config.MaxSizeMB < 0 || config.RotateInterval < 0 || config.MaxBackups < 0 || config.MaxAgeDays < 0 {
+		return nil, errors.New("log rotation limits can't be negative")
+	}
+	if config.CheckpointEvents < 0 || config.CheckpointInterval < 0 {
+		return nil, errors.New("log checkpoint intervals can't be negative")
+	}
+
+	ext := filepath.Ext(config.Filename)
+	prefix := strings.TrimSuffix(filepath.Base(config.Filename), ext) + "-"
+	r := &rotatingFile{
+		config:   config,
+		maxBytes: int64(config.MaxSizeMB) * 1024 * 1024,
+		segmentPattern: regexp.MustCompile("^" + regexp.QuoteMeta(prefix) +
+			`(\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}Z)-\d{3,}` + regexp.QuoteMeta(ext) + `(\.gz|\.zst)?$`),
+		mill:       make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		milled:     make(chan struct{}),
+		digest:     sha256.New(),
+		beforeRoll: beforeRoll,
+	}
+	r.archiving, r.stopArchiving = context.WithCancel(context.Background())
+	if config.KEKFilename != "" {
+		if config.Compression != CompressionNone {
+			return nil, errors.New("log compression can't be used with encryption")
+		}
+		kek, err := LoadKEK(config.KEKFilename)
+		if err != nil {
+			return nil, err
+		}
+		r.kek = kek
+	}
+	if config.SigningKeyFilename != "" {
+		key, err := LoadSigningKey(config.SigningKeyFilename)
+		if err != nil {
+			return nil, err
+		}
+		r.signingKey = key
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.Filename), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(config.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	if r.kek != nil && r.size == 0 {
+		encrypted, err := newEncryptingFile(file, r.kek)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		r.file = encrypted
+	}
+	// The best guess for when a file left from before a restart was started
+	r.started = info.ModTime()
+	if r.size == 0 {
+		r.started = time.Now()
+	}
+	if config.RotateInterval > 0 {
+		r.started = r.intervalStart(r.started)
+		r.nextRotation = r.started.Add(config.RotateInterval)
+	}
+	// Roll a file left over from an earlier interval straight away. Lines left
+	// from before a restart also aren't covered by the checkpoints this process
+	// writes, and an encrypted file can't be appended to, so they're left in
+	// their own segment when signing or encrypting
+	stale := !r.nextRotation.IsZero() && !time.Now().Before(r.nextRotation)
+	if stale || r.signingKey != nil || r.kek != nil {
+		if err := r.rotateLocked(time.Now()); err != nil {
+			if r.file != nil {
+				r.file.Close()
+			}
+			return nil, err
+		}
+	}
+	if config.RotateInterval > 0 {
+		go r.rotateOnInterval()
+	}
+	if r.signingKey != nil && config.CheckpointInterval > 0 {
+		go r.checkpointOnInterval()
+	}
+
+	// Finish compressing and deleting segments from before a restart
+	r.signalMill()
+	go r.millRun()
+	return r, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isClosed() {
+		return 0, errors.New("log file is closed")
+	}
+	if r.file == nil {
+		file, err := r.openFile()
+		if err != nil {
+			return 0, err
+		}
+		r.file = file
+	}
+
+	now := time.Now()
+	dueOnTime := !r.nextRotation.IsZero() && !now.Before(r.nextRotation)
+	dueOnSize := r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes
+	if dueOnTime || dueOnSize {
+		if err := r.rotateLocked(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if r.signingKey != nil {
+		r.digest.Write(p[:n])
+		r.lines++
+		if r.config.CheckpointEvents > 0 && r.lines >= r.config.CheckpointEvents {
+			if err := r.checkpointLocked(); err != nil {
+				common.Logger.Errorw("failed to write log checkpoint", "error", err)
+			}
+		}
+	}
+	return n, err
+}
+
+// Writes a signed checkpoint covering the lines since the last one, if
+// there are any
+func (r *rotatingFile) checkpointLocked() error {
+	if r.signingKey == nil || r.lines == 0 {
+		return nil
+	}
+	n, err := r.file.Write(checkpointLine(r.signingKey, r.lines, r.digest))
+	r.size += int64(n)
+	r.digest.Reset()
+	r.lines = 0
+	return err
+}
+
+func (r *rotatingFile) checkpointOnInterval() {
+	ticker := time.NewTicker(r.config.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.closing:
+			return
+		}
+		r.mu.Lock()
+		if r.file != nil {
+			if err := r.checkpointLocked(); err != nil {
+				common.Logger.Errorw("failed to write log checkpoint", "error", err)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Syncs the current segment to disk
+func (r *rotatingFile) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Syncs and closes the current segment, then stops the background goroutines.
+// Returns a channel that's closed once any compression or archiving in
+// progress is done, which is given up on once ctx is done
+func (r *rotatingFile) Close(ctx context.Context) (<-chan struct{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeOnce.Do(func() {
+		close(r.closing)
+		context.AfterFunc(ctx, r.stopArchiving)
+	})
+	if r.file == nil {
+		return r.milled, nil
+	}
+	checkpointErr := r.checkpointLocked()
+	syncErr := r.file.Sync()
+	closeErr := r.file.Close()
+	r.file = nil
+	return r.milled, errors.Join(checkpointErr, syncErr, closeErr)
+}
+
+func (r *rotatingFile) isClosed() bool {
+	select {
+	case <-r.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *rotatingFile) intervalStart(t time.Time) time.Time {
+	return t.UTC().Truncate(r.config.RotateInterval)
+}
+
+// Renames the current file to its segment name and starts a new one. Empty
+// files are kept, so nothing is rolled when no events were written. If the
+// new file can't be opened, the next Write tries again
+func (r *rotatingFile) rotateLocked(now time.Time) error {
+	var openErr error
+	if r.size > 0 {
+		if err := r.checkpointLocked(); err != nil {
+			return fmt.Errorf("failed to write checkpoint before rolling log file: %w", err)
+		}
+		if err := r.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync log file before rolling it: %w", err)
+		}
+		if err := r.beforeRoll(); err != nil {
+			return fmt.Errorf("failed to sync before rolling log file: %w", err)
+		}
+		// Renamed while still open, so the file can be kept if that fails.
+		// Reopening it would start a second encryption header part way
+		// through, which can't be decrypted
+		if err := os.Rename(r.config.Filename, r.segmentPath(r.started)); err != nil {
+			if _, ok := r.file.(*encryptingFile); r.kek != nil && !ok {
+				// Encrypted before restarting, so it can't be appended to
+				return fmt.Errorf("failed to roll encrypted log file: %w", err)
+			}
+			// Keep writing to the same file rather than losing events
+			common.Logger.Errorw("failed to roll log file", "error", err)
+		} else {
+			if err := r.file.Close(); err != nil {
+				common.Logger.Errorw("failed to close rolled log file", "error", err)
+			}
+			r.file, openErr = r.openFile()
+			r.size = 0
+			r.signalMill()
+		}
+	}
+
+	r.started = now
+	if r.config.RotateInterval > 0 {
+		r.started = r.intervalStart(now)
+		r.nextRotation = r.started.Add(r.config.RotateInterval)
+	}
+	return openErr
+}
+
+// Opens a new log file, encrypting it if there's a KEK
+func (r *rotatingFile) openFile() (logFile, error) {
+	file, err := os.OpenFile(r.config.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	if r.kek == nil {
+		return file, nil
+	}
+	encrypted, err := newEncryptingFile(file, r.kek)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// Returns the first unused name for a segment started at the given time. The
+// sequence number tells apart segments rolled on size within one interval
+func (r *rotatingFile) segmentPath(started time.Time) string {
+	ext := filepath.Ext(r.config.Filename)
+	base := strings.TrimSuffix(r.config.Filename, ext) + "-" + started.UTC().Format(segmentTimeFormat)
+	for seq := 0; ; seq++ {
+		name := fmt.Sprintf("%s-%03d%s", base, seq, ext)
+		if !exists(name) && !exists(name+".gz") && !exists(name+".zst") {
+			return name
+		}
+	}
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// Rolls the file when the interval ends, even if nothing is being written
+func (r *rotatingFile) rotateOnInterval() {
+	for {
+		r.mu.Lock()
+		next := r.nextRotation
+		r.mu.Unlock()
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-r.closing:
+			return
+		}
+
+		r.mu.Lock()
+		if r.file != nil && !time.Now().Before(r.nextRotation) {
+			if err := r.rotateLocked(time.Now()); err != nil {
+				common.Logger.Errorw("failed to roll log file", "error", err)
+				// Tried again by the next Write, or here after a while
+				// rather than straight away
+				if !time.Now().Before(r.nextRotation) {
+					r.nextRotation = time.Now().Add(min(r.config.RotateInterval, rotateRetryInterval))
+				}
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *rotatingFile) signalMill() {
+	select {
+	case r.mill <- struct{}{}:
+	default:
+		// Already signalled, and one pass handles every segment
+	}
+}
+
+func (r *rotatingFile) millRun() {
+	defer close(r.milled)
+	defer r.stopArchiving()
+	// Set while segments are waiting to be archived again
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-r.mill:
+			retry = r.millAndLog()
+		case <-retry:
+			retry = r.millAndLog()
+		case <-r.closing:
+			// Finish with a segment rolled just before closing
+			select {
+			case <-r.mill:
+				r.millAndLog()
+			default:
+			}
+			return
+		}
+	}
+}
+
+// Returns a channel that fires when a failed pass should be retried, or nil
+// if there's no need. Failures are only retried when archiving, otherwise
+// the next roll is soon enough
+func (r *rotatingFile) millAndLog() <-chan time.Time {
+	err := r.millOnce()
+	if err == nil {
+		return nil
+	}
+	common.Logger.Errorw("failed to compress, archive or delete rolled log files", "error", err)
+	if r.config.Archiver == nil {
+		return nil
+	}
+	return time.After(archiveRetryInterval)
+}
+
+type rolledSegment struct {
+	path       string
+	started    time.Time
+	compressed bool
+	modified   time.Time
+}
+
+// Compresses and signs any rolled segments that aren't, then either archives
+// them or deletes the ones that are past the retention limits
+func (r *rotatingFile) millOnce() error {
+	directory := filepath.Dir(r.config.Filename)
+	// Segments are renamed before they're closed, so they're only listed
+	// once they're complete
+	r.mu.Lock()
+	entries, err := os.ReadDir(directory)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var segments []rolledSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		unfinished := strings.TrimSuffix(strings.TrimSuffix(name, ".tmp"), SignatureSuffix)
+		if strings.HasSuffix(name, ".tmp") && r.segmentPattern.MatchString(unfinished) {
+			// Left by a compression or signing that was interrupted
+			os.Remove(filepath.Join(directory, name))
+			continue
+		}
+		match := r.segmentPattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		started, err := time.Parse(segmentTimeFormat, match[1])
+		if err != nil {
+			continue
+		}
+		segments = append(segments, rolledSegment{
+			path:       filepath.Join(directory, name),
+			started:    started,
+			compressed: match[2] != "",
+			modified:   info.ModTime(),
+		})
+	}
+
+	var errs []error
+	if r.config.Compression != CompressionNone {
+		for i, segment := range segments {
+			if segment.compressed {
+				continue
+			}
+			compressed, err := r.compress(segment.path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			segments[i].path = compressed
+			segments[i].compressed = true
+		}
+	}
+
+	if r.signingKey != nil {
+		for _, segment := range segments {
+			if !r.complete(segment) || exists(segment.path+SignatureSuffix) {
+				continue
+			}
+			if err := signSegment(r.signingKey, segment.path); err != nil {
+				errs = append(errs, fmt.Errorf("failed to sign %s: %w", segment.path, err))
+			}
+		}
+	}
+
+	if r.config.Archiver != nil {
+		return errors.Join(append(errs, r.archive(segments))...)
+	}
+
+	// Names sort in the order the segments were started
+	sort.Slice(segments, func(i, j int) bool { return segments[i].path > segments[j].path })
+	cutoff := time.Now().AddDate(0, 0, -r.config.MaxAgeDays)
+	kept := 0
+	for _, segment := range segments {
+		tooOld := r.config.MaxAgeDays > 0 && segment.modified.Before(cutoff)
+		tooMany := r.config.MaxBackups > 0 && kept >= r.config.MaxBackups
+		if !tooOld && !tooMany {
+			kept++
+			continue
+		}
+		for _, path := range []string{segment.path, segment.path + SignatureSuffix} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Archives the segments oldest first, deleting each once it's been archived.
+// Stops at the first failure or segment that isn't ready, so segments are
+// archived in order
+func (r *rotatingFile) archive(segments []rolledSegment) error {
+	sort.Slice(segments, func(i, j int) bool { return segments[i].path < segments[j].path })
+	for _, segment := range segments {
+		signed := r.signingKey != nil
+		if !r.complete(segment) || (signed && !exists(segment.path+SignatureSuffix)) {
+			// Compressing or signing it failed, which has been reported, so
+			// it and the segments after it are retried on the next pass
+			return nil
+		}
+		if err := r.config.Archiver.Archive(r.archiving, segment.path, segment.started); err != nil {
+			return err
+		}
+		if signed {
+			if err := r.config.Archiver.Archive(r.archiving, segment.path+SignatureSuffix, segment.started); err != nil {
+				return err
+			}
+		}
+		for _, path := range []string{segment.path, segment.path + SignatureSuffix} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to delete archived log file: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Whether the segment has been compressed, if it's going to be
+func (r *rotatingFile) complete(segment rolledSegment) bool {
+	return r.config.Compression == CompressionNone || segment.compressed
+}
+
+// Compresses the segment to a temporary file which is renamed once it's
+// complete, so a compressed segment is never seen half written. Returns
+// the compressed segment's path
+func (r *rotatingFile) compress(path string) (string, error) {
+	suffix := ".gz"
+	if r.config.Compression == CompressionZstd {
+		suffix = ".zst"
+	}
+	compressedPath := path + suffix
+	if exists(compressedPath) {
+		// Compressed before a restart, but the original wasn't removed
+		return compressedPath, os.Remove(path)
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.OpenFile(compressedPath+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var compressor io.WriteCloser
+	if r.config.Compression == CompressionZstd {
+		compressor, err = zstd.NewWriter(tmp)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		compressor = gzip.NewWriter(tmp)
+	}
+	if _, err := io.Copy(compressor, src); err != nil {
+		return "", fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if err := compressor.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	// Keep the time it was last written, which the retention is based on
+	os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	if err := os.Rename(tmp.Name(), compressedPath); err != nil {
+		return "", err
+	}
+	// Signed before compression was turned on, the compressed segment is
+	// signed instead
+	os.Remove(path + SignatureSuffix)
+	return compressedPath, os.Remove(path)
+}
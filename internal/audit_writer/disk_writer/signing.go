@@ -0,0 +1,193 @@
+package diskwriter
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Added to a rolled segment's name for its detached signature
+const SignatureSuffix = ".sig"
+
+// Written to the log file every CheckpointEvents lines or CheckpointInterval,
+// covering the lines since the previous checkpoint
+type checkpoint struct {
+	Lines int `json:"lines"`
+	// Of the lines, including their newlines
+	SHA256 string `json:"sha256"`
+	Time   string `json:"time"`
+}
+
+// A checkpoint line is {"checkpoint":<checkpoint>,"signature":<signature>},
+// where the signature is the base64 Ed25519 signature of the checkpoint
+// json exactly as it appears in the line
+func checkpointLine(key ed25519.PrivateKey, lines int, digest hash.Hash) []byte {
+	body, _ := json.Marshal(checkpoint{
+		Lines:  lines,
+		SHA256: hex.EncodeToString(digest.Sum(nil)),
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, body))
+	return fmt.Appendf(nil, `{"checkpoint":%s,"signature":"%s"}`+"\n", body, signature)
+}
+
+// Whether the line is a checkpoint rather than an event
+func IsCheckpoint(line []byte) bool {
+	return gjson.GetBytes(line, "checkpoint.sha256").Exists() && gjson.GetBytes(line, "signature").Exists()
+}
+
+// Loads a PEM encoded PKCS #8 Ed25519 private key, such as one created by
+// openssl genpkey -algorithm ed25519
+func LoadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key in %s isn't an ed25519 key", filename)
+	}
+	return signingKey, nil
+}
+
+// Loads a PEM encoded PKIX Ed25519 public key, such as one created by
+// openssl pkey -pubout
+func LoadVerifyingKey(filename string) (ed25519.PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	verifyingKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key in %s isn't an ed25519 key", filename)
+	}
+	return verifyingKey, nil
+}
+
+func readPEM(filename string) (*pem.Block, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found in %s", filename)
+	}
+	return block, nil
+}
+
+// Writes the detached signature of a rolled segment next to it, which is
+// the base64 Ed25519 signature of the segment's SHA-256
+func signSegment(key ed25519.PrivateKey, path string) error {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest)) + "\n"
+	tmp := path + SignatureSuffix + ".tmp"
+	if err := os.WriteFile(tmp, []byte(signature), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+SignatureSuffix)
+}
+
+// Checks the detached signature of a rolled segment, as it's stored so
+// compressed segments aren't decompressed
+func VerifySegment(key ed25519.PublicKey, path string) error {
+	content, err := os.ReadFile(path + SignatureSuffix)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	digest, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, digest, signature) {
+		return errors.New("segment doesn't match its signature")
+	}
+	return nil
+}
+
+func fileDigest(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return nil, err
+	}
+	return digest.Sum(nil), nil
+}
+
+// Checks the checkpoints in a log file's lines, fed in the order they were
+// written. Checkpoints can't be checked across files, as a file can start
+// part way through the lines a checkpoint covers after a restart
+type CheckpointVerifier struct {
+	key         ed25519.PublicKey
+	digest      hash.Hash
+	lines       int
+	checkpoints int
+}
+
+func NewCheckpointVerifier(key ed25519.PublicKey) *CheckpointVerifier {
+	return &CheckpointVerifier{key: key, digest: sha256.New()}
+}
+
+// The line is without its newline
+func (v *CheckpointVerifier) Verify(line []byte) error {
+	if !IsCheckpoint(line) {
+		v.digest.Write(line)
+		v.digest.Write([]byte("\n"))
+		v.lines++
+		return nil
+	}
+
+	body := gjson.GetBytes(line, "checkpoint")
+	signature, err := base64.StdEncoding.DecodeString(gjson.GetBytes(line, "signature").Str)
+	if err != nil || !ed25519.Verify(v.key, []byte(body.Raw), signature) {
+		return errors.New("checkpoint signature is invalid")
+	}
+	if lines := int(body.Get("lines").Int()); lines != v.lines {
+		return fmt.Errorf("checkpoint covers %d lines but %d lines came before it", lines, v.lines)
+	}
+	if sum := hex.EncodeToString(v.digest.Sum(nil)); sum != body.Get("sha256").Str {
+		return fmt.Errorf("lines before the checkpoint were modified, they hash to %s but the checkpoint has %s", sum, body.Get("sha256").Str)
+	}
+	v.digest.Reset()
+	v.lines = 0
+	v.checkpoints++
+	return nil
+}
+
+// Returns the number of checkpoints verified, and the number of lines
+// after the last one that no checkpoint covers yet
+func (v *CheckpointVerifier) Counts() (int, int) {
+	return v.checkpoints, v.lines
+}
@@ -0,0 +1,320 @@
+package fanoutwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/tidwall/gjson"
+)
+
+type Sink struct {
+	// Used in logs and as the sink label of the metrics
+	Name   string
+	Writer auditwritter.AuditWritter
+	// Required sinks are written before LogEvent returns and their errors are
+	// returned. Other sinks are written in the background, so a slow or broken
+	// sink can't hold up the rest
+	Required bool
+	// Only events for these clusters, from /log-request/{cluster}, are
+	// written to the sink, with "" for requests to /log-request. When nil
+	// every event is written
+	Clusters []string
+}
+
+// A required sink stays failing for this long after a write fails, unless
+// a later write succeeds. Limited, as no events are received to find out if
+// it has recovered while kube-audit-rest isn't ready
+const failingFor = time.Minute
+
+type fanoutWritter struct {
+	required []*sinkWritter
+	optional []*sinkWritter
+
+	// Held for reading while events are sent to the optional sinks' queues,
+	// so Close can't close them at the same time
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Returned once the writer is closed, as the sinks won't take more events
+var errClosed = errors.New("the fanout writer is closed")
+
+type sinkWritter struct {
+	name   string
+	writer auditwritter.AuditWritter
+	// nil when every event is written
+	clusters map[string]bool
+	latency  metrics.Histogram
+	errors   metrics.Counter
+	dropped  metrics.Counter
+	// Only used by optional sinks
+	queue chan queuedEvent
+	// Closed once everything queued has been written after closing the queue
+	stopped chan struct{}
+
+	mu sync.Mutex
+	// Number of writes in progress
+	writing int
+	// When a write last started with none in progress, or finished
+	progressed time.Time
+	// The error of the last write and when it failed, nil if it succeeded
+	lastErr  error
+	failedAt time.Time
+}
+
+type queuedEvent struct {
+	body []byte
+	// Set instead of body when the sink should be synced
+	synced chan struct{}
+}
+
+// bufferSize is how many events each optional sink can fall behind by
+// before events for it are dropped
+func New(sinks []Sink, bufferSize int, metricsServer metrics.MetricsServer) (auditwritter.AuditWritter, error) {
+	if len(sinks) == 0 {
+		return nil, errors.New("at least one sink is required")
+	}
+	if bufferSize < 1 {
+		return nil, errors.New("the sink buffer size must be at least 1")
+	}
+
+	latency := metricsServer.CreateAndRegisterHistogramVec(
+		"kube_audit_rest_sink_write_duration_seconds",
+		"Time taken to write an event to each sink",
+		[]string{"sink"},
+		nil,
+	)
+	writeErrors := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_sink_write_errors_total",
+		"Total number of events each sink failed to write",
+		[]string{"sink"},
+	)
+	dropped := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_sink_dropped_events_total",
+		"Total number of events dropped because an optional sink had fallen too far behind",
+		[]string{"sink"},
+	)
+
+	fw := &fanoutWritter{}
+	names := map[string]bool{}
+	for _, sink := range sinks {
+		if names[sink.Name] {
+			return nil, fmt.Errorf("sink %q is configured more than once", sink.Name)
+		}
+		names[sink.Name] = true
+
+		sw := &sinkWritter{
+			name:    sink.Name,
+			writer:  sink.Writer,
+			latency: latency.WithLabelValues(sink.Name),
+			errors:  writeErrors.WithLabelValues(sink.Name),
+			dropped: dropped.WithLabelValues(sink.Name),
+		}
+		if sink.Clusters != nil {
+			sw.clusters = map[string]bool{}
+			for _, cluster := range sink.Clusters {
+				sw.clusters[cluster] = true
+			}
+		}
+		if sink.Required {
+			fw.required = append(fw.required, sw)
+		} else {
+			sw.queue = make(chan queuedEvent, bufferSize)
+			sw.stopped = make(chan struct{})
+			go sw.run()
+			fw.optional = append(fw.optional, sw)
+		}
+	}
+	return fw, nil
+}
+
+func (fw *fanoutWritter) LogEvent(body []byte) error {
+	cluster := gjson.GetBytes(body, commonwriter.MetadataField+".cluster").Str
+	fw.mu.RLock()
+	if fw.closed {
+		fw.mu.RUnlock()
+		return errClosed
+	}
+	for _, sw := range fw.optional {
+		if !sw.wants(cluster) {
+			continue
+		}
+		select {
+		case sw.queue <- queuedEvent{body: body}:
+		default:
+			common.Logger.Warnw("sink has fallen behind, dropping event", "sink", sw.name)
+			sw.dropped.Inc()
+		}
+	}
+	fw.mu.RUnlock()
+
+	// Write the required sinks in parallel, so the slowest decides how long this takes
+	errs := make([]error, len(fw.required))
+	var wg sync.WaitGroup
+	for i, sw := range fw.required {
+		if !sw.wants(cluster) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = sw.write(body)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Waits for the optional sinks to catch up, then syncs every sink. Does
+// nothing once the writer is closed, as closing syncs the sinks
+func (fw *fanoutWritter) Sync() {
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+	if fw.closed {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, sw := range fw.optional {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			synced := make(chan struct{})
+			sw.queue <- queuedEvent{synced: synced}
+			<-synced
+		}()
+	}
+	for _, sw := range fw.required {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sw.writer.Sync()
+		}()
+	}
+	wg.Wait()
+}
+
+// Waits for the optional sinks to catch up, then closes every sink. Events
+// logged from then on are rejected
+func (fw *fanoutWritter) Close(ctx context.Context) error {
+	// Waits for events being queued, and Sync, to finish
+	alreadyClosed := false
+	err := common.WaitContext(ctx, func() {
+		fw.mu.Lock()
+		defer fw.mu.Unlock()
+		alreadyClosed = fw.closed
+		fw.closed = true
+	})
+	if err != nil {
+		return fmt.Errorf("gave up waiting for events being logged: %w", err)
+	}
+	if alreadyClosed {
+		return errClosed
+	}
+	sinks := append(append([]*sinkWritter{}, fw.required...), fw.optional...)
+	errs := make([]error, len(sinks))
+	var wg sync.WaitGroup
+	for i, sw := range sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = sw.close(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (sw *sinkWritter) close(ctx context.Context) error {
+	if sw.queue != nil {
+		queued := len(sw.queue)
+		close(sw.queue)
+		select {
+		case <-sw.stopped:
+			common.Logger.Infow("flushed queued events to sink", "sink", sw.name, "events", queued)
+		case <-ctx.Done():
+			return fmt.Errorf("sink %s: gave up writing queued events: %w", sw.name, ctx.Err())
+		}
+	}
+	if err := sw.writer.Close(ctx); err != nil {
+		return fmt.Errorf("sink %s: %w", sw.name, err)
+	}
+	return nil
+}
+
+func (sw *sinkWritter) wants(cluster string) bool {
+	return sw.clusters == nil || sw.clusters[cluster]
+}
+
+// Fails while a required sink is failing
+func (fw *fanoutWritter) Ready() error {
+	var errs []error
+	for _, sw := range fw.required {
+		sw.mu.Lock()
+		if sw.lastErr != nil && time.Since(sw.failedAt) < failingFor {
+			errs = append(errs, fmt.Errorf("sink %s is failing: %w", sw.name, sw.lastErr))
+		}
+		sw.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Fails when a sink has made no progress writing events for longer than timeout
+func (fw *fanoutWritter) Live(timeout time.Duration) error {
+	var errs []error
+	for _, sw := range append(append([]*sinkWritter{}, fw.required...), fw.optional...) {
+		sw.mu.Lock()
+		if sw.writing > 0 && time.Since(sw.progressed) > timeout {
+			errs = append(errs, fmt.Errorf("sink %s has made no progress writing events for %s", sw.name, time.Since(sw.progressed).Round(time.Second)))
+		}
+		sw.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func (sw *sinkWritter) write(body []byte) error {
+	start := time.Now()
+	sw.mu.Lock()
+	if sw.writing == 0 {
+		sw.progressed = start
+	}
+	sw.writing++
+	sw.mu.Unlock()
+
+	err := sw.writer.LogEvent(body)
+
+	sw.mu.Lock()
+	sw.writing--
+	sw.progressed = time.Now()
+	sw.lastErr = err
+	if err != nil {
+		sw.failedAt = sw.progressed
+	}
+	sw.mu.Unlock()
+	sw.latency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		sw.errors.Inc()
+		return fmt.Errorf("sink %s: %w", sw.name, err)
+	}
+	return nil
+}
+
+func (sw *sinkWritter) run() {
+	defer close(sw.stopped)
+	for event := range sw.queue {
+		if event.synced != nil {
+			sw.writer.Sync()
+			close(event.synced)
+			continue
+		}
+		if err := sw.write(event.body); err != nil {
+			common.Logger.Errorw("failed to write event", "error", err)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package fanoutwriter_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	fanoutwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/fanout_writer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+const event = `{"request":{"uid":"test-uid"}}`
+
+type sinkMetrics struct {
+	errors  *mymock.MockCounter
+	dropped *mymock.MockCounter
+}
+
+// Returns the error and dropped counters of each sink name
+func setup(t *testing.T, ctrl *gomock.Controller, names ...string) (*mymock.MockMetricsServer, map[string]sinkMetrics) {
+	ms := mymock.NewMockMetricsServer(ctrl)
+	latency := mymock.NewMockHistogramVec(ctrl)
+	histogram := mymock.NewMockHistogram(ctrl)
+	histogram.EXPECT().Observe(gomock.Any()).AnyTimes()
+	latency.EXPECT().WithLabelValues(gomock.Any()).Return(histogram).AnyTimes()
+	errorsVec := mymock.NewMockCounterVec(ctrl)
+	droppedVec := mymock.NewMockCounterVec(ctrl)
+	ms.EXPECT().CreateAndRegisterHistogramVec("kube_audit_rest_sink_write_duration_seconds", gomock.Any(), []string{"sink"}, gomock.Any()).Return(latency)
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_sink_write_errors_total", gomock.Any(), []string{"sink"}).Return(errorsVec)
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_sink_dropped_events_total", gomock.Any(), []string{"sink"}).Return(droppedVec)
+
+	counters := map[string]sinkMetrics{}
+	for _, name := range names {
+		m := sinkMetrics{errors: mymock.NewMockCounter(ctrl), dropped: mymock.NewMockCounter(ctrl)}
+		errorsVec.EXPECT().WithLabelValues(name).Return(m.errors).AnyTimes()
+		droppedVec.EXPECT().WithLabelValues(name).Return(m.dropped).AnyTimes()
+		counters[name] = m
+	}
+	return ms, counters
+}
+
+func Test_WhenRequiredSinksWritten_ThenEveryEventDelivered(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, _ := setup(t, ctrl, "disk", "kafka")
+	disk := mymock.NewMockAuditWritter(ctrl)
+	kafka := mymock.NewMockAuditWritter(ctrl)
+	disk.EXPECT().LogEvent([]byte(event)).Return(nil)
+	kafka.EXPECT().LogEvent([]byte(event)).Return(nil)
+
+	fw, err := fanoutwriter.New([]fanoutwriter.Sink{
+		{Name: "disk", Writer: disk, Required: true},
+		{Name: "kafka", Writer: kafka, Required: true},
+	}, 10, ms)
+	if err != nil {
+		t.Fatalf("creating fanout writer failed with : %s", err)
+	}
+
+	assert.NoError(t, fw.LogEvent([]byte(event)))
+}
+
+func Test_WhenRequiredSinkFails_ThenErrorReturnedAndCounted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, counters := setup(t, ctrl, "disk", "kafka")
+	disk := mymock.NewMockAuditWritter(ctrl)
+	kafka := mymock.NewMockAuditWritter(ctrl)
+	disk.EXPECT().LogEvent([]byte(event)).Return(nil)
+	kafka.EXPECT().LogEvent([]byte(event)).Return(errors.New("broker down"))
+	counters["kafka"].errors.EXPECT().Inc()
+
+	fw, err := fanoutwriter.New([]fanoutwriter.Sink{
+		{Name: "disk", Writer: disk, Required: true},
+		{Name: "kafka", Writer: kafka, Required: true},
+	}, 10, ms)
+	if err != nil {
+		t.Fatalf("creating fanout writer failed with : %s", err)
+	}
+
+	err = fw.LogEvent([]byte(event))
+	assert.ErrorContains(t, err, "sink kafka: broker down")
+}
+
+func Test_WhenSinkForClusters_ThenOnlyTheirEventsWritten(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, _ := setup(t, ctrl, "disk", "prod")
+	disk := mymock.NewMockAuditWritter(ctrl)
+	prod := mymock.NewMockAuditWritter(ctrl)
+	prodEvent := `{"request":{"uid":"test-uid"},"kubeAuditRest":{"cluster":"prod"}}`
+	devEvent := `{"request":{"uid":"test-uid"},"kubeAuditRest":{"cluster":"dev"}}`
+	disk.EXPECT().LogEvent([]byte(event)).Return(nil)
+	disk.EXPECT().LogEvent([]byte(prodEvent)).Return(nil)
+	disk.EXPECT().LogEvent([]byte(devEvent)).Return(nil)
+	prod.EXPECT().LogEvent([]byte(prodEvent)).Return(nil)
+
+	fw, err := fanoutwriter.New([]fanoutwriter.Sink{
+		{Name: "disk", Writer: disk, Required: true},
+		{Name: "prod", Writer: prod, Required: true, Clusters: []string{"prod"}},
+	}, 10, ms)
+	if err != nil {
+		t.Fatalf("creating fanout writer failed with : %s", err)
+	}
+
+	assert.NoError(t, fw.LogEvent([]byte(event)))
+	assert.NoError(t, fw.LogEvent([]byte(prodEvent)))
+	assert.NoError(t, fw.LogEvent([]byte(devEvent)))
+}
+
+func Test_WhenOptionalSinkBlocked_ThenOtherSinksNotBlocked(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, counters := setup(t, ctrl, "disk", "http")
+	disk := mymock.NewMockAuditWritter(ctrl)
+	remote := mymock.NewMockAuditWritter(ctrl)
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	disk.EXPECT().LogEvent([]byte(event)).Return(nil).Times(3)
+	disk.EXPECT().Sync()
+	// The first event is stuck being written, the second waits in the
+	// buffer and the third is dropped
+	remote.EXPECT().LogEvent([]byte(event)).DoAndReturn(func([]byte) error {
+		started <- struct{}{}
+		<-unblock
+		return nil
+	}).Times(2)
+	remote.EXPECT().Sync()
+	counters["http"].dropped.EXPECT().Inc()
+
+	fw, err := fanoutwriter.New([]fanoutwriter.Sink{
+		{Name: "disk", Writer: disk, Required: true},
+		{Name: "http", Writer: remote},
+	}, 1, ms)
+	if err != nil {
+		t.Fatalf("creating fanout writer failed with : %s", err)
+	}
+
+	assert.NoError(t, fw.LogEvent([]byte(event)))
+	<-started
+	assert.NoError(t, fw.LogEvent([]byte(event)))
+	assert.NoError(t, fw.LogEvent([]byte(event)))
+
+	close(unblock)
+	fw.Sync()
+}
+
+func Test_WhenRequiredSinkFailing_ThenNotReadyUntilItSucceeds(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, counters := setup(t, ctrl, "disk", "http")
+	disk := mymock.NewMockAuditWritter(ctrl)
+	remote := mymock.NewMockAuditWritter(ctrl)
+	gomock.InOrder(
+		disk.EXPECT().LogEvent([]byte(event)).Return(errors.New("disk full")),
+		disk.EXPECT().LogEvent([]byte(event)).Return(nil),
+	)
+	// Optional sinks failing don't affect readiness
+	remote.EXPECT().LogEvent([]byte(event)).Return(errors.New("connection refused")).Times(2)
+	disk.EXPECT().Sync().Times(2)
+	remote.EXPECT().Sync().Times(2)
+	counters["disk"].errors.EXPECT().Inc()
+	counters["http"].errors.EXPECT().Inc().Times(2)
+
+	fw, err := fanoutwriter.New([]fanoutwriter.Sink{
+		{Name: "disk", Writer: disk, Required: true},
+		{Name: "http", Writer: remote},
+	}, 10, ms)
+	if err != nil {
+		t.Fatalf("creating fanout writer failed with : %s", err)
+	}
+	health := fw.(auditwritter.HealthReporter)
+
+	assert.NoError(t, health.Ready())
+	assert.Error(t, fw.LogEvent([]byte(event)))
+	fw.Sync()
+	assert.ErrorContains(t, health.Ready(), "sink disk is failing")
+	assert.NoError(t, fw.LogEvent([]byte(event)))
+	fw.Sync()
+	assert.NoError(t, health.Ready())
+}
+
+func Test_WhenSinkWriteStuck_ThenNotLive(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, _ := setup(t, ctrl, "disk", "http")
+	disk := mymock.NewMockAuditWritter(ctrl)
+	remote := mymock.NewMockAuditWritter(ctrl)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	disk.EXPECT().LogEvent([]byte(event)).Return(nil)
+	disk.EXPECT().Sync()
+	remote.EXPECT().LogEvent([]byte(event)).DoAndReturn(func([]byte) error {
+		close(started)
+		<-unblock
+		return nil
+	})
+	remote.EXPECT().Sync()
+
+	fw, err := fanoutwriter.New([]fanoutwriter.Sink{
+		{Name: "disk", Writer: disk, Required: true},
+		{Name: "http", Writer: remote},
+	}, 10, ms)
+	if err != nil {
+		t.Fatalf("creating fanout writer failed with : %s", err)
+	}
+	health := fw.(auditwritter.HealthReporter)
+	assert.NoError(t, fw.LogEvent([]byte(event)))
+	<-started
+	time.Sleep(10 * time.Millisecond)
+
+	assert.ErrorContains(t, health.Live(time.Millisecond), "sink http")
+	assert.NoError(t, health.Live(time.Hour))
+	close(unblock)
+	fw.Sync()
+	assert.NoError(t, health.Live(time.Nanosecond))
+}
+
+func Test_WhenClosed_ThenQueuedEventsWrittenAndSinksClosed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, _ := setup(t, ctrl, "disk", "http")
+	disk := mymock.NewMockAuditWritter(ctrl)
+	remote := mymock.NewMockAuditWritter(ctrl)
+	disk.EXPECT().LogEvent([]byte(event)).Return(nil)
+	disk.EXPECT().Close(gomock.Any()).Return(nil)
+	// The queued event is written before the sink is closed
+	written := remote.EXPECT().LogEvent([]byte(event)).DoAndReturn(func([]byte) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	remote.EXPECT().Close(gomock.Any()).Return(errors.New("broker down")).After(written)
+
+	fw, err := fanoutwriter.New([]fanoutwriter.Sink{
+		{Name: "disk", Writer: disk, Required: true},
+		{Name: "http", Writer: remote},
+	}, 1, ms)
+	if err != nil {
+		t.Fatalf("creating fanout writer failed with : %s", err)
+	}
+	assert.NoError(t, fw.LogEvent([]byte(event)))
+
+	err = fw.Close(context.Background())
+	assert.ErrorContains(t, err, "sink http: broker down")
+}
+
+func Test_WhenClosedWhileEventsLogged_ThenLaterEventsRejected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, counters := setup(t, ctrl, "http")
+	remote := mymock.NewMockAuditWritter(ctrl)
+	remote.EXPECT().LogEvent(gomock.Any()).Return(nil).AnyTimes()
+	remote.EXPECT().Sync().AnyTimes()
+	remote.EXPECT().Close(gomock.Any()).Return(nil)
+	counters["http"].dropped.EXPECT().Inc().AnyTimes()
+
+	fw, err := fanoutwriter.New([]fanoutwriter.Sink{{Name: "http", Writer: remote}}, 1, ms)
+	if err != nil {
+		t.Fatalf("creating fanout writer failed with : %s", err)
+	}
+	// As if requests were still being handled after the listener gave up
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := fw.LogEvent([]byte(event)); err != nil {
+					return
+				}
+				if i%20 == 0 {
+					fw.Sync()
+				}
+			}
+		}()
+	}
+
+	assert.NoError(t, fw.Close(context.Background()))
+	wg.Wait()
+	assert.Error(t, fw.LogEvent([]byte(event)))
+	fw.Sync()
+	assert.Error(t, fw.Close(context.Background()))
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	disk := mymock.NewMockAuditWritter(ctrl)
+
+	_, err := fanoutwriter.New(nil, 10, mymock.NewMockMetricsServer(ctrl))
+	assert.Error(t, err)
+
+	_, err = fanoutwriter.New([]fanoutwriter.Sink{{Name: "disk", Writer: disk}}, 0, mymock.NewMockMetricsServer(ctrl))
+	assert.Error(t, err)
+
+	ms, _ := setup(t, ctrl, "disk")
+	_, err = fanoutwriter.New([]fanoutwriter.Sink{
+		{Name: "disk", Writer: disk, Required: true},
+		{Name: "disk", Writer: disk, Required: true},
+	}, 10, ms)
+	assert.Error(t, err)
+}
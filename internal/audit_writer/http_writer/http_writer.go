@@ -0,0 +1,380 @@
+package httpwriter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+)
+
+type Config struct {
+	// Events are POSTed here as newline delimited json
+	URL string
+	// Extra headers sent with every request, as "Name: value"
+	Headers []string
+	// Re-read for every request, so the token can be rotated
+	BearerTokenFilename string
+	Gzip                bool
+
+	// A batch is sent when any of these are reached
+	BatchMaxEvents int
+	BatchMaxBytes  int
+	BatchTimeout   time.Duration
+
+	// Retries are made on connection errors, 5xx and 429 responses,
+	// doubling the backoff each time up to MaxBackoff
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Timeout of each request
+	Timeout time.Duration
+
+	TLSCAFilename         string
+	TLSCertFilename       string
+	TLSKeyFilename        string
+	TLSInsecureSkipVerify bool
+}
+
+type httpWritter struct {
+	config    Config
+	headers   http.Header
+	client    *http.Client
+	formatter *commonwriter.Formatter
+	events    chan []byte
+	flushes   chan chan flushResult
+	// Cancelled once the writer is closed, abandoning any request in progress
+	ctx     context.Context
+	cancel  context.CancelFunc
+	sent    metrics.Counter
+	failed  metrics.Counter
+	retried metrics.Counter
+}
+
+type flushResult struct {
+	// Number of events sent or dropped by the flush
+	events int
+	err    error
+}
+
+// Returned for responses which won't succeed if they're retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func New(config Config, formatter *commonwriter.Formatter, metricsServer metrics.MetricsServer) (auditwritter.AuditWritter, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid http sink url %q", config.URL)
+	}
+	if config.BatchMaxEvents < 1 {
+		return nil, errors.New("the http batch must allow at least one event")
+	}
+	if config.BatchMaxBytes < 1 {
+		return nil, errors.New("the http batch must allow at least one byte")
+	}
+	if config.BatchTimeout <= 0 {
+		return nil, errors.New("the http batch timeout must be positive")
+	}
+	if config.MaxRetries < 0 {
+		return nil, errors.New("the http max retries can't be negative")
+	}
+
+	headers := http.Header{}
+	for _, header := range config.Headers {
+		name, value, found := strings.Cut(header, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid http header %q, expected Name: value", header)
+		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if config.BearerTokenFilename != "" {
+		if _, err := readToken(config.BearerTokenFilename); err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConfig, err := common.NewClientTLSConfig(config.TLSCAFilename, config.TLSCertFilename, config.TLSKeyFilename, config.TLSInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	ctx, cancel := context.WithCancel(context.Background())
+	hw := &httpWritter{
+		config:    config,
+		headers:   headers,
+		client:    &http.Client{Transport: transport, Timeout: config.Timeout},
+		formatter: formatter,
+		// Enough for the next batch to fill while the current one is sent
+		events:  make(chan []byte, config.BatchMaxEvents),
+		flushes: make(chan chan flushResult),
+		ctx:     ctx,
+		cancel:  cancel,
+		sent: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_http_events_sent_total",
+			"Total number of events accepted by the http sink",
+		),
+		failed: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_http_events_failed_total",
+			"Total number of events dropped after the http sink failed to accept them",
+		),
+		retried: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_http_retries_total",
+			"Total number of retried requests to the http sink",
+		),
+	}
+	go hw.run()
+	return hw, nil
+}
+
+// Returned once the writer is closed, as nothing will send events
+var errClosed = errors.New("the http sink is closed")
+
+func (hw *httpWritter) LogEvent(body []byte) error {
+	line, err := hw.formatter.Format(body)
+	if err != nil {
+		return fmt.Errorf("failed to format event: %w", err)
+	}
+	// Checked first, as select picks at random when the queue has room too
+	if hw.ctx.Err() != nil {
+		return errClosed
+	}
+	// Only blocks once a full batch is waiting to be sent
+	select {
+	case hw.events <- line:
+		return nil
+	case <-hw.ctx.Done():
+		return errClosed
+	}
+}
+
+// Sends any batched events, returning once they've been sent or dropped,
+// or straight away once the writer is closed
+func (hw *httpWritter) Sync() {
+	hw.Flush()
+}
+
+// Sends any batched events, then returns an error if any batch since the
+// last Flush was dropped after running out of retries. Batches the server
+// rejected aren't included, as sending them again won't help. Returns an
+// error without waiting once the writer is closed
+func (hw *httpWritter) Flush() error {
+	if hw.ctx.Err() != nil {
+		return errClosed
+	}
+	done := make(chan flushResult, 1)
+	select {
+	case hw.flushes <- done:
+	case <-hw.ctx.Done():
+		return errClosed
+	}
+	select {
+	case result := <-done:
+		return result.err
+	case <-hw.ctx.Done():
+		return errClosed
+	}
+}
+
+// Sends any batched events, then stops the writer. A batch still being sent
+// once ctx is done is dropped
+func (hw *httpWritter) Close(ctx context.Context) error {
+	defer hw.client.CloseIdleConnections()
+	defer hw.cancel()
+
+	if hw.ctx.Err() != nil {
+		return errClosed
+	}
+	done := make(chan flushResult, 1)
+	select {
+	case hw.flushes <- done:
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for the http sink: %w", ctx.Err())
+	case <-hw.ctx.Done():
+		return errClosed
+	}
+	select {
+	case result := <-done:
+		common.Logger.Infow("flushed events to the http sink", "events", result.events)
+		return result.err
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for the http sink: %w", ctx.Err())
+	}
+}
+
+// Batches events and sends them, one batch at a time so they're received in order
+func (hw *httpWritter) run() {
+	batch := &bytes.Buffer{}
+	count := 0
+	// The last batch dropped after running out of retries since the last Flush
+	var dropped error
+	timer := time.NewTimer(hw.config.BatchTimeout)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if count > 0 {
+			if err := hw.send(batch.Bytes(), count); err != nil {
+				dropped = err
+			}
+		}
+		batch.Reset()
+		count = 0
+	}
+	add := func(line []byte) {
+		// Send what we have first if this event would take the batch over the limit
+		if count > 0 && batch.Len()+len(line)+1 > hw.config.BatchMaxBytes {
+			flush()
+		}
+		batch.Write(line)
+		batch.WriteByte('\n')
+		count++
+		if count == 1 {
+			timer.Reset(hw.config.BatchTimeout)
+		}
+		if count >= hw.config.BatchMaxEvents || batch.Len() >= hw.config.BatchMaxBytes {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case line := <-hw.events:
+			add(line)
+		case <-timer.C:
+			flush()
+		case done := <-hw.flushes:
+			// Include events that were logged before Flush was called
+			flushed := count
+			for len(hw.events) > 0 {
+				add(<-hw.events)
+				flushed++
+			}
+			flush()
+			done <- flushResult{events: flushed, err: dropped}
+			dropped = nil
+		case <-hw.ctx.Done():
+			return
+		}
+	}
+}
+
+// Returns an error if the batch was dropped after running out of retries
+func (hw *httpWritter) send(batch []byte, count int) error {
+	payload := batch
+	if hw.config.Gzip {
+		compressed := &bytes.Buffer{}
+		gz := gzip.NewWriter(compressed)
+		gz.Write(batch)
+		gz.Close()
+		payload = compressed.Bytes()
+	}
+
+	backoff := hw.config.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := hw.post(payload)
+		if err == nil {
+			hw.sent.Add(float64(count))
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= hw.config.MaxRetries {
+			common.Logger.Errorw("failed to send events to the http sink", "events", count, "attempts", attempt+1, "error", err)
+			hw.failed.Add(float64(count))
+			if errors.As(err, &permanent) {
+				return nil
+			}
+			return err
+		}
+
+		wait := backoff
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if hw.config.MaxBackoff > 0 && wait > hw.config.MaxBackoff {
+			wait = hw.config.MaxBackoff
+		}
+		common.Logger.Warnw("retrying request to the http sink", "events", count, "attempt", attempt+1, "backoff", wait, "error", err)
+		hw.retried.Inc()
+		select {
+		case <-time.After(wait):
+		case <-hw.ctx.Done():
+			hw.failed.Add(float64(count))
+			return fmt.Errorf("writer closed before the batch was sent: %w", err)
+		}
+		backoff *= 2
+	}
+}
+
+// Returns how long the server asked us to wait before retrying, if it did
+func (hw *httpWritter) post(payload []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(hw.ctx, http.MethodPost, hw.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	req.Header = hw.headers.Clone()
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if hw.config.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if hw.config.BearerTokenFilename != "" {
+		token, err := readToken(hw.config.BearerTokenFilename)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := hw.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return retryAfter(resp), fmt.Errorf("http sink responded with %s", resp.Status)
+	default:
+		return 0, &permanentError{fmt.Errorf("http sink responded with %s", resp.Status)}
+	}
+}
+
+// Only the delay-seconds form of Retry-After is supported
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func readToken(filename string) (string, error) {
+	token, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read http sink bearer token: %w", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
@@ -0,0 +1,325 @@
+package httpwriter_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	httpwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/http_writer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+const event = `{"request":{"uid":"test-uid","namespace":"default"}}`
+
+// Records every request it receives, responding with the given statuses in
+// order and then 200 once they've been used up
+type fakeCollector struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]string
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	var lines []string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	c.requests = append(c.requests, r)
+	c.bodies = append(c.bodies, lines)
+
+	if len(c.statuses) > 0 {
+		w.WriteHeader(c.statuses[0])
+		c.statuses = c.statuses[1:]
+	}
+}
+
+func newServer(t *testing.T, statuses ...int) (*httptest.Server, *fakeCollector) {
+	collector := &fakeCollector{statuses: statuses}
+	server := httptest.NewServer(collector)
+	t.Cleanup(server.Close)
+	return server, collector
+}
+
+func newConfig(server *httptest.Server) httpwriter.Config {
+	return httpwriter.Config{
+		URL:            server.URL,
+		BatchMaxEvents: 100,
+		BatchMaxBytes:  1024 * 1024,
+		BatchTimeout:   time.Hour,
+		MaxRetries:     3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		Timeout:        5 * time.Second,
+	}
+}
+
+// Returns the sent, failed and retried counters
+func setup(t *testing.T) (*mymock.MockMetricsServer, *mymock.MockCounter, *mymock.MockCounter, *mymock.MockCounter) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	sent := mymock.NewMockCounter(ctrl)
+	failed := mymock.NewMockCounter(ctrl)
+	retried := mymock.NewMockCounter(ctrl)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_http_events_sent_total", gomock.Any()).Return(sent).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_http_events_failed_total", gomock.Any()).Return(failed).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_http_retries_total", gomock.Any()).Return(retried).AnyTimes()
+	return ms, sent, failed, retried
+}
+
+func newFormatter() *commonwriter.Formatter {
+	formatter, _ := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	return formatter
+}
+
+func Test_WhenBatchFull_ThenGzippedNDJSONSentWithHeaders(t *testing.T) {
+	server, collector := newServer(t)
+	ms, sent, _, _ := setup(t)
+	sent.EXPECT().Add(float64(2))
+
+	tokenFile := path.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("secret-token\n"), 0600)
+	config := newConfig(server)
+	config.BatchMaxEvents = 2
+	config.Gzip = true
+	config.Headers = []string{"X-Tenant: platform"}
+	config.BearerTokenFilename = tokenFile
+
+	hw, err := httpwriter.New(config, newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	hw.LogEvent([]byte(event))
+	hw.LogEvent([]byte(event))
+	hw.Sync()
+
+	assert.Len(t, collector.requests, 1)
+	req := collector.requests[0]
+	assert.Equal(t, "application/x-ndjson", req.Header.Get("Content-Type"))
+	assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Bearer secret-token", req.Header.Get("Authorization"))
+	assert.Equal(t, "platform", req.Header.Get("X-Tenant"))
+	assert.Len(t, collector.bodies[0], 2)
+	for _, line := range collector.bodies[0] {
+		assert.Equal(t, "test-uid", gjson.Get(line, "request.uid").Str)
+		assert.True(t, gjson.Get(line, "requestReceivedTimestamp").Exists())
+	}
+}
+
+func Test_WhenBatchTimeoutReached_ThenPartialBatchSent(t *testing.T) {
+	server, collector := newServer(t)
+	ms, sent, _, _ := setup(t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	sent.EXPECT().Add(float64(1)).Do(func(float64) { wg.Done() })
+
+	config := newConfig(server)
+	config.BatchTimeout = 10 * time.Millisecond
+	hw, err := httpwriter.New(config, newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	hw.LogEvent([]byte(event))
+
+	wg.Wait()
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	assert.Len(t, collector.requests, 1)
+}
+
+func Test_WhenBatchMaxBytesReached_ThenBatchSplit(t *testing.T) {
+	server, collector := newServer(t)
+	ms, sent, _, _ := setup(t)
+	sent.EXPECT().Add(float64(1)).Times(3)
+
+	config := newConfig(server)
+	// Each formatted event is around 100 bytes
+	config.BatchMaxBytes = 150
+	hw, err := httpwriter.New(config, newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	hw.LogEvent([]byte(event))
+	hw.LogEvent([]byte(event))
+	hw.LogEvent([]byte(event))
+	hw.Sync()
+
+	assert.Len(t, collector.requests, 3)
+}
+
+func Test_WhenServerUnavailable_ThenRetriedWithBackoff(t *testing.T) {
+	server, collector := newServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	ms, sent, _, retried := setup(t)
+	retried.EXPECT().Inc().Times(2)
+	sent.EXPECT().Add(float64(1))
+
+	hw, err := httpwriter.New(newConfig(server), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	hw.LogEvent([]byte(event))
+	hw.Sync()
+
+	assert.Len(t, collector.requests, 3)
+	assert.Equal(t, collector.bodies[0], collector.bodies[2])
+}
+
+func Test_WhenRetriesExhausted_ThenEventsFailed(t *testing.T) {
+	server, collector := newServer(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	ms, _, failed, retried := setup(t)
+	retried.EXPECT().Inc().Times(3)
+	failed.EXPECT().Add(float64(2))
+
+	hw, err := httpwriter.New(newConfig(server), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	hw.LogEvent([]byte(event))
+	hw.LogEvent([]byte(event))
+
+	assert.Error(t, hw.(auditwritter.Flusher).Flush())
+	assert.Len(t, collector.requests, 4)
+}
+
+func Test_WhenServerRejectsBatch_ThenNotRetried(t *testing.T) {
+	server, collector := newServer(t, http.StatusBadRequest)
+	ms, _, failed, _ := setup(t)
+	failed.EXPECT().Add(float64(1))
+
+	hw, err := httpwriter.New(newConfig(server), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	hw.LogEvent([]byte(event))
+
+	// Sending it again wouldn't help, so it's not reported
+	assert.NoError(t, hw.(auditwritter.Flusher).Flush())
+	assert.Len(t, collector.requests, 1)
+}
+
+func Test_WhenClosed_ThenBatchedEventsSent(t *testing.T) {
+	server, collector := newServer(t)
+	ms, sent, _, _ := setup(t)
+	sent.EXPECT().Add(float64(2))
+
+	hw, err := httpwriter.New(newConfig(server), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	hw.LogEvent([]byte(event))
+	hw.LogEvent([]byte(event))
+
+	assert.NoError(t, hw.Close(context.Background()))
+	assert.Len(t, collector.requests, 1)
+	assert.Len(t, collector.bodies[0], 2)
+}
+
+func Test_WhenCloseDeadlinePasses_ThenBatchDropped(t *testing.T) {
+	server, _ := newServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	ms, _, failed, retried := setup(t)
+	retried.EXPECT().Inc().AnyTimes()
+	dropped := make(chan struct{})
+	failed.EXPECT().Add(float64(1)).Do(func(float64) { close(dropped) })
+
+	config := newConfig(server)
+	config.InitialBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	hw, err := httpwriter.New(config, newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	hw.LogEvent([]byte(event))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, hw.Close(ctx), context.DeadlineExceeded)
+	// The backoff is abandoned once the writer is closed
+	select {
+	case <-dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch wasn't dropped after closing")
+	}
+}
+
+func Test_WhenUsedAfterClose_ThenErrorReturnedWithoutBlocking(t *testing.T) {
+	server, _ := newServer(t)
+	ms, _, _, _ := setup(t)
+
+	config := newConfig(server)
+	config.BatchMaxEvents = 1
+	hw, err := httpwriter.New(config, newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating http writer failed with : %s", err)
+	}
+	assert.NoError(t, hw.Close(context.Background()))
+
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		// More than the queue holds
+		for range 3 {
+			assert.Error(t, hw.LogEvent([]byte(event)))
+		}
+		hw.Sync()
+		assert.Error(t, hw.(auditwritter.Flusher).Flush())
+		assert.Error(t, hw.Close(context.Background()))
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer blocked after it was closed")
+	}
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	server, _ := newServer(t)
+	testCases := []struct {
+		name   string
+		modify func(*httpwriter.Config)
+	}{
+		{"no url", func(c *httpwriter.Config) { c.URL = "" }},
+		{"bad scheme", func(c *httpwriter.Config) { c.URL = "ftp://collector" }},
+		{"no batch events", func(c *httpwriter.Config) { c.BatchMaxEvents = 0 }},
+		{"no batch bytes", func(c *httpwriter.Config) { c.BatchMaxBytes = 0 }},
+		{"no batch timeout", func(c *httpwriter.Config) { c.BatchTimeout = 0 }},
+		{"negative retries", func(c *httpwriter.Config) { c.MaxRetries = -1 }},
+		{"bad header", func(c *httpwriter.Config) { c.Headers = []string{"X-Tenant"} }},
+		{"missing token", func(c *httpwriter.Config) { c.BearerTokenFilename = "/does/not/exist" }},
+		{"missing CA", func(c *httpwriter.Config) { c.TLSCAFilename = "/does/not/exist" }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ms, _, _, _ := setup(t)
+			config := newConfig(server)
+			tc.modify(&config)
+			_, err := httpwriter.New(config, newFormatter(), ms)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -2,9 +2,39 @@
 // to some medium (disk, stdout, etc.)
 package auditwritter
 
-//go:generate mockgen -package mymock -destination ../../mocks/audit_writer_mock.go github.com/RichardoC/kube-audit-rest/internal/audit_writer AuditWritter
+//go:generate mockgen -package mymock -destination ../../mocks/audit_writer_mock.go github.com/RichardoC/kube-audit-rest/internal/audit_writer AuditWritter,Flusher,HealthReporter
+
+import (
+	"context"
+	"time"
+)
 
 type AuditWritter interface {
-	LogEvent(body []byte)
+	// Returns an error if the event couldn't be written. Writers that
+	// deliver asynchronously can only report errors found before sending
+	LogEvent(body []byte) error
 	Sync()
+	// Writes out every event logged so far and releases the writer's
+	// resources, giving up once ctx is done. The writer mustn't be used after
+	Close(ctx context.Context) error
+}
+
+// Implemented by writers that deliver events in the background, so callers
+// can find out whether the events they've logged were delivered
+type Flusher interface {
+	// Waits for every event logged so far to be delivered or given up on,
+	// returning an error if any of them failed in a way that could succeed
+	// if they're logged again
+	Flush() error
+}
+
+// Implemented by writers that can tell whether they're healthy, for the
+// readiness and liveness probes
+type HealthReporter interface {
+	// Returns an error when events can't be written as they should be, such
+	// as the queue being full or a required sink failing
+	Ready() error
+	// Returns an error when a write has been in progress for longer than
+	// timeout, as the writer is likely wedged
+	Live(timeout time.Duration) error
 }
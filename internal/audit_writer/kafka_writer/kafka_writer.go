@@ -0,0 +1,294 @@
+package kafkawriter
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/tidwall/gjson"
+)
+
+// Field of the AdmissionRequest used as the message key, so
+// related events are written to the same partition in order
+type PartitionKey string
+
+const (
+	// Spread events over partitions at random
+	PartitionKeyNone      PartitionKey = "none"
+	PartitionKeyNamespace PartitionKey = "namespace"
+	PartitionKeyUID       PartitionKey = "uid"
+)
+
+type Config struct {
+	Brokers      []string
+	Topic        string
+	PartitionKey PartitionKey
+	// none, leader or all
+	RequiredAcks string
+	// none, gzip, snappy, lz4 or zstd
+	Compression string
+	// A batch is sent when any of these are reached, 0 means no limit
+	BatchMaxMessages int
+	BatchMaxBytes    int
+	BatchTimeout     time.Duration
+
+	TLSEnabled            bool
+	TLSCAFilename         string
+	TLSCertFilename       string
+	TLSKeyFilename        string
+	TLSInsecureSkipVerify bool
+
+	// Empty to disable, otherwise PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+	SASLMechanism        string
+	SASLUsername         string
+	SASLPasswordFilename string
+}
+
+type kafkaWritter struct {
+	producer       sarama.AsyncProducer
+	topic          string
+	partitionKey   PartitionKey
+	formatter      *commonwriter.Formatter
+	delivered      metrics.Counter
+	deliveryErrors metrics.Counter
+
+	mu sync.Mutex
+	// Broadcast whenever a message is acknowledged or fails
+	settled  *sync.Cond
+	inFlight int
+	// The last delivery error since the last Flush that could succeed if retried
+	failed error
+	// The error of the last message to settle, nil if it was delivered
+	lastErr error
+}
+
+func New(config Config, formatter *commonwriter.Formatter, metricsServer metrics.MetricsServer) (auditwritter.AuditWritter, error) {
+	if len(config.Brokers) == 0 {
+		return nil, errors.New("at least one kafka broker is required")
+	}
+	if config.Topic == "" {
+		return nil, errors.New("a kafka topic is required")
+	}
+	switch config.PartitionKey {
+	case PartitionKeyNone, PartitionKeyNamespace, PartitionKeyUID:
+	default:
+		return nil, fmt.Errorf("unknown partition key %q", config.PartitionKey)
+	}
+
+	saramaConfig, err := newSaramaConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewAsyncProducer(config.Brokers, saramaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka producer: %w", err)
+	}
+
+	kw := &kafkaWritter{
+		producer:     producer,
+		topic:        config.Topic,
+		partitionKey: config.PartitionKey,
+		formatter:    formatter,
+		delivered: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_kafka_messages_delivered_total",
+			"Total number of events acknowledged by kafka",
+		),
+		deliveryErrors: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_kafka_delivery_errors_total",
+			"Total number of events that failed to be delivered to kafka",
+		),
+	}
+	kw.settled = sync.NewCond(&kw.mu)
+	go kw.handleSuccesses()
+	go kw.handleErrors()
+	return kw, nil
+}
+
+func newSaramaConfig(config Config) (*sarama.Config, error) {
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.ClientID = "kube-audit-rest"
+	saramaConfig.Producer.Return.Successes = true
+	saramaConfig.Producer.Return.Errors = true
+	saramaConfig.Producer.Flush.Messages = config.BatchMaxMessages
+	saramaConfig.Producer.Flush.Bytes = config.BatchMaxBytes
+	saramaConfig.Producer.Flush.Frequency = config.BatchTimeout
+
+	switch config.RequiredAcks {
+	case "none":
+		saramaConfig.Producer.RequiredAcks = sarama.NoResponse
+	case "leader":
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all":
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return nil, fmt.Errorf("unknown required acks %q", config.RequiredAcks)
+	}
+
+	switch config.Compression {
+	case "none":
+		saramaConfig.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		saramaConfig.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		saramaConfig.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		saramaConfig.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		saramaConfig.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("unknown compression %q", config.Compression)
+	}
+
+	if config.TLSEnabled {
+		tlsConfig, err := common.NewClientTLSConfig(config.TLSCAFilename, config.TLSCertFilename, config.TLSKeyFilename, config.TLSInsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
+
+	if config.SASLMechanism != "" {
+		password, err := os.ReadFile(config.SASLPasswordFilename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kafka SASL password: %w", err)
+		}
+		saramaConfig.Net.SASL.Enable = true
+		saramaConfig.Net.SASL.User = config.SASLUsername
+		saramaConfig.Net.SASL.Password = strings.TrimSpace(string(password))
+
+		switch config.SASLMechanism {
+		case sarama.SASLTypePlaintext:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case sarama.SASLTypeSCRAMSHA256:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hashGenerator: sha256.New}
+			}
+		case sarama.SASLTypeSCRAMSHA512:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hashGenerator: sha512.New}
+			}
+		default:
+			return nil, fmt.Errorf("unknown SASL mechanism %q", config.SASLMechanism)
+		}
+	}
+
+	if err := saramaConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid kafka configuration: %w", err)
+	}
+	return saramaConfig, nil
+}
+
+func (kw *kafkaWritter) LogEvent(body []byte) error {
+	line, err := kw.formatter.Format(body)
+	if err != nil {
+		return fmt.Errorf("failed to format event: %w", err)
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: kw.topic,
+		Value: sarama.ByteEncoder(line),
+	}
+	switch kw.partitionKey {
+	case PartitionKeyNamespace:
+		msg.Key = sarama.StringEncoder(gjson.GetBytes(body, "request.namespace").Str)
+	case PartitionKeyUID:
+		msg.Key = sarama.StringEncoder(gjson.GetBytes(body, "request.uid").Str)
+	}
+
+	kw.mu.Lock()
+	kw.inFlight++
+	lastErr := kw.lastErr
+	kw.mu.Unlock()
+	// Only blocks once the producer's buffers are full
+	kw.producer.Input() <- msg
+	// Delivery is asynchronous, so the event is still sent but failing
+	// deliveries are reported until one succeeds
+	if lastErr != nil {
+		return fmt.Errorf("failed to deliver earlier events to kafka: %w", lastErr)
+	}
+	return nil
+}
+
+// Waits for every message to be acknowledged or fail
+func (kw *kafkaWritter) Sync() {
+	kw.Flush()
+}
+
+// Waits for every message to be acknowledged or fail, returning an error if
+// any failed since the last Flush. Messages too large for the broker aren't
+// included, as sending them again won't help
+func (kw *kafkaWritter) Flush() error {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	for kw.inFlight > 0 {
+		kw.settled.Wait()
+	}
+	err := kw.failed
+	kw.failed = nil
+	return err
+}
+
+// Waits for every message to be acknowledged or fail, then closes the producer
+func (kw *kafkaWritter) Close(ctx context.Context) error {
+	kw.mu.Lock()
+	pending := kw.inFlight
+	kw.mu.Unlock()
+
+	err := common.WaitContext(ctx, func() {
+		kw.mu.Lock()
+		defer kw.mu.Unlock()
+		for kw.inFlight > 0 {
+			kw.settled.Wait()
+		}
+	})
+	if err != nil {
+		kw.producer.AsyncClose()
+		return fmt.Errorf("gave up waiting for kafka to acknowledge events: %w", err)
+	}
+	common.Logger.Infow("flushed events to kafka", "events", pending)
+	return kw.producer.Close()
+}
+
+func (kw *kafkaWritter) handleSuccesses() {
+	for range kw.producer.Successes() {
+		kw.delivered.Inc()
+		kw.settle(nil)
+	}
+}
+
+func (kw *kafkaWritter) handleErrors() {
+	for err := range kw.producer.Errors() {
+		common.Logger.Errorw("failed to deliver event to kafka", "topic", err.Msg.Topic, "error", err.Err)
+		kw.deliveryErrors.Inc()
+		kw.settle(err.Err)
+	}
+}
+
+func (kw *kafkaWritter) settle(err error) {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	kw.inFlight--
+	if err != nil && errors.Is(err, sarama.ErrMessageSizeTooLarge) {
+		// Only this message failed
+		err = nil
+	}
+	kw.lastErr = err
+	if err != nil {
+		kw.failed = err
+	}
+	kw.settled.Broadcast()
+}
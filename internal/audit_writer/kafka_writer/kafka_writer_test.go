@@ -0,0 +1,212 @@
+package kafkawriter_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	kafkawriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/kafka_writer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+const topic = "audit"
+
+const event = `{"request":{"uid":"test-uid","namespace":"default"}}`
+
+func newBroker(t *testing.T, produceResponse *sarama.MockProduceResponse) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"ProduceRequest": produceResponse,
+	})
+	t.Cleanup(broker.Close)
+	return broker
+}
+
+func newConfig(broker *sarama.MockBroker) kafkawriter.Config {
+	return kafkawriter.Config{
+		Brokers:      []string{broker.Addr()},
+		Topic:        topic,
+		PartitionKey: kafkawriter.PartitionKeyNamespace,
+		RequiredAcks: "all",
+		Compression:  "gzip",
+	}
+}
+
+// Returns the delivered and delivery error counters
+func setup(t *testing.T) (*mymock.MockMetricsServer, *mymock.MockCounter, *mymock.MockCounter) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	delivered := mymock.NewMockCounter(ctrl)
+	deliveryErrors := mymock.NewMockCounter(ctrl)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_kafka_messages_delivered_total", gomock.Any()).Return(delivered).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_kafka_delivery_errors_total", gomock.Any()).Return(deliveryErrors).AnyTimes()
+	return ms, delivered, deliveryErrors
+}
+
+func newFormatter() *commonwriter.Formatter {
+	formatter, _ := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	return formatter
+}
+
+func waitFor(t *testing.T, wg *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for kafka delivery")
+	}
+}
+
+func Test_WhenBrokerAcknowledges_ThenDeliveryCounted(t *testing.T) {
+	broker := newBroker(t, sarama.NewMockProduceResponse(t))
+	ms, delivered, _ := setup(t)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	delivered.EXPECT().Inc().Do(func() { wg.Done() }).Times(2)
+
+	kw, err := kafkawriter.New(newConfig(broker), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating kafka writer failed with : %s", err)
+	}
+	kw.LogEvent([]byte(event))
+	kw.LogEvent([]byte(event))
+
+	assert.NoError(t, kw.(auditwritter.Flusher).Flush())
+	waitFor(t, &wg)
+	produceRequests := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produceRequests++
+		}
+	}
+	assert.GreaterOrEqual(t, produceRequests, 1)
+}
+
+func Test_WhenBrokerRejects_ThenDeliveryErrorCounted(t *testing.T) {
+	broker := newBroker(t, sarama.NewMockProduceResponse(t).SetError(topic, 0, sarama.ErrMessageSizeTooLarge))
+	ms, _, deliveryErrors := setup(t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	deliveryErrors.EXPECT().Inc().Do(func() { wg.Done() }).Times(1)
+
+	kw, err := kafkawriter.New(newConfig(broker), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating kafka writer failed with : %s", err)
+	}
+	kw.LogEvent([]byte(event))
+
+	// Sending it again wouldn't help, so it's not reported
+	assert.NoError(t, kw.(auditwritter.Flusher).Flush())
+	waitFor(t, &wg)
+}
+
+func Test_WhenDeliveryFails_ThenFlushReturnsError(t *testing.T) {
+	broker := newBroker(t, sarama.NewMockProduceResponse(t).SetError(topic, 0, sarama.ErrInvalidTimestamp))
+	ms, _, deliveryErrors := setup(t)
+	deliveryErrors.EXPECT().Inc()
+
+	kw, err := kafkawriter.New(newConfig(broker), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating kafka writer failed with : %s", err)
+	}
+	kw.LogEvent([]byte(event))
+
+	assert.Error(t, kw.(auditwritter.Flusher).Flush())
+	// Only reported once
+	assert.NoError(t, kw.(auditwritter.Flusher).Flush())
+}
+
+func Test_WhenDeliveryFails_ThenLogEventReturnsErrorUntilOneSucceeds(t *testing.T) {
+	broker := newBroker(t, sarama.NewMockProduceResponse(t).SetError(topic, 0, sarama.ErrInvalidTimestamp))
+	ms, delivered, deliveryErrors := setup(t)
+	deliveryErrors.EXPECT().Inc().Times(2)
+	delivered.EXPECT().Inc().Times(2)
+
+	kw, err := kafkawriter.New(newConfig(broker), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating kafka writer failed with : %s", err)
+	}
+	assert.NoError(t, kw.LogEvent([]byte(event)))
+	kw.Sync()
+	assert.Error(t, kw.LogEvent([]byte(event)))
+	kw.Sync()
+
+	// Once kafka recovers
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"ApiVersionsRequest": sarama.NewMockApiVersionsResponse(t),
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+	assert.Error(t, kw.LogEvent([]byte(event)))
+	kw.Sync()
+	assert.NoError(t, kw.LogEvent([]byte(event)))
+	kw.Sync()
+}
+
+func Test_WhenClosed_ThenPendingEventsDelivered(t *testing.T) {
+	broker := newBroker(t, sarama.NewMockProduceResponse(t))
+	ms, delivered, _ := setup(t)
+	delivered.EXPECT().Inc().Times(2)
+
+	kw, err := kafkawriter.New(newConfig(broker), newFormatter(), ms)
+	if err != nil {
+		t.Fatalf("creating kafka writer failed with : %s", err)
+	}
+	kw.LogEvent([]byte(event))
+	kw.LogEvent([]byte(event))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, kw.Close(ctx))
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	broker := newBroker(t, sarama.NewMockProduceResponse(t))
+	testCases := []struct {
+		name   string
+		modify func(*kafkawriter.Config)
+	}{
+		{"no brokers", func(c *kafkawriter.Config) { c.Brokers = nil }},
+		{"no topic", func(c *kafkawriter.Config) { c.Topic = "" }},
+		{"bad partition key", func(c *kafkawriter.Config) { c.PartitionKey = "name" }},
+		{"bad acks", func(c *kafkawriter.Config) { c.RequiredAcks = "some" }},
+		{"bad compression", func(c *kafkawriter.Config) { c.Compression = "bzip2" }},
+		{"bad SASL mechanism", func(c *kafkawriter.Config) {
+			c.SASLMechanism = "GSSAPI-ISH"
+			c.SASLPasswordFilename = "/dev/null"
+		}},
+		{"missing SASL password", func(c *kafkawriter.Config) {
+			c.SASLMechanism = sarama.SASLTypeSCRAMSHA512
+			c.SASLPasswordFilename = "/does/not/exist"
+		}},
+		{"missing CA", func(c *kafkawriter.Config) {
+			c.TLSEnabled = true
+			c.TLSCAFilename = "/does/not/exist"
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ms, _, _ := setup(t)
+			config := newConfig(broker)
+			tc.modify(&config)
+			_, err := kafkawriter.New(config, newFormatter(), ms)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package kafkawriter
+
+import (
+	"github.com/xdg-go/scram"
+)
+
+// Implements sarama.SCRAMClient, as sarama doesn't include one
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+func (sc *scramClient) Begin(userName, password, authzID string) error {
+	client, err := sc.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	sc.conversation = client.NewConversation()
+	return nil
+}
+
+func (sc *scramClient) Step(challenge string) (string, error) {
+	return sc.conversation.Step(challenge)
+}
+
+func (sc *scramClient) Done() bool {
+	return sc.conversation.Done()
+}
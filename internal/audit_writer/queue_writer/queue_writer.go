@@ -0,0 +1,343 @@
+package queuewriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+)
+
+// What happens to an event logged while the queue is full
+type OverflowMode string
+
+const (
+	// Wait for space, which delays the response to the apiserver
+	OverflowBlock OverflowMode = "block"
+	// Drop the event being logged
+	OverflowDropNewest OverflowMode = "drop-newest"
+	// Drop the oldest queued event to make space
+	OverflowDropOldest OverflowMode = "drop-oldest"
+	// Append the event to a file, which is read back once the queue has caught up
+	OverflowSpillToDisk OverflowMode = "spill-to-disk"
+)
+
+type Config struct {
+	// Maximum number of events held in memory
+	Size     int
+	Overflow OverflowMode
+	// Only used by OverflowSpillToDisk
+	SpillDirectory string
+	// Events are dropped once the spill file is this big, 0 means no limit
+	SpillMaxBytes int64
+}
+
+type queuedEvent struct {
+	body     []byte
+	enqueued time.Time
+	// Whether it was read from the spill file, which is told once it's written
+	spilled bool
+}
+
+// Returned once the writer is closed, as nothing will write the events
+var errClosed = errors.New("queue writer is closed")
+
+type queueWritter struct {
+	writer   auditwritter.AuditWritter
+	size     int
+	overflow OverflowMode
+
+	mu sync.Mutex
+	// Broadcast whenever events are queued or taken from the queue
+	changed *sync.Cond
+	events  []queuedEvent
+	// Nil unless spilling to disk
+	spill *spillFile
+	// Whether an event taken from the queue is still being written
+	writing bool
+	// When the event being written was taken from the queue
+	writingSince time.Time
+	// Events taken from the queue and written, or that failed to be
+	written int
+	// Whether the last event that didn't fit in the queue couldn't be spilled
+	spillFailed bool
+	// Set by Close to stop run, which closes stopped once it has
+	closed  bool
+	stopped chan struct{}
+
+	depth       metrics.Gauge
+	spillBytes  metrics.Gauge
+	latency     metrics.Gauge
+	dropped     metrics.Counter
+	writeErrors metrics.Counter
+}
+
+// Queues events in memory and writes them to the writer in the background, in order
+func New(writer auditwritter.AuditWritter, config Config, metricsServer metrics.MetricsServer) (auditwritter.AuditWritter, error) {
+	if config.Size < 1 {
+		return nil, errors.New("the queue size must be at least 1")
+	}
+
+	qw := &queueWritter{
+		writer:   writer,
+		size:     config.Size,
+		overflow: config.Overflow,
+		stopped:  make(chan struct{}),
+		depth: metricsServer.CreateAndRegisterGauge(
+			"kube_audit_rest_queue_depth_events",
+			"Number of events waiting to be written, including any spilled to disk",
+		),
+		spillBytes: metricsServer.CreateAndRegisterGauge(
+			"kube_audit_rest_queue_spill_bytes",
+			"Size of the events spilled to disk that are waiting to be written",
+		),
+		latency: metricsServer.CreateAndRegisterGauge(
+			"kube_audit_rest_queue_latency_seconds",
+			"Time the most recently written event spent queued",
+		),
+		dropped: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_queue_dropped_events_total",
+			"Total number of events dropped because the queue was full",
+		),
+		writeErrors: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_queue_write_errors_total",
+			"Total number of queued events the writer failed to write",
+		),
+	}
+	qw.changed = sync.NewCond(&qw.mu)
+
+	switch config.Overflow {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+	case OverflowSpillToDisk:
+		if config.SpillDirectory == "" {
+			return nil, errors.New("a spill directory is required to spill to disk")
+		}
+		spill, err := openSpillFile(config.SpillDirectory, config.SpillMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		if spill.pending() {
+			common.Logger.Infow("writing events spilled to disk before restarting", "events", spill.count)
+		}
+		qw.spill = spill
+	default:
+		return nil, fmt.Errorf("unknown queue overflow mode %q", config.Overflow)
+	}
+
+	qw.updateGauges()
+	go qw.run()
+	return qw, nil
+}
+
+func (qw *queueWritter) LogEvent(body []byte) error {
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+	event := queuedEvent{body: body, enqueued: time.Now()}
+	if qw.closed {
+		return errClosed
+	}
+
+	// Once events have been spilled, newer events have to follow them
+	if len(qw.events) >= qw.size || qw.spill.pending() {
+		switch qw.overflow {
+		case OverflowBlock:
+			for len(qw.events) >= qw.size && !qw.closed {
+				qw.changed.Wait()
+			}
+			if qw.closed {
+				return errClosed
+			}
+		case OverflowDropNewest:
+			qw.dropped.Inc()
+			return errors.New("queue is full, dropping event")
+		case OverflowDropOldest:
+			common.Logger.Warnw("queue is full, dropping the oldest event")
+			qw.dropped.Inc()
+			qw.events[0] = queuedEvent{}
+			qw.events = qw.events[1:]
+		case OverflowSpillToDisk:
+			if err := qw.spill.append(event); err != nil {
+				qw.spillFailed = true
+				qw.dropped.Inc()
+				return fmt.Errorf("queue is full and spilling to disk failed, dropping event: %w", err)
+			}
+			qw.spillFailed = false
+			qw.updateGauges()
+			qw.changed.Broadcast()
+			return nil
+		}
+	}
+
+	qw.events = append(qw.events, event)
+	qw.updateGauges()
+	qw.changed.Broadcast()
+	return nil
+}
+
+// Waits for every queued event to be written, then syncs the writer
+func (qw *queueWritter) Sync() {
+	qw.mu.Lock()
+	for len(qw.events) > 0 || qw.spill.pending() || qw.writing {
+		qw.changed.Wait()
+	}
+	qw.mu.Unlock()
+	qw.writer.Sync()
+}
+
+// Waits for every queued event to be written, then stops writing and closes
+// the writer. Events spilled to disk that aren't written in time are kept for
+// the next start. The writer is closed even if the queue isn't drained in time
+func (qw *queueWritter) Close(ctx context.Context) error {
+	qw.mu.Lock()
+	written := qw.written
+	qw.mu.Unlock()
+
+	err := common.WaitContext(ctx, func() {
+		qw.mu.Lock()
+		defer qw.mu.Unlock()
+		for len(qw.events) > 0 || qw.spill.pending() || qw.writing {
+			qw.changed.Wait()
+		}
+	})
+
+	// Stops run once it has finished writing the current event, if any
+	qw.mu.Lock()
+	qw.closed = true
+	qw.changed.Broadcast()
+	qw.mu.Unlock()
+	if err != nil {
+		err = fmt.Errorf("gave up writing queued events: %w", err)
+	} else if err = common.WaitContext(ctx, func() { <-qw.stopped }); err != nil {
+		err = fmt.Errorf("gave up waiting for the queue to stop: %w", err)
+	}
+
+	qw.mu.Lock()
+	drained := qw.written - written
+	qw.mu.Unlock()
+	common.Logger.Infow("flushed queued events", "events", drained)
+	return errors.Join(err, qw.writer.Close(ctx))
+}
+
+func (qw *queueWritter) run() {
+	defer close(qw.stopped)
+	for {
+		event, err := qw.next()
+		if errors.Is(err, errClosed) {
+			qw.closeSpill()
+			return
+		}
+		if err != nil {
+			common.Logger.Errorw("failed to read queued event", "error", err)
+			qw.writeErrors.Inc()
+			continue
+		}
+
+		qw.latency.Set(time.Since(event.enqueued).Seconds())
+		if err := qw.writer.LogEvent(event.body); err != nil {
+			common.Logger.Errorw("failed to write queued event", "error", err)
+			qw.writeErrors.Inc()
+		}
+		if event.spilled {
+			qw.commitSpill()
+		}
+	}
+}
+
+// Saves that the spilled events read so far have been written, so they're
+// not written again after a restart
+func (qw *queueWritter) commitSpill() {
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+	if err := qw.spill.commit(); err != nil {
+		common.Logger.Errorw("failed to save the spill file offset, events may be written again after a restart", "error", err)
+	}
+}
+
+func (qw *queueWritter) closeSpill() {
+	if qw.spill == nil {
+		return
+	}
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+	if err := qw.spill.close(); err != nil {
+		common.Logger.Errorw("failed to close the spill file", "error", err)
+	}
+}
+
+// Waits for and takes the oldest event, from memory first as anything
+// spilled to disk was logged after
+func (qw *queueWritter) next() (queuedEvent, error) {
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+
+	if qw.writing {
+		qw.written++
+	}
+	qw.writing = false
+	for len(qw.events) == 0 && !qw.spill.pending() && !qw.closed {
+		// Wake up Sync as the queue is empty
+		qw.changed.Broadcast()
+		qw.changed.Wait()
+	}
+	if qw.closed {
+		qw.changed.Broadcast()
+		return queuedEvent{}, errClosed
+	}
+	qw.writing = true
+	qw.writingSince = time.Now()
+	defer qw.changed.Broadcast()
+	defer qw.updateGauges()
+
+	if len(qw.events) > 0 {
+		event := qw.events[0]
+		qw.events[0] = queuedEvent{}
+		qw.events = qw.events[1:]
+		return event, nil
+	}
+	// Makes space for the next event that doesn't fit in the queue
+	qw.spillFailed = false
+	return qw.spill.next()
+}
+
+// Fails while the queue is saturated, so events are held up or dropped
+func (qw *queueWritter) Ready() error {
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+	// The next event will go to the spill file
+	if qw.spill != nil {
+		if qw.spillFailed && (len(qw.events) >= qw.size || qw.spill.pending()) {
+			return errors.New("queue is full and events can't be spilled to disk")
+		}
+		return nil
+	}
+	if len(qw.events) >= qw.size {
+		return fmt.Errorf("queue is full with %d events", len(qw.events))
+	}
+	return nil
+}
+
+// Fails when the writer has taken longer than timeout to write an event
+func (qw *queueWritter) Live(timeout time.Duration) error {
+	qw.mu.Lock()
+	defer qw.mu.Unlock()
+	if qw.writing && time.Since(qw.writingSince) > timeout {
+		return fmt.Errorf("writing a queued event has taken %s", time.Since(qw.writingSince).Round(time.Second))
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (qw *queueWritter) updateGauges() {
+	depth := len(qw.events)
+	var spillBytes int64
+	if qw.spill != nil {
+		depth += qw.spill.count
+		spillBytes = qw.spill.size()
+	}
+	qw.depth.Set(float64(depth))
+	qw.spillBytes.Set(float64(spillBytes))
+}
@@ -0,0 +1,442 @@
+package queuewriter_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	queuewriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/queue_writer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+// Records the events written to the mock writer, which waits for the gate to
+// be opened before writing each one
+type recorder struct {
+	mu      sync.Mutex
+	written []string
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func newRecorder(ctrl *gomock.Controller) (*mymock.MockAuditWritter, *recorder) {
+	rec := &recorder{started: make(chan struct{}, 100), gate: make(chan struct{})}
+	aw := mymock.NewMockAuditWritter(ctrl)
+	aw.EXPECT().LogEvent(gomock.Any()).DoAndReturn(func(body []byte) error {
+		rec.started <- struct{}{}
+		<-rec.gate
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.written = append(rec.written, string(body))
+		return nil
+	}).AnyTimes()
+	aw.EXPECT().Sync().AnyTimes()
+	return aw, rec
+}
+
+func (rec *recorder) open() {
+	close(rec.gate)
+}
+
+func (rec *recorder) events() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.written
+}
+
+func setup(t *testing.T, ctrl *gomock.Controller) (*mymock.MockMetricsServer, *mymock.MockCounter) {
+	ms := mymock.NewMockMetricsServer(ctrl)
+	gauge := mymock.NewMockGauge(ctrl)
+	gauge.EXPECT().Set(gomock.Any()).AnyTimes()
+	ms.EXPECT().CreateAndRegisterGauge(gomock.Any(), gomock.Any()).Return(gauge).AnyTimes()
+	dropped := mymock.NewMockCounter(ctrl)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_queue_dropped_events_total", gomock.Any()).Return(dropped)
+	writeErrors := mymock.NewMockCounter(ctrl)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_queue_write_errors_total", gomock.Any()).Return(writeErrors)
+	return ms, dropped
+}
+
+func logEvents(t *testing.T, qw interface{ LogEvent([]byte) error }, from int, to int) {
+	for i := from; i <= to; i++ {
+		assert.NoError(t, qw.LogEvent([]byte(fmt.Sprint(i))))
+	}
+}
+
+func Test_WhenEventsLogged_ThenWrittenInOrderBySync(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, _ := setup(t, ctrl)
+	rec.open()
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 10, Overflow: queuewriter.OverflowBlock}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 5)
+	qw.Sync()
+
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, rec.events())
+}
+
+func Test_WhenWrittenLater_ThenEventKeepsItsTimestamp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, _ := setup(t, ctrl)
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 10, Overflow: queuewriter.OverflowBlock}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	// Stamped as the event processor does when the request is received
+	received := "2023-02-04T21:56:41.610688981Z"
+	assert.NoError(t, qw.LogEvent([]byte(`{"request":{"uid":"abc"},"requestReceivedTimestamp":"`+received+`"}`)))
+	time.Sleep(50 * time.Millisecond)
+	rec.open()
+	qw.Sync()
+
+	// The writer formats the event as a real one would
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	assert.NoError(t, err)
+	line, err := formatter.Format([]byte(rec.events()[0]))
+	assert.NoError(t, err)
+	assert.Equal(t, received, gjson.GetBytes(line, "requestReceivedTimestamp").Str)
+}
+
+func Test_WhenQueueFullAndBlocking_ThenWaitsForSpace(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, _ := setup(t, ctrl)
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowBlock}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	// The first event is being written and the second fills the queue
+	logEvents(t, qw, 1, 1)
+	<-rec.started
+	logEvents(t, qw, 2, 2)
+
+	logged := make(chan struct{})
+	go func() {
+		logEvents(t, qw, 3, 3)
+		close(logged)
+	}()
+	select {
+	case <-logged:
+		t.Fatal("logging to a full queue didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rec.open()
+	<-logged
+	qw.Sync()
+	assert.Equal(t, []string{"1", "2", "3"}, rec.events())
+}
+
+func Test_WhenQueueFullAndDroppingNewest_ThenEventRejected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, dropped := setup(t, ctrl)
+	dropped.EXPECT().Inc()
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowDropNewest}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 1)
+	<-rec.started
+	logEvents(t, qw, 2, 2)
+	assert.Error(t, qw.LogEvent([]byte("3")))
+
+	rec.open()
+	qw.Sync()
+	assert.Equal(t, []string{"1", "2"}, rec.events())
+}
+
+func Test_WhenQueueFullAndDroppingOldest_ThenOldestQueuedEventDropped(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, dropped := setup(t, ctrl)
+	dropped.EXPECT().Inc()
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowDropOldest}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 1)
+	<-rec.started
+	logEvents(t, qw, 2, 3)
+
+	rec.open()
+	qw.Sync()
+	assert.Equal(t, []string{"1", "3"}, rec.events())
+}
+
+func Test_WhenQueueFullAndSpilling_ThenSpilledEventsWrittenInOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, _ := setup(t, ctrl)
+	spillDir := t.TempDir()
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowSpillToDisk, SpillDirectory: spillDir}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 1)
+	<-rec.started
+	logEvents(t, qw, 2, 5)
+
+	info, err := os.Stat(path.Join(spillDir, "queue.spill"))
+	assert.NoError(t, err)
+	assert.Greater(t, info.Size(), int64(0))
+
+	rec.open()
+	qw.Sync()
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, rec.events())
+	info, err = os.Stat(path.Join(spillDir, "queue.spill"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func Test_WhenSpillFileFull_ThenEventDropped(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, dropped := setup(t, ctrl)
+	dropped.EXPECT().Inc()
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowSpillToDisk, SpillDirectory: t.TempDir(), SpillMaxBytes: 20}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 1)
+	<-rec.started
+	// Each record is 13 bytes, so only one fits
+	logEvents(t, qw, 2, 3)
+	assert.Error(t, qw.LogEvent([]byte("4")))
+
+	rec.open()
+	qw.Sync()
+	assert.Equal(t, []string{"1", "2", "3"}, rec.events())
+}
+
+func Test_WhenQueueFull_ThenNotReadyUntilItHasSpace(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, dropped := setup(t, ctrl)
+	dropped.EXPECT().Inc()
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowDropNewest}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	health := qw.(auditwritter.HealthReporter)
+	logEvents(t, qw, 1, 1)
+	<-rec.started
+	assert.NoError(t, health.Ready())
+	logEvents(t, qw, 2, 2)
+	assert.Error(t, qw.LogEvent([]byte("3")))
+	assert.Error(t, health.Ready())
+
+	rec.open()
+	qw.Sync()
+	assert.NoError(t, health.Ready())
+}
+
+func Test_WhenSpillFileFull_ThenNotReadyUntilItHasSpace(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, dropped := setup(t, ctrl)
+	dropped.EXPECT().Inc()
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowSpillToDisk, SpillDirectory: t.TempDir(), SpillMaxBytes: 20}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	health := qw.(auditwritter.HealthReporter)
+	logEvents(t, qw, 1, 1)
+	<-rec.started
+	// Spilling to disk still takes events, while there's space
+	logEvents(t, qw, 2, 3)
+	assert.NoError(t, health.Ready())
+	assert.Error(t, qw.LogEvent([]byte("4")))
+	assert.Error(t, health.Ready())
+
+	rec.open()
+	qw.Sync()
+	assert.NoError(t, health.Ready())
+}
+
+func Test_WhenWriteTakesTooLong_ThenNotLive(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	ms, _ := setup(t, ctrl)
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 10, Overflow: queuewriter.OverflowBlock}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	health := qw.(auditwritter.HealthReporter)
+	assert.NoError(t, health.Live(time.Nanosecond))
+	logEvents(t, qw, 1, 1)
+	<-rec.started
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Error(t, health.Live(time.Millisecond))
+	assert.NoError(t, health.Live(time.Hour))
+	rec.open()
+	qw.Sync()
+	assert.NoError(t, health.Live(time.Nanosecond))
+}
+
+func Test_WhenRestartedWithSpilledEvents_ThenTheyAreWritten(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	// Never unblocked, as if the process had been killed
+	stuck, stuckRec := newRecorder(ctrl)
+	ms, _ := setup(t, ctrl)
+	spillDir := t.TempDir()
+
+	qw, err := queuewriter.New(stuck, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowSpillToDisk, SpillDirectory: spillDir}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 1)
+	<-stuckRec.started
+	logEvents(t, qw, 2, 4)
+
+	// Only what was spilled to disk survives the restart
+	aw, rec := newRecorder(ctrl)
+	ms, _ = setup(t, ctrl)
+	rec.open()
+	restarted, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowSpillToDisk, SpillDirectory: spillDir}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	restarted.Sync()
+	assert.Equal(t, []string{"3", "4"}, rec.events())
+}
+
+func Test_WhenRestartedAfterSomeSpilledEventsWritten_ThenOnlyTheRestAreWritten(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	first, firstRec := newRecorder(ctrl)
+	ms, _ := setup(t, ctrl)
+	spillDir := t.TempDir()
+
+	qw, err := queuewriter.New(first, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowSpillToDisk, SpillDirectory: spillDir}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 1)
+	<-firstRec.started
+	logEvents(t, qw, 2, 5)
+	// Let 1, 2 and the first spilled event through, then get stuck on the next
+	for range 3 {
+		firstRec.gate <- struct{}{}
+		<-firstRec.started
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, firstRec.events())
+
+	aw, rec := newRecorder(ctrl)
+	ms, _ = setup(t, ctrl)
+	rec.open()
+	restarted, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowSpillToDisk, SpillDirectory: spillDir}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	restarted.Sync()
+	assert.Equal(t, []string{"4", "5"}, rec.events())
+}
+
+func Test_WhenClosed_ThenQueuedEventsWrittenAndWriterClosed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	aw.EXPECT().Close(gomock.Any()).Return(nil)
+	ms, _ := setup(t, ctrl)
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 10, Overflow: queuewriter.OverflowBlock}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 3)
+	rec.open()
+
+	assert.NoError(t, qw.Close(context.Background()))
+	assert.Equal(t, []string{"1", "2", "3"}, rec.events())
+}
+
+func Test_WhenUsedAfterClose_ThenErrorReturnedWithoutBlocking(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	aw, rec := newRecorder(ctrl)
+	aw.EXPECT().Close(gomock.Any()).Return(nil)
+	ms, _ := setup(t, ctrl)
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowBlock}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	rec.open()
+	assert.NoError(t, qw.Close(context.Background()))
+
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		// More than the queue holds
+		for range 3 {
+			assert.Error(t, qw.LogEvent([]byte("1")))
+		}
+		qw.Sync()
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue writer blocked after it was closed")
+	}
+	assert.Empty(t, rec.events())
+}
+
+func Test_WhenCloseDeadlinePasses_ThenGivesUpAndClosesWriter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	// Never unblocked, so the queue can't drain
+	aw, _ := newRecorder(ctrl)
+	aw.EXPECT().Close(gomock.Any()).Return(nil)
+	ms, _ := setup(t, ctrl)
+
+	qw, err := queuewriter.New(aw, queuewriter.Config{Size: 10, Overflow: queuewriter.OverflowBlock}, ms)
+	if err != nil {
+		t.Fatalf("creating queue writer failed with : %s", err)
+	}
+	logEvents(t, qw, 1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, qw.Close(ctx), context.DeadlineExceeded)
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config queuewriter.Config
+	}{
+		{"no size", queuewriter.Config{Size: 0, Overflow: queuewriter.OverflowBlock}},
+		{"bad overflow", queuewriter.Config{Size: 1, Overflow: "drop-everything"}},
+		{"no spill directory", queuewriter.Config{Size: 1, Overflow: queuewriter.OverflowSpillToDisk}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ms := mymock.NewMockMetricsServer(ctrl)
+			gauge := mymock.NewMockGauge(ctrl)
+			ms.EXPECT().CreateAndRegisterGauge(gomock.Any(), gomock.Any()).Return(gauge).AnyTimes()
+			ms.EXPECT().CreateAndRegisterCounter(gomock.Any(), gomock.Any()).Return(mymock.NewMockCounter(ctrl)).AnyTimes()
+			_, err := queuewriter.New(mymock.NewMockAuditWritter(ctrl), tc.config, ms)
+			assert.Error(t, err)
+		})
+	}
+}
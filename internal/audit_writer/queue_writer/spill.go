@@ -0,0 +1,182 @@
+package queuewriter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+)
+
+const spillFilename = "queue.spill"
+
+// Holds the offset of the first event not written yet, so events written
+// before a restart aren't written again
+const offsetFilename = "queue.spill.offset"
+
+// Each record is the time it was queued in unix nanoseconds and the length
+// of the body, followed by the body
+const recordHeaderSize = 12
+
+// Events that didn't fit in the queue, in the order they were logged.
+// Not safe for concurrent use
+type spillFile struct {
+	file       *os.File
+	offsetFile *os.File
+	readOffset int64
+	// Offset after the last event written, which is saved
+	committedOffset int64
+	writeOffset     int64
+	// Number of events not read yet
+	count    int
+	maxBytes int64
+}
+
+// Events left from a previous run that weren't written are kept, so
+// they're written after a restart
+func openSpillFile(directory string, maxBytes int64) (*spillFile, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	file, err := os.OpenFile(path.Join(directory, spillFilename), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spill file: %w", err)
+	}
+	offsetFile, err := os.OpenFile(path.Join(directory, offsetFilename), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open spill offset file: %w", err)
+	}
+	sf := &spillFile{file: file, offsetFile: offsetFile, maxBytes: maxBytes}
+
+	var saved int64
+	if content, err := io.ReadAll(offsetFile); err == nil && len(content) > 0 {
+		if _, err := fmt.Sscanf(string(content), "%d", &saved); err != nil {
+			saved = -1
+		}
+	}
+
+	// Count the complete records after the saved offset, dropping any
+	// partial record from a crash
+	found := saved == 0
+	for {
+		if sf.writeOffset == saved {
+			found = true
+			sf.readOffset = saved
+			sf.count = 0
+		}
+		header := make([]byte, recordHeaderSize)
+		if _, err := file.ReadAt(header, sf.writeOffset); err != nil {
+			break
+		}
+		next := sf.writeOffset + recordHeaderSize + int64(binary.BigEndian.Uint32(header[8:]))
+		if info, err := file.Stat(); err != nil || next > info.Size() {
+			break
+		}
+		sf.writeOffset = next
+		sf.count++
+	}
+	if !found {
+		common.Logger.Warnw("spill offset doesn't match the spill file, writing every event in it", "offset", saved)
+	}
+	sf.committedOffset = sf.readOffset
+	if sf.count == 0 {
+		err = sf.reset()
+	} else {
+		err = file.Truncate(sf.writeOffset)
+	}
+	if err != nil {
+		sf.close()
+		return nil, fmt.Errorf("failed to truncate spill file: %w", err)
+	}
+	return sf, nil
+}
+
+func (sf *spillFile) pending() bool {
+	return sf != nil && sf.count > 0
+}
+
+func (sf *spillFile) size() int64 {
+	return sf.writeOffset - sf.committedOffset
+}
+
+func (sf *spillFile) append(event queuedEvent) error {
+	recordSize := int64(recordHeaderSize + len(event.body))
+	if sf.maxBytes > 0 && sf.size()+recordSize > sf.maxBytes {
+		return errors.New("spill file is full")
+	}
+
+	record := make([]byte, recordHeaderSize, recordSize)
+	binary.BigEndian.PutUint64(record, uint64(event.enqueued.UnixNano()))
+	binary.BigEndian.PutUint32(record[8:], uint32(len(event.body)))
+	record = append(record, event.body...)
+	if _, err := sf.file.WriteAt(record, sf.writeOffset); err != nil {
+		// Leave the offset alone so the partial record is overwritten
+		return err
+	}
+	sf.writeOffset += recordSize
+	sf.count++
+	return nil
+}
+
+// Must only be called when there are pending events. The event is read
+// again after a restart until it's committed
+func (sf *spillFile) next() (queuedEvent, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := sf.file.ReadAt(header, sf.readOffset); err != nil {
+		return queuedEvent{}, sf.discard(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := sf.file.ReadAt(body, sf.readOffset+recordHeaderSize); err != nil && err != io.EOF {
+		return queuedEvent{}, sf.discard(err)
+	}
+	sf.readOffset += recordHeaderSize + int64(len(body))
+	sf.count--
+	return queuedEvent{body: body, enqueued: time.Unix(0, int64(binary.BigEndian.Uint64(header))), spilled: true}, nil
+}
+
+// Saves that the events read so far have been written
+func (sf *spillFile) commit() error {
+	sf.committedOffset = sf.readOffset
+	// Start again from the beginning once everything has been written
+	if sf.count == 0 {
+		return sf.reset()
+	}
+	return sf.saveOffset()
+}
+
+// Fixed width, so it's always completely overwritten
+func (sf *spillFile) saveOffset() error {
+	_, err := sf.offsetFile.WriteAt(fmt.Appendf(nil, "%020d\n", sf.committedOffset), 0)
+	return err
+}
+
+func (sf *spillFile) close() error {
+	return errors.Join(sf.offsetFile.Sync(), sf.offsetFile.Close(), sf.file.Sync(), sf.file.Close())
+}
+
+// Drops everything in the file after it couldn't be read, so a broken
+// file doesn't stop newer events being written
+func (sf *spillFile) discard(cause error) error {
+	lost := sf.count
+	sf.count = 0
+	if err := sf.reset(); err != nil {
+		return err
+	}
+	return fmt.Errorf("failed to read spill file, dropped %d events: %w", lost, cause)
+}
+
+func (sf *spillFile) reset() error {
+	sf.readOffset = 0
+	sf.committedOffset = 0
+	sf.writeOffset = 0
+	// The offset is saved first, so a crash can't leave it past the end
+	if err := sf.saveOffset(); err != nil {
+		return err
+	}
+	return sf.file.Truncate(0)
+}
@@ -0,0 +1,344 @@
+package spoolwriter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+)
+
+const segmentSuffix = ".wal"
+
+// Each record is the length of the body, a CRC32 of the rest of the record and
+// the time it was spooled in unix nanoseconds, followed by the body
+const recordHeaderSize = 16
+
+var errSpoolFull = errors.New("spool is full")
+
+type segment struct {
+	// Offset of the segment's first record
+	base int64
+	size int64
+}
+
+func (s segment) end() int64 {
+	return s.base + s.size
+}
+
+type record struct {
+	body    []byte
+	spooled time.Time
+}
+
+// An append only log of events split over segment files. Records are addressed
+// by their offset from the start of the first segment ever written, which is
+// also the name of each segment file
+type spool struct {
+	directory       string
+	segmentMaxBytes int64
+	maxBytes        int64
+
+	mu       sync.Mutex
+	segments []segment
+	active   *os.File
+	// Closed and replaced whenever a record is appended
+	appended chan struct{}
+}
+
+func openSpool(directory string, segmentMaxBytes int64, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	s := &spool{
+		directory:       directory,
+		segmentMaxBytes: segmentMaxBytes,
+		maxBytes:        maxBytes,
+		appended:        make(chan struct{}),
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected file %s in spool directory", name)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, segment{base: base, size: info.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].base < s.segments[j].base })
+
+	if len(s.segments) == 0 {
+		s.segments = []segment{{base: 0}}
+	} else if err := s.repairLastSegment(); err != nil {
+		return nil, err
+	}
+
+	last := s.segments[len(s.segments)-1]
+	s.active, err = os.OpenFile(s.segmentPath(last.base), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	return s, nil
+}
+
+// Removes any partly written record left by a crash
+func (s *spool) repairLastSegment() error {
+	last := &s.segments[len(s.segments)-1]
+	file, err := os.Open(s.segmentPath(last.base))
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer file.Close()
+
+	var valid int64
+	for valid < last.size {
+		_, next, err := readRecord(file, valid, last.size)
+		if err != nil {
+			break
+		}
+		valid = next
+	}
+	if valid < last.size {
+		common.Logger.Warnw("removing partly written event from spool", "segment", s.segmentPath(last.base), "bytes", last.size-valid)
+		if err := os.Truncate(s.segmentPath(last.base), valid); err != nil {
+			return fmt.Errorf("failed to repair spool segment: %w", err)
+		}
+		last.size = valid
+	}
+	return nil
+}
+
+func (s *spool) segmentPath(base int64) string {
+	return path.Join(s.directory, fmt.Sprintf("%020d%s", base, segmentSuffix))
+}
+
+// The record is synced to disk before returning
+func (s *spool) append(body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recordSize := int64(recordHeaderSize + len(body))
+	if s.maxBytes > 0 && s.sizeLocked()+recordSize > s.maxBytes {
+		return errSpoolFull
+	}
+	if active := s.segments[len(s.segments)-1]; active.size > 0 && active.size+recordSize > s.segmentMaxBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	rec := make([]byte, recordHeaderSize, recordSize)
+	binary.BigEndian.PutUint32(rec, uint32(len(body)))
+	binary.BigEndian.PutUint64(rec[8:], uint64(time.Now().UnixNano()))
+	rec = append(rec, body...)
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(rec[8:]))
+
+	active := &s.segments[len(s.segments)-1]
+	if _, err := s.active.Write(rec); err != nil {
+		// Don't leave a partial record for the next one to follow
+		s.active.Truncate(active.size)
+		return fmt.Errorf("failed to write to spool: %w", err)
+	}
+	if err := s.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool: %w", err)
+	}
+	active.size += recordSize
+
+	close(s.appended)
+	s.appended = make(chan struct{})
+	return nil
+}
+
+func (s *spool) rotateLocked() error {
+	base := s.segments[len(s.segments)-1].end()
+	file, err := os.OpenFile(s.segmentPath(base), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	s.active.Close()
+	s.active = file
+	s.segments = append(s.segments, segment{base: base})
+	return nil
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active.Close()
+}
+
+// Returns the offset after the last record, and a channel that's closed once
+// another record is appended
+func (s *spool) end() (int64, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.segments[len(s.segments)-1].end(), s.appended
+}
+
+// Returns the offset of the oldest record still on disk
+func (s *spool) start() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.segments[0].base
+}
+
+func (s *spool) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizeLocked()
+}
+
+func (s *spool) sizeLocked() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// Returns the segment the record at offset is in. Offsets of records that
+// have been deleted are moved forward to the oldest record left
+func (s *spool) segmentAt(offset int64) (segment, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segments {
+		if offset < seg.end() {
+			return seg, max(offset, seg.base), true
+		}
+	}
+	return segment{}, offset, false
+}
+
+// Deletes the segments that only contain records before offset, apart from
+// the segment being appended to
+func (s *spool) deleteBefore(offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segments) > 1 && s.segments[0].end() <= offset {
+		if err := os.Remove(s.segmentPath(s.segments[0].base)); err != nil && !os.IsNotExist(err) {
+			common.Logger.Errorw("failed to delete spool segment", "error", err)
+			return
+		}
+		s.segments = s.segments[1:]
+	}
+}
+
+// Reads the record at offset within a segment of the given size, returning it
+// and the offset of the next record
+func readRecord(file *os.File, offset int64, segmentSize int64) (record, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return record{}, 0, err
+	}
+	next := offset + recordHeaderSize + int64(binary.BigEndian.Uint32(header))
+	if next > segmentSize {
+		return record{}, 0, errors.New("record is longer than the segment")
+	}
+	rest := make([]byte, next-offset-8)
+	if _, err := file.ReadAt(rest, offset+8); err != nil {
+		return record{}, 0, err
+	}
+	if crc32.ChecksumIEEE(rest) != binary.BigEndian.Uint32(header[4:]) {
+		return record{}, 0, errors.New("record checksum doesn't match")
+	}
+	return record{
+		body:    rest[8:],
+		spooled: time.Unix(0, int64(binary.BigEndian.Uint64(rest))),
+	}, next, nil
+}
+
+// Reads a spool sequentially, keeping the current segment open
+type spoolReader struct {
+	spool *spool
+	file  *os.File
+	base  int64
+}
+
+// Must only be called for offsets before the end of the spool. Returns the
+// record at offset and the offset of the next one. Corrupt records can't be
+// skipped individually, so the offset of the next segment is returned with
+// the error
+func (r *spoolReader) read(offset int64) (record, int64, error) {
+	seg, offset, ok := r.spool.segmentAt(offset)
+	if !ok {
+		return record{}, offset, errors.New("offset is past the end of the spool")
+	}
+	if r.file == nil || r.base != seg.base {
+		if r.file != nil {
+			r.file.Close()
+		}
+		file, err := os.Open(r.spool.segmentPath(seg.base))
+		if err != nil {
+			r.file = nil
+			return record{}, seg.end(), fmt.Errorf("failed to open spool segment: %w", err)
+		}
+		r.file = file
+		r.base = seg.base
+	}
+
+	rec, next, err := readRecord(r.file, offset-seg.base, seg.size)
+	if err != nil {
+		return record{}, seg.end(), err
+	}
+	return rec, seg.base + next, nil
+}
+
+func checkpointPath(directory string, sink string) string {
+	return path.Join(directory, sink+".checkpoint")
+}
+
+// Returns false if the sink hasn't been checkpointed before
+func readCheckpoint(directory string, sink string) (int64, bool, error) {
+	content, err := os.ReadFile(checkpointPath(directory, sink))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid checkpoint for %s: %w", sink, err)
+	}
+	return offset, true, nil
+}
+
+// Replaces the checkpoint atomically, so a crash leaves the old or new one
+func writeCheckpoint(directory string, sink string, offset int64) error {
+	tmp, err := os.CreateTemp(directory, sink+".checkpoint.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatInt(offset, 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), checkpointPath(directory, sink))
+}
@@ -0,0 +1,311 @@
+package spoolwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+)
+
+// Longest time to wait before sending events again after a sink failed to deliver them
+const maxReplayBackoff = 30 * time.Second
+
+type Sink struct {
+	// Names the sink's checkpoint file and is the sink label of the metrics
+	Name   string
+	Writer auditwritter.AuditWritter
+}
+
+type Config struct {
+	Directory string
+	// A new segment file is started once the current one reaches this size
+	SegmentMaxBytes int64
+	// Events are rejected once the spool is this big, 0 means no limit
+	MaxBytes int64
+	// How often each sink's progress is saved. Sinks are flushed first, so
+	// shorter intervals mean smaller batches for sinks that batch events
+	CheckpointInterval time.Duration
+}
+
+type spoolWritter struct {
+	spool      *spool
+	readers    []*sinkReader
+	spoolBytes metrics.Gauge
+	rejected   metrics.Counter
+	// Closed to make the readers send everything spooled and stop
+	closing chan struct{}
+}
+
+type sinkReader struct {
+	name      string
+	writer    auditwritter.AuditWritter
+	reader    spoolReader
+	directory string
+	interval  time.Duration
+	// Called after each checkpoint is saved
+	checkpointed func()
+	closing      <-chan struct{}
+	// Closed once every spooled event has been delivered after closing
+	stopped chan struct{}
+
+	// Offset of the first event not known to be delivered
+	checkpoint atomic.Int64
+	// When the first event not known to be delivered was spooled in unix
+	// nanoseconds, or 0 if every event read so far has been delivered
+	oldestUnsent  atomic.Int64
+	replayBackoff time.Duration
+
+	oldestUnsentAge metrics.Gauge
+	replays         metrics.Counter
+}
+
+// Events are appended to the spool before LogEvent returns, then written to
+// each sink in the background. The spool directory should be on a persistent
+// volume, so events that weren't delivered before a restart are sent after it
+func New(config Config, sinks []Sink, metricsServer metrics.MetricsServer) (auditwritter.AuditWritter, error) {
+	if config.Directory == "" {
+		return nil, errors.New("a spool directory is required")
+	}
+	if config.SegmentMaxBytes < 1 {
+		return nil, errors.New("the spool segment size must be at least 1 byte")
+	}
+	if config.CheckpointInterval <= 0 {
+		return nil, errors.New("the spool checkpoint interval must be positive")
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("at least one sink is required")
+	}
+
+	s, err := openSpool(config.Directory, config.SegmentMaxBytes, config.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	sw := &spoolWritter{
+		spool:   s,
+		closing: make(chan struct{}),
+		spoolBytes: metricsServer.CreateAndRegisterGauge(
+			"kube_audit_rest_spool_bytes",
+			"Size of the spool on disk",
+		),
+		rejected: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_spool_rejected_events_total",
+			"Total number of events rejected because the spool was full",
+		),
+	}
+	oldestUnsentAge := metricsServer.CreateAndRegisterGaugeVec(
+		"kube_audit_rest_spool_oldest_unsent_age_seconds",
+		"Age of the oldest event each sink hasn't delivered yet",
+		[]string{"sink"},
+	)
+	replays := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_spool_replays_total",
+		"Total number of times a sink failed to deliver events, so they were sent again",
+		[]string{"sink"},
+	)
+
+	end, _ := s.end()
+	names := map[string]bool{}
+	for _, sink := range sinks {
+		if names[sink.Name] {
+			return nil, fmt.Errorf("sink %q is configured more than once", sink.Name)
+		}
+		names[sink.Name] = true
+
+		checkpoint, found, err := readCheckpoint(config.Directory, sink.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			// Send everything still spooled to a new sink
+			checkpoint = s.start()
+		}
+		if checkpoint > end {
+			common.Logger.Warnw("spool checkpoint is past the end of the spool, skipping to the end", "sink", sink.Name, "checkpoint", checkpoint, "end", end)
+			checkpoint = end
+		}
+		if checkpoint < end {
+			common.Logger.Infow("sending spooled events that weren't delivered before restarting", "sink", sink.Name, "bytes", end-checkpoint)
+		}
+
+		r := &sinkReader{
+			name:            sink.Name,
+			writer:          sink.Writer,
+			reader:          spoolReader{spool: s},
+			directory:       config.Directory,
+			interval:        config.CheckpointInterval,
+			checkpointed:    sw.deleteDelivered,
+			closing:         sw.closing,
+			stopped:         make(chan struct{}),
+			oldestUnsentAge: oldestUnsentAge.WithLabelValues(sink.Name),
+			replays:         replays.WithLabelValues(sink.Name),
+		}
+		r.checkpoint.Store(checkpoint)
+		sw.readers = append(sw.readers, r)
+	}
+
+	for _, r := range sw.readers {
+		go r.run()
+	}
+	go sw.reportMetrics()
+	return sw, nil
+}
+
+func (sw *spoolWritter) LogEvent(body []byte) error {
+	if err := sw.spool.append(body); err != nil {
+		if errors.Is(err, errSpoolFull) {
+			sw.rejected.Inc()
+		}
+		return err
+	}
+	return nil
+}
+
+// Events are synced to disk as they're logged, and any that haven't been
+// delivered are sent after a restart, so there's nothing to wait for
+func (sw *spoolWritter) Sync() {}
+
+// Waits for every sink to deliver everything spooled, then closes the sinks.
+// Events that aren't delivered in time stay spooled for the next start
+func (sw *spoolWritter) Close(ctx context.Context) error {
+	end, _ := sw.spool.end()
+	close(sw.closing)
+	for _, r := range sw.readers {
+		pending := end - r.checkpoint.Load()
+		select {
+		case <-r.stopped:
+			common.Logger.Infow("flushed spooled events", "sink", r.name, "bytes", pending)
+		case <-ctx.Done():
+			return fmt.Errorf("gave up sending spooled events to %s, they'll be sent after restarting: %w", r.name, ctx.Err())
+		}
+	}
+
+	var errs []error
+	for _, r := range sw.readers {
+		if err := r.writer.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s: %w", r.name, err))
+		}
+	}
+	errs = append(errs, sw.spool.close())
+	return errors.Join(errs...)
+}
+
+func (sw *spoolWritter) deleteDelivered() {
+	oldest := sw.readers[0].checkpoint.Load()
+	for _, r := range sw.readers[1:] {
+		oldest = min(oldest, r.checkpoint.Load())
+	}
+	sw.spool.deleteBefore(oldest)
+}
+
+func (sw *spoolWritter) reportMetrics() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-sw.closing:
+			return
+		}
+		sw.spoolBytes.Set(float64(sw.spool.size()))
+		for _, r := range sw.readers {
+			age := 0.0
+			if oldest := r.oldestUnsent.Load(); oldest != 0 {
+				age = time.Since(time.Unix(0, oldest)).Seconds()
+			}
+			r.oldestUnsentAge.Set(age)
+		}
+	}
+}
+
+func (r *sinkReader) run() {
+	offset := r.checkpoint.Load()
+	lastCheckpoint := time.Now()
+	for {
+		end, appended := r.reader.spool.end()
+		if offset >= end {
+			select {
+			case <-r.closing:
+				if offset != r.checkpoint.Load() {
+					offset = r.commit(offset)
+				}
+				// Carry on if the sink failed and the events have to be sent again
+				if offset >= end {
+					close(r.stopped)
+					return
+				}
+				continue
+			default:
+			}
+			if offset == r.checkpoint.Load() {
+				select {
+				case <-appended:
+				case <-r.closing:
+				}
+				continue
+			}
+			// Give more events the chance to arrive before checkpointing,
+			// so sinks that batch events aren't flushed after every event
+			select {
+			case <-appended:
+				continue
+			case <-r.closing:
+				continue
+			case <-time.After(r.interval - time.Since(lastCheckpoint)):
+			}
+			offset = r.commit(offset)
+			lastCheckpoint = time.Now()
+			continue
+		}
+
+		rec, next, err := r.reader.read(offset)
+		if err != nil {
+			common.Logger.Errorw("skipping unreadable events in spool", "sink", r.name, "offset", offset, "next", next, "error", err)
+			offset = next
+			continue
+		}
+		r.oldestUnsent.CompareAndSwap(0, rec.spooled.UnixNano())
+		// Only events that can never be written are rejected here, so don't retry them
+		if err := r.writer.LogEvent(rec.body); err != nil {
+			common.Logger.Errorw("failed to write spooled event", "sink", r.name, "error", err)
+		}
+		offset = next
+
+		if time.Since(lastCheckpoint) >= r.interval {
+			offset = r.commit(offset)
+			lastCheckpoint = time.Now()
+		}
+	}
+}
+
+// Saves the sink's progress once the events before offset are delivered.
+// Returns the offset to carry on reading from, which is the last checkpoint
+// if the events have to be sent again
+func (r *sinkReader) commit(offset int64) int64 {
+	if flusher, ok := r.writer.(auditwritter.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			r.replayBackoff = min(max(2*r.replayBackoff, time.Second), maxReplayBackoff)
+			common.Logger.Warnw("sink failed to deliver spooled events, sending them again", "sink", r.name, "backoff", r.replayBackoff, "error", err)
+			r.replays.Inc()
+			r.oldestUnsent.Store(0)
+			time.Sleep(r.replayBackoff)
+			return r.checkpoint.Load()
+		}
+	} else {
+		r.writer.Sync()
+	}
+	r.replayBackoff = 0
+
+	if err := writeCheckpoint(r.directory, r.name, offset); err != nil {
+		// Carry on, at worst the events will be sent again after a restart
+		common.Logger.Errorw("failed to save spool checkpoint", "sink", r.name, "error", err)
+	}
+	r.checkpoint.Store(offset)
+	r.oldestUnsent.Store(0)
+	r.checkpointed()
+	return offset
+}
@@ -0,0 +1,309 @@
+package spoolwriter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	spoolwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/spool_writer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+// Records the events written to the mock writer
+type recorder struct {
+	mu      sync.Mutex
+	written []string
+}
+
+func (rec *recorder) record(body []byte) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.written = append(rec.written, string(body))
+	return nil
+}
+
+func (rec *recorder) events() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string{}, rec.written...)
+}
+
+func newRecorder(ctrl *gomock.Controller) (*mymock.MockAuditWritter, *recorder) {
+	rec := &recorder{}
+	aw := mymock.NewMockAuditWritter(ctrl)
+	aw.EXPECT().LogEvent(gomock.Any()).DoAndReturn(rec.record).AnyTimes()
+	aw.EXPECT().Sync().AnyTimes()
+	return aw, rec
+}
+
+// A sink that batches events, so reports delivery failures when flushed
+type flushingWriter struct {
+	*mymock.MockAuditWritter
+	*mymock.MockFlusher
+}
+
+// Returns the rejected events counter and the replays counter
+func setup(ctrl *gomock.Controller) (*mymock.MockMetricsServer, *mymock.MockCounter, *mymock.MockCounter) {
+	ms := mymock.NewMockMetricsServer(ctrl)
+	gauge := mymock.NewMockGauge(ctrl)
+	gauge.EXPECT().Set(gomock.Any()).AnyTimes()
+	ms.EXPECT().CreateAndRegisterGauge("kube_audit_rest_spool_bytes", gomock.Any()).Return(gauge).AnyTimes()
+	gaugeVec := mymock.NewMockGaugeVec(ctrl)
+	gaugeVec.EXPECT().WithLabelValues(gomock.Any()).Return(gauge).AnyTimes()
+	ms.EXPECT().CreateAndRegisterGaugeVec("kube_audit_rest_spool_oldest_unsent_age_seconds", gomock.Any(), []string{"sink"}).Return(gaugeVec).AnyTimes()
+	rejected := mymock.NewMockCounter(ctrl)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_spool_rejected_events_total", gomock.Any()).Return(rejected).AnyTimes()
+	replays := mymock.NewMockCounter(ctrl)
+	counterVec := mymock.NewMockCounterVec(ctrl)
+	counterVec.EXPECT().WithLabelValues(gomock.Any()).Return(replays).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_spool_replays_total", gomock.Any(), []string{"sink"}).Return(counterVec).AnyTimes()
+	return ms, rejected, replays
+}
+
+func newConfig(directory string) spoolwriter.Config {
+	return spoolwriter.Config{
+		Directory:          directory,
+		SegmentMaxBytes:    1024 * 1024,
+		CheckpointInterval: 10 * time.Millisecond,
+	}
+}
+
+func logEvents(t *testing.T, sw auditwritter.AuditWritter, from int, to int) {
+	for i := from; i <= to; i++ {
+		assert.NoError(t, sw.LogEvent([]byte(fmt.Sprint(i))))
+	}
+}
+
+func readCheckpoint(t *testing.T, directory string, sink string) int64 {
+	content, err := os.ReadFile(path.Join(directory, sink+".checkpoint"))
+	if err != nil {
+		return -1
+	}
+	offset, err := strconv.ParseInt(string(content), 10, 64)
+	assert.NoError(t, err)
+	return offset
+}
+
+func segments(t *testing.T, directory string) []string {
+	matches, err := filepath.Glob(path.Join(directory, "*.wal"))
+	assert.NoError(t, err)
+	return matches
+}
+
+func Test_WhenEventsLogged_ThenDeliveredToEachSinkAndCheckpointed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	kafka, kafkaRec := newRecorder(ctrl)
+	http, httpRec := newRecorder(ctrl)
+	ms, _, _ := setup(ctrl)
+	directory := t.TempDir()
+
+	sw, err := spoolwriter.New(newConfig(directory), []spoolwriter.Sink{{Name: "kafka", Writer: kafka}, {Name: "http", Writer: http}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	logEvents(t, sw, 1, 3)
+
+	expected := []string{"1", "2", "3"}
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expected, kafkaRec.events()) && assert.ObjectsAreEqual(expected, httpRec.events())
+	}, 5*time.Second, 5*time.Millisecond)
+	// Each record is a 16 byte header and a 1 byte body
+	assert.Eventually(t, func() bool {
+		return readCheckpoint(t, directory, "kafka") == 51 && readCheckpoint(t, directory, "http") == 51
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func Test_WhenRestarted_ThenUndeliveredEventsSentAndPartialRecordRemoved(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	directory := t.TempDir()
+	ms, _, _ := setup(ctrl)
+
+	// The first two events were delivered before the restart, the last one
+	// wasn't and a crash left part of a fourth behind
+	config := newConfig(directory)
+	config.CheckpointInterval = time.Hour
+	stuck := mymock.NewMockAuditWritter(ctrl)
+	stuck.EXPECT().LogEvent(gomock.Any()).Return(nil).AnyTimes()
+	sw, err := spoolwriter.New(config, []spoolwriter.Sink{{Name: "http", Writer: stuck}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	logEvents(t, sw, 1, 3)
+	assert.NoError(t, os.WriteFile(path.Join(directory, "http.checkpoint"), []byte("34"), 0600))
+	segment, err := os.OpenFile(segments(t, directory)[0], os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	segment.Write([]byte{0, 0, 0, 1, 2, 3})
+	segment.Close()
+
+	aw, rec := newRecorder(ctrl)
+	restarted, err := spoolwriter.New(newConfig(directory), []spoolwriter.Sink{{Name: "http", Writer: aw}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	logEvents(t, restarted, 4, 4)
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"3", "4"}, rec.events())
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func Test_WhenSinkFailsToDeliver_ThenEventsSentAgain(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, _, replays := setup(ctrl)
+	replayed := make(chan struct{})
+	replays.EXPECT().Inc().Do(func() { close(replayed) })
+
+	rec := &recorder{}
+	fw := flushingWriter{mymock.NewMockAuditWritter(ctrl), mymock.NewMockFlusher(ctrl)}
+	fw.MockAuditWritter.EXPECT().LogEvent(gomock.Any()).DoAndReturn(rec.record).AnyTimes()
+	gomock.InOrder(
+		fw.MockFlusher.EXPECT().Flush().Return(errors.New("collector unavailable")),
+		fw.MockFlusher.EXPECT().Flush().Return(nil).AnyTimes(),
+	)
+
+	sw, err := spoolwriter.New(newConfig(t.TempDir()), []spoolwriter.Sink{{Name: "http", Writer: fw}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	logEvents(t, sw, 1, 2)
+
+	<-replayed
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"1", "2", "1", "2"}, rec.events())
+	}, 5*time.Second, 5*time.Millisecond)
+}
+
+func Test_WhenReplayedLater_ThenEventKeepsItsTimestamp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	directory := t.TempDir()
+	ms, _, _ := setup(ctrl)
+
+	config := newConfig(directory)
+	config.CheckpointInterval = time.Hour
+	stuck := mymock.NewMockAuditWritter(ctrl)
+	stuck.EXPECT().LogEvent(gomock.Any()).Return(nil).AnyTimes()
+	sw, err := spoolwriter.New(config, []spoolwriter.Sink{{Name: "http", Writer: stuck}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	// Stamped as the event processor does when the request is received
+	received := time.Now().Format(time.RFC3339Nano)
+	assert.NoError(t, sw.LogEvent([]byte(`{"request":{"uid":"abc"},"requestReceivedTimestamp":"`+received+`"}`)))
+	time.Sleep(50 * time.Millisecond)
+
+	// The sink formats the replayed event as a real writer would
+	formatter, err := commonwriter.NewFormatter(commonwriter.FormatAuditEvent, commonwriter.AuditLevelMetadata)
+	assert.NoError(t, err)
+	aw, rec := newRecorder(ctrl)
+	_, err = spoolwriter.New(newConfig(directory), []spoolwriter.Sink{{Name: "http", Writer: aw}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	assert.Eventually(t, func() bool {
+		return len(rec.events()) == 1
+	}, 5*time.Second, 5*time.Millisecond)
+
+	line, err := formatter.Format([]byte(rec.events()[0]))
+	assert.NoError(t, err)
+	stamp, err := time.Parse(time.RFC3339Nano, received)
+	assert.NoError(t, err)
+	expected := stamp.UTC().Format("2006-01-02T15:04:05.000000Z")
+	assert.Equal(t, expected, gjson.GetBytes(line, "requestReceivedTimestamp").Str)
+	assert.Equal(t, expected, gjson.GetBytes(line, "stageTimestamp").Str)
+}
+
+func Test_WhenSpoolFull_ThenEventRejected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, rejected, _ := setup(ctrl)
+	rejected.EXPECT().Inc()
+
+	config := newConfig(t.TempDir())
+	// Only two 17 byte records fit, and the sink never checkpoints
+	config.MaxBytes = 40
+	config.CheckpointInterval = time.Hour
+	aw, _ := newRecorder(ctrl)
+	sw, err := spoolwriter.New(config, []spoolwriter.Sink{{Name: "http", Writer: aw}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	logEvents(t, sw, 1, 2)
+	assert.Error(t, sw.LogEvent([]byte("3")))
+}
+
+func Test_WhenSegmentsDelivered_ThenDeleted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, _, _ := setup(ctrl)
+	directory := t.TempDir()
+
+	config := newConfig(directory)
+	// Each record gets its own segment
+	config.SegmentMaxBytes = 20
+	aw, rec := newRecorder(ctrl)
+	sw, err := spoolwriter.New(config, []spoolwriter.Sink{{Name: "http", Writer: aw}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	logEvents(t, sw, 1, 5)
+
+	assert.Eventually(t, func() bool {
+		return len(rec.events()) == 5 && len(segments(t, directory)) == 1
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.True(t, strings.HasSuffix(segments(t, directory)[0], "00000000000000000068.wal"))
+}
+
+func Test_WhenClosed_ThenSpooledEventsDeliveredAndCheckpointed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms, _, _ := setup(ctrl)
+	directory := t.TempDir()
+
+	config := newConfig(directory)
+	config.CheckpointInterval = time.Hour
+	aw, rec := newRecorder(ctrl)
+	aw.EXPECT().Close(gomock.Any()).Return(nil)
+	sw, err := spoolwriter.New(config, []spoolwriter.Sink{{Name: "http", Writer: aw}}, ms)
+	if err != nil {
+		t.Fatalf("creating spool writer failed with : %s", err)
+	}
+	logEvents(t, sw, 1, 3)
+
+	assert.NoError(t, sw.Close(context.Background()))
+	assert.Equal(t, []string{"1", "2", "3"}, rec.events())
+	assert.Equal(t, int64(51), readCheckpoint(t, directory, "http"))
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(*spoolwriter.Config, *[]spoolwriter.Sink)
+	}{
+		{"no directory", func(c *spoolwriter.Config, _ *[]spoolwriter.Sink) { c.Directory = "" }},
+		{"no segment size", func(c *spoolwriter.Config, _ *[]spoolwriter.Sink) { c.SegmentMaxBytes = 0 }},
+		{"no checkpoint interval", func(c *spoolwriter.Config, _ *[]spoolwriter.Sink) { c.CheckpointInterval = 0 }},
+		{"no sinks", func(_ *spoolwriter.Config, s *[]spoolwriter.Sink) { *s = nil }},
+		{"duplicate sink", func(_ *spoolwriter.Config, s *[]spoolwriter.Sink) { *s = append(*s, (*s)[0]) }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			ms, _, _ := setup(ctrl)
+			config := newConfig(t.TempDir())
+			sinks := []spoolwriter.Sink{{Name: "http", Writer: mymock.NewMockAuditWritter(ctrl)}}
+			tc.modify(&config, &sinks)
+			_, err := spoolwriter.New(config, sinks, ms)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package stderrwriter
 
 import (
+	"context"
 	"log"
 
 	auditwritter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
@@ -10,22 +11,28 @@ import (
 )
 
 type stderrWritter struct {
-	writer *zapio.Writer
+	writer    *zapio.Writer
+	formatter *commonwriter.Formatter
 }
 
-func New() auditwritter.AuditWritter {
+func New(formatter *commonwriter.Formatter) auditwritter.AuditWritter {
 	lg, err := zap.NewProduction()
 	if err != nil {
 		log.Fatalf("can't initialize zap logger: %v", err)
 	}
 	writer := &zapio.Writer{Log: lg, Level: zap.InfoLevel}
-	return &stderrWritter{writer: writer}
+	return &stderrWritter{writer: writer, formatter: formatter}
 }
 
-func (w *stderrWritter) LogEvent(body []byte) {
-	commonwriter.LogEvent(body, w.writer)
+func (w *stderrWritter) LogEvent(body []byte) error {
+	return w.formatter.LogEvent(body, w.writer)
 }
 
 func (w *stderrWritter) Sync() {
 	w.writer.Sync()
 }
+
+func (w *stderrWritter) Close(ctx context.Context) error {
+	// Flushes any partly written line
+	return w.writer.Close()
+}
@@ -3,11 +3,13 @@ package stderrwriter_test
 import (
 	"testing"
 
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
 	stderrwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/stderr_writer"
 )
 
 func Test_WhenWritingEvent_ThenSucceeds(t *testing.T) {
-	writer := stderrwriter.New()
+	formatter, _ := commonwriter.NewFormatter(commonwriter.FormatAdmissionReview, "")
+	writer := stderrwriter.New(formatter)
 	event := "{\"testEvent\": \"test\"}"
 	writer.LogEvent([]byte(event))
 }
@@ -0,0 +1,125 @@
+package directoryblobstore
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	blobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store"
+)
+
+type directoryBlobStore struct {
+	directory string
+}
+
+// Blobs are stored as <directory>/sha256/<first two characters>/<digest>,
+// so no directory gets too large. Whether a blob is used is tracked by its
+// modification time
+func New(directory string) (blobstore.BlobStore, error) {
+	if directory == "" {
+		return nil, errors.New("a blob directory is required")
+	}
+	if err := os.MkdirAll(filepath.Join(directory, "sha256"), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &directoryBlobStore{directory: directory}, nil
+}
+
+func (ds *directoryBlobStore) Put(ctx context.Context, digest string, body []byte) (bool, error) {
+	if len(digest) != 64 || !isHex(digest) {
+		return false, fmt.Errorf("invalid blob digest %q", digest)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	blobPath := filepath.Join(ds.directory, "sha256", digest[:2], digest)
+	// A blob of the wrong size was cut short, e.g. by a crash, so it's
+	// written again
+	if info, err := os.Stat(blobPath); err == nil && info.Size() == int64(len(body)) {
+		now := time.Now()
+		if err := os.Chtimes(blobPath, now, now); err != nil {
+			return false, fmt.Errorf("failed to mark blob as used: %w", err)
+		}
+		return false, nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("failed to check blob: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0700); err != nil {
+		return false, err
+	}
+	// Written then renamed, so a blob is never seen partly written
+	tmp, err := os.CreateTemp(filepath.Dir(blobPath), digest+".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	_, writeErr := tmp.Write(body)
+	syncErr := tmp.Sync()
+	closeErr := tmp.Close()
+	if err := errors.Join(writeErr, syncErr, closeErr); err != nil {
+		os.Remove(tmp.Name())
+		return false, fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	if err := syncDir(filepath.Dir(blobPath)); err != nil {
+		return false, fmt.Errorf("failed to sync blob directory: %w", err)
+	}
+	return true, nil
+}
+
+// So a rename survives a crash
+func syncDir(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	return errors.Join(dir.Sync(), dir.Close())
+}
+
+// Temporary files left by a crash are deleted too, but aren't counted
+func (ds *directoryBlobStore) Sweep(ctx context.Context, before time.Time) (int, error) {
+	swept := 0
+	err := filepath.WalkDir(filepath.Join(ds.directory, "sha256"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if !strings.Contains(entry.Name(), ".tmp-") {
+			swept++
+		}
+		return nil
+	})
+	return swept, err
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
@@ -0,0 +1,117 @@
+package directoryblobstore_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	directoryblobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store/directory_blob_store"
+	"github.com/stretchr/testify/assert"
+)
+
+func digest(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_WhenPut_ThenStoredUnderDigest(t *testing.T) {
+	directory := t.TempDir()
+	bs, err := directoryblobstore.New(directory)
+	if err != nil {
+		t.Fatalf("creating directory blob store failed with : %s", err)
+	}
+	body := `{"kind":"ConfigMap"}`
+
+	stored, err := bs.Put(context.Background(), digest(body), []byte(body))
+
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	content, err := os.ReadFile(filepath.Join(directory, "sha256", digest(body)[:2], digest(body)))
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(content))
+}
+
+func Test_WhenPutTwice_ThenStoredOnceAndMarkedAsUsed(t *testing.T) {
+	directory := t.TempDir()
+	bs, err := directoryblobstore.New(directory)
+	if err != nil {
+		t.Fatalf("creating directory blob store failed with : %s", err)
+	}
+	body := `{"kind":"ConfigMap"}`
+	blobPath := filepath.Join(directory, "sha256", digest(body)[:2], digest(body))
+	_, err = bs.Put(context.Background(), digest(body), []byte(body))
+	assert.NoError(t, err)
+	old := time.Now().Add(-48 * time.Hour)
+	assert.NoError(t, os.Chtimes(blobPath, old, old))
+
+	stored, err := bs.Put(context.Background(), digest(body), []byte(body))
+
+	assert.NoError(t, err)
+	assert.False(t, stored)
+	info, err := os.Stat(blobPath)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), info.ModTime(), time.Minute)
+}
+
+func Test_WhenStoredBlobCutShort_ThenWrittenAgain(t *testing.T) {
+	directory := t.TempDir()
+	bs, err := directoryblobstore.New(directory)
+	if err != nil {
+		t.Fatalf("creating directory blob store failed with : %s", err)
+	}
+	body := `{"kind":"ConfigMap"}`
+	blobPath := filepath.Join(directory, "sha256", digest(body)[:2], digest(body))
+	_, err = bs.Put(context.Background(), digest(body), []byte(body))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(blobPath, 5))
+
+	stored, err := bs.Put(context.Background(), digest(body), []byte(body))
+
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	content, err := os.ReadFile(blobPath)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(content))
+}
+
+func Test_WhenSwept_ThenOnlyUnusedBlobsDeleted(t *testing.T) {
+	directory := t.TempDir()
+	bs, err := directoryblobstore.New(directory)
+	if err != nil {
+		t.Fatalf("creating directory blob store failed with : %s", err)
+	}
+	unused, used := `{"name":"unused"}`, `{"name":"used"}`
+	for _, body := range []string{unused, used} {
+		_, err := bs.Put(context.Background(), digest(body), []byte(body))
+		assert.NoError(t, err)
+	}
+	unusedPath := filepath.Join(directory, "sha256", digest(unused)[:2], digest(unused))
+	old := time.Now().Add(-48 * time.Hour)
+	assert.NoError(t, os.Chtimes(unusedPath, old, old))
+	leftover := filepath.Join(directory, "sha256", digest(unused)[:2], digest(unused)+".tmp-123")
+	assert.NoError(t, os.WriteFile(leftover, nil, 0600))
+	assert.NoError(t, os.Chtimes(leftover, old, old))
+
+	swept, err := bs.Sweep(context.Background(), time.Now().Add(-24*time.Hour))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, swept)
+	assert.NoFileExists(t, unusedPath)
+	assert.NoFileExists(t, leftover)
+	assert.FileExists(t, filepath.Join(directory, "sha256", digest(used)[:2], digest(used)))
+}
+
+func Test_WhenDigestInvalid_ThenErrorReturned(t *testing.T) {
+	bs, err := directoryblobstore.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("creating directory blob store failed with : %s", err)
+	}
+
+	_, err = bs.Put(context.Background(), "../../etc/passwd", []byte("{}"))
+
+	assert.Error(t, err)
+}
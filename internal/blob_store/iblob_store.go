@@ -0,0 +1,20 @@
+// Package blobstore provides the interfaces to store large objects outside
+// of the events that contain them
+package blobstore
+
+//go:generate mockgen -package mymock -destination ../../mocks/blob_store_mock.go github.com/RichardoC/kube-audit-rest/internal/blob_store BlobStore
+
+import (
+	"context"
+	"time"
+)
+
+type BlobStore interface {
+	// Stores body under digest, the hex SHA-256 of body. If it's already
+	// stored it's marked as used instead, so it isn't swept. Returns whether
+	// the body was newly stored
+	Put(ctx context.Context, digest string, body []byte) (bool, error)
+	// Deletes the blobs that haven't been stored or used since before,
+	// returning how many were deleted. Stops early once ctx is done
+	Sweep(ctx context.Context, before time.Time) (int, error)
+}
@@ -0,0 +1,111 @@
+package s3blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	blobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/minio/minio-go/v7"
+)
+
+// Blobs are only marked as used again once this old, so storing the same
+// body repeatedly doesn't copy it every time. Retention must be longer
+const refreshAfter = time.Hour
+
+// User metadata updated when a blob is marked as used, as S3 can't copy an
+// object onto itself without changing something
+const usedMetadata = "Used"
+
+type Config struct {
+	common.S3ClientConfig
+	Bucket string
+	// Prepended to every object key, optional
+	Prefix string
+}
+
+type s3BlobStore struct {
+	config Config
+	client *minio.Client
+}
+
+// Blobs are stored as <prefix>/sha256/<digest>. Whether a blob is used is
+// tracked by its last modified time, which is updated by copying the blob
+// onto itself
+func New(config Config) (blobstore.BlobStore, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("an s3 bucket is required for blobs")
+	}
+	client, err := common.NewS3Client(config.S3ClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobStore{config: config, client: client}, nil
+}
+
+func (ss *s3BlobStore) key(digest string) string {
+	return path.Join(ss.config.Prefix, "sha256", digest)
+}
+
+func (ss *s3BlobStore) Put(ctx context.Context, digest string, body []byte) (bool, error) {
+	key := ss.key(digest)
+	info, err := ss.client.StatObject(ctx, ss.config.Bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		if time.Since(info.LastModified) < refreshAfter {
+			return false, nil
+		}
+		_, err := ss.client.CopyObject(ctx,
+			minio.CopyDestOptions{
+				Bucket:          ss.config.Bucket,
+				Object:          key,
+				ReplaceMetadata: true,
+				UserMetadata:    map[string]string{usedMetadata: time.Now().UTC().Format(time.RFC3339)},
+			},
+			minio.CopySrcOptions{Bucket: ss.config.Bucket, Object: key},
+		)
+		if err != nil {
+			return false, fmt.Errorf("failed to mark blob as used: %w", err)
+		}
+		return false, nil
+	}
+	if minio.ToErrorResponse(err).StatusCode != http.StatusNotFound {
+		return false, fmt.Errorf("failed to check for blob: %w", err)
+	}
+
+	_, err = ss.client.PutObject(ctx, ss.config.Bucket, key, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{
+		ContentType:    "application/json",
+		SendContentMd5: true,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to upload blob: %w", err)
+	}
+	return true, nil
+}
+
+func (ss *s3BlobStore) Sweep(ctx context.Context, before time.Time) (int, error) {
+	swept := 0
+	objects := ss.client.ListObjects(ctx, ss.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    ss.key("") + "/",
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return swept, fmt.Errorf("failed to list blobs: %w", object.Err)
+		}
+		// Skip folder placeholders, which some S3 compatible APIs list
+		if strings.HasSuffix(object.Key, "/") || !object.LastModified.Before(before) {
+			continue
+		}
+		if err := ss.client.RemoveObject(ctx, ss.config.Bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			return swept, fmt.Errorf("failed to delete blob: %w", err)
+		}
+		swept++
+	}
+	return swept, nil
+}
@@ -0,0 +1,148 @@
+package s3blobstore_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	blobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store"
+	s3blobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store/s3_blob_store"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+)
+
+const bucket = "blobs"
+
+// The fake S3's clock starts at started, and can be moved forward without
+// requests being rejected for being signed at the wrong time
+func setup(t *testing.T, started time.Time) (blobstore.BlobStore, gofakes3.Backend, gofakes3.TimeSourceAdvancer) {
+	clock := gofakes3.FixedTimeSource(started)
+	backend := s3mem.New(s3mem.WithTimeSource(clock))
+	assert.NoError(t, backend.CreateBucket(bucket))
+	fake := gofakes3.New(backend, gofakes3.WithTimeSource(clock), gofakes3.WithTimeSkewLimit(0)).Server()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The fake treats the empty delimiter of a recursive listing as a
+		// delimiter, rather than none
+		query := r.URL.Query()
+		if query.Has("delimiter") && query.Get("delimiter") == "" {
+			query.Del("delimiter")
+			r.URL.RawQuery = query.Encode()
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	directory := t.TempDir()
+	accessKey := path.Join(directory, "access-key")
+	secretKey := path.Join(directory, "secret-key")
+	os.WriteFile(accessKey, []byte("access\n"), 0600)
+	os.WriteFile(secretKey, []byte("secret\n"), 0600)
+	bs, err := s3blobstore.New(s3blobstore.Config{
+		S3ClientConfig: common.S3ClientConfig{
+			Endpoint:          strings.TrimPrefix(server.URL, "http://"),
+			Region:            "us-east-1",
+			AccessKeyFilename: accessKey,
+			SecretKeyFilename: secretKey,
+			DisableTLS:        true,
+		},
+		Bucket: bucket,
+		Prefix: "kube-audit-rest",
+	})
+	if err != nil {
+		t.Fatalf("creating s3 blob store failed with : %s", err)
+	}
+	return bs, backend, clock
+}
+
+func digest(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func key(body string) string {
+	return "kube-audit-rest/sha256/" + digest(body)
+}
+
+func Test_WhenPut_ThenUploadedUnderDigest(t *testing.T) {
+	bs, backend, _ := setup(t, time.Now())
+	body := `{"kind":"ConfigMap"}`
+
+	stored, err := bs.Put(context.Background(), digest(body), []byte(body))
+
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	object, err := backend.GetObject(bucket, key(body), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer object.Contents.Close()
+	content, _ := io.ReadAll(object.Contents)
+	assert.Equal(t, body, string(content))
+}
+
+func Test_WhenPutAgainSoon_ThenNotStoredOrCopied(t *testing.T) {
+	bs, backend, _ := setup(t, time.Now())
+	body := `{"kind":"ConfigMap"}`
+	_, err := bs.Put(context.Background(), digest(body), []byte(body))
+	assert.NoError(t, err)
+
+	stored, err := bs.Put(context.Background(), digest(body), []byte(body))
+
+	assert.NoError(t, err)
+	assert.False(t, stored)
+	object, err := backend.HeadObject(bucket, key(body))
+	if assert.NoError(t, err) {
+		assert.NotContains(t, object.Metadata, "X-Amz-Meta-Used")
+	}
+}
+
+func Test_WhenOldBlobPutAgain_ThenMarkedAsUsed(t *testing.T) {
+	bs, backend, _ := setup(t, time.Now().Add(-48*time.Hour))
+	body := `{"kind":"ConfigMap"}`
+	_, err := bs.Put(context.Background(), digest(body), []byte(body))
+	assert.NoError(t, err)
+
+	stored, err := bs.Put(context.Background(), digest(body), []byte(body))
+
+	assert.NoError(t, err)
+	assert.False(t, stored)
+	object, err := backend.HeadObject(bucket, key(body))
+	if assert.NoError(t, err) {
+		assert.Contains(t, object.Metadata, "X-Amz-Meta-Used")
+	}
+}
+
+func Test_WhenSwept_ThenOnlyUnusedBlobsDeleted(t *testing.T) {
+	bs, backend, clock := setup(t, time.Now().Add(-48*time.Hour))
+	unused, used := `{"name":"unused"}`, `{"name":"used"}`
+	_, err := bs.Put(context.Background(), digest(unused), []byte(unused))
+	assert.NoError(t, err)
+	clock.Advance(48 * time.Hour)
+	_, err = bs.Put(context.Background(), digest(used), []byte(used))
+	assert.NoError(t, err)
+
+	swept, err := bs.Sweep(context.Background(), time.Now().Add(-24*time.Hour))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, swept)
+	_, err = backend.HeadObject(bucket, key(unused))
+	assert.Error(t, err)
+	_, err = backend.HeadObject(bucket, key(used))
+	assert.NoError(t, err)
+}
+
+func Test_WhenNoBucket_ThenErrorReturned(t *testing.T) {
+	_, err := s3blobstore.New(s3blobstore.Config{S3ClientConfig: common.S3ClientConfig{Endpoint: "localhost:9000"}})
+
+	assert.Error(t, err)
+}
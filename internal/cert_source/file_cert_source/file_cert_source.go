@@ -0,0 +1,173 @@
+package filecertsource
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	certsource "github.com/RichardoC/kube-audit-rest/internal/cert_source"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Loads the certificate and key from files, reloading them when they change
+type fileCertSource struct {
+	certFilename string
+	keyFilename  string
+	cert         atomic.Pointer[tls.Certificate]
+	// The files' modification times and sizes when cert was loaded
+	loadedStat string
+	expiry     metrics.Gauge
+	watcher    *fsnotify.Watcher
+	stop       chan struct{}
+	stopped    sync.WaitGroup
+	closeOnce  sync.Once
+}
+
+// The files are watched for changes, and also checked every interval in
+// case a change is missed, such as on filesystems without notifications.
+// A new certificate is only used once it's been validated, until then the
+// old one is kept
+func New(certFilename string, keyFilename string, interval time.Duration, metricsServer metrics.MetricsServer) (certsource.CertSource, error) {
+	if interval <= 0 {
+		return nil, errors.New("the certificate reload interval must be positive")
+	}
+	fcs := &fileCertSource{
+		certFilename: certFilename,
+		keyFilename:  keyFilename,
+		expiry: metricsServer.CreateAndRegisterGauge(
+			"kube_audit_rest_tls_cert_expiry_timestamp_seconds",
+			"Time the serving certificate expires, in seconds since the epoch",
+		),
+		stop: make(chan struct{}),
+	}
+	if err := fcs.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch certificate files: %w", err)
+	}
+	// The directories are watched rather than the files, as kubernetes
+	// replaces the files of mounted secrets by swapping a symlink
+	for _, dir := range uniqueDirs(certFilename, keyFilename) {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch certificate directory %s: %w", dir, err)
+		}
+	}
+	fcs.watcher = watcher
+
+	fcs.stopped.Add(1)
+	go fcs.run(interval)
+	return fcs, nil
+}
+
+func (fcs *fileCertSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return fcs.cert.Load(), nil
+}
+
+func (fcs *fileCertSource) Close() {
+	fcs.closeOnce.Do(func() {
+		close(fcs.stop)
+		fcs.watcher.Close()
+		fcs.stopped.Wait()
+	})
+}
+
+func (fcs *fileCertSource) run(interval time.Duration) {
+	defer fcs.stopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fcs.stop:
+			return
+		case _, ok := <-fcs.watcher.Events:
+			if !ok {
+				return
+			}
+		case err, ok := <-fcs.watcher.Errors:
+			if !ok {
+				return
+			}
+			common.Logger.Warnw("error watching certificate files", "error", err)
+		case <-ticker.C:
+		}
+		if err := fcs.reload(); err != nil {
+			common.Logger.Warnw("failed to reload TLS certificate, still using the old one", "error", err)
+		}
+	}
+}
+
+// Loads the files if they've changed since they were last loaded
+func (fcs *fileCertSource) reload() error {
+	stat, err := statFiles(fcs.certFilename, fcs.keyFilename)
+	if err != nil {
+		return err
+	}
+	if stat == fcs.loadedStat {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(fcs.certFilename, fcs.keyFilename)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("TLS certificate %s is only valid from %s to %s", fcs.certFilename, leaf.NotBefore, leaf.NotAfter)
+	}
+
+	fcs.cert.Store(&cert)
+	fcs.loadedStat = stat
+	fcs.expiry.Set(float64(leaf.NotAfter.Unix()))
+	common.Logger.Infow("loaded TLS certificate",
+		"filename", fcs.certFilename,
+		"subject", leaf.Subject.String(),
+		"serial", leaf.SerialNumber.String(),
+		"notAfter", leaf.NotAfter,
+	)
+	return nil
+}
+
+// Summarises the files, so a change to either can be noticed
+func statFiles(filenames ...string) (string, error) {
+	stat := ""
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return "", fmt.Errorf("failed to read TLS certificate: %w", err)
+		}
+		stat += fmt.Sprintf("%s:%d:%d;", filename, info.ModTime().UnixNano(), info.Size())
+	}
+	return stat, nil
+}
+
+func uniqueDirs(filenames ...string) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	for _, filename := range filenames {
+		dir := filepath.Dir(filename)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,167 @@
+package filecertsource_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	certsource "github.com/RichardoC/kube-audit-rest/internal/cert_source"
+	filecertsource "github.com/RichardoC/kube-audit-rest/internal/cert_source/file_cert_source"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the PEM encoded self-signed certificate and key
+func newKeyPair(t *testing.T, serial int64, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key failed with : %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "kube-audit-rest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate failed with : %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding key failed with : %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// Writes the files by renaming, so they're never read half written
+func writeKeyPair(t *testing.T, dir string, cert []byte, key []byte) {
+	for name, content := range map[string][]byte{"tls.crt": cert, "tls.key": key} {
+		tmp := filepath.Join(dir, "."+name)
+		if err := os.WriteFile(tmp, content, 0o600); err != nil {
+			t.Fatalf("writing %s failed with : %s", name, err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("writing %s failed with : %s", name, err)
+		}
+	}
+}
+
+func setup(t *testing.T) (*mymock.MockMetricsServer, *mymock.MockGauge) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	expiry := mymock.NewMockGauge(ctrl)
+	ms.EXPECT().CreateAndRegisterGauge("kube_audit_rest_tls_cert_expiry_timestamp_seconds", gomock.Any()).Return(expiry)
+	return ms, expiry
+}
+
+func servedSerial(t *testing.T, cs certsource.CertSource) int64 {
+	cert, err := cs.GetCertificate(nil)
+	assert.NoError(t, err)
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func Test_WhenFilesReplaced_ThenNewCertificateServed(t *testing.T) {
+	dir := t.TempDir()
+	firstExpiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	secondExpiry := firstExpiry.Add(24 * time.Hour)
+	cert, key := newKeyPair(t, 1, firstExpiry)
+	writeKeyPair(t, dir, cert, key)
+	ms, expiry := setup(t)
+	expiry.EXPECT().Set(float64(firstExpiry.Unix()))
+	reloaded := make(chan struct{})
+	expiry.EXPECT().Set(float64(secondExpiry.Unix())).Do(func(float64) { close(reloaded) })
+
+	cs, err := filecertsource.New(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), time.Hour, ms)
+	if err != nil {
+		t.Fatalf("creating cert source failed with : %s", err)
+	}
+	defer cs.Close()
+	assert.Equal(t, int64(1), servedSerial(t, cs))
+
+	cert, key = newKeyPair(t, 2, secondExpiry)
+	writeKeyPair(t, dir, cert, key)
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("certificate wasn't reloaded")
+	}
+	assert.Equal(t, int64(2), servedSerial(t, cs))
+}
+
+func Test_WhenNotNotified_ThenCertificateReloadedOnInterval(t *testing.T) {
+	dir := t.TempDir()
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	cert, key := newKeyPair(t, 1, expires)
+	writeKeyPair(t, dir, cert, key)
+	ms, expiry := setup(t)
+	expiry.EXPECT().Set(float64(expires.Unix()))
+	reloaded := make(chan struct{})
+	expiry.EXPECT().Set(float64(expires.Add(time.Hour).Unix())).Do(func(float64) { close(reloaded) })
+
+	// Watching a symlink to the directory only notices changes to the link
+	link := filepath.Join(t.TempDir(), "tls")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatalf("linking certificate directory failed with : %s", err)
+	}
+	cs, err := filecertsource.New(filepath.Join(link, "tls.crt"), filepath.Join(link, "tls.key"), 50*time.Millisecond, ms)
+	if err != nil {
+		t.Fatalf("creating cert source failed with : %s", err)
+	}
+	defer cs.Close()
+
+	cert, key = newKeyPair(t, 2, expires.Add(time.Hour))
+	writeKeyPair(t, dir, cert, key)
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("certificate wasn't reloaded")
+	}
+}
+
+func Test_WhenNewFilesInvalid_ThenOldCertificateKept(t *testing.T) {
+	dir := t.TempDir()
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	cert, key := newKeyPair(t, 1, expires)
+	writeKeyPair(t, dir, cert, key)
+	ms, expiry := setup(t)
+	expiry.EXPECT().Set(float64(expires.Unix()))
+
+	cs, err := filecertsource.New(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), 10*time.Millisecond, ms)
+	if err != nil {
+		t.Fatalf("creating cert source failed with : %s", err)
+	}
+	defer cs.Close()
+
+	// A certificate with someone else's key, then an expired one
+	otherCert, _ := newKeyPair(t, 2, expires)
+	writeKeyPair(t, dir, otherCert, key)
+	time.Sleep(100 * time.Millisecond)
+	expiredCert, expiredKey := newKeyPair(t, 3, time.Now().Add(-time.Minute))
+	writeKeyPair(t, dir, expiredCert, expiredKey)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, int64(1), servedSerial(t, cs))
+}
+
+func Test_WhenFilesMissing_ThenErrorReturned(t *testing.T) {
+	ms := mymock.NewMockMetricsServer(gomock.NewController(t))
+	ms.EXPECT().CreateAndRegisterGauge(gomock.Any(), gomock.Any()).Return(mymock.NewMockGauge(gomock.NewController(t)))
+	dir := t.TempDir()
+
+	_, err := filecertsource.New(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), time.Minute, ms)
+
+	assert.Error(t, err)
+}
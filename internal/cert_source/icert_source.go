@@ -0,0 +1,15 @@
+// Package certsource provides the interfaces to supply the serving
+// certificate of the TLS server, which can change while it's running
+package certsource
+
+//go:generate mockgen -package mymock -destination ../../mocks/cert_source_mock.go github.com/RichardoC/kube-audit-rest/internal/cert_source CertSource
+
+import "crypto/tls"
+
+type CertSource interface {
+	// Returns the current certificate, for use as tls.Config.GetCertificate
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Stops watching for new certificates. The current certificate is still
+	// returned after
+	Close()
+}
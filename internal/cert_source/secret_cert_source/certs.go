@@ -0,0 +1,190 @@
+package secretcertsource
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// Allows for clocks that are a little behind
+const backdate = 5 * time.Minute
+
+// A certificate with its key, in PEM and parsed
+type keyPair struct {
+	certPEM []byte
+	keyPEM  []byte
+	cert    *x509.Certificate
+	key     crypto.Signer
+}
+
+func newCA(validity time.Duration) (*keyPair, error) {
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("kube-audit-rest-ca@%d", now.Unix())},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(validity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	return newKeyPair(template, nil)
+}
+
+// The certificate doesn't outlive the CA
+func newServingCert(ca *keyPair, dnsNames []string, validity time.Duration) (*keyPair, error) {
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-backdate),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return newKeyPair(template, ca)
+}
+
+// Self-signed when parent is nil
+func newKeyPair(template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	template.SerialNumber = serial
+
+	issuer, signer := template, crypto.Signer(key)
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return &keyPair{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+		cert:    cert,
+		key:     key,
+	}, nil
+}
+
+// Only the first certificate in certPEM is used
+func parseKeyPair(certPEM []byte, keyPEM []byte) (*keyPair, error) {
+	certs, err := parseCerts(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no key found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %w", err)
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key can't sign")
+	}
+	if !publicKeysEqual(certs[0].PublicKey, key.Public()) {
+		return nil, errors.New("key doesn't match the certificate")
+	}
+	first, _ := pem.Decode(certPEM)
+	return &keyPair{certPEM: pem.EncodeToMemory(first), keyPEM: keyPEM, cert: certs[0], key: key}, nil
+}
+
+func parseCerts(certPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := certPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	equaler, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && equaler.Equal(b)
+}
+
+// The CA certificates the apiserver should trust: the current CA, then
+// any earlier ones that haven't expired, so certificates they signed are
+// trusted until every replica has the new certificate
+func caBundle(current *keyPair, previous []byte) []byte {
+	bundle := bytes.Clone(current.certPEM)
+	earlier, err := parseCerts(previous)
+	if err != nil {
+		return bundle
+	}
+	now := time.Now()
+	for _, cert := range earlier {
+		if cert.Equal(current.cert) || now.After(cert.NotAfter) {
+			continue
+		}
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return bundle
+}
+
+// Whether the certificate was signed by one of the CAs in the bundle
+func signedByAny(cert *x509.Certificate, bundle []byte) bool {
+	cas, err := parseCerts(bundle)
+	if err != nil {
+		return false
+	}
+	for _, ca := range cas {
+		if cert.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the serving certificate needs replacing, as it's expiring, for
+// other names or wasn't signed by the CA
+func needsRenewal(cert *x509.Certificate, ca *keyPair, dnsNames []string, renewBefore time.Duration) bool {
+	if time.Now().Add(renewBefore).After(cert.NotAfter) {
+		return true
+	}
+	if !slices.Equal(cert.DNSNames, dnsNames) {
+		return true
+	}
+	return cert.CheckSignatureFrom(ca.cert) != nil
+}
@@ -0,0 +1,315 @@
+package secretcertsource
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	certsource "github.com/RichardoC/kube-audit-rest/internal/cert_source"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Keys of the secret, alongside tls.crt and tls.key. ca.crt has the
+// current CA first, followed by any earlier CAs that are still trusted
+const (
+	caCertKey = "ca.crt"
+	caKeyKey  = "ca.key"
+)
+
+// Time allowed for each sync with the kubernetes API
+const syncTimeout = 30 * time.Second
+
+type Config struct {
+	Client kubernetes.Interface
+	// The secret the CA and serving certificate are stored in, so every
+	// replica serves a certificate signed by the same CA
+	Namespace  string
+	SecretName string
+	// The ValidatingWebhookConfiguration whose webhooks have their caBundle
+	// set to the CA, optional
+	WebhookName string
+	// Names the serving certificate is for, such as <service>.<namespace>.svc
+	DNSNames     []string
+	CAValidity   time.Duration
+	CertValidity time.Duration
+	// The CA and certificate are replaced once they'd expire within this
+	RenewBefore time.Duration
+	// How often to check the secret, renewing what's expiring and picking
+	// up what other replicas have renewed
+	CheckInterval time.Duration
+}
+
+// Generates its own CA and serving certificate, stored in a secret
+type secretCertSource struct {
+	config Config
+	cert   atomic.Pointer[tls.Certificate]
+	expiry metrics.Gauge
+	errors metrics.Counter
+	// The CA bundle last set on the webhook. Only used by New and run
+	trusted []byte
+	stop    chan struct{}
+	stopped sync.WaitGroup
+	once    sync.Once
+}
+
+// The secret is created, or what's in it is renewed if needed, before
+// returning. Failing to set the webhook's caBundle is only logged, as it may
+// not have been created yet, and is retried every check interval. Once
+// serving, a certificate from a new CA is only served after the webhook's
+// caBundle has been set to include that CA
+func New(config Config, metricsServer metrics.MetricsServer) (certsource.CertSource, error) {
+	if config.Namespace == "" || config.SecretName == "" {
+		return nil, errors.New("the namespace and name of the TLS secret are required")
+	}
+	if len(config.DNSNames) == 0 {
+		return nil, errors.New("at least one DNS name is required for the serving certificate")
+	}
+	if config.RenewBefore <= 0 || config.CertValidity <= config.RenewBefore || config.CAValidity <= config.RenewBefore {
+		return nil, errors.New("the CA and certificate validity must be longer than the renewal period, which must be positive")
+	}
+	if config.CheckInterval <= 0 {
+		return nil, errors.New("the certificate check interval must be positive")
+	}
+
+	scs := &secretCertSource{
+		config: config,
+		expiry: metricsServer.CreateAndRegisterGauge(
+			"kube_audit_rest_tls_cert_expiry_timestamp_seconds",
+			"Time the serving certificate expires, in seconds since the epoch",
+		),
+		errors: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_self_signed_tls_errors_total",
+			"Total number of failures to sync the self-signed CA and certificate with the secret or webhook",
+		),
+		stop: make(chan struct{}),
+	}
+	bundle, serving, err := scs.syncSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := scs.syncWebhook(bundle); err != nil {
+		scs.errors.Inc()
+		common.Logger.Warnw("failed to set the webhook's caBundle, will retry", "webhook", config.WebhookName, "error", err)
+	}
+	// Served even if the webhook may not trust it yet, as there's nothing else
+	if err := scs.use(serving); err != nil {
+		return nil, err
+	}
+
+	scs.stopped.Add(1)
+	go scs.run()
+	return scs, nil
+}
+
+func (scs *secretCertSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return scs.cert.Load(), nil
+}
+
+func (scs *secretCertSource) Close() {
+	scs.once.Do(func() {
+		close(scs.stop)
+		scs.stopped.Wait()
+	})
+}
+
+func (scs *secretCertSource) run() {
+	defer scs.stopped.Done()
+	ticker := time.NewTicker(scs.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-scs.stop:
+			return
+		case <-ticker.C:
+		}
+		bundle, serving, err := scs.syncSecret()
+		if err != nil {
+			scs.errors.Inc()
+			common.Logger.Errorw("failed to sync the TLS secret, still using the old certificate", "secret", scs.config.SecretName, "error", err)
+			continue
+		}
+		if err := scs.syncWebhook(bundle); err != nil {
+			scs.errors.Inc()
+			common.Logger.Errorw("failed to set the webhook's caBundle", "webhook", scs.config.WebhookName, "error", err)
+			// The API server would reject a certificate from a CA it doesn't trust
+			if !scs.trusts(serving.cert) {
+				common.Logger.Warnw("still using the old certificate until the webhook trusts the new CA", "webhook", scs.config.WebhookName)
+				continue
+			}
+		}
+		if err := scs.use(serving); err != nil {
+			scs.errors.Inc()
+			common.Logger.Errorw("failed to use the new certificate, still using the old one", "error", err)
+		}
+	}
+}
+
+// Creates or renews the secret as needed, retrying if another replica
+// changes it at the same time. Returns the CA bundle and the serving
+// certificate
+func (scs *secretCertSource) syncSecret() ([]byte, *keyPair, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	var bundle []byte
+	var serving *keyPair
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		var err error
+		bundle, serving, err = scs.trySyncSecret(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sync secret %s/%s: %w", scs.config.Namespace, scs.config.SecretName, err)
+	}
+	return bundle, serving, nil
+}
+
+func (scs *secretCertSource) trySyncSecret(ctx context.Context) ([]byte, *keyPair, error) {
+	secrets := scs.config.Client.CoreV1().Secrets(scs.config.Namespace)
+	secret, err := secrets.Get(ctx, scs.config.SecretName, metav1.GetOptions{})
+	exists := err == nil
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: scs.config.SecretName, Namespace: scs.config.Namespace},
+			Type:       corev1.SecretTypeTLS,
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	data := secret.Data
+	if data == nil {
+		data = map[string][]byte{}
+	}
+
+	ca, err := parseKeyPair(data[caCertKey], data[caKeyKey])
+	if err != nil && exists {
+		common.Logger.Warnw("replacing the CA in the TLS secret", "secret", scs.config.SecretName, "error", err)
+	}
+	if err != nil || time.Now().Add(scs.config.RenewBefore).After(ca.cert.NotAfter) {
+		if ca, err = newCA(scs.config.CAValidity); err != nil {
+			return nil, nil, err
+		}
+		common.Logger.Infow("generated a new CA", "subject", ca.cert.Subject.String(), "notAfter", ca.cert.NotAfter)
+	}
+	bundle := caBundle(ca, data[caCertKey])
+
+	serving, err := parseKeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey])
+	if err != nil || needsRenewal(serving.cert, ca, scs.config.DNSNames, scs.config.RenewBefore) {
+		if serving, err = newServingCert(ca, scs.config.DNSNames, scs.config.CertValidity); err != nil {
+			return nil, nil, err
+		}
+		common.Logger.Infow("generated a new serving certificate", "dnsNames", scs.config.DNSNames, "notAfter", serving.cert.NotAfter)
+	}
+
+	updated := map[string][]byte{
+		caCertKey:               bundle,
+		caKeyKey:                ca.keyPEM,
+		corev1.TLSCertKey:       serving.certPEM,
+		corev1.TLSPrivateKeyKey: serving.keyPEM,
+	}
+	if !dataEqual(data, updated) {
+		secret = secret.DeepCopy()
+		secret.Data = updated
+		if !exists {
+			_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		} else {
+			_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return bundle, serving, nil
+}
+
+// Whether the webhook is known to trust the certificate's CA, as it's in the
+// caBundle last set or it's the CA of the certificate being served
+func (scs *secretCertSource) trusts(cert *x509.Certificate) bool {
+	if signedByAny(cert, scs.trusted) {
+		return true
+	}
+	current := scs.cert.Load()
+	return current != nil && len(cert.AuthorityKeyId) > 0 &&
+		bytes.Equal(cert.AuthorityKeyId, current.Leaf.AuthorityKeyId) &&
+		bytes.Equal(cert.RawIssuer, current.Leaf.RawIssuer)
+}
+
+// Serves the certificate if it isn't already being served
+func (scs *secretCertSource) use(serving *keyPair) error {
+	if current := scs.cert.Load(); current != nil && current.Leaf.Equal(serving.cert) {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(serving.certPEM, serving.keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load serving certificate: %w", err)
+	}
+	cert.Leaf = serving.cert
+	scs.cert.Store(&cert)
+	scs.expiry.Set(float64(serving.cert.NotAfter.Unix()))
+	common.Logger.Infow("loaded TLS certificate",
+		"secret", scs.config.SecretName,
+		"subject", serving.cert.Subject.String(),
+		"serial", serving.cert.SerialNumber.String(),
+		"notAfter", serving.cert.NotAfter,
+	)
+	return nil
+}
+
+// Sets the caBundle of every webhook in the configuration
+func (scs *secretCertSource) syncWebhook(bundle []byte) error {
+	if scs.config.WebhookName == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	webhooks := scs.config.Client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := webhooks.Get(ctx, scs.config.WebhookName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range config.Webhooks {
+			if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, bundle) {
+				config.Webhooks[i].ClientConfig.CABundle = bundle
+				changed = true
+			}
+		}
+		if !changed {
+			scs.trusted = bundle
+			return nil
+		}
+		if _, err := webhooks.Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		scs.trusted = bundle
+		common.Logger.Infow("set the webhook's caBundle", "webhook", scs.config.WebhookName)
+		return nil
+	})
+}
+
+func dataEqual(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if !bytes.Equal(value, b[key]) {
+			return false
+		}
+	}
+	return true
+}
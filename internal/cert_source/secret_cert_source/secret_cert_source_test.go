@@ -0,0 +1,241 @@
+package secretcertsource_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	certsource "github.com/RichardoC/kube-audit-rest/internal/cert_source"
+	secretcertsource "github.com/RichardoC/kube-audit-rest/internal/cert_source/secret_cert_source"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const dnsName = "kube-audit-rest.kube-audit-rest.svc"
+
+func webhookConfiguration() *admissionregistrationv1.ValidatingWebhookConfiguration {
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-audit-rest"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{Name: "kube-audit-rest.kube-audit-rest.svc.cluster.local", ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte("$CABUNDLEB64")}},
+		},
+	}
+}
+
+func config(client kubernetes.Interface) secretcertsource.Config {
+	return secretcertsource.Config{
+		Client:        client,
+		Namespace:     "kube-audit-rest",
+		SecretName:    "kube-audit-rest-tls",
+		WebhookName:   "kube-audit-rest",
+		DNSNames:      []string{dnsName},
+		CAValidity:    10 * 365 * 24 * time.Hour,
+		CertValidity:  90 * 24 * time.Hour,
+		RenewBefore:   30 * 24 * time.Hour,
+		CheckInterval: time.Hour,
+	}
+}
+
+func newSource(t *testing.T, config secretcertsource.Config) certsource.CertSource {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	expiry := mymock.NewMockGauge(ctrl)
+	expiry.EXPECT().Set(gomock.Any()).AnyTimes()
+	errors := mymock.NewMockCounter(ctrl)
+	errors.EXPECT().Inc().AnyTimes()
+	ms.EXPECT().CreateAndRegisterGauge("kube_audit_rest_tls_cert_expiry_timestamp_seconds", gomock.Any()).Return(expiry)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_self_signed_tls_errors_total", gomock.Any()).Return(errors)
+
+	cs, err := secretcertsource.New(config, ms)
+	if err != nil {
+		t.Fatalf("creating cert source failed with : %s", err)
+	}
+	t.Cleanup(cs.Close)
+	return cs
+}
+
+func secret(t *testing.T, client kubernetes.Interface) *corev1.Secret {
+	secret, err := client.CoreV1().Secrets("kube-audit-rest").Get(context.Background(), "kube-audit-rest-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting secret failed with : %s", err)
+	}
+	return secret
+}
+
+func caBundle(t *testing.T, client kubernetes.Interface) []byte {
+	webhook, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), "kube-audit-rest", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting webhook failed with : %s", err)
+	}
+	return webhook.Webhooks[0].ClientConfig.CABundle
+}
+
+func countCerts(bundle []byte) int {
+	count := 0
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		count++
+	}
+	return count
+}
+
+// Checks the served certificate is trusted by the webhook's caBundle
+func assertTrusted(t *testing.T, cs certsource.CertSource, bundle []byte) *x509.Certificate {
+	cert, err := cs.GetCertificate(nil)
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	assert.True(t, roots.AppendCertsFromPEM(bundle))
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: dnsName})
+	assert.NoError(t, err)
+	return cert.Leaf
+}
+
+func Test_WhenNoSecret_ThenCreatedAndWebhookPatched(t *testing.T) {
+	client := fake.NewClientset(webhookConfiguration())
+
+	cs := newSource(t, config(client))
+
+	stored := secret(t, client)
+	assert.Equal(t, corev1.SecretTypeTLS, stored.Type)
+	for _, key := range []string{"ca.crt", "ca.key", "tls.crt", "tls.key"} {
+		assert.NotEmpty(t, stored.Data[key], key)
+	}
+	assert.Equal(t, stored.Data["ca.crt"], caBundle(t, client))
+	assertTrusted(t, cs, caBundle(t, client))
+}
+
+func Test_WhenSecretValid_ThenReused(t *testing.T) {
+	client := fake.NewClientset(webhookConfiguration())
+	first := newSource(t, config(client))
+	before := secret(t, client)
+
+	second := newSource(t, config(client))
+
+	assert.Equal(t, before.Data, secret(t, client).Data)
+	firstCert, _ := first.GetCertificate(nil)
+	secondCert, _ := second.GetCertificate(nil)
+	assert.True(t, firstCert.Leaf.Equal(secondCert.Leaf))
+}
+
+func Test_WhenCertificateExpiring_ThenRenewedWithSameCA(t *testing.T) {
+	client := fake.NewClientset(webhookConfiguration())
+	short := config(client)
+	short.CertValidity = 40 * 24 * time.Hour
+	first := newSource(t, short)
+	before := secret(t, client)
+
+	// Now within the renewal period of the first certificate
+	long := config(client)
+	long.RenewBefore = 50 * 24 * time.Hour
+	second := newSource(t, long)
+
+	after := secret(t, client)
+	assert.Equal(t, before.Data["ca.crt"], after.Data["ca.crt"])
+	assert.NotEqual(t, before.Data["tls.crt"], after.Data["tls.crt"])
+	firstCert, _ := first.GetCertificate(nil)
+	assert.False(t, firstCert.Leaf.Equal(assertTrusted(t, second, caBundle(t, client))))
+}
+
+func Test_WhenCAExpiring_ThenNewCATrustedAlongsideOld(t *testing.T) {
+	client := fake.NewClientset(webhookConfiguration())
+	short := config(client)
+	short.CAValidity = 40 * 24 * time.Hour
+	first := newSource(t, short)
+
+	long := config(client)
+	long.RenewBefore = 50 * 24 * time.Hour
+	long.CertValidity = 60 * 24 * time.Hour
+	second := newSource(t, long)
+
+	bundle := caBundle(t, client)
+	assert.Equal(t, 2, countCerts(bundle))
+	// Replicas still serving the old certificate are trusted until they
+	// pick up the new one
+	assertTrusted(t, first, bundle)
+	assertTrusted(t, second, bundle)
+}
+
+func Test_WhenWebhookCantBePatched_ThenNewCANotServedUntilItIs(t *testing.T) {
+	client := fake.NewClientset(webhookConfiguration())
+	var failing atomic.Bool
+	client.PrependReactor("update", "validatingwebhookconfigurations", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if failing.Load() {
+			return true, nil, errors.New("unavailable")
+		}
+		return false, nil, nil
+	})
+	short := config(client)
+	short.CAValidity = 40 * 24 * time.Hour
+	short.CheckInterval = 10 * time.Millisecond
+	first := newSource(t, short)
+	old, _ := first.GetCertificate(nil)
+
+	// Another replica replaces the expiring CA, but can't patch the webhook
+	failing.Store(true)
+	long := config(client)
+	long.RenewBefore = 50 * 24 * time.Hour
+	long.CertValidity = 60 * 24 * time.Hour
+	newSource(t, long)
+	assert.Equal(t, 1, countCerts(caBundle(t, client)))
+
+	time.Sleep(100 * time.Millisecond)
+	current, _ := first.GetCertificate(nil)
+	assert.True(t, old.Leaf.Equal(current.Leaf))
+	assertTrusted(t, first, caBundle(t, client))
+
+	failing.Store(false)
+	assert.Eventually(t, func() bool {
+		current, _ := first.GetCertificate(nil)
+		return !old.Leaf.Equal(current.Leaf)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, countCerts(caBundle(t, client)))
+	assertTrusted(t, first, caBundle(t, client))
+}
+
+func Test_WhenNamesChange_ThenCertificateReissued(t *testing.T) {
+	client := fake.NewClientset(webhookConfiguration())
+	newSource(t, config(client))
+
+	renamed := config(client)
+	renamed.DNSNames = []string{"audit.example.com"}
+	cs := newSource(t, renamed)
+
+	cert, err := cs.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"audit.example.com"}, cert.Leaf.DNSNames)
+}
+
+func Test_WhenWebhookMissing_ThenCertificateStillServed(t *testing.T) {
+	client := fake.NewClientset()
+
+	cs := newSource(t, config(client))
+
+	assertTrusted(t, cs, secret(t, client).Data["ca.crt"])
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	client := fake.NewClientset()
+
+	noNames := config(client)
+	noNames.DNSNames = nil
+	_, err := secretcertsource.New(noNames, ms)
+	assert.Error(t, err)
+
+	renewTooLate := config(client)
+	renewTooLate.RenewBefore = renewTooLate.CertValidity
+	_, err = secretcertsource.New(renewTooLate, ms)
+	assert.Error(t, err)
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// How to connect to an S3 compatible API
+type S3ClientConfig struct {
+	// host:port of the S3 compatible API, such as s3.eu-west-1.amazonaws.com
+	Endpoint string
+	Region   string
+
+	// Re-read for every request, so the keys can be rotated. When both are
+	// empty the credentials are taken from the environment, the shared AWS
+	// credentials file or the instance's IAM role
+	AccessKeyFilename string
+	SecretKeyFilename string
+
+	DisableTLS            bool
+	TLSCAFilename         string
+	TLSInsecureSkipVerify bool
+}
+
+// Reads the keys from their files whenever they're needed
+type fileCredentials struct {
+	accessKeyFilename string
+	secretKeyFilename string
+}
+
+func (fc *fileCredentials) Retrieve() (credentials.Value, error) {
+	accessKey, err := os.ReadFile(fc.accessKeyFilename)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to read s3 access key: %w", err)
+	}
+	secretKey, err := os.ReadFile(fc.secretKeyFilename)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to read s3 secret key: %w", err)
+	}
+	return credentials.Value{
+		AccessKeyID:     strings.TrimSpace(string(accessKey)),
+		SecretAccessKey: strings.TrimSpace(string(secretKey)),
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+func (fc *fileCredentials) RetrieveWithCredContext(*credentials.CredContext) (credentials.Value, error) {
+	return fc.Retrieve()
+}
+
+func (fc *fileCredentials) IsExpired() bool {
+	return true
+}
+
+// Creates a client that doesn't retry failed requests itself, so callers
+// can decide what's worth retrying
+func NewS3Client(config S3ClientConfig) (*minio.Client, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("an s3 endpoint is required")
+	}
+
+	var creds *credentials.Credentials
+	switch {
+	case config.AccessKeyFilename != "" && config.SecretKeyFilename != "":
+		fc := &fileCredentials{accessKeyFilename: config.AccessKeyFilename, secretKeyFilename: config.SecretKeyFilename}
+		if _, err := fc.Retrieve(); err != nil {
+			return nil, err
+		}
+		creds = credentials.New(fc)
+	case config.AccessKeyFilename != "" || config.SecretKeyFilename != "":
+		return nil, errors.New("both the s3 access key and secret key files are needed")
+	default:
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	tlsConfig, err := NewClientTLSConfig(config.TLSCAFilename, "", "", config.TLSInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:      creds,
+		Secure:     !config.DisableTLS,
+		Region:     config.Region,
+		Transport:  transport,
+		MaxRetries: 1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+	return client, nil
+}
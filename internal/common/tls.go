@@ -0,0 +1,40 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Builds the TLS configuration for connecting to a remote sink.
+// caFilename is optional and replaces the system roots, certFilename
+// and keyFilename are optional and used for client authentication
+func NewClientTLSConfig(caFilename string, certFilename string, keyFilename string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFilename != "" {
+		caCert, err := os.ReadFile(caFilename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", caFilename)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFilename != "" || keyFilename != "" {
+		cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
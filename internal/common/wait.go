@@ -0,0 +1,21 @@
+package common
+
+import "context"
+
+// Runs wait, returning early with the context's error if it's cancelled
+// first. wait carries on in the background if it's abandoned, so this is
+// only for things that will finish eventually or don't matter once the
+// process exits
+func WaitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,22 @@
+package common_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitContext(t *testing.T) {
+	err := common.WaitContext(context.Background(), func() {})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	blocked := make(chan struct{})
+	defer close(blocked)
+	err = common.WaitContext(ctx, func() { <-blocked })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,183 @@
+package celfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	eventfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/google/cel-go/cel"
+	"gopkg.in/yaml.v3"
+)
+
+// Upper bound on the cost of evaluating a single expression, so a badly
+// written expression can't stall the webhook response
+const evaluationCostLimit = 1000000
+
+// An example configuration
+//
+//	defaultAction: include
+//	filters:
+//	  - name: ci-deletes
+//	    action: exclude
+//	    expression: >-
+//	      request.userInfo.username.startsWith("system:serviceaccount:ci-") &&
+//	      request.operation == "DELETE"
+type Config struct {
+	// Action taken when no expression matches, defaults to include
+	DefaultAction eventfilter.Action `yaml:"defaultAction"`
+	// Evaluated in order, the first matching expression decides the action
+	Filters []Filter `yaml:"filters"`
+}
+
+type Filter struct {
+	Name   string             `yaml:"name"`
+	Action eventfilter.Action `yaml:"action"`
+	// Must evaluate to a bool, the AdmissionRequest is available as `request`
+	Expression string `yaml:"expression"`
+}
+
+type compiledFilter struct {
+	Filter
+	program cel.Program
+}
+
+type celFilter struct {
+	defaultAction eventfilter.Action
+	filters       []compiledFilter
+	matches       metrics.CounterVec
+	evalErrors    metrics.CounterVec
+}
+
+func New(configFilename string, metricsServer metrics.MetricsServer) (eventfilter.EventFilter, error) {
+	data, err := os.ReadFile(configFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CEL filter file: %w", err)
+	}
+	config, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CEL filter file %s: %w", configFilename, err)
+	}
+
+	env, err := cel.NewEnv(cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Compile everything up front so every broken expression is reported at boot
+	var compileErrs []error
+	filters := make([]compiledFilter, 0, len(config.Filters))
+	for _, filter := range config.Filters {
+		program, err := compile(env, filter.Expression)
+		if err != nil {
+			compileErrs = append(compileErrs, fmt.Errorf("filter %q: %w", filter.Name, err))
+			continue
+		}
+		filters = append(filters, compiledFilter{Filter: filter, program: program})
+	}
+	if len(compileErrs) > 0 {
+		return nil, errors.Join(compileErrs...)
+	}
+
+	matches := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_cel_filter_matches_total",
+		"Total number of events matched by each CEL filter",
+		[]string{"filter"},
+	)
+	evalErrors := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_cel_filter_evaluation_errors_total",
+		"Total number of errors evaluating each CEL filter",
+		[]string{"filter"},
+	)
+	// Initialise the counters so they are published before the first event
+	for _, filter := range filters {
+		matches.WithLabelValues(filter.Name)
+		evalErrors.WithLabelValues(filter.Name)
+	}
+
+	return &celFilter{
+		defaultAction: config.DefaultAction,
+		filters:       filters,
+		matches:       matches,
+		evalErrors:    evalErrors,
+	}, nil
+}
+
+func parseConfig(data []byte) (Config, error) {
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return config, err
+	}
+
+	if config.DefaultAction == "" {
+		config.DefaultAction = eventfilter.ActionInclude
+	}
+	if !config.DefaultAction.Valid() {
+		return config, fmt.Errorf("defaultAction must be %q or %q, got %q", eventfilter.ActionInclude, eventfilter.ActionExclude, config.DefaultAction)
+	}
+
+	names := map[string]bool{}
+	for i, filter := range config.Filters {
+		if filter.Name == "" {
+			return config, fmt.Errorf("filter %d has no name", i)
+		}
+		if names[filter.Name] {
+			return config, fmt.Errorf("filter name %q is used more than once", filter.Name)
+		}
+		names[filter.Name] = true
+		if !filter.Action.Valid() {
+			return config, fmt.Errorf("filter %q action must be %q or %q, got %q", filter.Name, eventfilter.ActionInclude, eventfilter.ActionExclude, filter.Action)
+		}
+	}
+	return config, nil
+}
+
+func compile(env *cel.Env, expression string) (cel.Program, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	// Fields of the request are dynamically typed, so those are checked during evaluation
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("expression must return a bool, got %s", ast.OutputType())
+	}
+	return env.Program(ast, cel.CostLimit(evaluationCostLimit))
+}
+
+func (cf *celFilter) ShouldWrite(body []byte) bool {
+	var review struct {
+		Request map[string]any `json:"request"`
+	}
+	if err := json.Unmarshal(body, &review); err != nil {
+		common.Logger.Debugw("failed to parse request for CEL filters", "error", err)
+		return cf.defaultAction == eventfilter.ActionInclude
+	}
+	activation := map[string]any{"request": review.Request}
+
+	for _, filter := range cf.filters {
+		out, _, err := filter.program.Eval(activation)
+		if err != nil {
+			// Usually a missing field, e.g. request.namespace on a cluster scoped resource
+			common.Logger.Debugw("failed to evaluate CEL filter", "filter", filter.Name, "error", err)
+			cf.evalErrors.WithLabelValues(filter.Name).Inc()
+			continue
+		}
+		matched, ok := out.Value().(bool)
+		if !ok {
+			common.Logger.Debugw("CEL filter didn't return a bool", "filter", filter.Name, "result", out.Value())
+			cf.evalErrors.WithLabelValues(filter.Name).Inc()
+			continue
+		}
+		if matched {
+			cf.matches.WithLabelValues(filter.Name).Inc()
+			return filter.Action == eventfilter.ActionInclude
+		}
+	}
+	return cf.defaultAction == eventfilter.ActionInclude
+}
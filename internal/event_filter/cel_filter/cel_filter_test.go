@@ -0,0 +1,151 @@
+package celfilter_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	celfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter/cel_filter"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+filters:
+  - name: ci-deletes
+    action: exclude
+    expression: >-
+      request.userInfo.username.startsWith("system:serviceaccount:ci-") &&
+      request.operation == "DELETE"
+  - name: kube-system
+    action: exclude
+    expression: request.namespace == "kube-system"
+`
+
+const ciDeleteRequest = `{"request":{"uid":"1","operation":"DELETE","namespace":"default","userInfo":{"username":"system:serviceaccount:ci-runner"}}}`
+const ciCreateRequest = `{"request":{"uid":"2","operation":"CREATE","namespace":"default","userInfo":{"username":"system:serviceaccount:ci-runner"}}}`
+const kubeSystemRequest = `{"request":{"uid":"3","operation":"UPDATE","namespace":"kube-system","userInfo":{"username":"admin"}}}`
+const clusterScopedRequest = `{"request":{"uid":"4","operation":"UPDATE","userInfo":{"username":"admin"}}}`
+
+func writeConfig(t *testing.T, config string) string {
+	configFile := path.Join(t.TempDir(), "cel.yaml")
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+type counters struct {
+	matches    *mymock.MockCounterVec
+	evalErrors *mymock.MockCounterVec
+	counter    *mymock.MockCounter
+}
+
+func setup(t *testing.T) (*mymock.MockMetricsServer, counters) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	c := counters{
+		matches:    mymock.NewMockCounterVec(ctrl),
+		evalErrors: mymock.NewMockCounterVec(ctrl),
+		counter:    mymock.NewMockCounter(ctrl),
+	}
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_cel_filter_matches_total", gomock.Any(), gomock.Any()).Return(c.matches).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_cel_filter_evaluation_errors_total", gomock.Any(), gomock.Any()).Return(c.evalErrors).AnyTimes()
+	return ms, c
+}
+
+func Test_WhenExpressionsMatch_ThenFirstMatchDecides(t *testing.T) {
+	ms, c := setup(t)
+	c.matches.EXPECT().WithLabelValues(gomock.Any()).Return(c.counter).AnyTimes()
+	c.evalErrors.EXPECT().WithLabelValues(gomock.Any()).Return(c.counter).AnyTimes()
+	c.counter.EXPECT().Inc().AnyTimes()
+
+	cf, err := celfilter.New(writeConfig(t, testConfig), ms)
+	if err != nil {
+		t.Fatalf("creating CEL filter failed with : %s", err)
+	}
+
+	assert.False(t, cf.ShouldWrite([]byte(ciDeleteRequest)))
+	assert.True(t, cf.ShouldWrite([]byte(ciCreateRequest)))
+	assert.False(t, cf.ShouldWrite([]byte(kubeSystemRequest)))
+}
+
+func Test_WhenFieldIsBool_ThenUsableDirectly(t *testing.T) {
+	ms, c := setup(t)
+	c.matches.EXPECT().WithLabelValues(gomock.Any()).Return(c.counter).AnyTimes()
+	c.evalErrors.EXPECT().WithLabelValues(gomock.Any()).Return(c.counter).AnyTimes()
+	c.counter.EXPECT().Inc().AnyTimes()
+
+	cf, err := celfilter.New(writeConfig(t, "filters:\n  - name: dry-run\n    action: exclude\n    expression: request.dryRun\n"), ms)
+	if err != nil {
+		t.Fatalf("creating CEL filter failed with : %s", err)
+	}
+
+	assert.False(t, cf.ShouldWrite([]byte(`{"request":{"uid":"1","dryRun":true}}`)))
+	assert.True(t, cf.ShouldWrite([]byte(`{"request":{"uid":"2","dryRun":false}}`)))
+}
+
+func Test_WhenEvaluationFails_ThenErrorCountedAndDefaultApplied(t *testing.T) {
+	ms, c := setup(t)
+	c.matches.EXPECT().WithLabelValues("kube-system").Return(c.counter)
+	// Once at creation, once for the error as request.namespace
+	// doesn't exist for cluster scoped resources
+	c.evalErrors.EXPECT().WithLabelValues("kube-system").Return(c.counter).Times(2)
+	c.counter.EXPECT().Inc().Times(1)
+
+	cf, err := celfilter.New(writeConfig(t, `
+defaultAction: exclude
+filters:
+  - name: kube-system
+    action: include
+    expression: request.namespace == "kube-system"
+`), ms)
+	if err != nil {
+		t.Fatalf("creating CEL filter failed with : %s", err)
+	}
+
+	assert.False(t, cf.ShouldWrite([]byte(clusterScopedRequest)))
+}
+
+func Test_WhenEventMatches_ThenMatchCounted(t *testing.T) {
+	ms, c := setup(t)
+	c.evalErrors.EXPECT().WithLabelValues("ci-deletes").Return(c.counter)
+	// Once at creation, once for the match
+	c.matches.EXPECT().WithLabelValues("ci-deletes").Return(c.counter).Times(2)
+	c.counter.EXPECT().Inc().Times(1)
+
+	cf, err := celfilter.New(writeConfig(t, `
+filters:
+  - name: ci-deletes
+    action: exclude
+    expression: request.operation == "DELETE"
+`), ms)
+	if err != nil {
+		t.Fatalf("creating CEL filter failed with : %s", err)
+	}
+
+	assert.False(t, cf.ShouldWrite([]byte(ciDeleteRequest)))
+	assert.True(t, cf.ShouldWrite([]byte(ciCreateRequest)))
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config string
+	}{
+		{"syntax error", "filters:\n  - name: a\n    action: exclude\n    expression: request.operation ==\n"},
+		{"not a bool", "filters:\n  - name: a\n    action: exclude\n    expression: size(request) + 1\n"},
+		{"unknown variable", "filters:\n  - name: a\n    action: exclude\n    expression: object.kind == \"Secret\"\n"},
+		{"missing name", "filters:\n  - action: exclude\n    expression: \"true\"\n"},
+		{"duplicate name", "filters:\n  - name: a\n    action: exclude\n    expression: \"true\"\n  - name: a\n    action: include\n    expression: \"true\"\n"},
+		{"bad action", "filters:\n  - name: a\n    action: drop\n    expression: \"true\"\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ms, _ := setup(t)
+			_, err := celfilter.New(writeConfig(t, tc.config), ms)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+// Package eventfilter provides the interfaces to decide whether
+// an event should be written by the audit writer or dropped
+package eventfilter
+
+//go:generate mockgen -package mymock -destination ../../mocks/event_filter_mock.go github.com/RichardoC/kube-audit-rest/internal/event_filter EventFilter
+
+type EventFilter interface {
+	// Returns true if the AdmissionReview in body should be written
+	ShouldWrite(body []byte) bool
+}
+
+// What a filter does with an event matching one of its rules
+type Action string
+
+const (
+	ActionInclude Action = "include"
+	ActionExclude Action = "exclude"
+)
+
+func (a Action) Valid() bool {
+	return a == ActionInclude || a == ActionExclude
+}
@@ -0,0 +1,201 @@
+package policyfilter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	eventfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v3"
+)
+
+// Label used in the drop counter when no rule matched and the default action is exclude
+const defaultRuleName = "default"
+
+// An example policy
+//
+//	defaultAction: include
+//	rules:
+//	  - name: controller-manager-leases
+//	    action: exclude
+//	    resources:
+//	      - group: coordination.k8s.io
+//	        resources: ["leases"]
+//	    usernames: ["system:kube-controller-manager"]
+//	  - name: dry-run
+//	    action: exclude
+//	    dryRun: true
+type Policy struct {
+	// Action taken when no rule matches, defaults to include
+	DefaultAction eventfilter.Action `yaml:"defaultAction"`
+	// Evaluated in order, the first matching rule decides the action
+	Rules []Rule `yaml:"rules"`
+}
+
+// A rule matches a request when every non empty field matches
+type Rule struct {
+	Name   string             `yaml:"name"`
+	Action eventfilter.Action `yaml:"action"`
+	// Matches if any of these match
+	Resources []GroupResources `yaml:"resources"`
+	// CREATE, UPDATE, DELETE or CONNECT
+	Operations []string `yaml:"operations"`
+	// Use "" to match cluster scoped resources
+	Namespaces []string `yaml:"namespaces"`
+	Usernames  []string `yaml:"usernames"`
+	// Matches if the user is in any of these groups
+	Groups []string `yaml:"groups"`
+	DryRun *bool    `yaml:"dryRun"`
+}
+
+// Follows the format of the kubernetes audit policy
+// https://kubernetes.io/docs/tasks/debug/debug-cluster/audit/#audit-policy
+type GroupResources struct {
+	// "" is the core group, "*" matches every group
+	Group string `yaml:"group"`
+	// Resource names such as "pods", "pods/log", "pods/*" (any pod subresource),
+	// "*/status" or "*". An empty list matches every resource in the group
+	Resources []string `yaml:"resources"`
+}
+
+type policyFilter struct {
+	policy  Policy
+	dropped metrics.CounterVec
+}
+
+func New(policyFilename string, metricsServer metrics.MetricsServer) (eventfilter.EventFilter, error) {
+	data, err := os.ReadFile(policyFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	policy, err := parsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", policyFilename, err)
+	}
+
+	dropped := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_policy_dropped_events_total",
+		"Total number of events dropped by the filter policy, by rule",
+		[]string{"rule"},
+	)
+	// Initialise the counters so they are published before the first drop
+	for _, rule := range policy.Rules {
+		if rule.Action == eventfilter.ActionExclude {
+			dropped.WithLabelValues(rule.Name)
+		}
+	}
+	if policy.DefaultAction == eventfilter.ActionExclude {
+		dropped.WithLabelValues(defaultRuleName)
+	}
+
+	return &policyFilter{policy: policy, dropped: dropped}, nil
+}
+
+func parsePolicy(data []byte) (Policy, error) {
+	var policy Policy
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policy); err != nil {
+		return policy, err
+	}
+
+	if policy.DefaultAction == "" {
+		policy.DefaultAction = eventfilter.ActionInclude
+	}
+	if !policy.DefaultAction.Valid() {
+		return policy, fmt.Errorf("defaultAction must be %q or %q, got %q", eventfilter.ActionInclude, eventfilter.ActionExclude, policy.DefaultAction)
+	}
+
+	names := map[string]bool{defaultRuleName: true}
+	for i, rule := range policy.Rules {
+		if rule.Name == "" {
+			return policy, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return policy, fmt.Errorf("rule name %q is reserved or used more than once", rule.Name)
+		}
+		names[rule.Name] = true
+		if !rule.Action.Valid() {
+			return policy, fmt.Errorf("rule %q action must be %q or %q, got %q", rule.Name, eventfilter.ActionInclude, eventfilter.ActionExclude, rule.Action)
+		}
+	}
+	return policy, nil
+}
+
+func (pf *policyFilter) ShouldWrite(body []byte) bool {
+	req := gjson.GetBytes(body, "request")
+	for _, rule := range pf.policy.Rules {
+		if rule.matches(req) {
+			common.Logger.Debugw("policy rule matched", "rule", rule.Name, "action", rule.Action, "uid", req.Get("uid").Str)
+			if rule.Action == eventfilter.ActionExclude {
+				pf.dropped.WithLabelValues(rule.Name).Inc()
+				return false
+			}
+			return true
+		}
+	}
+
+	if pf.policy.DefaultAction == eventfilter.ActionExclude {
+		pf.dropped.WithLabelValues(defaultRuleName).Inc()
+		return false
+	}
+	return true
+}
+
+func (r *Rule) matches(req gjson.Result) bool {
+	if len(r.Resources) > 0 && !slices.ContainsFunc(r.Resources, func(gr GroupResources) bool {
+		return gr.matches(req.Get("resource.group").Str, req.Get("resource.resource").Str, req.Get("subResource").Str)
+	}) {
+		return false
+	}
+	if len(r.Operations) > 0 && !slices.Contains(r.Operations, req.Get("operation").Str) {
+		return false
+	}
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, req.Get("namespace").Str) {
+		return false
+	}
+	if len(r.Usernames) > 0 && !slices.Contains(r.Usernames, req.Get("userInfo.username").Str) {
+		return false
+	}
+	if len(r.Groups) > 0 && !slices.ContainsFunc(req.Get("userInfo.groups").Array(), func(g gjson.Result) bool {
+		return slices.Contains(r.Groups, g.Str)
+	}) {
+		return false
+	}
+	if r.DryRun != nil && *r.DryRun != req.Get("dryRun").Bool() {
+		return false
+	}
+	return true
+}
+
+func (gr *GroupResources) matches(group string, resource string, subResource string) bool {
+	if gr.Group != "*" && gr.Group != group {
+		return false
+	}
+	if len(gr.Resources) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(gr.Resources, func(pattern string) bool {
+		if pattern == "*" {
+			return true
+		}
+		patternResource, patternSubResource, hasSubResource := strings.Cut(pattern, "/")
+		if !hasSubResource {
+			// "pods" only matches the pods themselves, not their subresources
+			return subResource == "" && patternResource == resource
+		}
+		if patternResource != "*" && patternResource != resource {
+			return false
+		}
+		if patternSubResource == "*" {
+			return subResource != ""
+		}
+		return patternSubResource == subResource
+	})
+}
@@ -0,0 +1,156 @@
+package policyfilter_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	eventfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter"
+	policyfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter/policy_filter"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+rules:
+  - name: controller-manager-leases
+    action: exclude
+    resources:
+      - group: coordination.k8s.io
+        resources: ["leases"]
+    usernames: ["system:kube-controller-manager"]
+  - name: keep-pod-exec
+    action: include
+    resources:
+      - group: ""
+        resources: ["pods/exec"]
+  - name: pod-subresources
+    action: exclude
+    resources:
+      - group: ""
+        resources: ["pods/*"]
+  - name: dry-run
+    action: exclude
+    dryRun: true
+  - name: nodes-group
+    action: exclude
+    operations: ["UPDATE"]
+    groups: ["system:nodes"]
+`
+
+const leaseRequest = `{"request":{"uid":"1","resource":{"group":"coordination.k8s.io","version":"v1","resource":"leases"},"operation":"UPDATE","namespace":"kube-system","userInfo":{"username":"system:kube-controller-manager","groups":["system:authenticated"]},"dryRun":false}}`
+const podExecRequest = `{"request":{"uid":"2","resource":{"group":"","version":"v1","resource":"pods"},"subResource":"exec","operation":"CONNECT","namespace":"default","userInfo":{"username":"admin","groups":["system:masters"]},"dryRun":false}}`
+const podLogRequest = `{"request":{"uid":"3","resource":{"group":"","version":"v1","resource":"pods"},"subResource":"log","operation":"CONNECT","namespace":"default","userInfo":{"username":"admin","groups":["system:masters"]},"dryRun":false}}`
+const podRequest = `{"request":{"uid":"4","resource":{"group":"","version":"v1","resource":"pods"},"operation":"CREATE","namespace":"default","userInfo":{"username":"admin","groups":["system:masters"]},"dryRun":false}}`
+const dryRunRequest = `{"request":{"uid":"5","resource":{"group":"apps","version":"v1","resource":"deployments"},"operation":"CREATE","namespace":"default","userInfo":{"username":"admin","groups":["system:masters"]},"dryRun":true}}`
+const nodeRequest = `{"request":{"uid":"6","resource":{"group":"","version":"v1","resource":"nodes"},"subResource":"status","operation":"UPDATE","userInfo":{"username":"system:node:a","groups":["system:nodes","system:authenticated"]},"dryRun":false}}`
+
+func writePolicy(t *testing.T, policy string) string {
+	policyFile := path.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(policyFile, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return policyFile
+}
+
+func setup(t *testing.T, policy string) (eventfilter.EventFilter, *mymock.MockCounterVec, error) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	counterVec := mymock.NewMockCounterVec(ctrl)
+	counter := mymock.NewMockCounter(ctrl)
+	counter.EXPECT().Inc().AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounterVec(gomock.Any(), gomock.Any(), []string{"rule"}).Return(counterVec).AnyTimes()
+	counterVec.EXPECT().WithLabelValues(gomock.Any()).Return(counter).AnyTimes()
+
+	pf, err := policyfilter.New(writePolicy(t, policy), ms)
+	return pf, counterVec, err
+}
+
+func Test_WhenRulesMatch_ThenFirstMatchDecides(t *testing.T) {
+	pf, _, err := setup(t, testPolicy)
+	if err != nil {
+		t.Fatalf("creating policy filter failed with : %s", err)
+	}
+
+	testCases := []struct {
+		name        string
+		body        string
+		shouldWrite bool
+	}{
+		{"lease from controller manager", leaseRequest, false},
+		{"pod exec included before pod subresources", podExecRequest, true},
+		{"pod log", podLogRequest, false},
+		{"pod itself is not a subresource", podRequest, true},
+		{"dry run", dryRunRequest, false},
+		{"node group", nodeRequest, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.shouldWrite, pf.ShouldWrite([]byte(tc.body)))
+		})
+	}
+}
+
+func Test_WhenDefaultActionExclude_ThenUnmatchedDropped(t *testing.T) {
+	pf, _, err := setup(t, `
+defaultAction: exclude
+rules:
+  - name: pods
+    action: include
+    resources:
+      - group: ""
+        resources: ["pods"]
+`)
+	if err != nil {
+		t.Fatalf("creating policy filter failed with : %s", err)
+	}
+
+	assert.True(t, pf.ShouldWrite([]byte(podRequest)))
+	assert.False(t, pf.ShouldWrite([]byte(leaseRequest)))
+}
+
+func Test_WhenEventDropped_ThenRuleCounterIncremented(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	counterVec := mymock.NewMockCounterVec(ctrl)
+	counter := mymock.NewMockCounter(ctrl)
+	ms.EXPECT().CreateAndRegisterCounterVec(gomock.Any(), gomock.Any(), gomock.Any()).Return(counterVec)
+	// Once at creation, once for the drop
+	counterVec.EXPECT().WithLabelValues("dry-run").Return(counter).Times(2)
+	counter.EXPECT().Inc().Times(1)
+
+	pf, err := policyfilter.New(writePolicy(t, "rules:\n  - name: dry-run\n    action: exclude\n    dryRun: true\n"), ms)
+	if err != nil {
+		t.Fatalf("creating policy filter failed with : %s", err)
+	}
+
+	assert.False(t, pf.ShouldWrite([]byte(dryRunRequest)))
+	assert.True(t, pf.ShouldWrite([]byte(podRequest)))
+}
+
+func Test_WhenPolicyInvalid_ThenErrorReturned(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy string
+	}{
+		{"unknown field", "rules:\n  - name: a\n    action: exclude\n    verbs: [get]\n"},
+		{"missing name", "rules:\n  - action: exclude\n"},
+		{"duplicate name", "rules:\n  - name: a\n    action: exclude\n  - name: a\n    action: include\n"},
+		{"bad action", "rules:\n  - name: a\n    action: drop\n"},
+		{"bad default action", "defaultAction: drop\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := setup(t, tc.policy)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_WhenPolicyFileMissing_ThenErrorReturned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	_, err := policyfilter.New(path.Join(t.TempDir(), "missing.yaml"), ms)
+	assert.Error(t, err)
+}
@@ -1,15 +1,23 @@
 package eventprocessorimpl
 
 import (
+	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	auditwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer"
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
 	"github.com/RichardoC/kube-audit-rest/internal/common"
+	eventfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter"
 	eventprocessor "github.com/RichardoC/kube-audit-rest/internal/event_processor"
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
 	"github.com/RichardoC/kube-audit-rest/internal/metrics"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // minimum viable response
@@ -24,37 +32,68 @@ const responseTemplate = `{
 }`
 
 type eventProcImpl struct {
-	validReqProc     metrics.Counter
-	totalReq         metrics.Counter
-	eventWritter     auditwriter.AuditWritter
-	responseTemplate template.Template
+	// By cluster, which is empty for requests to /log-request
+	validReqProc      metrics.CounterVec
+	totalReq          metrics.CounterVec
+	transformErrors   metrics.Counter
+	writeErrors       metrics.Counter
+	eventWritter      auditwriter.AuditWritter
+	eventFilters      []eventfilter.EventFilter
+	eventTransformers []eventtransformer.EventTransformer
+	responseTemplate  template.Template
+	// Events the writer accepted
+	written atomic.Int64
+	mu      sync.Mutex
+	// Events being written, and when writing last made progress
+	writing    int
+	progressed time.Time
 }
 
-func New(eventWritter auditwriter.AuditWritter, metricsServer metrics.MetricsServer) (eventprocessor.EventProcessor, error) {
-	validReqProc := metricsServer.CreateAndRegisterCounter(
+// Every filter must accept an event for it to be written, then the
+// transformers are applied in order before it's passed to the writer
+func New(eventWritter auditwriter.AuditWritter, metricsServer metrics.MetricsServer, eventFilters []eventfilter.EventFilter, eventTransformers []eventtransformer.EventTransformer) (eventprocessor.EventProcessor, error) {
+	validReqProc := metricsServer.CreateAndRegisterCounterVec(
 		"kube_audit_rest_valid_requests_processed_total",
-		"Total number of valid requests processed",
+		"Total number of valid requests processed, by the cluster in the request path",
+		[]string{"cluster"},
 	)
-	totalReq := metricsServer.CreateAndRegisterCounter(
+	totalReq := metricsServer.CreateAndRegisterCounterVec(
 		"kube_audit_rest_http_requests_total",
-		"Total number of requests to kube-audit-rest",
+		"Total number of requests to kube-audit-rest, by the cluster in the request path",
+		[]string{"cluster"},
+	)
+	transformErrors := metricsServer.CreateAndRegisterCounter(
+		"kube_audit_rest_event_transform_errors_total",
+		"Total number of valid requests not written because transforming them failed",
+	)
+	writeErrors := metricsServer.CreateAndRegisterCounter(
+		"kube_audit_rest_event_write_errors_total",
+		"Total number of valid requests the writer failed to write",
 	)
 	tmpl, err := template.New("name").Parse(responseTemplate)
 
 	if err != nil {
 		return &eventProcImpl{}, err
 	}
-	
+
 	return &eventProcImpl{
-		validReqProc:     validReqProc,
-		totalReq:         totalReq,
-		eventWritter:     eventWritter,
-		responseTemplate: *tmpl,
+		validReqProc:      validReqProc,
+		totalReq:          totalReq,
+		transformErrors:   transformErrors,
+		writeErrors:       writeErrors,
+		eventWritter:      eventWritter,
+		eventFilters:      eventFilters,
+		eventTransformers: eventTransformers,
+		responseTemplate:  *tmpl,
 	}, nil
 }
 
+// Requests to /log-request/{cluster} have the cluster added to the event as
+// kubeAuditRest.cluster, before it's filtered
 func (ep *eventProcImpl) ProcessEvent(w http.ResponseWriter, r *http.Request) {
-	ep.totalReq.Inc()
+	received := time.Now()
+	cluster := r.PathValue("cluster")
+	ep.totalReq.WithLabelValues(cluster).Inc()
 	common.Logger.Debugw("Got request", "request", r)
 	var body []byte
 	// Don't bother with any logic if there is no request
@@ -98,11 +137,35 @@ func (ep *eventProcImpl) ProcessEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Sychronous so that slower writes *do* slow our responses
-	ep.eventWritter.LogEvent(body)
+	// Only kube-audit-rest sets its metadata, so a request can't pick the
+	// cluster, and so the sinks, its event is written to
+	if gjson.GetBytes(body, commonwriter.MetadataField).Exists() {
+		withoutMetadata, err := sjson.DeleteBytes(body, commonwriter.MetadataField)
+		if err != nil {
+			common.Logger.Errorw("failed to remove metadata from request", "uid", requestUid, "error", err)
+			w.Header().Set("error", "invalid request")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		common.Logger.Warnw("removed metadata sent in the request", "uid", requestUid, "remoteAddr", r.RemoteAddr)
+		body = withoutMetadata
+	}
+	if cluster != "" {
+		if withCluster, err := sjson.SetBytes(body, commonwriter.MetadataField+".cluster", cluster); err == nil {
+			body = withCluster
+		} else {
+			common.Logger.Errorw("failed to add cluster to event", "uid", requestUid, "cluster", cluster, "error", err)
+		}
+	}
+
+	if ep.shouldWrite(body) {
+		ep.writeEvent(body, requestUid, received)
+	} else {
+		common.Logger.Debugw("event filtered out", "uid", requestUid)
+	}
 
 	// Record we processed a valid request
-	ep.validReqProc.Inc()
+	ep.validReqProc.WithLabelValues(cluster).Inc()
 
 	// Template the uid into our default approval and finish up
 
@@ -110,3 +173,67 @@ func (ep *eventProcImpl) ProcessEvent(w http.ResponseWriter, r *http.Request) {
 
 	// fmt.Fprintf(w, responseTemplate, requestUid)
 }
+
+func (ep *eventProcImpl) shouldWrite(body []byte) bool {
+	for _, filter := range ep.eventFilters {
+		if !filter.ShouldWrite(body) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ep *eventProcImpl) writeEvent(body []byte, requestUid string, received time.Time) {
+	// Stamped here rather than by the writer, which may write the event
+	// much later. Any timestamp sent in the request is replaced
+	if withTimestamp, err := sjson.SetBytes(body, commonwriter.TimestampField, received.Format(time.RFC3339Nano)); err == nil {
+		body = withTimestamp
+	} else {
+		common.Logger.Errorw("failed to add timestamp to event", "uid", requestUid, "error", err)
+	}
+
+	var err error
+	for _, transformer := range ep.eventTransformers {
+		body, err = transformer.Transform(body)
+		if err != nil {
+			// Better to lose the event than write something that should've been redacted
+			common.Logger.Errorw("failed to transform event, not writing it", "uid", requestUid, "error", err)
+			ep.transformErrors.Inc()
+			return
+		}
+	}
+
+	// Sychronous so that slower writes *do* slow our responses
+	ep.mu.Lock()
+	if ep.writing == 0 {
+		ep.progressed = time.Now()
+	}
+	ep.writing++
+	ep.mu.Unlock()
+	err = ep.eventWritter.LogEvent(body)
+	ep.mu.Lock()
+	ep.writing--
+	ep.progressed = time.Now()
+	ep.mu.Unlock()
+	if err != nil {
+		common.Logger.Errorw("failed to write event", "uid", requestUid, "error", err)
+		ep.writeErrors.Inc()
+		return
+	}
+	ep.written.Add(1)
+}
+
+func (ep *eventProcImpl) Written() int64 {
+	return ep.written.Load()
+}
+
+// Covers every writer, including a sink that can't tell whether it's
+// healthy itself
+func (ep *eventProcImpl) Live(timeout time.Duration) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.writing > 0 && time.Since(ep.progressed) > timeout {
+		return fmt.Errorf("writing events has made no progress for %s", time.Since(ep.progressed).Round(time.Second))
+	}
+	return nil
+}
@@ -1,14 +1,25 @@
 package eventprocessorimpl_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
+	commonwriter "github.com/RichardoC/kube-audit-rest/internal/audit_writer/common_writer"
+	eventfilter "github.com/RichardoC/kube-audit-rest/internal/event_filter"
 	eventprocessor "github.com/RichardoC/kube-audit-rest/internal/event_processor"
 	eventprocessorimpl "github.com/RichardoC/kube-audit-rest/internal/event_processor/event_processor_impl"
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
 	mymock "github.com/RichardoC/kube-audit-rest/mocks"
 	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 type mockResponseWriter struct{}
@@ -31,22 +42,60 @@ var correctBodyRequest string = `
 }
 `
 
+// Matches an event that's the expected one once the timestamp the event
+// processor adds is removed
+type stampedEvent string
+
+func (e stampedEvent) Matches(x interface{}) bool {
+	body, ok := x.([]byte)
+	if !ok {
+		return false
+	}
+	stamp := gjson.GetBytes(body, commonwriter.TimestampField).Str
+	if _, err := time.Parse(time.RFC3339Nano, stamp); err != nil {
+		return false
+	}
+	unstamped, err := sjson.DeleteBytes(body, commonwriter.TimestampField)
+	if err != nil {
+		return false
+	}
+	var want, got bytes.Buffer
+	json.Compact(&want, []byte(e))
+	json.Compact(&got, unstamped)
+	return want.String() == got.String()
+}
+
+func (e stampedEvent) String() string {
+	return fmt.Sprintf("is %s with a timestamp", string(e))
+}
+
 func setup(t *testing.T) (*mymock.MockAuditWritter, *mymock.MockMetricsServer) {
 	ctrl := gomock.NewController(t)
 	aw := mymock.NewMockAuditWritter(ctrl)
 	ms := mymock.NewMockMetricsServer(ctrl)
 	counter := mymock.NewMockCounter(ctrl)
 	counter.EXPECT().Inc().AnyTimes()
+	counterVec := mymock.NewMockCounterVec(ctrl)
+	counterVec.EXPECT().WithLabelValues(gomock.Any()).Return(counter).AnyTimes()
 	ms.EXPECT().CreateAndRegisterCounter(gomock.Any(), gomock.Any()).Return(counter).Times(2)
+	ms.EXPECT().CreateAndRegisterCounterVec(gomock.Any(), gomock.Any(), []string{"cluster"}).Return(counterVec).Times(2)
 	return aw, ms
 }
 
 func sendRequest(ep eventprocessor.EventProcessor, header map[string][]string, body string) {
+	sendClusterRequest(ep, header, body, "")
+}
+
+// Sends the request as if it was routed from /log-request/{cluster}
+func sendClusterRequest(ep eventprocessor.EventProcessor, header map[string][]string, body, cluster string) {
 	reader := strings.NewReader(body)
 	req, _ := http.NewRequest("POST", "localhost:80", reader)
 	if header != nil {
 		req.Header = header
 	}
+	if cluster != "" {
+		req.SetPathValue("cluster", cluster)
+	}
 	respWriter := &mockResponseWriter{}
 	ep.ProcessEvent(respWriter, req)
 }
@@ -56,8 +105,8 @@ func Test_WhenRequestWellFormatted_ThenResponseSent(t *testing.T) {
 	header["Content-Type"] = []string{"application/json"}
 
 	aw, ms := setup(t)
-	aw.EXPECT().LogEvent([]byte(correctBodyRequest))
-	ep, err := eventprocessorimpl.New(aw, ms)
+	aw.EXPECT().LogEvent(stampedEvent(correctBodyRequest))
+	ep, err := eventprocessorimpl.New(aw, ms, nil, nil)
 	if err != nil {
 		t.Errorf("creating event processor failed with : %s", err)
 	}
@@ -69,7 +118,7 @@ func Test_WhenBadHeader_ThenNoEventLogged(t *testing.T) {
 	header := make(map[string][]string)
 
 	aw, ms := setup(t)
-	ep, err := eventprocessorimpl.New(aw, ms)
+	ep, err := eventprocessorimpl.New(aw, ms, nil, nil)
 	if err != nil {
 		t.Errorf("creating event processor failed with : %s", err)
 	}
@@ -82,7 +131,7 @@ func Test_WhenInvalidJsonBody_ThenNoEventLogged(t *testing.T) {
 	header["Content-Type"] = []string{"application/json"}
 
 	aw, ms := setup(t)
-	ep, err := eventprocessorimpl.New(aw, ms)
+	ep, err := eventprocessorimpl.New(aw, ms, nil, nil)
 
 	if err != nil {
 		t.Errorf("creating event processor failed with : %s", err)
@@ -90,3 +139,193 @@ func Test_WhenInvalidJsonBody_ThenNoEventLogged(t *testing.T) {
 
 	sendRequest(ep, header, "")
 }
+
+func Test_WhenFilterRejectsEvent_ThenNoEventLogged(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	ctrl := gomock.NewController(t)
+	accept := mymock.NewMockEventFilter(ctrl)
+	accept.EXPECT().ShouldWrite([]byte(correctBodyRequest)).Return(true)
+	reject := mymock.NewMockEventFilter(ctrl)
+	reject.EXPECT().ShouldWrite([]byte(correctBodyRequest)).Return(false)
+	ep, err := eventprocessorimpl.New(aw, ms, []eventfilter.EventFilter{accept, reject}, nil)
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+
+	sendRequest(ep, header, correctBodyRequest)
+}
+
+func Test_WhenFiltersAcceptEvent_ThenEventLogged(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	aw.EXPECT().LogEvent(stampedEvent(correctBodyRequest))
+	ctrl := gomock.NewController(t)
+	accept := mymock.NewMockEventFilter(ctrl)
+	accept.EXPECT().ShouldWrite([]byte(correctBodyRequest)).Return(true)
+	ep, err := eventprocessorimpl.New(aw, ms, []eventfilter.EventFilter{accept}, nil)
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+
+	sendRequest(ep, header, correctBodyRequest)
+}
+
+func Test_WhenTransformersSucceed_ThenTransformedEventLogged(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	aw.EXPECT().LogEvent([]byte("second"))
+	ctrl := gomock.NewController(t)
+	first := mymock.NewMockEventTransformer(ctrl)
+	first.EXPECT().Transform(stampedEvent(correctBodyRequest)).Return([]byte("first"), nil)
+	second := mymock.NewMockEventTransformer(ctrl)
+	second.EXPECT().Transform([]byte("first")).Return([]byte("second"), nil)
+	ep, err := eventprocessorimpl.New(aw, ms, nil, []eventtransformer.EventTransformer{first, second})
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+
+	sendRequest(ep, header, correctBodyRequest)
+}
+
+func Test_WhenTransformerFails_ThenNoEventLogged(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	ctrl := gomock.NewController(t)
+	failing := mymock.NewMockEventTransformer(ctrl)
+	failing.EXPECT().Transform(gomock.Any()).Return(nil, errors.New("failed"))
+	ep, err := eventprocessorimpl.New(aw, ms, nil, []eventtransformer.EventTransformer{failing})
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+
+	sendRequest(ep, header, correctBodyRequest)
+}
+
+func Test_WhenRequestForCluster_ThenClusterAddedBeforeFiltering(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+	withCluster := `{"request":{"uid":"test-uid"},"kubeAuditRest":{"cluster":"prod"}}`
+
+	aw, ms := setup(t)
+	aw.EXPECT().LogEvent(stampedEvent(withCluster))
+	ctrl := gomock.NewController(t)
+	accept := mymock.NewMockEventFilter(ctrl)
+	accept.EXPECT().ShouldWrite([]byte(withCluster)).Return(true)
+	ep, err := eventprocessorimpl.New(aw, ms, []eventfilter.EventFilter{accept}, nil)
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+
+	sendClusterRequest(ep, header, `{"request":{"uid":"test-uid"}}`, "prod")
+}
+
+func Test_WhenRequestHasForgedCluster_ThenItIsRemoved(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	aw.EXPECT().LogEvent(stampedEvent(`{"request":{"uid":"test-uid"}}`))
+	ep, err := eventprocessorimpl.New(aw, ms, nil, nil)
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+
+	sendRequest(ep, header, `{"request":{"uid":"test-uid"},"kubeAuditRest":{"cluster":"prod"}}`)
+}
+
+func Test_WhenClusterRequestHasForgedCluster_ThenRoutedClusterUsed(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	aw.EXPECT().LogEvent(stampedEvent(`{"request":{"uid":"test-uid"},"kubeAuditRest":{"cluster":"dev"}}`))
+	ep, err := eventprocessorimpl.New(aw, ms, nil, nil)
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+
+	sendClusterRequest(ep, header, `{"request":{"uid":"test-uid"},"kubeAuditRest":{"cluster":"prod","region":"eu"}}`, "dev")
+}
+
+func Test_WhenRequestHasTimestamp_ThenReplacedWithReceivedTime(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	before := time.Now()
+	aw.EXPECT().LogEvent(stampedEvent(`{"request":{"uid":"test-uid"}}`)).Do(func(body []byte) {
+		received, err := time.Parse(time.RFC3339Nano, gjson.GetBytes(body, commonwriter.TimestampField).Str)
+		assert.NoError(t, err)
+		assert.False(t, received.Before(before))
+	})
+	ep, err := eventprocessorimpl.New(aw, ms, nil, nil)
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+
+	sendRequest(ep, header, `{"request":{"uid":"test-uid"},"requestReceivedTimestamp":"2000-01-01T00:00:00Z"}`)
+}
+
+func Test_WhenEventsWritten_ThenOnlyAcceptedOnesCounted(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	gomock.InOrder(
+		aw.EXPECT().LogEvent(gomock.Any()).Return(nil).Times(2),
+		aw.EXPECT().LogEvent(gomock.Any()).Return(errors.New("disk full")),
+	)
+	ep, err := eventprocessorimpl.New(aw, ms, nil, nil)
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+	tracker, ok := ep.(eventprocessor.WriteTracker)
+	assert.True(t, ok)
+
+	for range 3 {
+		sendRequest(ep, header, correctBodyRequest)
+	}
+	// Rejected as invalid, so never written
+	sendRequest(ep, header, "")
+
+	assert.Equal(t, int64(2), tracker.Written())
+}
+
+func Test_WhenWriteMakesNoProgress_ThenLiveFails(t *testing.T) {
+	header := make(map[string][]string)
+	header["Content-Type"] = []string{"application/json"}
+
+	aw, ms := setup(t)
+	release := make(chan struct{})
+	aw.EXPECT().LogEvent(gomock.Any()).DoAndReturn(func([]byte) error {
+		<-release
+		return nil
+	})
+	ep, err := eventprocessorimpl.New(aw, ms, nil, nil)
+	if err != nil {
+		t.Errorf("creating event processor failed with : %s", err)
+	}
+	tracker := ep.(eventprocessor.WriteTracker)
+	assert.NoError(t, tracker.Live(0))
+
+	done := make(chan struct{})
+	go func() {
+		sendRequest(ep, header, correctBodyRequest)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return tracker.Live(0) != nil }, time.Second, time.Millisecond)
+	assert.NoError(t, tracker.Live(time.Hour))
+	close(release)
+	<-done
+	assert.NoError(t, tracker.Live(0))
+}
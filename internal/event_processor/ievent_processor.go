@@ -4,8 +4,20 @@ package eventprocessor
 
 //go:generate mockgen -package mymock -destination ../../mocks/event_processor_mock.go github.com/RichardoC/kube-audit-rest/internal/event_processor EventProcessor
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 type EventProcessor interface {
 	ProcessEvent(http.ResponseWriter, *http.Request)
 }
+
+// Implemented by EventProcessors that keep track of the events they've
+// passed to the writer
+type WriteTracker interface {
+	// Returns how many events the writer has accepted so far
+	Written() int64
+	// Fails when writing events has made no progress for longer than timeout
+	Live(timeout time.Duration) error
+}
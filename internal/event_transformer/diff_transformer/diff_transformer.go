@@ -0,0 +1,223 @@
+package difftransformer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+type Mode string
+
+const (
+	// An RFC 6902 JSON Patch turning oldObject into object
+	ModeJSONPatch Mode = "json-patch"
+	// The JSON Pointers of every changed value, without the values
+	ModePaths Mode = "paths"
+)
+
+// The top level field the diff is written to
+const DiffField = "objectDiff"
+
+type operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type diffTransformer struct {
+	mode    Mode
+	ignored [][]string
+	diffed  metrics.Counter
+}
+
+// Ignored paths are within the object, such as metadata.managedFields, with
+// dots within keys escaped with a backslash and "*" matching every key or
+// array element. Everything below an ignored path is ignored too
+func New(mode Mode, ignoredPaths []string, metricsServer metrics.MetricsServer) (eventtransformer.EventTransformer, error) {
+	if !slices.Contains([]Mode{ModeJSONPatch, ModePaths}, mode) {
+		return nil, fmt.Errorf("unknown diff mode %q", mode)
+	}
+
+	ignored := make([][]string, 0, len(ignoredPaths))
+	for _, path := range ignoredPaths {
+		if path == "" {
+			return nil, fmt.Errorf("ignored diff paths can't be empty")
+		}
+		ignored = append(ignored, eventtransformer.SplitPath(path))
+	}
+
+	diffed := metricsServer.CreateAndRegisterCounter(
+		"kube_audit_rest_diffed_events_total",
+		"Total number of events with a diff between oldObject and object",
+	)
+
+	return &diffTransformer{mode: mode, ignored: ignored, diffed: diffed}, nil
+}
+
+// Events without both an object and an oldObject, such as creates and
+// deletes, are left as they are
+func (dt *diffTransformer) Transform(body []byte) ([]byte, error) {
+	oldObject := gjson.GetBytes(body, "request.oldObject")
+	object := gjson.GetBytes(body, "request.object")
+	if !oldObject.IsObject() || !object.IsObject() {
+		return body, nil
+	}
+
+	operations := []operation{}
+	dt.diff(oldObject, object, nil, &operations)
+
+	var diff any = operations
+	if dt.mode == ModePaths {
+		paths := make([]string, 0, len(operations))
+		for _, op := range operations {
+			paths = append(paths, op.Path)
+		}
+		diff = paths
+	}
+
+	// Leave any HTML characters in the values as they were
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(diff); err != nil {
+		return nil, fmt.Errorf("failed to encode diff: %w", err)
+	}
+	body, err := sjson.SetRawBytes(body, DiffField, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add diff: %w", err)
+	}
+	dt.diffed.Inc()
+	return body, nil
+}
+
+// Appends the operations turning from into to, which are at path
+func (dt *diffTransformer) diff(from, to gjson.Result, path []string, operations *[]operation) {
+	if dt.isIgnored(path) {
+		return
+	}
+	switch {
+	case from.IsObject() && to.IsObject():
+		dt.diffObjects(from, to, path, operations)
+	case from.IsArray() && to.IsArray():
+		dt.diffArrays(from, to, path, operations)
+	case !equal(from, to):
+		*operations = append(*operations, operation{Op: "replace", Path: pointer(path), Value: json.RawMessage(to.Raw)})
+	}
+}
+
+func (dt *diffTransformer) diffObjects(from, to gjson.Result, path []string, operations *[]operation) {
+	fromMap := from.Map()
+	toMap := to.Map()
+	// In the order of the objects, so the diff is the same for the same change
+	from.ForEach(func(key, value gjson.Result) bool {
+		childPath := append(slices.Clone(path), key.Str)
+		if toValue, ok := toMap[key.Str]; ok {
+			dt.diff(value, toValue, childPath, operations)
+		} else if !dt.isIgnored(childPath) {
+			*operations = append(*operations, operation{Op: "remove", Path: pointer(childPath)})
+		}
+		return true
+	})
+	to.ForEach(func(key, value gjson.Result) bool {
+		childPath := append(slices.Clone(path), key.Str)
+		if _, ok := fromMap[key.Str]; !ok && !dt.isIgnored(childPath) {
+			*operations = append(*operations, operation{Op: "add", Path: pointer(childPath), Value: json.RawMessage(value.Raw)})
+		}
+		return true
+	})
+}
+
+// Elements are compared by index, so inserting near the start of an array
+// replaces every element after it
+func (dt *diffTransformer) diffArrays(from, to gjson.Result, path []string, operations *[]operation) {
+	fromElements := from.Array()
+	toElements := to.Array()
+	common := min(len(fromElements), len(toElements))
+	for i := 0; i < common; i++ {
+		dt.diff(fromElements[i], toElements[i], append(slices.Clone(path), strconv.Itoa(i)), operations)
+	}
+	// Removed from the end, so the indexes of the earlier removals don't shift
+	for i := len(fromElements) - 1; i >= common; i-- {
+		childPath := append(slices.Clone(path), strconv.Itoa(i))
+		if !dt.isIgnored(childPath) {
+			*operations = append(*operations, operation{Op: "remove", Path: pointer(childPath)})
+		}
+	}
+	for i := common; i < len(toElements); i++ {
+		childPath := append(slices.Clone(path), strconv.Itoa(i))
+		if !dt.isIgnored(childPath) {
+			*operations = append(*operations, operation{Op: "add", Path: pointer(childPath), Value: json.RawMessage(toElements[i].Raw)})
+		}
+	}
+}
+
+// Whether path is, or is below, an ignored path
+func (dt *diffTransformer) isIgnored(path []string) bool {
+	for _, ignored := range dt.ignored {
+		if len(ignored) > len(path) {
+			continue
+		}
+		matches := true
+		for i, segment := range ignored {
+			if segment != "*" && segment != path[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares values semantically, so differences in whitespace or escaping
+// aren't changes
+func equal(a, b gjson.Result) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case gjson.String:
+		return a.Str == b.Str
+	case gjson.Number:
+		if a.Raw == b.Raw {
+			return true
+		}
+		// Integers are only written one way, and large ones can't be
+		// compared as floats
+		if isInteger(a.Raw) && isInteger(b.Raw) {
+			return false
+		}
+		return a.Num == b.Num
+	case gjson.JSON:
+		// Only reached when an object is compared with an array
+		return false
+	}
+	// Null, true and false
+	return true
+}
+
+func isInteger(raw string) bool {
+	return !strings.ContainsAny(raw, ".eE")
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// Returns the RFC 6901 JSON Pointer of path within the object
+func pointer(path []string) string {
+	var b strings.Builder
+	for _, segment := range path {
+		b.WriteByte('/')
+		b.WriteString(pointerEscaper.Replace(segment))
+	}
+	return b.String()
+}
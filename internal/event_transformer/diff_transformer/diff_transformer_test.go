@@ -0,0 +1,115 @@
+package difftransformer_test
+
+import (
+	"testing"
+
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	difftransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer/diff_transformer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+const deploymentUpdate = `{"request":{"uid":"1","kind":{"group":"apps","version":"v1","kind":"Deployment"},"operation":"UPDATE",` +
+	`"object":{"kind":"Deployment","metadata":{"name":"d","resourceVersion":"2","labels":{"app":"web","example.com/tier":"<b>"},"managedFields":[{"manager":"kubectl"}]},"spec":{"replicas":3,"paused":true,"template":{"spec":{"containers":[{"name":"web","image":"web:2"}]}}}},` +
+	`"oldObject":{"kind":"Deployment","metadata":{"name":"d","resourceVersion":"1","labels":{"app":"web","owner":"a"},"managedFields":[]},"spec":{"replicas":1.0,"template":{"spec":{"containers":[{"name":"web","image":"web:1"},{"name":"sidecar","image":"proxy"}]}}}}}}`
+
+const configMapCreate = `{"request":{"uid":"2","kind":{"group":"","version":"v1","kind":"ConfigMap"},"operation":"CREATE",` +
+	`"object":{"kind":"ConfigMap","metadata":{"name":"c"},"data":{"colour":"blue"}},"oldObject":null}}`
+
+var defaultIgnoredPaths = []string{"metadata.managedFields", "metadata.resourceVersion"}
+
+func setup(t *testing.T, mode difftransformer.Mode, ignoredPaths []string) (eventtransformer.EventTransformer, *mymock.MockCounter) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	counter := mymock.NewMockCounter(ctrl)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_diffed_events_total", gomock.Any()).Return(counter)
+
+	dt, err := difftransformer.New(mode, ignoredPaths, ms)
+	if err != nil {
+		t.Fatalf("creating diff transformer failed with : %s", err)
+	}
+	return dt, counter
+}
+
+func Test_WhenModeJSONPatch_ThenPatchFromOldObjectToObjectAdded(t *testing.T) {
+	dt, counter := setup(t, difftransformer.ModeJSONPatch, defaultIgnoredPaths)
+	counter.EXPECT().Inc()
+
+	out, err := dt.Transform([]byte(deploymentUpdate))
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op":"remove","path":"/metadata/labels/owner"},
+		{"op":"add","path":"/metadata/labels/example.com~1tier","value":"<b>"},
+		{"op":"replace","path":"/spec/replicas","value":3},
+		{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"web:2"},
+		{"op":"remove","path":"/spec/template/spec/containers/1"},
+		{"op":"add","path":"/spec/paused","value":true}
+	]`, gjson.GetBytes(out, "objectDiff").Raw)
+	assert.Contains(t, gjson.GetBytes(out, "objectDiff").Raw, `"<b>"`)
+	// The event itself is unchanged
+	assert.Equal(t, gjson.Get(deploymentUpdate, "request").Raw, gjson.GetBytes(out, "request").Raw)
+}
+
+func Test_WhenModePaths_ThenChangedPathsAdded(t *testing.T) {
+	dt, counter := setup(t, difftransformer.ModePaths, defaultIgnoredPaths)
+	counter.EXPECT().Inc()
+
+	out, err := dt.Transform([]byte(deploymentUpdate))
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["/metadata/labels/owner","/metadata/labels/example.com~1tier","/spec/replicas","/spec/template/spec/containers/0/image","/spec/template/spec/containers/1","/spec/paused"]`,
+		gjson.GetBytes(out, "objectDiff").Raw)
+}
+
+func Test_WhenPathsNotIgnored_ThenNoisyFieldsIncluded(t *testing.T) {
+	dt, counter := setup(t, difftransformer.ModePaths, []string{`metadata.labels.example\.com/tier`, "spec.template.spec.containers.*.image"})
+	counter.EXPECT().Inc()
+
+	out, err := dt.Transform([]byte(deploymentUpdate))
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `["/metadata/resourceVersion","/metadata/labels/owner","/metadata/managedFields/0","/spec/replicas","/spec/template/spec/containers/1","/spec/paused"]`,
+		gjson.GetBytes(out, "objectDiff").Raw)
+}
+
+func Test_WhenObjectsEqual_ThenEmptyDiffAdded(t *testing.T) {
+	dt, counter := setup(t, difftransformer.ModeJSONPatch, nil)
+	counter.EXPECT().Inc()
+
+	out, err := dt.Transform([]byte(`{"request":{"object":{"a":{"b":[1,"x"]},"c":1e2},"oldObject":{ "a" : {"b":[1,"x"]},"c":100}}}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", gjson.GetBytes(out, "objectDiff").Raw)
+}
+
+func Test_WhenLargeIntegersDiffer_ThenReplaced(t *testing.T) {
+	dt, counter := setup(t, difftransformer.ModeJSONPatch, nil)
+	counter.EXPECT().Inc()
+
+	out, err := dt.Transform([]byte(`{"request":{"object":{"n":9007199254740993},"oldObject":{"n":9007199254740992}}}`))
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"op":"replace","path":"/n","value":9007199254740993}]`, gjson.GetBytes(out, "objectDiff").Raw)
+}
+
+func Test_WhenNoOldObject_ThenEventUnchanged(t *testing.T) {
+	dt, _ := setup(t, difftransformer.ModeJSONPatch, defaultIgnoredPaths)
+
+	out, err := dt.Transform([]byte(configMapCreate))
+
+	assert.NoError(t, err)
+	assert.Equal(t, configMapCreate, string(out))
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+
+	_, err := difftransformer.New("unified", nil, ms)
+	assert.Error(t, err)
+	_, err = difftransformer.New(difftransformer.ModePaths, []string{""}, ms)
+	assert.Error(t, err)
+}
@@ -0,0 +1,17 @@
+// Package eventtransformer provides the interfaces to modify events
+// before they are written by the audit writer
+package eventtransformer
+
+//go:generate mockgen -package mymock -destination ../../mocks/event_transformer_mock.go github.com/RichardoC/kube-audit-rest/internal/event_transformer EventTransformer
+
+type EventTransformer interface {
+	// Returns the modified AdmissionReview in body.
+	// If an error is returned the event must not be written
+	Transform(body []byte) ([]byte, error)
+}
+
+// Implemented by transformers with work in the background, which is stopped
+// by Close once no more events will be transformed
+type Closer interface {
+	Close()
+}
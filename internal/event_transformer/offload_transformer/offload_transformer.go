@@ -0,0 +1,171 @@
+package offloadtransformer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	blobstore "github.com/RichardoC/kube-audit-rest/internal/blob_store"
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Blobs can be marked as used up to an hour late, so shorter retentions
+// could sweep blobs that are still used
+const minRetention = 24 * time.Hour
+
+// Also the time allowed for each sweep, a sweep that takes longer carries on
+// the next time
+const sweepInterval = time.Hour
+
+// Both the object and the state before the request are offloaded
+var objectPaths = []string{"request.object", "request.oldObject"}
+
+type Config struct {
+	Store blobstore.BlobStore
+	// Objects larger than this many bytes are offloaded
+	Threshold int
+	// Blobs that haven't been used for this long are swept, 0 keeps them forever
+	Retention time.Duration
+	// Time allowed to store each object, after which it's written as it is
+	Timeout time.Duration
+}
+
+type offloadTransformer struct {
+	store     blobstore.BlobStore
+	threshold int
+	timeout   time.Duration
+	// Cancelled by Close, stopping the sweeper
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopped   sync.WaitGroup
+	offloaded metrics.Counter
+	bytes     metrics.Counter
+	stored    metrics.Counter
+	errors    metrics.Counter
+	swept     metrics.Counter
+}
+
+// Starts sweeping the store in the background when there's a retention,
+// until Close is called
+func New(config Config, metricsServer metrics.MetricsServer) (eventtransformer.EventTransformer, error) {
+	if config.Store == nil {
+		return nil, errors.New("a blob store is required")
+	}
+	if config.Threshold <= 0 {
+		return nil, errors.New("the offload threshold must be positive")
+	}
+	if config.Retention != 0 && config.Retention < minRetention {
+		return nil, fmt.Errorf("blob retention must be at least %s, or 0 to keep blobs forever", minRetention)
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.New("the blob store timeout must be positive")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ot := &offloadTransformer{
+		store:     config.Store,
+		threshold: config.Threshold,
+		timeout:   config.Timeout,
+		ctx:       ctx,
+		cancel:    cancel,
+		offloaded: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_offloaded_objects_total",
+			"Total number of objects replaced by a reference to the blob store",
+		),
+		bytes: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_offloaded_bytes_total",
+			"Total number of bytes of objects replaced by a reference to the blob store",
+		),
+		stored: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_blobs_stored_total",
+			"Total number of blobs stored, objects already in the blob store aren't stored again",
+		),
+		errors: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_blob_store_errors_total",
+			"Total number of failures to store or sweep blobs, objects that can't be stored are written as they are",
+		),
+		swept: metricsServer.CreateAndRegisterCounter(
+			"kube_audit_rest_blobs_swept_total",
+			"Total number of blobs deleted after not being used for the retention period",
+		),
+	}
+	if config.Retention > 0 {
+		ot.stopped.Add(1)
+		go ot.sweep(config.Retention)
+	}
+	return ot, nil
+}
+
+// Stops the sweeper, abandoning a sweep in progress, and waits for it
+func (ot *offloadTransformer) Close() {
+	ot.cancel()
+	ot.stopped.Wait()
+}
+
+// Objects are replaced by {"$blob":"sha256:<digest>","size":<bytes>}. If an
+// object can't be stored it's left as it is, so the event is still written
+func (ot *offloadTransformer) Transform(body []byte) ([]byte, error) {
+	for _, objectPath := range objectPaths {
+		object := gjson.GetBytes(body, objectPath)
+		if !object.IsObject() || len(object.Raw) <= ot.threshold {
+			continue
+		}
+		sum := sha256.Sum256([]byte(object.Raw))
+		digest := hex.EncodeToString(sum[:])
+		ctx, cancel := context.WithTimeout(ot.ctx, ot.timeout)
+		stored, err := ot.store.Put(ctx, digest, []byte(object.Raw))
+		cancel()
+		if err != nil {
+			common.Logger.Errorw("failed to store object in the blob store, writing it as it is", "path", objectPath, "error", err)
+			ot.errors.Inc()
+			continue
+		}
+		if stored {
+			ot.stored.Inc()
+		}
+
+		reference := fmt.Appendf(nil, `{"$blob":"sha256:%s","size":%d}`, digest, len(object.Raw))
+		body, err = sjson.SetRawBytes(body, objectPath, reference)
+		if err != nil {
+			return nil, fmt.Errorf("failed to replace %s with its blob: %w", objectPath, err)
+		}
+		ot.offloaded.Inc()
+		ot.bytes.Add(float64(len(object.Raw)))
+	}
+	return body, nil
+}
+
+func (ot *offloadTransformer) sweep(retention time.Duration) {
+	defer ot.stopped.Done()
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(ot.ctx, sweepInterval)
+		swept, err := ot.store.Sweep(ctx, time.Now().Add(-retention))
+		cancel()
+		if swept > 0 {
+			common.Logger.Infow("swept unused blobs", "blobs", swept)
+			ot.swept.Add(float64(swept))
+		}
+		if ot.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			common.Logger.Errorw("failed to sweep blobs, trying again later", "error", err)
+			ot.errors.Inc()
+		}
+		select {
+		case <-ticker.C:
+		case <-ot.ctx.Done():
+			return
+		}
+	}
+}
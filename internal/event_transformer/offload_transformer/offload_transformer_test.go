@@ -0,0 +1,189 @@
+package offloadtransformer_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	offloadtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer/offload_transformer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+var largeObject = `{"kind":"ConfigMap","data":{"big":"` + strings.Repeat("x", 100) + `"}}`
+
+const smallObject = `{"kind":"ConfigMap"}`
+
+func digest(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func request(object, oldObject string) string {
+	return `{"request":{"uid":"1","operation":"UPDATE","object":` + object + `,"oldObject":` + oldObject + `}}`
+}
+
+type offloadMetrics struct {
+	offloaded, bytes, stored, errors, swept *mymock.MockCounter
+}
+
+func setup(t *testing.T) (*mymock.MockMetricsServer, *mymock.MockBlobStore, offloadMetrics) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	store := mymock.NewMockBlobStore(ctrl)
+	m := offloadMetrics{
+		offloaded: mymock.NewMockCounter(ctrl),
+		bytes:     mymock.NewMockCounter(ctrl),
+		stored:    mymock.NewMockCounter(ctrl),
+		errors:    mymock.NewMockCounter(ctrl),
+		swept:     mymock.NewMockCounter(ctrl),
+	}
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_offloaded_objects_total", gomock.Any()).Return(m.offloaded)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_offloaded_bytes_total", gomock.Any()).Return(m.bytes)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_blobs_stored_total", gomock.Any()).Return(m.stored)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_blob_store_errors_total", gomock.Any()).Return(m.errors)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_blobs_swept_total", gomock.Any()).Return(m.swept)
+	return ms, store, m
+}
+
+// Expectations for the sweeper must be set before it's created
+func newTransformer(t *testing.T, ms *mymock.MockMetricsServer, store *mymock.MockBlobStore, retention time.Duration) eventtransformer.EventTransformer {
+	ot, err := offloadtransformer.New(offloadtransformer.Config{Store: store, Threshold: 64, Retention: retention, Timeout: 50 * time.Millisecond}, ms)
+	if err != nil {
+		t.Fatalf("creating offload transformer failed with : %s", err)
+	}
+	t.Cleanup(ot.(eventtransformer.Closer).Close)
+	return ot
+}
+
+func Test_WhenObjectOverThreshold_ThenReplacedByReference(t *testing.T) {
+	ms, store, m := setup(t)
+	store.EXPECT().Put(gomock.Any(), digest(largeObject), []byte(largeObject)).Return(true, nil)
+	m.stored.EXPECT().Inc()
+	m.offloaded.EXPECT().Inc()
+	m.bytes.EXPECT().Add(float64(len(largeObject)))
+
+	ot := newTransformer(t, ms, store, 0)
+	out, err := ot.Transform([]byte(request(largeObject, smallObject)))
+
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"$blob":"sha256:`+digest(largeObject)+`","size":`+strconv.Itoa(len(largeObject))+`}`, gjson.GetBytes(out, "request.object").Raw)
+	assert.Equal(t, smallObject, gjson.GetBytes(out, "request.oldObject").Raw)
+}
+
+func Test_WhenObjectsIdentical_ThenStoredOnce(t *testing.T) {
+	ms, store, m := setup(t)
+	gomock.InOrder(
+		store.EXPECT().Put(gomock.Any(), digest(largeObject), gomock.Any()).Return(true, nil),
+		store.EXPECT().Put(gomock.Any(), digest(largeObject), gomock.Any()).Return(false, nil),
+	)
+	m.stored.EXPECT().Inc()
+	m.offloaded.EXPECT().Inc().Times(2)
+	m.bytes.EXPECT().Add(gomock.Any()).Times(2)
+
+	ot := newTransformer(t, ms, store, 0)
+	out, err := ot.Transform([]byte(request(largeObject, largeObject)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, gjson.GetBytes(out, "request.object").Raw, gjson.GetBytes(out, "request.oldObject").Raw)
+}
+
+func Test_WhenStoreFails_ThenObjectKept(t *testing.T) {
+	ms, store, m := setup(t)
+	store.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).Return(false, errors.New("disk full"))
+	m.errors.EXPECT().Inc()
+	event := request(largeObject, "null")
+
+	ot := newTransformer(t, ms, store, 0)
+	out, err := ot.Transform([]byte(event))
+
+	assert.NoError(t, err)
+	assert.Equal(t, event, string(out))
+}
+
+func Test_WhenStoreTooSlow_ThenObjectKept(t *testing.T) {
+	ms, store, m := setup(t)
+	store.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, _ string, _ []byte) (bool, error) {
+		<-ctx.Done()
+		return false, ctx.Err()
+	})
+	m.errors.EXPECT().Inc()
+	event := request(largeObject, "null")
+
+	ot := newTransformer(t, ms, store, 0)
+	start := time.Now()
+	out, err := ot.Transform([]byte(event))
+
+	assert.NoError(t, err)
+	assert.Equal(t, event, string(out))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func Test_WhenClosed_ThenSweepStopped(t *testing.T) {
+	started := make(chan struct{})
+	ms, store, _ := setup(t)
+	store.EXPECT().Sweep(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, _ time.Time) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	ot := newTransformer(t, ms, store, 48*time.Hour)
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		ot.(eventtransformer.Closer).Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sweeper wasn't stopped")
+	}
+}
+
+func Test_WhenRetentionSet_ThenUnusedBlobsSwept(t *testing.T) {
+	done := make(chan struct{})
+	ms, store, m := setup(t)
+	store.EXPECT().Sweep(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, before time.Time) (int, error) {
+		assert.WithinDuration(t, time.Now().Add(-48*time.Hour), before, time.Minute)
+		return 2, nil
+	})
+	m.swept.EXPECT().Add(float64(2)).Do(func(float64) { close(done) })
+	newTransformer(t, ms, store, 48*time.Hour)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blobs weren't swept")
+	}
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	store := mymock.NewMockBlobStore(ctrl)
+	testCases := []struct {
+		name   string
+		config offloadtransformer.Config
+	}{
+		{"no store", offloadtransformer.Config{Threshold: 64, Timeout: time.Second}},
+		{"no threshold", offloadtransformer.Config{Store: store, Timeout: time.Second}},
+		{"short retention", offloadtransformer.Config{Store: store, Threshold: 64, Retention: time.Hour, Timeout: time.Second}},
+		{"no timeout", offloadtransformer.Config{Store: store, Threshold: 64}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := offloadtransformer.New(tc.config, ms)
+			assert.Error(t, err)
+		})
+	}
+}
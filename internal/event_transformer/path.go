@@ -0,0 +1,23 @@
+package eventtransformer
+
+import "strings"
+
+// Splits a path within an object, such as metadata.annotations.example\.com/token,
+// on dots, except those escaped with a backslash
+func SplitPath(path string) []string {
+	var segments []string
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path):
+			i++
+			current.WriteByte(path[i])
+		case path[i] == '.':
+			segments = append(segments, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	return append(segments, current.String())
+}
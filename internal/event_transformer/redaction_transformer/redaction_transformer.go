@@ -0,0 +1,193 @@
+package redactiontransformer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+type Mode string
+
+const (
+	// Delete the field
+	ModeRemove Mode = "remove"
+	// Replace the value with a fixed string
+	ModeMask Mode = "mask"
+	// Replace the value with a salted SHA-256, so changes are still detectable
+	ModeHash Mode = "hash"
+)
+
+const maskValue = "REDACTED"
+
+// Always redacted, in the same format as the user provided rules. There's
+// no rule for the token of a TokenRequest, as it's only set in the response
+// after admission, so it's never in an event
+var DefaultRules = []string{
+	"Secret:data",
+	"Secret:stringData",
+	// kubectl apply stores the whole Secret, data included, in this annotation
+	`Secret:metadata.annotations.kubectl\.kubernetes\.io/last-applied-configuration`,
+}
+
+// Both the object and the state before the request are redacted
+var objectPaths = []string{"request.object", "request.oldObject"}
+
+type rule struct {
+	// Matched against request.kind.kind, "*" matches every kind
+	kind string
+	// Path within the object, with "*" matching every key or array element
+	path []string
+}
+
+type redactionTransformer struct {
+	mode     Mode
+	rules    []rule
+	salt     []byte
+	redacted metrics.Counter
+}
+
+// Rules are of the form <kind>:<path>, such as "ConfigMap:data.password"
+// or "*:metadata.annotations.example\.com/token". Dots within keys are escaped
+// with a backslash. If salt is empty for the hash mode a random one is used,
+// so hashes can only be compared within the lifetime of this process
+func New(mode Mode, rules []string, salt []byte, metricsServer metrics.MetricsServer) (eventtransformer.EventTransformer, error) {
+	if !slices.Contains([]Mode{ModeRemove, ModeMask, ModeHash}, mode) {
+		return nil, fmt.Errorf("unknown redaction mode %q", mode)
+	}
+
+	parsedRules := make([]rule, 0, len(DefaultRules)+len(rules))
+	for _, r := range append(slices.Clone(DefaultRules), rules...) {
+		parsed, err := parseRule(r)
+		if err != nil {
+			return nil, err
+		}
+		parsedRules = append(parsedRules, parsed)
+	}
+
+	if mode == ModeHash && len(salt) == 0 {
+		common.Logger.Warnw("no redaction salt provided, generating a random one so hashes will change on restart")
+		salt = make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+
+	redacted := metricsServer.CreateAndRegisterCounter(
+		"kube_audit_rest_redacted_fields_total",
+		"Total number of fields redacted from events",
+	)
+
+	return &redactionTransformer{mode: mode, rules: parsedRules, salt: salt, redacted: redacted}, nil
+}
+
+func parseRule(r string) (rule, error) {
+	kind, path, found := strings.Cut(r, ":")
+	if !found || kind == "" || path == "" {
+		return rule{}, fmt.Errorf("redaction rule %q must be of the form <kind>:<path>", r)
+	}
+	return rule{kind: kind, path: eventtransformer.SplitPath(path)}, nil
+}
+
+func (rt *redactionTransformer) Transform(body []byte) ([]byte, error) {
+	kind := gjson.GetBytes(body, "request.kind.kind").Str
+	var err error
+	for _, r := range rt.rules {
+		if r.kind != "*" && r.kind != kind {
+			continue
+		}
+		for _, objectPath := range objectPaths {
+			matches := expand(gjson.GetBytes(body, objectPath), objectPath, r.path)
+			// Work backwards so removing array elements doesn't shift the later matches
+			for i := len(matches) - 1; i >= 0; i-- {
+				body, err = rt.redact(body, matches[i])
+				if err != nil {
+					return nil, fmt.Errorf("failed to redact %s: %w", matches[i], err)
+				}
+			}
+		}
+	}
+	return body, nil
+}
+
+// Returns the escaped paths of every existing value matching segments
+func expand(value gjson.Result, prefix string, segments []string) []string {
+	if !value.Exists() {
+		return nil
+	}
+	if len(segments) == 0 {
+		return []string{prefix}
+	}
+
+	if !value.IsObject() && !value.IsArray() {
+		return nil
+	}
+	var matches []string
+	if segments[0] == "*" {
+		children(value, prefix, func(childPath string, child gjson.Result) {
+			matches = append(matches, expand(child, childPath, segments[1:])...)
+		})
+		return matches
+	}
+	child := value.Get(gjson.Escape(segments[0]))
+	return expand(child, prefix+"."+gjson.Escape(segments[0]), segments[1:])
+}
+
+// Calls fn with the escaped path of every member of an object or array
+func children(value gjson.Result, prefix string, fn func(string, gjson.Result)) {
+	index := 0
+	value.ForEach(func(key, child gjson.Result) bool {
+		if value.IsArray() {
+			fn(prefix+"."+strconv.Itoa(index), child)
+			index++
+		} else {
+			fn(prefix+"."+gjson.Escape(key.Str), child)
+		}
+		return true
+	})
+}
+
+func (rt *redactionTransformer) redact(body []byte, path string) ([]byte, error) {
+	if rt.mode == ModeRemove {
+		rt.redacted.Inc()
+		return sjson.DeleteBytes(body, path)
+	}
+
+	// Keep the keys of maps such as Secret data visible, so it's clear which ones changed
+	value := gjson.GetBytes(body, path)
+	if !value.IsObject() && !value.IsArray() {
+		return rt.replace(body, path, value)
+	}
+	var err error
+	children(value, path, func(childPath string, child gjson.Result) {
+		if err == nil {
+			body, err = rt.replace(body, childPath, child)
+		}
+	})
+	return body, err
+}
+
+func (rt *redactionTransformer) replace(body []byte, path string, value gjson.Result) ([]byte, error) {
+	rt.redacted.Inc()
+	if rt.mode == ModeMask {
+		return sjson.SetBytes(body, path, maskValue)
+	}
+
+	hash := sha256.New()
+	hash.Write(rt.salt)
+	if value.Type == gjson.String {
+		hash.Write([]byte(value.Str))
+	} else {
+		hash.Write([]byte(value.Raw))
+	}
+	return sjson.SetBytes(body, path, "sha256:"+hex.EncodeToString(hash.Sum(nil)))
+}
@@ -0,0 +1,118 @@
+package redactiontransformer_test
+
+import (
+	"strings"
+	"testing"
+
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	redactiontransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer/redaction_transformer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+const secretRequest = `{"request":{"uid":"1","kind":{"group":"","version":"v1","kind":"Secret"},"operation":"UPDATE",` +
+	`"object":{"kind":"Secret","metadata":{"name":"s","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{\"data\":{\"password\":\"aHVudGVyMg==\"}}","team":"a"}},"data":{"password":"aHVudGVyMg==","user":"YWRtaW4="},"type":"Opaque"},` +
+	`"oldObject":{"kind":"Secret","metadata":{"name":"s"},"stringData":{"password":"hunter1"},"type":"Opaque"}}}`
+
+const configMapRequest = `{"request":{"uid":"2","kind":{"group":"","version":"v1","kind":"ConfigMap"},"operation":"CREATE",` +
+	`"object":{"kind":"ConfigMap","metadata":{"name":"c"},"data":{"password":"hunter2","colour":"blue"},"list":[{"token":"a"},{"token":"b"}]},"oldObject":null}}`
+
+func setup(t *testing.T, mode redactiontransformer.Mode, rules []string, salt string) eventtransformer.EventTransformer {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	counter := mymock.NewMockCounter(ctrl)
+	counter.EXPECT().Inc().AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounter(gomock.Any(), gomock.Any()).Return(counter)
+
+	rt, err := redactiontransformer.New(mode, rules, []byte(salt), ms)
+	if err != nil {
+		t.Fatalf("creating redaction transformer failed with : %s", err)
+	}
+	return rt
+}
+
+func Test_WhenModeRemove_ThenSecretDataRemoved(t *testing.T) {
+	rt := setup(t, redactiontransformer.ModeRemove, nil, "")
+
+	out, err := rt.Transform([]byte(secretRequest))
+
+	assert.NoError(t, err)
+	assert.False(t, gjson.GetBytes(out, "request.object.data").Exists())
+	assert.False(t, gjson.GetBytes(out, "request.oldObject.stringData").Exists())
+	assert.False(t, gjson.GetBytes(out, `request.object.metadata.annotations.kubectl\.kubernetes\.io\/last-applied-configuration`).Exists())
+	assert.Equal(t, "a", gjson.GetBytes(out, "request.object.metadata.annotations.team").Str)
+	assert.Equal(t, "Opaque", gjson.GetBytes(out, "request.object.type").Str)
+	assert.NotContains(t, string(out), "aHVudGVyMg==")
+	assert.NotContains(t, string(out), "hunter1")
+}
+
+func Test_WhenModeMask_ThenKeysKeptAndValuesMasked(t *testing.T) {
+	rt := setup(t, redactiontransformer.ModeMask, nil, "")
+
+	out, err := rt.Transform([]byte(secretRequest))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "REDACTED", gjson.GetBytes(out, "request.object.data.password").Str)
+	assert.Equal(t, "REDACTED", gjson.GetBytes(out, "request.object.data.user").Str)
+	assert.Equal(t, "REDACTED", gjson.GetBytes(out, "request.oldObject.stringData.password").Str)
+	assert.Equal(t, "REDACTED", gjson.GetBytes(out, `request.object.metadata.annotations.kubectl\.kubernetes\.io\/last-applied-configuration`).Str)
+}
+
+func Test_WhenModeHash_ThenHashesComparable(t *testing.T) {
+	rt := setup(t, redactiontransformer.ModeHash, nil, "salt")
+	otherSalt := setup(t, redactiontransformer.ModeHash, nil, "pepper")
+
+	out, err := rt.Transform([]byte(secretRequest))
+	assert.NoError(t, err)
+	again, err := rt.Transform([]byte(secretRequest))
+	assert.NoError(t, err)
+	otherOut, err := otherSalt.Transform([]byte(secretRequest))
+	assert.NoError(t, err)
+
+	password := gjson.GetBytes(out, "request.object.data.password").Str
+	assert.True(t, strings.HasPrefix(password, "sha256:"))
+	assert.Equal(t, password, gjson.GetBytes(again, "request.object.data.password").Str)
+	assert.NotEqual(t, password, gjson.GetBytes(out, "request.object.data.user").Str)
+	assert.NotEqual(t, password, gjson.GetBytes(otherOut, "request.object.data.password").Str)
+}
+
+func Test_WhenUserRulesProvided_ThenMatchingPathsRedacted(t *testing.T) {
+	rt := setup(t, redactiontransformer.ModeMask, []string{"ConfigMap:data.password", "*:list.*.token", "Secret:does.not.exist"}, "")
+
+	out, err := rt.Transform([]byte(configMapRequest))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "REDACTED", gjson.GetBytes(out, "request.object.data.password").Str)
+	assert.Equal(t, "blue", gjson.GetBytes(out, "request.object.data.colour").Str)
+	assert.Equal(t, `["REDACTED","REDACTED"]`, gjson.GetBytes(out, "request.object.list.#.token").Raw)
+}
+
+func Test_WhenRemovingArrayElements_ThenAllRemoved(t *testing.T) {
+	rt := setup(t, redactiontransformer.ModeRemove, []string{"ConfigMap:list.*"}, "")
+
+	out, err := rt.Transform([]byte(configMapRequest))
+
+	assert.NoError(t, err)
+	assert.Equal(t, `[]`, gjson.GetBytes(out, "request.object.list").Raw)
+}
+
+func Test_WhenKindDoesNotMatch_ThenEventUnchanged(t *testing.T) {
+	rt := setup(t, redactiontransformer.ModeRemove, nil, "")
+
+	out, err := rt.Transform([]byte(configMapRequest))
+
+	assert.NoError(t, err)
+	assert.Equal(t, configMapRequest, string(out))
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+
+	_, err := redactiontransformer.New("scramble", nil, nil, ms)
+	assert.Error(t, err)
+	_, err = redactiontransformer.New(redactiontransformer.ModeMask, []string{"data.password"}, nil, ms)
+	assert.Error(t, err)
+}
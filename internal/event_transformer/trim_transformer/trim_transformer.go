@@ -0,0 +1,87 @@
+package trimtransformer
+
+import (
+	"fmt"
+
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+type Field string
+
+const (
+	// Written by server side apply to track which manager owns each field
+	FieldManagedFields Field = "managed-fields"
+	// Written by kubectl apply, a copy of the whole object as last applied
+	FieldLastAppliedConfiguration Field = "last-applied-configuration"
+	FieldStatus                   Field = "status"
+)
+
+// The escaped path of each field within the object
+var fieldPaths = map[Field]string{
+	FieldManagedFields:            "metadata.managedFields",
+	FieldLastAppliedConfiguration: `metadata.annotations.kubectl\.kubernetes\.io/last-applied-configuration`,
+	FieldStatus:                   "status",
+}
+
+// Both the object and the state before the request are trimmed
+var objectPaths = []string{"request.object", "request.oldObject"}
+
+type trimTransformer struct {
+	fields []Field
+	// Bytes removed, by field
+	trimmed metrics.CounterVec
+	// Bytes removed from each event
+	saved metrics.Histogram
+}
+
+func New(fields []Field, metricsServer metrics.MetricsServer) (eventtransformer.EventTransformer, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields to trim")
+	}
+	for _, field := range fields {
+		if _, ok := fieldPaths[field]; !ok {
+			return nil, fmt.Errorf("unknown field to trim %q", field)
+		}
+	}
+
+	trimmed := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_trimmed_bytes_total",
+		"Total number of bytes trimmed from events, by field",
+		[]string{"field"},
+	)
+	saved := metricsServer.CreateAndRegisterHistogramVec(
+		"kube_audit_rest_trimmed_event_bytes",
+		"Number of bytes trimmed from each event",
+		nil,
+		// 64B to 4MiB
+		[]float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304},
+	).WithLabelValues()
+
+	return &trimTransformer{fields: fields, trimmed: trimmed, saved: saved}, nil
+}
+
+func (tt *trimTransformer) Transform(body []byte) ([]byte, error) {
+	before := len(body)
+	for _, field := range tt.fields {
+		fieldBefore := len(body)
+		for _, objectPath := range objectPaths {
+			path := objectPath + "." + fieldPaths[field]
+			if !gjson.GetBytes(body, path).Exists() {
+				continue
+			}
+			var err error
+			body, err = sjson.DeleteBytes(body, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to trim %s: %w", path, err)
+			}
+		}
+		if trimmed := fieldBefore - len(body); trimmed > 0 {
+			tt.trimmed.WithLabelValues(string(field)).Add(float64(trimmed))
+		}
+	}
+	tt.saved.Observe(float64(before - len(body)))
+	return body, nil
+}
@@ -0,0 +1,99 @@
+package trimtransformer_test
+
+import (
+	"testing"
+
+	eventtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer"
+	trimtransformer "github.com/RichardoC/kube-audit-rest/internal/event_transformer/trim_transformer"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+const lastApplied = `"kubectl.kubernetes.io/last-applied-configuration":"{\"kind\":\"Deployment\"}"`
+
+const deploymentUpdate = `{"request":{"uid":"1","operation":"UPDATE",` +
+	`"object":{"kind":"Deployment","metadata":{"name":"d","annotations":{` + lastApplied + `,"team":"a"},"managedFields":[{"manager":"kubectl"}]},"spec":{"replicas":2},"status":{"replicas":1}},` +
+	`"oldObject":{"kind":"Deployment","metadata":{"name":"d","managedFields":[{"manager":"kubectl"}]},"spec":{"replicas":1},"status":{"replicas":1}}}}`
+
+type trimMetrics struct {
+	byField map[string]*mymock.MockCounter
+	saved   *mymock.MockHistogram
+}
+
+func setup(t *testing.T, fields ...trimtransformer.Field) (eventtransformer.EventTransformer, trimMetrics) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	trimmed := mymock.NewMockCounterVec(ctrl)
+	savedVec := mymock.NewMockHistogramVec(ctrl)
+	m := trimMetrics{byField: map[string]*mymock.MockCounter{}, saved: mymock.NewMockHistogram(ctrl)}
+	for _, field := range []string{"managed-fields", "last-applied-configuration", "status"} {
+		m.byField[field] = mymock.NewMockCounter(ctrl)
+		trimmed.EXPECT().WithLabelValues(field).Return(m.byField[field]).AnyTimes()
+	}
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_trimmed_bytes_total", gomock.Any(), []string{"field"}).Return(trimmed)
+	ms.EXPECT().CreateAndRegisterHistogramVec("kube_audit_rest_trimmed_event_bytes", gomock.Any(), nil, gomock.Any()).Return(savedVec)
+	savedVec.EXPECT().WithLabelValues().Return(m.saved)
+
+	tt, err := trimtransformer.New(fields, ms)
+	if err != nil {
+		t.Fatalf("creating trim transformer failed with : %s", err)
+	}
+	return tt, m
+}
+
+func Test_WhenAllFieldsTrimmed_ThenRemovedFromBothObjects(t *testing.T) {
+	tt, m := setup(t, trimtransformer.FieldManagedFields, trimtransformer.FieldLastAppliedConfiguration, trimtransformer.FieldStatus)
+	// Each field is removed along with its key and the comma before it
+	managedFields := 2 * len(`,"managedFields":[{"manager":"kubectl"}]`)
+	annotation := len(lastApplied + ",")
+	status := 2 * len(`,"status":{"replicas":1}`)
+	m.byField["managed-fields"].EXPECT().Add(float64(managedFields))
+	m.byField["last-applied-configuration"].EXPECT().Add(float64(annotation))
+	m.byField["status"].EXPECT().Add(float64(status))
+	m.saved.EXPECT().Observe(float64(managedFields + annotation + status))
+
+	out, err := tt.Transform([]byte(deploymentUpdate))
+
+	assert.NoError(t, err)
+	assert.Equal(t, `{"request":{"uid":"1","operation":"UPDATE",`+
+		`"object":{"kind":"Deployment","metadata":{"name":"d","annotations":{"team":"a"}},"spec":{"replicas":2}},`+
+		`"oldObject":{"kind":"Deployment","metadata":{"name":"d"},"spec":{"replicas":1}}}}`, string(out))
+}
+
+func Test_WhenOnlyManagedFieldsTrimmed_ThenRestKept(t *testing.T) {
+	tt, m := setup(t, trimtransformer.FieldManagedFields)
+	m.byField["managed-fields"].EXPECT().Add(gomock.Any())
+	m.saved.EXPECT().Observe(gomock.Any())
+
+	out, err := tt.Transform([]byte(deploymentUpdate))
+
+	assert.NoError(t, err)
+	assert.False(t, gjson.GetBytes(out, "request.object.metadata.managedFields").Exists())
+	assert.False(t, gjson.GetBytes(out, "request.oldObject.metadata.managedFields").Exists())
+	assert.Equal(t, "a", gjson.GetBytes(out, "request.object.metadata.annotations.team").Str)
+	assert.True(t, gjson.GetBytes(out, `request.object.metadata.annotations.kubectl\.kubernetes\.io/last-applied-configuration`).Exists())
+	assert.Equal(t, int64(1), gjson.GetBytes(out, "request.object.status.replicas").Int())
+}
+
+func Test_WhenNothingToTrim_ThenEventUnchanged(t *testing.T) {
+	tt, m := setup(t, trimtransformer.FieldStatus)
+	m.saved.EXPECT().Observe(float64(0))
+	create := `{"request":{"uid":"2","operation":"CREATE","object":{"kind":"ConfigMap","data":{"status":"ok"}},"oldObject":null}}`
+
+	out, err := tt.Transform([]byte(create))
+
+	assert.NoError(t, err)
+	assert.Equal(t, create, string(out))
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+
+	_, err := trimtransformer.New(nil, ms)
+	assert.Error(t, err)
+	_, err = trimtransformer.New([]trimtransformer.Field{"spec"}, ms)
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+// Package health serves the readiness and liveness probes, from checks
+// registered by the components that can tell whether they're healthy
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+)
+
+// Returns an error describing the problem when unhealthy
+type Check func() error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// A set of checks served as one probe, which fails when any of them does
+type Checks struct {
+	// Used in logs, such as "readiness"
+	probe string
+
+	mu     sync.Mutex
+	checks []namedCheck
+	// Names of the checks that failed last time, so only changes are logged
+	failing map[string]bool
+}
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type probeResult struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+func New(probe string) *Checks {
+	return &Checks{probe: probe, failing: map[string]bool{}}
+}
+
+// Adds a check, which must not block for long as it's run for every probe
+func (c *Checks) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Responds with 200 when every check passes and 503 otherwise, in plain
+// text, or in JSON with every check's result for ?format=json
+func (c *Checks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := c.run()
+	status := http.StatusOK
+	if result.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			common.Logger.Errorw("failed to write probe response", "probe", c.probe, "error", err)
+		}
+		return
+	}
+
+	var body strings.Builder
+	for _, check := range result.Checks {
+		if check.Error != "" {
+			fmt.Fprintf(&body, "%s failed: %s\n", check.Name, check.Error)
+		}
+	}
+	if body.Len() == 0 {
+		body.WriteString("ok\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write([]byte(body.String())); err != nil {
+		common.Logger.Errorw("failed to write probe response", "probe", c.probe, "error", err)
+	}
+}
+
+func (c *Checks) run() probeResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := probeResult{Status: "ok", Checks: []checkResult{}}
+	for _, nc := range c.checks {
+		err := nc.check()
+		if err == nil {
+			if c.failing[nc.name] {
+				common.Logger.Infow("health check passing again", "probe", c.probe, "check", nc.name)
+				delete(c.failing, nc.name)
+			}
+			result.Checks = append(result.Checks, checkResult{Name: nc.name, Status: "ok"})
+			continue
+		}
+		if !c.failing[nc.name] {
+			common.Logger.Warnw("health check failing", "probe", c.probe, "check", nc.name, "error", err)
+			c.failing[nc.name] = true
+		}
+		result.Status = "failed"
+		result.Checks = append(result.Checks, checkResult{Name: nc.name, Status: "failed", Error: err.Error()})
+	}
+	return result
+}
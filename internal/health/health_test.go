@@ -0,0 +1,66 @@
+package health_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RichardoC/kube-audit-rest/internal/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(checks *health.Checks, target string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	checks.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+	return recorder
+}
+
+func Test_WhenEveryCheckPasses_ThenOk(t *testing.T) {
+	checks := health.New("readiness")
+	checks.Add("tls", func() error { return nil })
+	checks.Add("queue", func() error { return nil })
+
+	resp := probe(checks, "/readyz")
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "ok\n", resp.Body.String())
+}
+
+func Test_WhenNoChecks_ThenOk(t *testing.T) {
+	resp := probe(health.New("liveness"), "/healthz")
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func Test_WhenCheckFails_ThenUnavailableWithReason(t *testing.T) {
+	checks := health.New("readiness")
+	checks.Add("tls", func() error { return nil })
+	checks.Add("queue", func() error { return errors.New("queue is full") })
+
+	resp := probe(checks, "/readyz")
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "queue failed: queue is full\n", resp.Body.String())
+}
+
+func Test_WhenJSONRequested_ThenEveryCheckDetailed(t *testing.T) {
+	checks := health.New("readiness")
+	checks.Add("tls", func() error { return nil })
+	checks.Add("queue", func() error { return errors.New("queue is full") })
+
+	resp := probe(checks, "/readyz?format=json")
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+	var body map[string]any
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+	assert.Equal(t, map[string]any{
+		"status": "failed",
+		"checks": []any{
+			map[string]any{"name": "tls", "status": "ok"},
+			map[string]any{"name": "queue", "status": "failed", "error": "queue is full"},
+		},
+	}, body)
+}
@@ -4,7 +4,11 @@ package httplistener
 
 //go:generate mockgen -package mymock -destination ../../mocks/http_listener_mock.go github.com/RichardoC/kube-audit-rest/internal/http_listener HttpListener
 
+import "context"
+
 type HttpListener interface {
 	Start()
-	Stop()
+	// Stops accepting requests and waits for those in progress to finish,
+	// giving up once ctx is done
+	Stop(ctx context.Context) error
 }
@@ -0,0 +1,117 @@
+package logrequestlistener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+)
+
+// Only lets clients with a certificate from the CA bundle connect, such as
+// the apiserver's webhook client certificate, optionally limited to some
+// names
+type ClientVerifier struct {
+	roots *x509.CertPool
+	// Subject common names and SANs, everyone the CA trusts when empty
+	allowed  map[string]bool
+	rejected metrics.CounterVec
+}
+
+func NewClientVerifier(caFilename string, allowedNames []string, metricsServer metrics.MetricsServer) (*ClientVerifier, error) {
+	caPEM, err := os.ReadFile(caFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in client CA %s", caFilename)
+	}
+	allowed := map[string]bool{}
+	for _, name := range allowedNames {
+		if name == "" {
+			return nil, errors.New("allowed client names can't be empty")
+		}
+		allowed[name] = true
+	}
+	rejected := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_client_cert_rejected_total",
+		"Total number of connections rejected because of their client certificate, by reason",
+		[]string{"reason"},
+	)
+	return &ClientVerifier{roots: roots, allowed: allowed, rejected: rejected}, nil
+}
+
+// Makes the server ask for client certificates and verify them
+func (cv *ClientVerifier) Apply(config *tls.Config) {
+	// Verified here rather than by crypto/tls, so every rejection can be
+	// logged and counted
+	config.ClientAuth = tls.RequestClientCert
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		withPeer := config.Clone()
+		withPeer.GetConfigForClient = nil
+		remoteAddr := hello.Conn.RemoteAddr().String()
+		withPeer.VerifyConnection = func(state tls.ConnectionState) error {
+			return cv.verify(state, remoteAddr)
+		}
+		return withPeer, nil
+	}
+}
+
+func (cv *ClientVerifier) verify(state tls.ConnectionState, remoteAddr string) error {
+	if len(state.PeerCertificates) == 0 {
+		return cv.reject("no-certificate", remoteAddr, nil, errors.New("no client certificate"))
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         cv.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return cv.reject("untrusted", remoteAddr, leaf, fmt.Errorf("untrusted client certificate: %w", err))
+	}
+	if len(cv.allowed) > 0 && !cv.allows(leaf) {
+		return cv.reject("not-allowed", remoteAddr, leaf, errors.New("client certificate isn't for an allowed name"))
+	}
+	return nil
+}
+
+func (cv *ClientVerifier) allows(cert *x509.Certificate) bool {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, name := range names {
+		if cv.allowed[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (cv *ClientVerifier) reject(reason string, remoteAddr string, cert *x509.Certificate, err error) error {
+	cv.rejected.WithLabelValues(reason).Inc()
+	fields := []any{"reason", reason, "remoteAddr", remoteAddr, "error", err}
+	if cert != nil {
+		fields = append(fields,
+			"subject", cert.Subject.String(),
+			"dnsNames", cert.DNSNames,
+			"issuer", cert.Issuer.String(),
+			"serial", cert.SerialNumber.String(),
+		)
+	}
+	common.Logger.Warnw("rejected client", fields...)
+	return err
+}
@@ -0,0 +1,167 @@
+package logrequestlistener_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	logrequestlistener "github.com/RichardoC/kube-audit-rest/internal/http_listener/log_request_listener"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+var localhost = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) issuer {
+	return issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+// Self-signed when parent is nil
+func issue(t *testing.T, template *x509.Certificate, parent *issuer) issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key failed with : %s", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerCert := key, template
+	if parent != nil {
+		signer, signerCert = parent.key, parent.cert
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("creating certificate failed with : %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate failed with : %s", err)
+	}
+	return issuer{cert: cert, key: key}
+}
+
+func (i issuer) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{i.cert.Raw}, PrivateKey: i.key, Leaf: i.cert}
+}
+
+func clientCert(t *testing.T, ca issuer, cn string, dnsNames ...string) *tls.Certificate {
+	cert := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    dnsNames,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca).tlsCertificate()
+	return &cert
+}
+
+// Starts a server verifying clients against clientCA, returning its URL and
+// a client trusting it. The counter of each reason is returned too
+func setupVerifier(t *testing.T, clientCA issuer, allowedNames []string) (string, func(*tls.Certificate) *http.Client, map[string]*mymock.MockCounter) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	rejected := mymock.NewMockCounterVec(ctrl)
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_client_cert_rejected_total", gomock.Any(), []string{"reason"}).Return(rejected)
+	counters := map[string]*mymock.MockCounter{}
+	for _, reason := range []string{"no-certificate", "untrusted", "not-allowed"} {
+		counters[reason] = mymock.NewMockCounter(ctrl)
+		rejected.EXPECT().WithLabelValues(reason).Return(counters[reason]).AnyTimes()
+	}
+	caFilename := writeFile(t, "client-ca.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCA.cert.Raw})))
+	cv, err := logrequestlistener.NewClientVerifier(caFilename, allowedNames, ms)
+	if err != nil {
+		t.Fatalf("creating client verifier failed with : %s", err)
+	}
+
+	serverCA := newCA(t)
+	serverCert := issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "server"}, IPAddresses: localhost}, &serverCA).tlsCertificate()
+	config := &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	cv.Apply(config)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = config
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	newClient := func(cert *tls.Certificate) *http.Client {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	}
+	return server.URL, newClient, counters
+}
+
+func Test_WhenClientCertificateTrusted_ThenConnectionAccepted(t *testing.T) {
+	ca := newCA(t)
+	url, newClient, _ := setupVerifier(t, ca, nil)
+
+	resp, err := newClient(clientCert(t, ca, "kube-apiserver")).Get(url)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_WhenNoClientCertificate_ThenConnectionRejected(t *testing.T) {
+	ca := newCA(t)
+	url, newClient, counters := setupVerifier(t, ca, nil)
+	counters["no-certificate"].EXPECT().Inc()
+
+	_, err := newClient(nil).Get(url)
+
+	assert.Error(t, err)
+}
+
+func Test_WhenClientCertificateFromOtherCA_ThenConnectionRejected(t *testing.T) {
+	ca := newCA(t)
+	url, newClient, counters := setupVerifier(t, ca, nil)
+	counters["untrusted"].EXPECT().Inc()
+
+	_, err := newClient(clientCert(t, newCA(t), "kube-apiserver")).Get(url)
+
+	assert.Error(t, err)
+}
+
+func Test_WhenAllowedNamesSet_ThenOnlyThoseAccepted(t *testing.T) {
+	ca := newCA(t)
+	url, newClient, counters := setupVerifier(t, ca, []string{"kube-apiserver", "apiserver.example.com"})
+	counters["not-allowed"].EXPECT().Inc()
+
+	resp, err := newClient(clientCert(t, ca, "kube-apiserver")).Get(url)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = newClient(clientCert(t, ca, "other", "apiserver.example.com")).Get(url)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = newClient(clientCert(t, ca, "system:anonymous")).Get(url)
+	assert.Error(t, err)
+}
+
+func Test_WhenClientCAInvalid_ThenErrorReturned(t *testing.T) {
+	ms := mymock.NewMockMetricsServer(gomock.NewController(t))
+
+	_, err := logrequestlistener.NewClientVerifier(writeFile(t, "client-ca.crt", "not a certificate"), nil, ms)
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,154 @@
+package logrequestlistener
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	"gopkg.in/yaml.v3"
+)
+
+// The clusters served by one kube-audit-rest, which each send their
+// requests to /log-request/<name>. An example clusters file
+//
+//	clusters:
+//	  - name: prod-eu
+//	    tokenFilename: /etc/kube-audit-rest/tokens/prod-eu
+//	    sinks: ["disk", "kafka"]
+//	  - name: dev
+type Cluster struct {
+	// Used in the request path, the events and metrics labels
+	Name string `yaml:"name"`
+	// When set, requests need an "Authorization: Bearer <token>" header with
+	// the token in this file. Re-read for every request, so the token can be
+	// rotated
+	TokenFilename string `yaml:"tokenFilename"`
+	// The sinks the cluster's events are written to, all of them when empty
+	Sinks []string `yaml:"sinks"`
+}
+
+type clustersFile struct {
+	Clusters []Cluster `yaml:"clusters"`
+}
+
+var clusterNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+func LoadClusters(filename string) ([]Cluster, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clusters file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var file clustersFile
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid clusters file %s: %w", filename, err)
+	}
+	if len(file.Clusters) == 0 {
+		return nil, fmt.Errorf("invalid clusters file %s: no clusters", filename)
+	}
+
+	names := map[string]bool{}
+	for _, cluster := range file.Clusters {
+		// Also used in file names, so can't be a path
+		if !clusterNamePattern.MatchString(cluster.Name) || cluster.Name == "." || cluster.Name == ".." {
+			return nil, fmt.Errorf("invalid clusters file %s: cluster name %q must only contain letters, digits, '.', '_' and '-'", filename, cluster.Name)
+		}
+		if names[cluster.Name] {
+			return nil, fmt.Errorf("invalid clusters file %s: cluster %s is configured more than once", filename, cluster.Name)
+		}
+		names[cluster.Name] = true
+		if cluster.TokenFilename != "" {
+			if _, err := readToken(cluster.TokenFilename); err != nil {
+				return nil, fmt.Errorf("cluster %s: %w", cluster.Name, err)
+			}
+		}
+	}
+	return file.Clusters, nil
+}
+
+func hasClusterTokens(clusters []Cluster) bool {
+	for _, cluster := range clusters {
+		if cluster.TokenFilename != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type clusterHandler struct {
+	clusters map[string]Cluster
+	next     http.Handler
+	rejected metrics.CounterVec
+}
+
+// Passes requests to /log-request/{cluster} for known clusters, with the
+// token when they have one, to next. Others are rejected with 404 or 401
+func NewClusterHandler(clusters []Cluster, next http.Handler, metricsServer metrics.MetricsServer) http.Handler {
+	byName := map[string]Cluster{}
+	for _, cluster := range clusters {
+		byName[cluster.Name] = cluster
+	}
+	rejected := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_cluster_rejected_requests_total",
+		"Total number of requests to /log-request/{cluster} rejected, by cluster and reason",
+		[]string{"cluster", "reason"},
+	)
+	return &clusterHandler{clusters: byName, next: next, rejected: rejected}
+}
+
+func (ch *clusterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("cluster")
+	cluster, ok := ch.clusters[name]
+	if !ok {
+		common.Logger.Warnw("request for unknown cluster", "cluster", name, "remoteAddr", r.RemoteAddr)
+		// Not labelled with the name, so requests can't add label values
+		ch.rejected.WithLabelValues("", "unknown-cluster").Inc()
+		http.NotFound(w, r)
+		return
+	}
+
+	if cluster.TokenFilename != "" {
+		token, err := readToken(cluster.TokenFilename)
+		if err != nil {
+			common.Logger.Errorw("failed to read cluster token", "cluster", name, "error", err)
+			ch.rejected.WithLabelValues(name, "token-unreadable").Inc()
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !hasToken(r, token) {
+			common.Logger.Warnw("request with a missing or wrong token", "cluster", name, "remoteAddr", r.RemoteAddr)
+			ch.rejected.WithLabelValues(name, "unauthorized").Inc()
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	ch.next.ServeHTTP(w, r)
+}
+
+func readToken(filename string) (string, error) {
+	token, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bearer token: %w", err)
+	}
+	trimmed := strings.TrimSpace(string(token))
+	if trimmed == "" {
+		return "", fmt.Errorf("bearer token file %s is empty", filename)
+	}
+	return trimmed, nil
+}
+
+// Whether the request has an "Authorization: Bearer <token>" header with
+// the token
+func hasToken(r *http.Request, token string) bool {
+	presented, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
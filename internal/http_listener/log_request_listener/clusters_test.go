@@ -0,0 +1,130 @@
+package logrequestlistener_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	logrequestlistener "github.com/RichardoC/kube-audit-rest/internal/http_listener/log_request_listener"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing %s failed with : %s", name, err)
+	}
+	return filename
+}
+
+// Returns a mux serving the handler like the listener does, and the
+// counter of each cluster and reason
+func setupHandler(t *testing.T, clusters []logrequestlistener.Cluster, next http.Handler) (*http.ServeMux, map[[2]string]*mymock.MockCounter) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	rejected := mymock.NewMockCounterVec(ctrl)
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_cluster_rejected_requests_total", gomock.Any(), []string{"cluster", "reason"}).Return(rejected)
+	counters := map[[2]string]*mymock.MockCounter{}
+	for _, labels := range [][2]string{{"", "unknown-cluster"}, {"prod", "unauthorized"}, {"prod", "token-unreadable"}} {
+		counter := mymock.NewMockCounter(ctrl)
+		rejected.EXPECT().WithLabelValues(labels[0], labels[1]).Return(counter).AnyTimes()
+		counters[labels] = counter
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /log-request/{cluster}", logrequestlistener.NewClusterHandler(clusters, next, ms))
+	return mux, counters
+}
+
+func send(mux *http.ServeMux, path, token string) int {
+	req := httptest.NewRequest("POST", path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func Test_WhenClusterKnown_ThenRequestPassedOnWithCluster(t *testing.T) {
+	var clusters []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clusters = append(clusters, r.PathValue("cluster"))
+	})
+	mux, _ := setupHandler(t, []logrequestlistener.Cluster{{Name: "prod"}, {Name: "dev"}}, next)
+
+	assert.Equal(t, http.StatusOK, send(mux, "/log-request/prod", ""))
+	assert.Equal(t, http.StatusOK, send(mux, "/log-request/dev", ""))
+	assert.Equal(t, []string{"prod", "dev"}, clusters)
+}
+
+func Test_WhenClusterUnknown_ThenNotFound(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request for an unknown cluster was passed on")
+	})
+	mux, counters := setupHandler(t, []logrequestlistener.Cluster{{Name: "prod"}}, next)
+	counters[[2]string{"", "unknown-cluster"}].EXPECT().Inc()
+
+	assert.Equal(t, http.StatusNotFound, send(mux, "/log-request/staging", ""))
+}
+
+func Test_WhenClusterHasToken_ThenOnlyRequestsWithItPassedOn(t *testing.T) {
+	passed := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed++
+	})
+	tokenFilename := writeFile(t, "token", "s3cret\n")
+	mux, counters := setupHandler(t, []logrequestlistener.Cluster{{Name: "prod", TokenFilename: tokenFilename}}, next)
+	counters[[2]string{"prod", "unauthorized"}].EXPECT().Inc().Times(2)
+
+	assert.Equal(t, http.StatusUnauthorized, send(mux, "/log-request/prod", ""))
+	assert.Equal(t, http.StatusUnauthorized, send(mux, "/log-request/prod", "wrong"))
+	assert.Equal(t, http.StatusOK, send(mux, "/log-request/prod", "s3cret"))
+	assert.Equal(t, 1, passed)
+
+	// Rotated tokens are used straight away
+	if err := os.WriteFile(tokenFilename, []byte("rotated"), 0o600); err != nil {
+		t.Fatalf("rotating token failed with : %s", err)
+	}
+	assert.Equal(t, http.StatusOK, send(mux, "/log-request/prod", "rotated"))
+	assert.Equal(t, 2, passed)
+}
+
+func Test_WhenClustersFileValid_ThenClustersLoaded(t *testing.T) {
+	tokenFilename := writeFile(t, "token", "s3cret")
+	filename := writeFile(t, "clusters.yaml", `
+clusters:
+  - name: prod-eu
+    tokenFilename: `+tokenFilename+`
+    sinks: ["disk"]
+  - name: dev
+`)
+
+	clusters, err := logrequestlistener.LoadClusters(filename)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []logrequestlistener.Cluster{
+		{Name: "prod-eu", TokenFilename: tokenFilename, Sinks: []string{"disk"}},
+		{Name: "dev"},
+	}, clusters)
+}
+
+func Test_WhenClustersFileInvalid_ThenErrorReturned(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":         "clusters: []",
+		"path as name":  "clusters: [{name: ../etc}]",
+		"dot name":      "clusters: [{name: ..}]",
+		"duplicate":     "clusters: [{name: prod}, {name: prod}]",
+		"unknown field": "clusters: [{name: prod, token: abc}]",
+		"missing token": "clusters: [{name: prod, tokenFilename: /does/not/exist}]",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := logrequestlistener.LoadClusters(writeFile(t, "clusters.yaml", content))
+			assert.Error(t, err)
+		})
+	}
+}
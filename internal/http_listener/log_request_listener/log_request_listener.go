@@ -2,55 +2,114 @@ package logrequestlistener
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
+	certsource "github.com/RichardoC/kube-audit-rest/internal/cert_source"
 	"github.com/RichardoC/kube-audit-rest/internal/common"
 	eventprocessor "github.com/RichardoC/kube-audit-rest/internal/event_processor"
 	httplistener "github.com/RichardoC/kube-audit-rest/internal/http_listener"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
 )
 
 type logRequestListener struct {
-	server          *http.Server
-	certFilename    string
-	certKeyFilename string
+	server *http.Server
 }
 
-func New(port int, certFilename string, certKeyFilename string, eProc eventprocessor.EventProcessor) httplistener.HttpListener {
-	router := http.NewServeMux()
-	router.HandleFunc("POST /log-request", eProc.ProcessEvent)
+type Config struct {
+	Port int
+	// Supplies the serving certificate for every TLS handshake, so it can
+	// be rotated without restarting
+	Certificates certsource.CertSource
+	// When set, clients must present a certificate it accepts, optional
+	ClientVerifier *ClientVerifier
+	// When set, each cluster can also send its requests to
+	// /log-request/<name>, optional
+	Clusters []Cluster
+	// When set, every request must come from its allowed sources. Its token
+	// is needed for /log-request and clusters without their own, optional
+	Authenticator *RequestAuthenticator
+}
+
+func New(config Config, eProc eventprocessor.EventProcessor, metricsServer metrics.MetricsServer) httplistener.HttpListener {
+	handler := NewHandler(config, eProc, metricsServer)
+
+	tlsConfig := &tls.Config{
+		GetCertificate: config.Certificates.GetCertificate,
+		// Set up front, as the client verifier's per connection config is
+		// copied from this rather than the copy the server adds them to
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if config.ClientVerifier != nil {
+		config.ClientVerifier.Apply(tlsConfig)
+	}
 
-	addr := fmt.Sprintf(":%d", port)
+	addr := fmt.Sprintf(":%d", config.Port)
 	server := &http.Server{
 		Addr:         addr,
-		Handler:      router,
+		Handler:      handler,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  15 * time.Second,
+		TLSConfig:    tlsConfig,
 	}
 
-	return &logRequestListener{
-		server:          server,
-		certFilename:    certFilename,
-		certKeyFilename: certKeyFilename,
+	return &logRequestListener{server: server}
+}
+
+// The routes served by the listener
+func NewHandler(config Config, eProc eventprocessor.EventProcessor, metricsServer metrics.MetricsServer) http.Handler {
+	var tokenFilename string
+	if config.Authenticator != nil {
+		tokenFilename = config.Authenticator.tokenFilename
 	}
+
+	router := http.NewServeMux()
+	// Otherwise clusters' tokens could be avoided by sending requests to
+	// /log-request instead
+	if hasClusterTokens(config.Clusters) && tokenFilename == "" {
+		common.Logger.Warnw("not serving /log-request, as clusters have tokens and --bearer-token-filename isn't set")
+	} else {
+		var plain http.Handler = http.HandlerFunc(eProc.ProcessEvent)
+		if config.Authenticator != nil {
+			plain = config.Authenticator.WrapToken(plain)
+		}
+		router.Handle("POST /log-request", plain)
+	}
+	if len(config.Clusters) > 0 {
+		// Clusters with their own token need it instead of the bearer token
+		clusters := slices.Clone(config.Clusters)
+		for i := range clusters {
+			if clusters[i].TokenFilename == "" {
+				clusters[i].TokenFilename = tokenFilename
+			}
+		}
+		router.Handle("POST /log-request/{cluster}", NewClusterHandler(clusters, http.HandlerFunc(eProc.ProcessEvent), metricsServer))
+	}
+
+	if config.Authenticator != nil {
+		return config.Authenticator.WrapSources(router)
+	}
+	return router
 }
 
 func (lrl *logRequestListener) Start() {
 	common.Logger.Infow("Starting server", "addr", lrl.server.Addr)
-	if err := lrl.server.ListenAndServeTLS(lrl.certFilename, lrl.certKeyFilename); err != nil && err != http.ErrServerClosed {
+	if err := lrl.server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 		common.Logger.Fatalw("Failed to start server", "error", err, "addr", lrl.server.Addr)
 	}
 }
 
-func (lrl *logRequestListener) Stop() {
+// Shutdown waits for the handlers of requests in progress to return, so
+// every event they log has been passed to the writer
+func (lrl *logRequestListener) Stop(ctx context.Context) error {
 	common.Logger.Warnw("Log Request Listener is shutting down...")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
 	lrl.server.SetKeepAlivesEnabled(false)
 	if err := lrl.server.Shutdown(ctx); err != nil {
-		common.Logger.Fatalf("Could not gracefully shutdown the server: %v\n", err)
+		return fmt.Errorf("could not gracefully shutdown the server: %w", err)
 	}
+	return nil
 }
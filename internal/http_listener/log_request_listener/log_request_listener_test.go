@@ -1,12 +1,17 @@
 package logrequestlistener_test
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	eventprocessor "github.com/RichardoC/kube-audit-rest/internal/event_processor"
 	logrequestlistener "github.com/RichardoC/kube-audit-rest/internal/http_listener/log_request_listener"
 	mymock "github.com/RichardoC/kube-audit-rest/mocks"
 	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
 )
 
 func setup(t *testing.T) eventprocessor.EventProcessor {
@@ -17,8 +22,75 @@ func setup(t *testing.T) eventprocessor.EventProcessor {
 
 func Test_WhenListenerNotStarted_ThenStopSucceeds(t *testing.T) {
 	mockEvProc := setup(t)
-	lrl := logrequestlistener.New(1234, "", "", mockEvProc)
-	lrl.Stop()
+	ctrl := gomock.NewController(t)
+	config := logrequestlistener.Config{Port: 1234, Certificates: mymock.NewMockCertSource(ctrl)}
+	lrl := logrequestlistener.New(config, mockEvProc, mymock.NewMockMetricsServer(ctrl))
+	assert.NoError(t, lrl.Stop(context.Background()))
+}
+
+// With a bearer token when tokenFilename is set. Rejections are allowed,
+// but not checked
+func newHandler(t *testing.T, clusters []logrequestlistener.Cluster, tokenFilename string) (http.Handler, *mymock.MockEventProcessor) {
+	ctrl := gomock.NewController(t)
+	eProc := mymock.NewMockEventProcessor(ctrl)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	rejected := mymock.NewMockCounterVec(ctrl)
+	counter := mymock.NewMockCounter(ctrl)
+	counter.EXPECT().Inc().AnyTimes()
+	rejected.EXPECT().WithLabelValues(gomock.Any()).Return(counter).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounterVec(gomock.Any(), gomock.Any(), gomock.Any()).Return(rejected).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounter(gomock.Any(), gomock.Any()).Return(counter).AnyTimes()
+	config := logrequestlistener.Config{Port: 1234, Certificates: mymock.NewMockCertSource(ctrl), Clusters: clusters}
+	if tokenFilename != "" {
+		authenticator, err := logrequestlistener.NewRequestAuthenticator(tokenFilename, nil, ms)
+		if err != nil {
+			t.Fatalf("creating request authenticator failed with : %s", err)
+		}
+		config.Authenticator = authenticator
+	}
+	return logrequestlistener.NewHandler(config, eProc, ms), eProc
+}
+
+func post(handler http.Handler, path, body, token string) int {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func Test_WhenClustersHaveNoTokens_ThenLogRequestServed(t *testing.T) {
+	handler, eProc := newHandler(t, []logrequestlistener.Cluster{{Name: "prod"}}, "")
+	eProc.EXPECT().ProcessEvent(gomock.Any(), gomock.Any())
+
+	assert.Equal(t, http.StatusOK, post(handler, "/log-request", `{"request":{"uid":"test-uid"}}`, ""))
+}
+
+func Test_WhenClustersHaveTokens_ThenLogRequestNotServed(t *testing.T) {
+	tokenFilename := writeFile(t, "token", "s3cret")
+	handler, _ := newHandler(t, []logrequestlistener.Cluster{{Name: "prod", TokenFilename: tokenFilename}}, "")
+
+	// Without the token, the cluster can't be picked through the body either
+	forged := `{"request":{"uid":"test-uid"},"kubeAuditRest":{"cluster":"prod"}}`
+	assert.Equal(t, http.StatusNotFound, post(handler, "/log-request", forged, ""))
+}
+
+func Test_WhenBearerAndClusterTokens_ThenEachRouteNeedsItsToken(t *testing.T) {
+	clusters := []logrequestlistener.Cluster{{Name: "prod", TokenFilename: writeFile(t, "prod", "prod-token")}, {Name: "dev"}}
+	handler, eProc := newHandler(t, clusters, writeFile(t, "token", "bearer-token"))
+	eProc.EXPECT().ProcessEvent(gomock.Any(), gomock.Any()).Times(3)
+	body := `{"request":{"uid":"test-uid"}}`
+
+	assert.Equal(t, http.StatusUnauthorized, post(handler, "/log-request", body, ""))
+	assert.Equal(t, http.StatusUnauthorized, post(handler, "/log-request", body, "prod-token"))
+	assert.Equal(t, http.StatusOK, post(handler, "/log-request", body, "bearer-token"))
+	assert.Equal(t, http.StatusUnauthorized, post(handler, "/log-request/prod", body, "bearer-token"))
+	assert.Equal(t, http.StatusOK, post(handler, "/log-request/prod", body, "prod-token"))
+	// Clusters without their own token need the bearer token
+	assert.Equal(t, http.StatusUnauthorized, post(handler, "/log-request/dev", body, ""))
+	assert.Equal(t, http.StatusOK, post(handler, "/log-request/dev", body, "bearer-token"))
 }
 
 // Testing the Start and Stop of the server is difficult because we need
@@ -0,0 +1,123 @@
+package logrequestlistener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+)
+
+// Restricts who can submit events when client certificates can't be used,
+// such as with managed control planes, by a bearer token and/or the
+// source address of requests
+type RequestAuthenticator struct {
+	// Re-read for every request, so the token can be rotated. No token is
+	// needed when empty
+	tokenFilename string
+	// Requests from anywhere are allowed when empty
+	allowedSources []netip.Prefix
+	unauthorized   metrics.CounterVec
+	forbidden      metrics.Counter
+}
+
+func NewRequestAuthenticator(tokenFilename string, allowedCIDRs []string, metricsServer metrics.MetricsServer) (*RequestAuthenticator, error) {
+	if tokenFilename == "" && len(allowedCIDRs) == 0 {
+		return nil, errors.New("a bearer token or allowed source CIDRs are needed")
+	}
+	if tokenFilename != "" {
+		if _, err := readToken(tokenFilename); err != nil {
+			return nil, err
+		}
+	}
+	var allowedSources []netip.Prefix
+	for _, cidr := range allowedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed source CIDR %q: %w", cidr, err)
+		}
+		allowedSources = append(allowedSources, prefix.Masked())
+	}
+	unauthorized := metricsServer.CreateAndRegisterCounterVec(
+		"kube_audit_rest_unauthorized_requests_total",
+		"Total number of requests rejected with 401 for a missing or wrong bearer token, by reason",
+		[]string{"reason"},
+	)
+	forbidden := metricsServer.CreateAndRegisterCounter(
+		"kube_audit_rest_forbidden_requests_total",
+		"Total number of requests rejected with 403 as they came from a source address that isn't allowed",
+	)
+	return &RequestAuthenticator{
+		tokenFilename:  tokenFilename,
+		allowedSources: allowedSources,
+		unauthorized:   unauthorized,
+		forbidden:      forbidden,
+	}, nil
+}
+
+// Passes requests from allowed sources to next. Others are rejected with 403
+func (ra *RequestAuthenticator) WrapSources(next http.Handler) http.Handler {
+	if len(ra.allowedSources) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The address of the connection, as headers such as X-Forwarded-For
+		// can be set by anyone
+		if !ra.allowsSource(r.RemoteAddr) {
+			common.Logger.Warnw("request from a source that isn't allowed", "remoteAddr", r.RemoteAddr)
+			ra.forbidden.Inc()
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Passes requests with the token to next. Others are rejected with 401
+func (ra *RequestAuthenticator) WrapToken(next http.Handler) http.Handler {
+	if ra.tokenFilename == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := readToken(ra.tokenFilename)
+		if err != nil {
+			common.Logger.Errorw("failed to read bearer token", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !hasToken(r, token) {
+			reason := "wrong-token"
+			if r.Header.Get("Authorization") == "" {
+				reason = "missing-token"
+			}
+			common.Logger.Warnw("request with a missing or wrong bearer token", "reason", reason, "remoteAddr", r.RemoteAddr)
+			ra.unauthorized.WithLabelValues(reason).Inc()
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ra *RequestAuthenticator) allowsSource(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	// IPv4 clients of dual stack listeners have IPv4-mapped IPv6 addresses
+	addr = addr.Unmap()
+	for _, prefix := range ra.allowedSources {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package logrequestlistener_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	logrequestlistener "github.com/RichardoC/kube-audit-rest/internal/http_listener/log_request_listener"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+type authCounters struct {
+	missingToken *mymock.MockCounter
+	wrongToken   *mymock.MockCounter
+	forbidden    *mymock.MockCounter
+}
+
+// Returns the authenticator wrapping a handler that counts the requests
+// passed on to it
+func setupAuthenticator(t *testing.T, tokenFilename string, allowedCIDRs []string) (http.Handler, *int, authCounters) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	unauthorized := mymock.NewMockCounterVec(ctrl)
+	counters := authCounters{
+		missingToken: mymock.NewMockCounter(ctrl),
+		wrongToken:   mymock.NewMockCounter(ctrl),
+		forbidden:    mymock.NewMockCounter(ctrl),
+	}
+	ms.EXPECT().CreateAndRegisterCounterVec("kube_audit_rest_unauthorized_requests_total", gomock.Any(), []string{"reason"}).Return(unauthorized)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_forbidden_requests_total", gomock.Any()).Return(counters.forbidden)
+	unauthorized.EXPECT().WithLabelValues("missing-token").Return(counters.missingToken).AnyTimes()
+	unauthorized.EXPECT().WithLabelValues("wrong-token").Return(counters.wrongToken).AnyTimes()
+
+	ra, err := logrequestlistener.NewRequestAuthenticator(tokenFilename, allowedCIDRs, ms)
+	if err != nil {
+		t.Fatalf("creating request authenticator failed with : %s", err)
+	}
+	passed := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed++
+	})
+	return ra.WrapSources(ra.WrapToken(next)), &passed, counters
+}
+
+func sendFrom(handler http.Handler, remoteAddr, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/log-request", nil)
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func Test_WhenBearerTokenSet_ThenOnlyRequestsWithItPassedOn(t *testing.T) {
+	handler, passed, counters := setupAuthenticator(t, writeFile(t, "token", "s3cret\n"), nil)
+	counters.missingToken.EXPECT().Inc()
+	counters.wrongToken.EXPECT().Inc()
+
+	assert.Equal(t, http.StatusOK, sendFrom(handler, "10.0.0.1:1234", "s3cret").Code)
+	missing := sendFrom(handler, "10.0.0.1:1234", "")
+	assert.Equal(t, http.StatusUnauthorized, missing.Code)
+	assert.Equal(t, "Bearer", missing.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, sendFrom(handler, "10.0.0.1:1234", "guess").Code)
+	assert.Equal(t, 1, *passed)
+}
+
+func Test_WhenBearerTokenRotated_ThenNewTokenNeeded(t *testing.T) {
+	tokenFilename := writeFile(t, "token", "old")
+	handler, passed, counters := setupAuthenticator(t, tokenFilename, nil)
+	counters.wrongToken.EXPECT().Inc()
+
+	if err := os.WriteFile(tokenFilename, []byte("new"), 0o600); err != nil {
+		t.Fatalf("writing token failed with : %s", err)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, sendFrom(handler, "10.0.0.1:1234", "old").Code)
+	assert.Equal(t, http.StatusOK, sendFrom(handler, "10.0.0.1:1234", "new").Code)
+	assert.Equal(t, 1, *passed)
+}
+
+func Test_WhenAllowedSourcesSet_ThenOthersForbidden(t *testing.T) {
+	handler, passed, counters := setupAuthenticator(t, "", []string{"10.0.0.0/24", "fd00::/64"})
+	counters.forbidden.EXPECT().Inc().Times(2)
+
+	assert.Equal(t, http.StatusOK, sendFrom(handler, "10.0.0.7:1234", "").Code)
+	assert.Equal(t, http.StatusOK, sendFrom(handler, "[fd00::1]:1234", "").Code)
+	// IPv4 clients of an IPv6 listener
+	assert.Equal(t, http.StatusOK, sendFrom(handler, "[::ffff:10.0.0.8]:1234", "").Code)
+	assert.Equal(t, http.StatusForbidden, sendFrom(handler, "10.0.1.7:1234", "").Code)
+	assert.Equal(t, http.StatusForbidden, sendFrom(handler, "[fd01::1]:1234", "").Code)
+	assert.Equal(t, 3, *passed)
+}
+
+func Test_WhenTokenAndSourcesSet_ThenBothNeeded(t *testing.T) {
+	handler, passed, counters := setupAuthenticator(t, writeFile(t, "token", "s3cret"), []string{"10.0.0.0/24"})
+	counters.forbidden.EXPECT().Inc()
+	counters.missingToken.EXPECT().Inc()
+
+	assert.Equal(t, http.StatusForbidden, sendFrom(handler, "192.168.0.1:1234", "s3cret").Code)
+	assert.Equal(t, http.StatusUnauthorized, sendFrom(handler, "10.0.0.1:1234", "").Code)
+	assert.Equal(t, http.StatusOK, sendFrom(handler, "10.0.0.1:1234", "s3cret").Code)
+	assert.Equal(t, 1, *passed)
+}
+
+func Test_WhenAuthenticatorConfigInvalid_ThenErrorReturned(t *testing.T) {
+	ms := mymock.NewMockMetricsServer(gomock.NewController(t))
+
+	_, err := logrequestlistener.NewRequestAuthenticator("", nil, ms)
+	assert.Error(t, err)
+	_, err = logrequestlistener.NewRequestAuthenticator(writeFile(t, "token", " \n"), nil, ms)
+	assert.Error(t, err)
+	_, err = logrequestlistener.NewRequestAuthenticator("", []string{"10.0.0.0/33"}, ms)
+	assert.Error(t, err)
+}
@@ -1,10 +1,40 @@
 // Package metrics provides the interfaces to interact with a metrics server
 package metrics
 
-//go:generate mockgen -package mymock -destination ../../mocks/metrics_mock.go github.com/RichardoC/kube-audit-rest/internal/metrics Counter,MetricsServer
+//go:generate mockgen -package mymock -destination ../../mocks/metrics_mock.go github.com/RichardoC/kube-audit-rest/internal/metrics Counter,CounterVec,Gauge,GaugeVec,Histogram,HistogramVec,MetricsServer
+
+import "net/http"
 
 type Counter interface {
 	Inc()
+	// Adds the given value, which must not be negative
+	Add(float64)
+}
+
+// A set of counters sharing a name, partitioned by label values
+type CounterVec interface {
+	// Returns the counter for the given label values, creating it if needed
+	WithLabelValues(labelValues ...string) Counter
+}
+
+type Gauge interface {
+	Set(float64)
+}
+
+// A set of gauges sharing a name, partitioned by label values
+type GaugeVec interface {
+	// Returns the gauge for the given label values, creating it if needed
+	WithLabelValues(labelValues ...string) Gauge
+}
+
+type Histogram interface {
+	Observe(float64)
+}
+
+// A set of histograms sharing a name, partitioned by label values
+type HistogramVec interface {
+	// Returns the histogram for the given label values, creating it if needed
+	WithLabelValues(labelValues ...string) Histogram
 }
 
 // A server that exposes an endpoint where it publishes metrics
@@ -13,6 +43,18 @@ type MetricsServer interface {
 	Start()
 	// Stop the server gracefully
 	Stop()
+	// Serves handler for the pattern alongside the metrics, such as the
+	// health probes. Must be called before Start
+	Handle(pattern string, handler http.Handler)
 	// Creates the counter, registers it and returns it
 	CreateAndRegisterCounter(name string, help string) Counter
+	// Creates the gauge, registers it and returns it
+	CreateAndRegisterGauge(name string, help string) Gauge
+	// Creates the counter vector with the given label names, registers it and returns it
+	CreateAndRegisterCounterVec(name string, help string, labelNames []string) CounterVec
+	// Creates the gauge vector with the given label names, registers it and returns it
+	CreateAndRegisterGaugeVec(name string, help string, labelNames []string) GaugeVec
+	// Creates the histogram vector with the given label names and bucket
+	// upper bounds, registers it and returns it. Default buckets are used if nil
+	CreateAndRegisterHistogramVec(name string, help string, labelNames []string, buckets []float64) HistogramVec
 }
@@ -14,6 +14,7 @@ import (
 
 type prometheusMetricsServer struct {
 	reg    prometheus.Registerer
+	router *http.ServeMux
 	server *http.Server
 }
 
@@ -32,7 +33,7 @@ func New(port int) metrics.MetricsServer {
 		IdleTimeout:  15 * time.Second,
 	}
 
-	metricsServer := &prometheusMetricsServer{reg: reg, server: server}
+	metricsServer := &prometheusMetricsServer{reg: reg, router: router, server: server}
 	return metricsServer
 }
 
@@ -42,6 +43,61 @@ func (ms *prometheusMetricsServer) CreateAndRegisterCounter(name string, help st
 	return counter
 }
 
+func (ms *prometheusMetricsServer) CreateAndRegisterGauge(name string, help string) metrics.Gauge {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+	ms.reg.MustRegister(gauge)
+	return gauge
+}
+
+func (ms *prometheusMetricsServer) CreateAndRegisterCounterVec(name string, help string, labelNames []string) metrics.CounterVec {
+	counterVec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames)
+	ms.reg.MustRegister(counterVec)
+	return &prometheusCounterVec{counterVec: counterVec}
+}
+
+// Wraps the prometheus CounterVec so it returns our Counter interface
+type prometheusCounterVec struct {
+	counterVec *prometheus.CounterVec
+}
+
+func (cv *prometheusCounterVec) WithLabelValues(labelValues ...string) metrics.Counter {
+	return cv.counterVec.WithLabelValues(labelValues...)
+}
+
+func (ms *prometheusMetricsServer) CreateAndRegisterGaugeVec(name string, help string, labelNames []string) metrics.GaugeVec {
+	gaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames)
+	ms.reg.MustRegister(gaugeVec)
+	return &prometheusGaugeVec{gaugeVec: gaugeVec}
+}
+
+// Wraps the prometheus GaugeVec so it returns our Gauge interface
+type prometheusGaugeVec struct {
+	gaugeVec *prometheus.GaugeVec
+}
+
+func (gv *prometheusGaugeVec) WithLabelValues(labelValues ...string) metrics.Gauge {
+	return gv.gaugeVec.WithLabelValues(labelValues...)
+}
+
+func (ms *prometheusMetricsServer) CreateAndRegisterHistogramVec(name string, help string, labelNames []string, buckets []float64) metrics.HistogramVec {
+	histogramVec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labelNames)
+	ms.reg.MustRegister(histogramVec)
+	return &prometheusHistogramVec{histogramVec: histogramVec}
+}
+
+// Wraps the prometheus HistogramVec so it returns our Histogram interface
+type prometheusHistogramVec struct {
+	histogramVec *prometheus.HistogramVec
+}
+
+func (hv *prometheusHistogramVec) WithLabelValues(labelValues ...string) metrics.Histogram {
+	return hv.histogramVec.WithLabelValues(labelValues...)
+}
+
+func (ms *prometheusMetricsServer) Handle(pattern string, handler http.Handler) {
+	ms.router.Handle(pattern, handler)
+}
+
 func (ms *prometheusMetricsServer) Start() {
 	common.Logger.Infow("Starting server", "addr", ms.server.Addr)
 	if err := ms.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -37,6 +37,30 @@ func Test_WhenCounterCreated_ThenItCanBeIncremented(t *testing.T) {
 	counter.Inc()
 }
 
+func Test_WhenGaugeCreated_ThenItCanBeSet(t *testing.T) {
+	ms := prometheusmetrics.New(1234)
+	gauge := ms.CreateAndRegisterGauge("test_gauge", "This gauge is for test purposes")
+	gauge.Set(2)
+}
+
+func Test_WhenCounterVecCreated_ThenItCanBeIncremented(t *testing.T) {
+	ms := prometheusmetrics.New(1234)
+	counterVec := ms.CreateAndRegisterCounterVec("test_counter_vec", "This counter vec is for test purposes", []string{"label"})
+	counterVec.WithLabelValues("value").Inc()
+}
+
+func Test_WhenGaugeVecCreated_ThenItCanBeSet(t *testing.T) {
+	ms := prometheusmetrics.New(1234)
+	gaugeVec := ms.CreateAndRegisterGaugeVec("test_gauge_vec", "This gauge vec is for test purposes", []string{"label"})
+	gaugeVec.WithLabelValues("value").Set(2)
+}
+
+func Test_WhenHistogramVecCreated_ThenItCanBeObserved(t *testing.T) {
+	ms := prometheusmetrics.New(1234)
+	histogramVec := ms.CreateAndRegisterHistogramVec("test_histogram_vec", "This histogram vec is for test purposes", []string{"label"}, nil)
+	histogramVec.WithLabelValues("value").Observe(0.5)
+}
+
 func Test_WhenServerStarted_ThenServesRequests(t *testing.T) {
 	port := getFreePort()
 	ms := prometheusmetrics.New(port)
@@ -72,3 +96,30 @@ func Test_WhenServerStarted_ThenServesRequests(t *testing.T) {
 
 	ms.Stop()
 }
+
+func Test_WhenHandlerAdded_ThenServedAlongsideMetrics(t *testing.T) {
+	port := getFreePort()
+	ms := prometheusmetrics.New(port)
+	ms.Handle("/readyz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	go ms.Start()
+
+	requestURL := fmt.Sprintf("http://localhost:%d/readyz", port)
+	res, err := http.Get(requestURL)
+	for i := 0; i < REQUEST_MAX_RETRIES; i++ {
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+		res, err = http.Get(requestURL)
+	}
+	if err != nil {
+		log.Fatalf("Error making http request: %s\n", err)
+	}
+	res.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	ms.Stop()
+}
@@ -0,0 +1,18 @@
+// Package segmentarchiver provides the interfaces to copy rolled log
+// segments to long term storage
+package segmentarchiver
+
+//go:generate mockgen -package mymock -destination ../../mocks/segment_archiver_mock.go github.com/RichardoC/kube-audit-rest/internal/segment_archiver SegmentArchiver
+
+import (
+	"context"
+	"time"
+)
+
+type SegmentArchiver interface {
+	// Copies the rolled segment at path, which was started at the given time.
+	// Returns nil only once the copy is known to be complete, after which the
+	// caller deletes the segment. Gives up, including on retries, once ctx is
+	// done
+	Archive(ctx context.Context, path string, started time.Time) error
+}
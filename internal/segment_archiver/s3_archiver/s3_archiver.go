@@ -0,0 +1,199 @@
+package s3archiver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	"github.com/RichardoC/kube-audit-rest/internal/metrics"
+	segmentarchiver "github.com/RichardoC/kube-audit-rest/internal/segment_archiver"
+	"github.com/minio/minio-go/v7"
+)
+
+// User metadata holding the SHA-256 of the segment, so it can be checked
+// once downloaded, as multipart uploads have no usable ETag. The upload
+// itself is checked by the server against the Content-MD5 of each part
+const checksumMetadata = "Sha256"
+
+type Config struct {
+	common.S3ClientConfig
+	Bucket string
+	// Prepended to every object key, optional
+	Prefix string
+	// Segments are stored under <prefix>/<cluster>/<YYYY-MM-DD>/<HH>/
+	Cluster string
+
+	// Failed or unverified uploads are retried, doubling the backoff each time
+	MaxRetries     int
+	InitialBackoff time.Duration
+}
+
+type s3Archiver struct {
+	config   Config
+	client   *minio.Client
+	uploads  metrics.Counter
+	errors   metrics.Counter
+	uploaded metrics.Counter
+}
+
+func New(config Config, metricsServer metrics.MetricsServer) (segmentarchiver.SegmentArchiver, error) {
+	archivers, err := NewForClusters(config, []string{config.Cluster}, metricsServer)
+	if err != nil {
+		return nil, err
+	}
+	return archivers[config.Cluster], nil
+}
+
+// Returns an archiver for each of the clusters, sharing a client and
+// metrics, for when each cluster has its own log files. config.Cluster is
+// ignored
+func NewForClusters(config Config, clusters []string, metricsServer metrics.MetricsServer) (map[string]segmentarchiver.SegmentArchiver, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("an s3 bucket is required")
+	}
+	for _, cluster := range clusters {
+		if cluster == "" {
+			return nil, errors.New("a cluster name is required to archive to s3")
+		}
+	}
+	if config.MaxRetries < 0 {
+		return nil, errors.New("the s3 max retries can't be negative")
+	}
+
+	// Retries are made here, so they also cover failed verification
+	client, err := common.NewS3Client(config.S3ClientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := metricsServer.CreateAndRegisterCounter(
+		"kube_audit_rest_archive_uploads_total",
+		"Total number of log segments uploaded to s3",
+	)
+	uploadErrors := metricsServer.CreateAndRegisterCounter(
+		"kube_audit_rest_archive_upload_errors_total",
+		"Total number of failed or unverified uploads of log segments to s3",
+	)
+	uploaded := metricsServer.CreateAndRegisterCounter(
+		"kube_audit_rest_archive_uploaded_bytes_total",
+		"Total number of bytes of log segments uploaded to s3",
+	)
+
+	archivers := map[string]segmentarchiver.SegmentArchiver{}
+	for _, cluster := range clusters {
+		clusterConfig := config
+		clusterConfig.Cluster = cluster
+		archivers[cluster] = &s3Archiver{
+			config:   clusterConfig,
+			client:   client,
+			uploads:  uploads,
+			errors:   uploadErrors,
+			uploaded: uploaded,
+		}
+	}
+	return archivers, nil
+}
+
+// Uploads the segment, retrying until it's been uploaded and verified or
+// the retries run out
+func (sa *s3Archiver) Archive(ctx context.Context, segmentPath string, started time.Time) error {
+	sum, size, err := checksum(segmentPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", segmentPath, err)
+	}
+	key := sa.key(segmentPath, started)
+
+	backoff := sa.config.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := sa.upload(ctx, segmentPath, key, sum, size)
+		if err == nil {
+			common.Logger.Infow("archived log segment", "path", segmentPath, "bucket", sa.config.Bucket, "key", key, "bytes", size)
+			sa.uploads.Inc()
+			sa.uploaded.Add(float64(size))
+			return nil
+		}
+		sa.errors.Inc()
+		if attempt >= sa.config.MaxRetries {
+			return fmt.Errorf("failed to archive %s to s3 after %d attempts: %w", segmentPath, attempt+1, err)
+		}
+		common.Logger.Warnw("retrying upload to s3", "path", segmentPath, "attempt", attempt+1, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up archiving %s to s3: %w", segmentPath, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// Partitions the segments by cluster, then by the UTC date and hour they
+// were started
+func (sa *s3Archiver) key(segmentPath string, started time.Time) string {
+	started = started.UTC()
+	return path.Join(sa.config.Prefix, sa.config.Cluster, started.Format("2006-01-02"), started.Format("15"), filepath.Base(segmentPath))
+}
+
+// Uploads the segment, with Content-MD5 so the server rejects a corrupted
+// upload, then checks the stored object has the size of the local file and
+// its SHA-256 in the metadata
+func (sa *s3Archiver) upload(ctx context.Context, segmentPath string, key string, sum string, size int64) error {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = sa.client.PutObject(ctx, sa.config.Bucket, key, file, size, minio.PutObjectOptions{
+		ContentType:    contentType(segmentPath),
+		UserMetadata:   map[string]string{checksumMetadata: sum},
+		SendContentMd5: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	info, err := sa.client.StatObject(ctx, sa.config.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to verify upload: %w", err)
+	}
+	if info.Size != size {
+		return fmt.Errorf("uploaded object has %d bytes, expected %d", info.Size, size)
+	}
+	if info.UserMetadata[checksumMetadata] != sum {
+		return fmt.Errorf("uploaded object has sha256 metadata %q, expected %q", info.UserMetadata[checksumMetadata], sum)
+	}
+	return nil
+}
+
+func checksum(segmentPath string) (string, int64, error) {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func contentType(segmentPath string) string {
+	switch filepath.Ext(segmentPath) {
+	case ".gz":
+		return "application/gzip"
+	case ".zst":
+		return "application/zstd"
+	default:
+		return "application/x-ndjson"
+	}
+}
@@ -0,0 +1,201 @@
+package s3archiver_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RichardoC/kube-audit-rest/internal/common"
+	segmentarchiver "github.com/RichardoC/kube-audit-rest/internal/segment_archiver"
+	s3archiver "github.com/RichardoC/kube-audit-rest/internal/segment_archiver/s3_archiver"
+	mymock "github.com/RichardoC/kube-audit-rest/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/stretchr/testify/assert"
+)
+
+const bucket = "audit"
+
+// Fails the first failures requests, then hands the rest to the fake S3
+type flakyHandler struct {
+	mu       sync.Mutex
+	failures int
+	// Strips the checksum from uploads, so they never verify
+	corrupt bool
+	next    http.Handler
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	fail := h.failures > 0
+	if fail {
+		h.failures--
+	}
+	h.mu.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if h.corrupt && r.Method == http.MethodPut {
+		r.Header.Del("X-Amz-Meta-Sha256")
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func newServer(t *testing.T, handler *flakyHandler) (*httptest.Server, gofakes3.Backend) {
+	backend := s3mem.New()
+	assert.NoError(t, backend.CreateBucket(bucket))
+	handler.next = gofakes3.New(backend).Server()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, backend
+}
+
+func newConfig(t *testing.T, server *httptest.Server) s3archiver.Config {
+	directory := t.TempDir()
+	accessKey := path.Join(directory, "access-key")
+	secretKey := path.Join(directory, "secret-key")
+	os.WriteFile(accessKey, []byte("access\n"), 0600)
+	os.WriteFile(secretKey, []byte("secret\n"), 0600)
+	return s3archiver.Config{
+		S3ClientConfig: common.S3ClientConfig{
+			Endpoint:          strings.TrimPrefix(server.URL, "http://"),
+			Region:            "us-east-1",
+			AccessKeyFilename: accessKey,
+			SecretKeyFilename: secretKey,
+			DisableTLS:        true,
+		},
+		Bucket:         bucket,
+		Prefix:         "kube-audit-rest",
+		Cluster:        "prod-eu",
+		MaxRetries:     2,
+		InitialBackoff: time.Millisecond,
+	}
+}
+
+// Returns the uploads, errors and uploaded bytes counters
+func setup(t *testing.T) (*mymock.MockMetricsServer, *mymock.MockCounter, *mymock.MockCounter, *mymock.MockCounter) {
+	ctrl := gomock.NewController(t)
+	ms := mymock.NewMockMetricsServer(ctrl)
+	uploads := mymock.NewMockCounter(ctrl)
+	errors := mymock.NewMockCounter(ctrl)
+	uploaded := mymock.NewMockCounter(ctrl)
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_archive_uploads_total", gomock.Any()).Return(uploads).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_archive_upload_errors_total", gomock.Any()).Return(errors).AnyTimes()
+	ms.EXPECT().CreateAndRegisterCounter("kube_audit_rest_archive_uploaded_bytes_total", gomock.Any()).Return(uploaded).AnyTimes()
+	return ms, uploads, errors, uploaded
+}
+
+func newArchiver(t *testing.T, config s3archiver.Config, ms *mymock.MockMetricsServer) segmentarchiver.SegmentArchiver {
+	sa, err := s3archiver.New(config, ms)
+	if err != nil {
+		t.Fatalf("creating s3 archiver failed with : %s", err)
+	}
+	return sa
+}
+
+func writeSegment(t *testing.T, name string, content string) string {
+	segment := path.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(segment, []byte(content), 0600))
+	return segment
+}
+
+func Test_WhenArchived_ThenUploadedUnderClusterDateAndHour(t *testing.T) {
+	server, backend := newServer(t, &flakyHandler{})
+	ms, uploads, _, uploaded := setup(t)
+	uploads.EXPECT().Inc()
+	uploaded.EXPECT().Add(float64(11))
+
+	sa := newArchiver(t, newConfig(t, server), ms)
+	segment := writeSegment(t, "audit-2024-03-05T14-00-00Z-000.log", "{\"event\":1}")
+	started := time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)
+	assert.NoError(t, sa.Archive(context.Background(), segment, started))
+
+	object, err := backend.GetObject(bucket, "kube-audit-rest/prod-eu/2024-03-05/14/audit-2024-03-05T14-00-00Z-000.log", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer object.Contents.Close()
+	content, _ := io.ReadAll(object.Contents)
+	assert.Equal(t, "{\"event\":1}", string(content))
+	assert.Equal(t, "application/x-ndjson", object.Metadata["Content-Type"])
+	// The segment is left for the caller to delete
+	assert.FileExists(t, segment)
+}
+
+func Test_WhenUploadFails_ThenRetried(t *testing.T) {
+	server, backend := newServer(t, &flakyHandler{failures: 2})
+	ms, uploads, errors, uploaded := setup(t)
+	errors.EXPECT().Inc().Times(2)
+	uploads.EXPECT().Inc()
+	uploaded.EXPECT().Add(gomock.Any())
+
+	sa := newArchiver(t, newConfig(t, server), ms)
+	segment := writeSegment(t, "audit-2024-03-05T14-00-00Z-000.log.gz", "compressed")
+	assert.NoError(t, sa.Archive(context.Background(), segment, time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)))
+
+	object, err := backend.HeadObject(bucket, "kube-audit-rest/prod-eu/2024-03-05/14/audit-2024-03-05T14-00-00Z-000.log.gz")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "application/gzip", object.Metadata["Content-Type"])
+	}
+}
+
+func Test_WhenUploadNotVerified_ThenErrorReturnedAfterRetries(t *testing.T) {
+	server, _ := newServer(t, &flakyHandler{corrupt: true})
+	ms, _, errors, _ := setup(t)
+	errors.EXPECT().Inc().Times(3)
+
+	sa := newArchiver(t, newConfig(t, server), ms)
+	segment := writeSegment(t, "audit-2024-03-05T14-00-00Z-000.log", "{\"event\":1}")
+	assert.Error(t, sa.Archive(context.Background(), segment, time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)))
+}
+
+func Test_WhenContextDone_ThenStopsRetrying(t *testing.T) {
+	server, _ := newServer(t, &flakyHandler{failures: 100})
+	ms, _, errors, _ := setup(t)
+	errors.EXPECT().Inc().AnyTimes()
+
+	config := newConfig(t, server)
+	config.MaxRetries = 5
+	config.InitialBackoff = time.Hour
+	sa := newArchiver(t, config, ms)
+	segment := writeSegment(t, "audit-2024-03-05T14-00-00Z-000.log", "{\"event\":1}")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.ErrorIs(t, sa.Archive(ctx, segment, time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func Test_WhenConfigInvalid_ThenErrorReturned(t *testing.T) {
+	server, _ := newServer(t, &flakyHandler{})
+	ms, _, _, _ := setup(t)
+	testCases := []struct {
+		name   string
+		modify func(*s3archiver.Config)
+	}{
+		{"no endpoint", func(c *s3archiver.Config) { c.Endpoint = "" }},
+		{"no bucket", func(c *s3archiver.Config) { c.Bucket = "" }},
+		{"no cluster", func(c *s3archiver.Config) { c.Cluster = "" }},
+		{"negative retries", func(c *s3archiver.Config) { c.MaxRetries = -1 }},
+		{"only access key", func(c *s3archiver.Config) { c.SecretKeyFilename = "" }},
+		{"missing secret key", func(c *s3archiver.Config) { c.SecretKeyFilename = path.Join(t.TempDir(), "missing") }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := newConfig(t, server)
+			tc.modify(&config)
+			_, err := s3archiver.New(config, ms)
+			assert.Error(t, err)
+		})
+	}
+}
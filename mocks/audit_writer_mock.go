@@ -1,11 +1,13 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/RichardoC/kube-audit-rest/internal/audit_writer (interfaces: AuditWritter)
+// Source: github.com/RichardoC/kube-audit-rest/internal/audit_writer (interfaces: AuditWritter,Flusher,HealthReporter)
 
 // Package mymock is a generated GoMock package.
 package mymock
 
 import (
+	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -33,10 +35,26 @@ func (m *MockAuditWritter) EXPECT() *MockAuditWritterMockRecorder {
 	return m.recorder
 }
 
+// Close mocks base method.
+func (m *MockAuditWritter) Close(arg0 context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockAuditWritterMockRecorder) Close(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockAuditWritter)(nil).Close), arg0)
+}
+
 // LogEvent mocks base method.
-func (m *MockAuditWritter) LogEvent(arg0 []byte) {
+func (m *MockAuditWritter) LogEvent(arg0 []byte) error {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "LogEvent", arg0)
+	ret := m.ctrl.Call(m, "LogEvent", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // LogEvent indicates an expected call of LogEvent.
@@ -56,3 +74,91 @@ func (mr *MockAuditWritterMockRecorder) Sync() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Sync", reflect.TypeOf((*MockAuditWritter)(nil).Sync))
 }
+
+// MockFlusher is a mock of Flusher interface.
+type MockFlusher struct {
+	ctrl     *gomock.Controller
+	recorder *MockFlusherMockRecorder
+}
+
+// MockFlusherMockRecorder is the mock recorder for MockFlusher.
+type MockFlusherMockRecorder struct {
+	mock *MockFlusher
+}
+
+// NewMockFlusher creates a new mock instance.
+func NewMockFlusher(ctrl *gomock.Controller) *MockFlusher {
+	mock := &MockFlusher{ctrl: ctrl}
+	mock.recorder = &MockFlusherMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockFlusher) EXPECT() *MockFlusherMockRecorder {
+	return m.recorder
+}
+
+// Flush mocks base method.
+func (m *MockFlusher) Flush() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Flush")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Flush indicates an expected call of Flush.
+func (mr *MockFlusherMockRecorder) Flush() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Flush", reflect.TypeOf((*MockFlusher)(nil).Flush))
+}
+
+// MockHealthReporter is a mock of HealthReporter interface.
+type MockHealthReporter struct {
+	ctrl     *gomock.Controller
+	recorder *MockHealthReporterMockRecorder
+}
+
+// MockHealthReporterMockRecorder is the mock recorder for MockHealthReporter.
+type MockHealthReporterMockRecorder struct {
+	mock *MockHealthReporter
+}
+
+// NewMockHealthReporter creates a new mock instance.
+func NewMockHealthReporter(ctrl *gomock.Controller) *MockHealthReporter {
+	mock := &MockHealthReporter{ctrl: ctrl}
+	mock.recorder = &MockHealthReporterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockHealthReporter) EXPECT() *MockHealthReporterMockRecorder {
+	return m.recorder
+}
+
+// Live mocks base method.
+func (m *MockHealthReporter) Live(arg0 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Live", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Live indicates an expected call of Live.
+func (mr *MockHealthReporterMockRecorder) Live(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Live", reflect.TypeOf((*MockHealthReporter)(nil).Live), arg0)
+}
+
+// Ready mocks base method.
+func (m *MockHealthReporter) Ready() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Ready")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Ready indicates an expected call of Ready.
+func (mr *MockHealthReporterMockRecorder) Ready() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ready", reflect.TypeOf((*MockHealthReporter)(nil).Ready))
+}
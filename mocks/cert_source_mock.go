@@ -0,0 +1,62 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/RichardoC/kube-audit-rest/internal/cert_source (interfaces: CertSource)
+
+// Package mymock is a generated GoMock package.
+package mymock
+
+import (
+	tls "crypto/tls"
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockCertSource is a mock of CertSource interface.
+type MockCertSource struct {
+	ctrl     *gomock.Controller
+	recorder *MockCertSourceMockRecorder
+}
+
+// MockCertSourceMockRecorder is the mock recorder for MockCertSource.
+type MockCertSourceMockRecorder struct {
+	mock *MockCertSource
+}
+
+// NewMockCertSource creates a new mock instance.
+func NewMockCertSource(ctrl *gomock.Controller) *MockCertSource {
+	mock := &MockCertSource{ctrl: ctrl}
+	mock.recorder = &MockCertSourceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCertSource) EXPECT() *MockCertSourceMockRecorder {
+	return m.recorder
+}
+
+// Close mocks base method.
+func (m *MockCertSource) Close() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Close")
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockCertSourceMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockCertSource)(nil).Close))
+}
+
+// GetCertificate mocks base method.
+func (m *MockCertSource) GetCertificate(arg0 *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCertificate", arg0)
+	ret0, _ := ret[0].(*tls.Certificate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCertificate indicates an expected call of GetCertificate.
+func (mr *MockCertSourceMockRecorder) GetCertificate(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCertificate", reflect.TypeOf((*MockCertSource)(nil).GetCertificate), arg0)
+}
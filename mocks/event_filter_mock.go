@@ -0,0 +1,48 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/RichardoC/kube-audit-rest/internal/event_filter (interfaces: EventFilter)
+
+// Package mymock is a generated GoMock package.
+package mymock
+
+import (
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockEventFilter is a mock of EventFilter interface.
+type MockEventFilter struct {
+	ctrl     *gomock.Controller
+	recorder *MockEventFilterMockRecorder
+}
+
+// MockEventFilterMockRecorder is the mock recorder for MockEventFilter.
+type MockEventFilterMockRecorder struct {
+	mock *MockEventFilter
+}
+
+// NewMockEventFilter creates a new mock instance.
+func NewMockEventFilter(ctrl *gomock.Controller) *MockEventFilter {
+	mock := &MockEventFilter{ctrl: ctrl}
+	mock.recorder = &MockEventFilterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockEventFilter) EXPECT() *MockEventFilterMockRecorder {
+	return m.recorder
+}
+
+// ShouldWrite mocks base method.
+func (m *MockEventFilter) ShouldWrite(arg0 []byte) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ShouldWrite", arg0)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// ShouldWrite indicates an expected call of ShouldWrite.
+func (mr *MockEventFilterMockRecorder) ShouldWrite(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ShouldWrite", reflect.TypeOf((*MockEventFilter)(nil).ShouldWrite), arg0)
+}
@@ -0,0 +1,49 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/RichardoC/kube-audit-rest/internal/event_transformer (interfaces: EventTransformer)
+
+// Package mymock is a generated GoMock package.
+package mymock
+
+import (
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockEventTransformer is a mock of EventTransformer interface.
+type MockEventTransformer struct {
+	ctrl     *gomock.Controller
+	recorder *MockEventTransformerMockRecorder
+}
+
+// MockEventTransformerMockRecorder is the mock recorder for MockEventTransformer.
+type MockEventTransformerMockRecorder struct {
+	mock *MockEventTransformer
+}
+
+// NewMockEventTransformer creates a new mock instance.
+func NewMockEventTransformer(ctrl *gomock.Controller) *MockEventTransformer {
+	mock := &MockEventTransformer{ctrl: ctrl}
+	mock.recorder = &MockEventTransformerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockEventTransformer) EXPECT() *MockEventTransformerMockRecorder {
+	return m.recorder
+}
+
+// Transform mocks base method.
+func (m *MockEventTransformer) Transform(arg0 []byte) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Transform", arg0)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Transform indicates an expected call of Transform.
+func (mr *MockEventTransformerMockRecorder) Transform(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Transform", reflect.TypeOf((*MockEventTransformer)(nil).Transform), arg0)
+}
@@ -5,6 +5,7 @@
 package mymock
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
@@ -46,13 +47,15 @@ func (mr *MockHttpListenerMockRecorder) Start() *gomock.Call {
 }
 
 // Stop mocks base method.
-func (m *MockHttpListener) Stop() {
+func (m *MockHttpListener) Stop(arg0 context.Context) error {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Stop")
+	ret := m.ctrl.Call(m, "Stop", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // Stop indicates an expected call of Stop.
-func (mr *MockHttpListenerMockRecorder) Stop() *gomock.Call {
+func (mr *MockHttpListenerMockRecorder) Stop(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stop", reflect.TypeOf((*MockHttpListener)(nil).Stop))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stop", reflect.TypeOf((*MockHttpListener)(nil).Stop), arg0)
 }
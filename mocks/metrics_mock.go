@@ -1,10 +1,11 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/RichardoC/kube-audit-rest/internal/metrics (interfaces: Counter,MetricsServer)
+// Source: github.com/RichardoC/kube-audit-rest/internal/metrics (interfaces: Counter,CounterVec,Gauge,GaugeVec,Histogram,HistogramVec,MetricsServer)
 
 // Package mymock is a generated GoMock package.
 package mymock
 
 import (
+	http "net/http"
 	reflect "reflect"
 
 	metrics "github.com/RichardoC/kube-audit-rest/internal/metrics"
@@ -34,6 +35,18 @@ func (m *MockCounter) EXPECT() *MockCounterMockRecorder {
 	return m.recorder
 }
 
+// Add mocks base method.
+func (m *MockCounter) Add(arg0 float64) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Add", arg0)
+}
+
+// Add indicates an expected call of Add.
+func (mr *MockCounterMockRecorder) Add(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockCounter)(nil).Add), arg0)
+}
+
 // Inc mocks base method.
 func (m *MockCounter) Inc() {
 	m.ctrl.T.Helper()
@@ -46,6 +59,199 @@ func (mr *MockCounterMockRecorder) Inc() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Inc", reflect.TypeOf((*MockCounter)(nil).Inc))
 }
 
+// MockCounterVec is a mock of CounterVec interface.
+type MockCounterVec struct {
+	ctrl     *gomock.Controller
+	recorder *MockCounterVecMockRecorder
+}
+
+// MockCounterVecMockRecorder is the mock recorder for MockCounterVec.
+type MockCounterVecMockRecorder struct {
+	mock *MockCounterVec
+}
+
+// NewMockCounterVec creates a new mock instance.
+func NewMockCounterVec(ctrl *gomock.Controller) *MockCounterVec {
+	mock := &MockCounterVec{ctrl: ctrl}
+	mock.recorder = &MockCounterVecMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCounterVec) EXPECT() *MockCounterVecMockRecorder {
+	return m.recorder
+}
+
+// WithLabelValues mocks base method.
+func (m *MockCounterVec) WithLabelValues(arg0 ...string) metrics.Counter {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{}
+	for _, a := range arg0 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "WithLabelValues", varargs...)
+	ret0, _ := ret[0].(metrics.Counter)
+	return ret0
+}
+
+// WithLabelValues indicates an expected call of WithLabelValues.
+func (mr *MockCounterVecMockRecorder) WithLabelValues(arg0 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WithLabelValues", reflect.TypeOf((*MockCounterVec)(nil).WithLabelValues), arg0...)
+}
+
+// MockGauge is a mock of Gauge interface.
+type MockGauge struct {
+	ctrl     *gomock.Controller
+	recorder *MockGaugeMockRecorder
+}
+
+// MockGaugeMockRecorder is the mock recorder for MockGauge.
+type MockGaugeMockRecorder struct {
+	mock *MockGauge
+}
+
+// NewMockGauge creates a new mock instance.
+func NewMockGauge(ctrl *gomock.Controller) *MockGauge {
+	mock := &MockGauge{ctrl: ctrl}
+	mock.recorder = &MockGaugeMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockGauge) EXPECT() *MockGaugeMockRecorder {
+	return m.recorder
+}
+
+// Set mocks base method.
+func (m *MockGauge) Set(arg0 float64) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Set", arg0)
+}
+
+// Set indicates an expected call of Set.
+func (mr *MockGaugeMockRecorder) Set(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockGauge)(nil).Set), arg0)
+}
+
+// MockGaugeVec is a mock of GaugeVec interface.
+type MockGaugeVec struct {
+	ctrl     *gomock.Controller
+	recorder *MockGaugeVecMockRecorder
+}
+
+// MockGaugeVecMockRecorder is the mock recorder for MockGaugeVec.
+type MockGaugeVecMockRecorder struct {
+	mock *MockGaugeVec
+}
+
+// NewMockGaugeVec creates a new mock instance.
+func NewMockGaugeVec(ctrl *gomock.Controller) *MockGaugeVec {
+	mock := &MockGaugeVec{ctrl: ctrl}
+	mock.recorder = &MockGaugeVecMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockGaugeVec) EXPECT() *MockGaugeVecMockRecorder {
+	return m.recorder
+}
+
+// WithLabelValues mocks base method.
+func (m *MockGaugeVec) WithLabelValues(arg0 ...string) metrics.Gauge {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{}
+	for _, a := range arg0 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "WithLabelValues", varargs...)
+	ret0, _ := ret[0].(metrics.Gauge)
+	return ret0
+}
+
+// WithLabelValues indicates an expected call of WithLabelValues.
+func (mr *MockGaugeVecMockRecorder) WithLabelValues(arg0 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WithLabelValues", reflect.TypeOf((*MockGaugeVec)(nil).WithLabelValues), arg0...)
+}
+
+// MockHistogram is a mock of Histogram interface.
+type MockHistogram struct {
+	ctrl     *gomock.Controller
+	recorder *MockHistogramMockRecorder
+}
+
+// MockHistogramMockRecorder is the mock recorder for MockHistogram.
+type MockHistogramMockRecorder struct {
+	mock *MockHistogram
+}
+
+// NewMockHistogram creates a new mock instance.
+func NewMockHistogram(ctrl *gomock.Controller) *MockHistogram {
+	mock := &MockHistogram{ctrl: ctrl}
+	mock.recorder = &MockHistogramMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockHistogram) EXPECT() *MockHistogramMockRecorder {
+	return m.recorder
+}
+
+// Observe mocks base method.
+func (m *MockHistogram) Observe(arg0 float64) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Observe", arg0)
+}
+
+// Observe indicates an expected call of Observe.
+func (mr *MockHistogramMockRecorder) Observe(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Observe", reflect.TypeOf((*MockHistogram)(nil).Observe), arg0)
+}
+
+// MockHistogramVec is a mock of HistogramVec interface.
+type MockHistogramVec struct {
+	ctrl     *gomock.Controller
+	recorder *MockHistogramVecMockRecorder
+}
+
+// MockHistogramVecMockRecorder is the mock recorder for MockHistogramVec.
+type MockHistogramVecMockRecorder struct {
+	mock *MockHistogramVec
+}
+
+// NewMockHistogramVec creates a new mock instance.
+func NewMockHistogramVec(ctrl *gomock.Controller) *MockHistogramVec {
+	mock := &MockHistogramVec{ctrl: ctrl}
+	mock.recorder = &MockHistogramVecMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockHistogramVec) EXPECT() *MockHistogramVecMockRecorder {
+	return m.recorder
+}
+
+// WithLabelValues mocks base method.
+func (m *MockHistogramVec) WithLabelValues(arg0 ...string) metrics.Histogram {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{}
+	for _, a := range arg0 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "WithLabelValues", varargs...)
+	ret0, _ := ret[0].(metrics.Histogram)
+	return ret0
+}
+
+// WithLabelValues indicates an expected call of WithLabelValues.
+func (mr *MockHistogramVecMockRecorder) WithLabelValues(arg0 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WithLabelValues", reflect.TypeOf((*MockHistogramVec)(nil).WithLabelValues), arg0...)
+}
+
 // MockMetricsServer is a mock of MetricsServer interface.
 type MockMetricsServer struct {
 	ctrl     *gomock.Controller
@@ -83,6 +289,74 @@ func (mr *MockMetricsServerMockRecorder) CreateAndRegisterCounter(arg0, arg1 int
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAndRegisterCounter", reflect.TypeOf((*MockMetricsServer)(nil).CreateAndRegisterCounter), arg0, arg1)
 }
 
+// CreateAndRegisterCounterVec mocks base method.
+func (m *MockMetricsServer) CreateAndRegisterCounterVec(arg0, arg1 string, arg2 []string) metrics.CounterVec {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAndRegisterCounterVec", arg0, arg1, arg2)
+	ret0, _ := ret[0].(metrics.CounterVec)
+	return ret0
+}
+
+// CreateAndRegisterCounterVec indicates an expected call of CreateAndRegisterCounterVec.
+func (mr *MockMetricsServerMockRecorder) CreateAndRegisterCounterVec(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAndRegisterCounterVec", reflect.TypeOf((*MockMetricsServer)(nil).CreateAndRegisterCounterVec), arg0, arg1, arg2)
+}
+
+// CreateAndRegisterGauge mocks base method.
+func (m *MockMetricsServer) CreateAndRegisterGauge(arg0, arg1 string) metrics.Gauge {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAndRegisterGauge", arg0, arg1)
+	ret0, _ := ret[0].(metrics.Gauge)
+	return ret0
+}
+
+// CreateAndRegisterGauge indicates an expected call of CreateAndRegisterGauge.
+func (mr *MockMetricsServerMockRecorder) CreateAndRegisterGauge(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAndRegisterGauge", reflect.TypeOf((*MockMetricsServer)(nil).CreateAndRegisterGauge), arg0, arg1)
+}
+
+// CreateAndRegisterGaugeVec mocks base method.
+func (m *MockMetricsServer) CreateAndRegisterGaugeVec(arg0, arg1 string, arg2 []string) metrics.GaugeVec {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAndRegisterGaugeVec", arg0, arg1, arg2)
+	ret0, _ := ret[0].(metrics.GaugeVec)
+	return ret0
+}
+
+// CreateAndRegisterGaugeVec indicates an expected call of CreateAndRegisterGaugeVec.
+func (mr *MockMetricsServerMockRecorder) CreateAndRegisterGaugeVec(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAndRegisterGaugeVec", reflect.TypeOf((*MockMetricsServer)(nil).CreateAndRegisterGaugeVec), arg0, arg1, arg2)
+}
+
+// CreateAndRegisterHistogramVec mocks base method.
+func (m *MockMetricsServer) CreateAndRegisterHistogramVec(arg0, arg1 string, arg2 []string, arg3 []float64) metrics.HistogramVec {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateAndRegisterHistogramVec", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(metrics.HistogramVec)
+	return ret0
+}
+
+// CreateAndRegisterHistogramVec indicates an expected call of CreateAndRegisterHistogramVec.
+func (mr *MockMetricsServerMockRecorder) CreateAndRegisterHistogramVec(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAndRegisterHistogramVec", reflect.TypeOf((*MockMetricsServer)(nil).CreateAndRegisterHistogramVec), arg0, arg1, arg2, arg3)
+}
+
+// Handle mocks base method.
+func (m *MockMetricsServer) Handle(arg0 string, arg1 http.Handler) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Handle", arg0, arg1)
+}
+
+// Handle indicates an expected call of Handle.
+func (mr *MockMetricsServerMockRecorder) Handle(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Handle", reflect.TypeOf((*MockMetricsServer)(nil).Handle), arg0, arg1)
+}
+
 // Start mocks base method.
 func (m *MockMetricsServer) Start() {
 	m.ctrl.T.Helper()
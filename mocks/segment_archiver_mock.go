@@ -0,0 +1,50 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: github.com/RichardoC/kube-audit-rest/internal/segment_archiver (interfaces: SegmentArchiver)
+
+// Package mymock is a generated GoMock package.
+package mymock
+
+import (
+	context "context"
+	reflect "reflect"
+	time "time"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockSegmentArchiver is a mock of SegmentArchiver interface.
+type MockSegmentArchiver struct {
+	ctrl     *gomock.Controller
+	recorder *MockSegmentArchiverMockRecorder
+}
+
+// MockSegmentArchiverMockRecorder is the mock recorder for MockSegmentArchiver.
+type MockSegmentArchiverMockRecorder struct {
+	mock *MockSegmentArchiver
+}
+
+// NewMockSegmentArchiver creates a new mock instance.
+func NewMockSegmentArchiver(ctrl *gomock.Controller) *MockSegmentArchiver {
+	mock := &MockSegmentArchiver{ctrl: ctrl}
+	mock.recorder = &MockSegmentArchiverMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSegmentArchiver) EXPECT() *MockSegmentArchiverMockRecorder {
+	return m.recorder
+}
+
+// Archive mocks base method.
+func (m *MockSegmentArchiver) Archive(arg0 context.Context, arg1 string, arg2 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Archive", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Archive indicates an expected call of Archive.
+func (mr *MockSegmentArchiverMockRecorder) Archive(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Archive", reflect.TypeOf((*MockSegmentArchiver)(nil).Archive), arg0, arg1, arg2)
+}
@@ -43,11 +43,11 @@ then
     # Redirecting output to confirm standard library logs redirected to
     # structured logger to prevent repeats of #31
     echo "Also doing race detection"
-    go run -race ./cmd/kube-audit-rest/main.go --cert-filename=./tmp/server.crt --cert-key-filename=./tmp/server.key \
+    go run -race ./cmd/kube-audit-rest --cert-filename=./tmp/server.crt --cert-key-filename=./tmp/server.key \
         --server-port="$SERVER_PORT" --metrics-port="$METRICS_PORT" --logger-filename=./tmp/kube-audit-rest.log  > ./tmp/kube-audit-rest-output.log  2>&1 &
 else
     # Run current server with those local certs on port $SERVER_PORT
-    go run ./cmd/kube-audit-rest/main.go --cert-filename=./tmp/server.crt --cert-key-filename=./tmp/server.key \
+    go run ./cmd/kube-audit-rest --cert-filename=./tmp/server.crt --cert-key-filename=./tmp/server.key \
         --server-port="$SERVER_PORT" --metrics-port="$METRICS_PORT" --logger-filename=./tmp/kube-audit-rest.log  > ./tmp/kube-audit-rest-output.log  2>&1 &
 fi
 KUBE_AUDIT_PID=$!